@@ -79,7 +79,7 @@ func TestHandlerBasics(t *testing.T) {
 	}
 	uuid := string(uuidBytes)
 
-	ds, err := storedir.OpenDirectory(tmpdir, 0, 0)
+	ds, err := storedir.OpenDirectory(tmpdir, 0, 0, storedir.DurabilityNone, 0)
 	if err != nil {
 		t.Fatalf("Couldn't OpenDirectory %v: %v", tmpdir, err)
 	}
@@ -0,0 +1,142 @@
+// Package events delivers notable cluster events, such as stores going
+// offline or files losing redundancy, to configurable sinks.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/encryptio/slime/internal/logging"
+)
+
+// Event types.
+const (
+	StoreDisconnected = "store_disconnected"
+	StoreConnected    = "store_connected"
+	StoreDead         = "store_dead"
+	StoreUndead       = "store_undead"
+	CorruptionFound   = "corruption_found"
+	FileAtRisk        = "file_at_risk"
+	RedundancyChanged = "redundancy_changed"
+)
+
+// Types lists every event type.
+var Types = []string{
+	StoreDisconnected,
+	StoreConnected,
+	StoreDead,
+	StoreUndead,
+	CorruptionFound,
+	FileAtRisk,
+	RedundancyChanged,
+}
+
+// An Event is something that happened to the cluster that an operator might
+// want to know about.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+
+	Store string `json:"store,omitempty"` // uuid of the store involved
+	Path  string `json:"path,omitempty"`  // path of the file involved
+
+	// Details holds anything else specific to the event type, such as the
+	// margin of a file at risk or the new redundancy level.
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// A Sink is somewhere events are delivered to.
+type Sink interface {
+	Send(e Event) error
+}
+
+// queueSize is the number of events each sink may fall behind by before new
+// events for it are dropped.
+var queueSize = 1000
+
+type sinkQueue struct {
+	sink  Sink
+	types map[string]bool // nil for all types
+	queue chan Event
+}
+
+// A Dispatcher sends events to its sinks in the background. Each sink has its
+// own queue, so a slow sink doesn't hold up the others. A nil *Dispatcher
+// discards all events.
+type Dispatcher struct {
+	sinks []*sinkQueue
+	wg    sync.WaitGroup
+}
+
+// NewDispatcher creates a Dispatcher with no sinks. Add sinks with AddSink
+// before emitting any events.
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{}
+}
+
+// AddSink adds a sink receiving events of the given types, or of every type if
+// none are given.
+func (d *Dispatcher) AddSink(s Sink, types ...string) {
+	q := &sinkQueue{
+		sink:  s,
+		queue: make(chan Event, queueSize),
+	}
+	if len(types) > 0 {
+		q.types = make(map[string]bool, len(types))
+		for _, t := range types {
+			q.types[t] = true
+		}
+	}
+
+	d.sinks = append(d.sinks, q)
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for e := range q.queue {
+			err := q.sink.Send(e)
+			if err != nil {
+				logging.Errorf("Couldn't send %v event: %v", e.Type, err)
+			}
+		}
+	}()
+}
+
+// Emit queues e for delivery to every sink that wants it, setting its time if
+// it is zero. It never blocks; if a sink has fallen too far behind, the event
+// is dropped for that sink.
+func (d *Dispatcher) Emit(e Event) {
+	if d == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	for _, q := range d.sinks {
+		if q.types != nil && !q.types[e.Type] {
+			continue
+		}
+
+		select {
+		case q.queue <- e:
+		default:
+			logging.Warnf("Dropped %v event, too many waiting to be sent", e.Type)
+		}
+	}
+}
+
+// Close waits for queued events to be sent, then stops the Dispatcher. No
+// events may be emitted after it is called.
+func (d *Dispatcher) Close() {
+	if d == nil {
+		return
+	}
+
+	for _, q := range d.sinks {
+		close(q.queue)
+	}
+	d.wg.Wait()
+}
@@ -0,0 +1,201 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordSink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (s *recordSink) Send(e Event) error {
+	s.mu.Lock()
+	s.events = append(s.events, e)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *recordSink) types() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []string
+	for _, e := range s.events {
+		ret = append(ret, e.Type)
+	}
+	return ret
+}
+
+func TestDispatcher(t *testing.T) {
+	all := &recordSink{}
+	stores := &recordSink{}
+
+	d := NewDispatcher()
+	d.AddSink(all)
+	d.AddSink(stores, StoreDead, StoreUndead)
+
+	d.Emit(Event{Type: StoreDead})
+	d.Emit(Event{Type: FileAtRisk})
+	d.Emit(Event{Type: StoreUndead})
+	d.Close()
+
+	if got, want := all.types(), []string{StoreDead, FileAtRisk, StoreUndead}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unfiltered sink got %v, wanted %v", got, want)
+	}
+	if got, want := stores.types(), []string{StoreDead, StoreUndead}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Filtered sink got %v, wanted %v", got, want)
+	}
+	if all.events[0].Time.IsZero() {
+		t.Errorf("Emit didn't set the event time")
+	}
+
+	var nilDispatcher *Dispatcher
+	nilDispatcher.Emit(Event{Type: StoreDead})
+	nilDispatcher.Close()
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slime-events-test-")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.log")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatalf("Couldn't create file sink: %v", err)
+	}
+
+	for _, typ := range []string{StoreDisconnected, StoreConnected} {
+		err = sink.Send(Event{Type: typ, Store: "abc"})
+		if err != nil {
+			t.Fatalf("Couldn't send event: %v", err)
+		}
+	}
+	sink.Close()
+
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Couldn't open event log: %v", err)
+	}
+	defer fh.Close()
+
+	var got []string
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		var e Event
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			t.Fatalf("Couldn't parse event log line %q: %v", scanner.Text(), err)
+		}
+		if e.Store != "abc" {
+			t.Errorf("Event has store %#v, wanted \"abc\"", e.Store)
+		}
+		got = append(got, e.Type)
+	}
+
+	if want := []string{StoreDisconnected, StoreConnected}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Event log has %v, wanted %v", got, want)
+	}
+}
+
+func TestHTTPSinkRetries(t *testing.T) {
+	oldDelay := httpRetryDelay
+	httpRetryDelay = time.Millisecond
+	defer func() { httpRetryDelay = oldDelay }()
+
+	var mu sync.Mutex
+	requests := 0
+	var received Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer srv.Close()
+
+	err := NewHTTPSink(srv.URL, 5).Send(Event{Type: FileAtRisk, Path: "a"})
+	if err != nil {
+		t.Fatalf("Couldn't send event: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("Webhook got %v requests, wanted 3", requests)
+	}
+	if received.Type != FileAtRisk || received.Path != "a" {
+		t.Errorf("Webhook got %#v", received)
+	}
+
+	requests = -10
+	err = NewHTTPSink(srv.URL, 2).Send(Event{Type: FileAtRisk})
+	if err == nil {
+		t.Errorf("Send succeeded when every attempt failed")
+	}
+	if requests != -7 {
+		t.Errorf("Webhook got %v requests, wanted 3", requests+10)
+	}
+}
+
+func TestExecSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slime-events-test-")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "out")
+	sink := &ExecSink{Command: []string{"sh", "-c", `echo "$SLIME_EVENT" > "$0"; cat >> "$0"`, path}}
+	err = sink.Send(Event{Type: StoreDead, Store: "abc"})
+	if err != nil {
+		t.Fatalf("Couldn't send event: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Couldn't read command output: %v", err)
+	}
+
+	want := StoreDead + "\n"
+	if len(data) < len(want) || string(data[:len(want)]) != want {
+		t.Fatalf("Command didn't get the event type, wrote %q", data)
+	}
+
+	var e Event
+	err = json.Unmarshal(data[len(want):], &e)
+	if err != nil {
+		t.Fatalf("Couldn't parse event from command input %q: %v", data, err)
+	}
+	if e.Type != StoreDead || e.Store != "abc" {
+		t.Errorf("Command got %#v", e)
+	}
+}
+
+func TestExecSinkTimeout(t *testing.T) {
+	sink := &ExecSink{Command: []string{"sleep", "10"}, Timeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	err := sink.Send(Event{Type: StoreDead})
+	if err == nil {
+		t.Errorf("Hung command didn't return an error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Hung command took %v to be killed", elapsed)
+	}
+}
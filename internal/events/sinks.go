@@ -0,0 +1,167 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+var httpRetryDelay = time.Second
+
+// execTimeout is how long an ExecSink's command may run when its Timeout is
+// zero.
+var execTimeout = 30 * time.Second
+
+// HTTPSink POSTs each event as a JSON object to a URL, retrying failed
+// requests with exponential backoff.
+type HTTPSink struct {
+	URL     string
+	Retries int // retries after the first attempt
+
+	client *http.Client
+}
+
+// NewHTTPSink creates an HTTPSink.
+func NewHTTPSink(url string, retries int) *HTTPSink {
+	return &HTTPSink{
+		URL:     url,
+		Retries: retries,
+		client: &http.Client{
+			Timeout: time.Second * 15,
+		},
+	}
+}
+
+func (s *HTTPSink) Send(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	delay := httpRetryDelay
+	for try := 0; ; try++ {
+		err = s.post(body)
+		if err == nil || try >= s.Retries {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (s *HTTPSink) post(body []byte) error {
+	resp, err := s.client.Post(s.URL, "application/json; charset=utf-8",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %v returned %v", s.URL, resp.Status)
+	}
+
+	return nil
+}
+
+// FileSink appends each event to a file as a line of JSON.
+type FileSink struct {
+	mu sync.Mutex
+	fh *os.File
+}
+
+// NewFileSink opens path for appending, creating it if needed.
+func NewFileSink(path string) (*FileSink, error) {
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{fh: fh}, nil
+}
+
+func (s *FileSink) Send(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.fh.Write(line)
+	return err
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	return s.fh.Close()
+}
+
+// ExecSink runs a command for each event, with the event as a JSON object on
+// its standard input and its type in the SLIME_EVENT environment variable.
+// Commands still running after Timeout are killed, so that a hung command
+// doesn't hold up later events.
+type ExecSink struct {
+	Command []string
+	Timeout time.Duration // 0 means 30 seconds
+}
+
+func (s *ExecSink) Send(e Event) error {
+	if len(s.Command) == 0 {
+		return fmt.Errorf("no command to run")
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(s.Command[0], s.Command[1:]...)
+	cmd.Env = append(os.Environ(), "SLIME_EVENT="+e.Type)
+	cmd.Stdin = bytes.NewReader(body)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("%v: %v", s.Command[0], err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = execTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err = <-done:
+	case <-timer.C:
+		cmd.Process.Kill()
+		// Wait also waits for the command's output to close, which processes
+		// it started may keep open, so don't wait on it for long.
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+		return fmt.Errorf("%v: killed after running for %v", s.Command[0], timeout)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%v: %v (output: %q)", s.Command[0], err, out.Bytes())
+	}
+	return nil
+}
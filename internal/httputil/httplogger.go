@@ -2,11 +2,15 @@ package httputil
 
 import (
 	"bufio"
+	"encoding/hex"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"time"
+
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/tracing"
 )
 
 type stattingReadCloser struct {
@@ -74,16 +78,30 @@ func LogHTTPRequests(inner http.Handler) http.Handler {
 
 		started := time.Now()
 		defer func() {
+			fields := logging.Fields{
+				"remote":        req.RemoteAddr,
+				"method":        req.Method,
+				"url":           record.reqURL,
+				"total_seconds": time.Now().Sub(started).Seconds(),
+			}
+			if id := req.Header.Get(RequestIDHeader); id != "" {
+				fields["request_id"] = id
+			}
+			if sc := tracing.Extract(req.Header); sc.Sampled {
+				fields["trace_id"] = hex.EncodeToString(sc.TraceID[:])
+			}
+
 			if record.hijacked {
-				log.Printf("%s %s %s -> Connection Hijacked in %v",
-					req.RemoteAddr, req.Method, record.reqURL,
-					time.Now().Sub(started))
+				logging.Log(logging.Info, fmt.Sprintf("%s %s -> Connection Hijacked",
+					req.Method, record.reqURL), fields)
 			} else {
-				log.Printf("%s %s %s -> %d, read %d in %v, wrote %d in %v, total time %v",
-					req.RemoteAddr, req.Method, record.reqURL, record.code,
-					src.bytes, src.time,
-					record.bytes, record.time,
-					time.Now().Sub(started))
+				fields["status"] = record.code
+				fields["read_bytes"] = src.bytes
+				fields["read_seconds"] = src.time.Seconds()
+				fields["wrote_bytes"] = record.bytes
+				fields["write_seconds"] = record.time.Seconds()
+				logging.Log(logging.Info, fmt.Sprintf("%s %s -> %d",
+					req.Method, record.reqURL, record.code), fields)
 			}
 		}()
 
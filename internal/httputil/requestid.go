@@ -0,0 +1,32 @@
+package httputil
+
+import (
+	"net/http"
+
+	"github.com/encryptio/slime/internal/uuid"
+)
+
+// RequestIDHeader carries the ID of the request that caused an HTTP request,
+// so that requests to the chunk servers can be matched up with the proxy
+// request they are part of.
+const RequestIDHeader = "X-Request-ID"
+
+// NewRequestID returns a new random request ID.
+func NewRequestID() string {
+	return uuid.Fmt(uuid.Gen4())
+}
+
+// AddRequestIDs gives every request without an X-Request-ID header a new one,
+// and echoes the ID back in the response.
+func AddRequestIDs(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = NewRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		inner.ServeHTTP(w, r)
+	})
+}
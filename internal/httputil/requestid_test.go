@@ -0,0 +1,32 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddRequestIDs(t *testing.T) {
+	var seen string
+	h := AddRequestIDs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(RequestIDHeader)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, mustRequest("GET", "/", ""))
+	if seen == "" {
+		t.Fatalf("No request ID was generated")
+	}
+	if got := rec.Header().Get(RequestIDHeader); got != seen {
+		t.Fatalf("Response request ID %#v does not match %#v", got, seen)
+	}
+
+	req := mustRequest("GET", "/", "")
+	req.Header.Set(RequestIDHeader, "given")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if seen != "given" || rec.Header().Get(RequestIDHeader) != "given" {
+		t.Fatalf("Given request ID was not kept, saw %#v and returned %#v",
+			seen, rec.Header().Get(RequestIDHeader))
+	}
+}
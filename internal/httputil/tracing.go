@@ -0,0 +1,31 @@
+package httputil
+
+import (
+	"net/http"
+
+	"github.com/encryptio/slime/internal/tracing"
+)
+
+// TraceHTTPRequests traces each request in a span, which is a child of the
+// span in the request's traceparent header if there is one, and starts a new
+// trace otherwise. The traceparent header is replaced with the new span before
+// the request is passed on to inner, so handlers make their spans children of
+// it.
+func TraceHTTPRequests(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := "HTTP " + r.Method
+		span := tracing.Start(tracing.Extract(r.Header), name)
+		if span == nil {
+			span = tracing.StartRoot(name)
+		}
+		defer span.End()
+
+		span.SetAttribute("url", r.URL.String())
+		if id := r.Header.Get(RequestIDHeader); id != "" {
+			span.SetAttribute("request_id", id)
+		}
+		tracing.Inject(r.Header, span.Context())
+
+		inner.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,189 @@
+// Package logging writes levelled log lines, as text or as JSON objects.
+//
+// Lines written with the standard log package are treated as info level, so
+// that they are filtered and formatted along with everything else once
+// Configure has been called.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Level is the importance of a log line.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the name of a level, such as "warn".
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %#v", s)
+}
+
+// Fields are extra values attached to a log line, such as a request ID.
+type Fields map[string]interface{}
+
+var (
+	mu       sync.Mutex
+	output   io.Writer = os.Stderr
+	minLevel           = Info
+	asJSON   bool
+)
+
+// Configure sets the lowest level that is written, and whether lines are
+// written as JSON objects. It also redirects the standard log package through
+// this one.
+func Configure(w io.Writer, level Level, json bool) {
+	mu.Lock()
+	output = w
+	minLevel = level
+	asJSON = json
+	mu.Unlock()
+
+	log.SetOutput(stdWriter{})
+	log.SetFlags(log.Lshortfile)
+}
+
+// Enabled returns whether lines at the given level are written.
+func Enabled(level Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return level >= minLevel
+}
+
+// Log writes msg at the given level, along with fields, which may be nil.
+func Log(level Level, msg string, fields Fields) {
+	write(level, caller(2), msg, fields)
+}
+
+// Debugf, Infof, Warnf, and Errorf write a formatted message at their level.
+func Debugf(format string, args ...interface{}) {
+	write(Debug, caller(2), fmt.Sprintf(format, args...), nil)
+}
+
+func Infof(format string, args ...interface{}) {
+	write(Info, caller(2), fmt.Sprintf(format, args...), nil)
+}
+
+func Warnf(format string, args ...interface{}) {
+	write(Warn, caller(2), fmt.Sprintf(format, args...), nil)
+}
+
+func Errorf(format string, args ...interface{}) {
+	write(Error, caller(2), fmt.Sprintf(format, args...), nil)
+}
+
+// caller returns the file:line of the caller skip frames up, like
+// log.Lshortfile.
+func caller(skip int) string {
+	_, file, line, ok := runtime.Caller(skip)
+	if !ok {
+		return "???:0"
+	}
+	return filepath.Base(file) + ":" + strconv.Itoa(line)
+}
+
+func write(level Level, from, msg string, fields Fields) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if level < minLevel {
+		return
+	}
+
+	var buf bytes.Buffer
+	if asJSON {
+		obj := make(map[string]interface{}, len(fields)+4)
+		for k, v := range fields {
+			obj[k] = v
+		}
+		obj["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+		obj["level"] = level.String()
+		obj["caller"] = from
+		obj["msg"] = msg
+
+		data, err := json.Marshal(obj)
+		if err != nil {
+			data, _ = json.Marshal(map[string]interface{}{
+				"level": level.String(),
+				"msg":   msg,
+				"error": "couldn't encode fields: " + err.Error(),
+			})
+		}
+		buf.Write(data)
+	} else {
+		buf.WriteString(from)
+		buf.WriteString(": ")
+		if level != Info {
+			buf.WriteString(strings.ToUpper(level.String()))
+			buf.WriteString(": ")
+		}
+		buf.WriteString(msg)
+
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&buf, " %s=%s", k, formatValue(fields[k]))
+		}
+	}
+	buf.WriteByte('\n')
+
+	output.Write(buf.Bytes())
+}
+
+func formatValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// stdWriter receives lines from the standard log package, which are written
+// with log.Lshortfile.
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+
+	from := "???:0"
+	if i := strings.Index(line, ": "); i >= 0 {
+		from, line = line[:i], line[i+2:]
+	}
+
+	write(Info, from, line, nil)
+	return len(p), nil
+}
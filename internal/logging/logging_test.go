@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestText(t *testing.T) {
+	var buf bytes.Buffer
+	Configure(&buf, Info, false)
+	defer Configure(os.Stderr, Info, false)
+
+	Debugf("hidden %d", 1)
+	Infof("shown %d", 2)
+	Log(Warn, "warned", Fields{"b": 2, "a": "x y"})
+	log.Printf("from std")
+
+	re := regexp.MustCompile(`^logging_test\.go:\d+: shown 2
+logging_test\.go:\d+: WARN: warned a="x y" b=2
+logging_test\.go:\d+: from std
+$`)
+	if !re.MatchString(buf.String()) {
+		t.Fatalf("Unexpected log output %q", buf.String())
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	Configure(&buf, Warn, true)
+	defer Configure(os.Stderr, Info, false)
+
+	Infof("hidden")
+	log.Printf("also hidden")
+	Log(Error, "failed", Fields{"request_id": "abc"})
+
+	var obj map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &obj)
+	if err != nil {
+		t.Fatalf("Couldn't decode log output %q: %v", buf.String(), err)
+	}
+
+	for k, v := range map[string]string{
+		"level":      "error",
+		"msg":        "failed",
+		"request_id": "abc",
+	} {
+		if obj[k] != v {
+			t.Errorf("Wanted %v = %#v, but got %#v", k, v, obj[k])
+		}
+	}
+	if caller, _ := obj["caller"].(string); !regexp.MustCompile(`^logging_test\.go:\d+$`).MatchString(caller) {
+		t.Errorf("Unexpected caller %#v", obj["caller"])
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{Debug, Info, Warn, Error} {
+		got, err := ParseLevel(l.String())
+		if err != nil || got != l {
+			t.Errorf("ParseLevel(%#v) = %v, %v", l.String(), got, err)
+		}
+	}
+
+	_, err := ParseLevel("loud")
+	if err == nil {
+		t.Errorf("ParseLevel accepted an unknown level")
+	}
+}
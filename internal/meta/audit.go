@@ -0,0 +1,85 @@
+package meta
+
+import (
+	"github.com/encryptio/kvl"
+	"github.com/encryptio/kvl/keys"
+	"github.com/encryptio/kvl/tuple"
+)
+
+// AuditEntry records a change made to the cluster, and who made it.
+type AuditEntry struct {
+	Time int64    // unix nanoseconds
+	ID   [16]byte // distinguishes entries made at the same time
+
+	Action string // what was done, such as "redundancy" or "store.dead"
+	User   string // who did it, as given by the client; may be empty
+	Source string // the address the request came from
+	Target string // what it was done to, such as a store uuid or a key
+
+	// Before and After describe what was changed, usually as JSON. They are
+	// empty when there was nothing before, or nothing is left after.
+	Before string
+	After  string
+}
+
+func auditKey(t int64, id [16]byte) []byte {
+	return tuple.MustAppend(nil, "audit", t, id)
+}
+
+// AddAuditEntry appends e to the audit log. Entries are never changed or
+// removed once added.
+func (l *Layer) AddAuditEntry(e AuditEntry) error {
+	return l.inner.Set(kvl.Pair{
+		auditKey(e.Time, e.ID),
+		tuple.MustAppend(nil, 0, e.Action, e.User, e.Source, e.Target, e.Before, e.After),
+	})
+}
+
+// AuditEntries returns up to limit entries from the audit log that come before
+// the entry with the given time and ID, newest first. Entries made at the same
+// time are ordered by ID. A beforeTime of 0 returns the newest entries.
+func (l *Layer) AuditEntries(beforeTime int64, beforeID [16]byte, limit int) ([]AuditEntry, error) {
+	if limit <= 0 {
+		return nil, ErrBadArgument
+	}
+
+	var rang kvl.RangeQuery
+	rang.Low, rang.High = keys.PrefixRange(tuple.MustAppend(nil, "audit"))
+	if beforeTime != 0 {
+		rang.High = auditKey(beforeTime, beforeID)
+	}
+	rang.Limit = limit
+	rang.Descending = true
+
+	ps, err := l.inner.Range(rang)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]AuditEntry, 0, len(ps))
+	for _, p := range ps {
+		var typ string
+		var e AuditEntry
+		err := tuple.UnpackInto(p.Key, &typ, &e.Time, &e.ID)
+		if err != nil {
+			return nil, err
+		}
+		if typ != "audit" {
+			return nil, ErrBadKeyType
+		}
+
+		var version int
+		err = tuple.UnpackInto(p.Value, &version,
+			&e.Action, &e.User, &e.Source, &e.Target, &e.Before, &e.After)
+		if err != nil {
+			return nil, err
+		}
+		if version != 0 {
+			return nil, ErrUnknownMetaVersion
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
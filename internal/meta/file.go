@@ -24,6 +24,10 @@ type File struct {
 	PrefixID     [16]byte
 	DataChunks   uint16
 	MappingValue uint32
+	Codec        uint8
+	LocalGroup   uint16 // data chunks per local parity group; 0 if not LRC
+	Tier         string // tier label of the locations the chunks belong on
+	Archived     bool   // encoded with the archive layout, not the write layout
 	Locations    [][16]byte
 }
 
@@ -36,9 +40,24 @@ func (f *File) toPair() kvl.Pair {
 
 	p.Key = fileKey(f.Path)
 
+	// Write the oldest version that holds every field set, so that proxies
+	// that haven't been upgraded can still read files that don't use the
+	// newer features.
+	version := f.version()
 	p.Value = tuple.MustAppend(nil,
-		0, f.Size, f.SHA256, f.WriteTime, f.PrefixID, f.DataChunks,
+		version, f.Size, f.SHA256, f.WriteTime, f.PrefixID, f.DataChunks,
 		f.MappingValue)
+	switch version {
+	case 1:
+		p.Value = tuple.MustAppend(p.Value, f.Codec)
+	case 2:
+		p.Value = tuple.MustAppend(p.Value, f.Codec, f.LocalGroup)
+	case 3:
+		p.Value = tuple.MustAppend(p.Value, f.Codec, f.LocalGroup, f.Tier)
+	case 4:
+		p.Value = tuple.MustAppend(p.Value, f.Codec, f.LocalGroup, f.Tier,
+			f.Archived)
+	}
 	for _, loc := range f.Locations {
 		p.Value = tuple.MustAppend(p.Value, loc)
 	}
@@ -46,6 +65,22 @@ func (f *File) toPair() kvl.Pair {
 	return p
 }
 
+// version returns the lowest serialization version that can hold f.
+func (f *File) version() int {
+	switch {
+	case f.Archived:
+		return 4
+	case f.Tier != "":
+		return 3
+	case f.LocalGroup != 0:
+		return 2
+	case f.Codec != 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
 func (f *File) fromPair(p kvl.Pair) error {
 	var typ string
 	err := tuple.UnpackInto(p.Key, &typ, &f.Path)
@@ -59,7 +94,42 @@ func (f *File) fromPair(p kvl.Pair) error {
 	var version int
 	left, err := tuple.UnpackIntoPartial(p.Value, &version, &f.Size, &f.SHA256,
 		&f.WriteTime, &f.PrefixID, &f.DataChunks, &f.MappingValue)
-	if version != 0 {
+	if err != nil {
+		return err
+	}
+
+	f.Tier = ""
+	f.Archived = false
+
+	switch version {
+	case 0:
+		// version 0 files predate codec selection
+		f.Codec = 0
+		f.LocalGroup = 0
+	case 1:
+		left, err = tuple.UnpackIntoPartial(left, &f.Codec)
+		if err != nil {
+			return err
+		}
+		f.LocalGroup = 0
+	case 2:
+		left, err = tuple.UnpackIntoPartial(left, &f.Codec, &f.LocalGroup)
+		if err != nil {
+			return err
+		}
+	case 3:
+		// version 3 files predate archiving
+		left, err = tuple.UnpackIntoPartial(left, &f.Codec, &f.LocalGroup, &f.Tier)
+		if err != nil {
+			return err
+		}
+	case 4:
+		left, err = tuple.UnpackIntoPartial(left, &f.Codec, &f.LocalGroup,
+			&f.Tier, &f.Archived)
+		if err != nil {
+			return err
+		}
+	default:
 		return ErrUnknownMetaVersion
 	}
 
@@ -4,6 +4,9 @@ import (
 	"reflect"
 	"testing"
 	"testing/quick"
+
+	"github.com/encryptio/kvl"
+	"github.com/encryptio/kvl/tuple"
 )
 
 func TestFileSerialization(t *testing.T) {
@@ -40,3 +43,147 @@ func TestFileSerialization(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestFileVersion0(t *testing.T) {
+	f := File{
+		Path:         "a",
+		Size:         3,
+		WriteTime:    12345,
+		DataChunks:   2,
+		MappingValue: 1 << 31,
+		Locations:    [][16]byte{{1}, {2}, {3}},
+	}
+
+	pair := kvl.Pair{Key: fileKey(f.Path)}
+	pair.Value = tuple.MustAppend(nil,
+		0, f.Size, f.SHA256, f.WriteTime, f.PrefixID, f.DataChunks,
+		f.MappingValue)
+	for _, loc := range f.Locations {
+		pair.Value = tuple.MustAppend(pair.Value, loc)
+	}
+
+	var f2 File
+	err := f2.fromPair(pair)
+	if err != nil {
+		t.Fatalf("Couldn't fromPair on a version 0 file: %v", err)
+	}
+
+	if !reflect.DeepEqual(f, f2) {
+		t.Errorf("version 0 file decoded to %#v, wanted %#v", f2, f)
+	}
+}
+
+func TestFileVersion1(t *testing.T) {
+	f := File{
+		Path:       "a",
+		Size:       3,
+		WriteTime:  12345,
+		DataChunks: 2,
+		Codec:      1,
+		Locations:  [][16]byte{{1}, {2}, {3}},
+	}
+
+	pair := kvl.Pair{Key: fileKey(f.Path)}
+	pair.Value = tuple.MustAppend(nil,
+		1, f.Size, f.SHA256, f.WriteTime, f.PrefixID, f.DataChunks,
+		f.MappingValue, f.Codec)
+	for _, loc := range f.Locations {
+		pair.Value = tuple.MustAppend(pair.Value, loc)
+	}
+
+	var f2 File
+	err := f2.fromPair(pair)
+	if err != nil {
+		t.Fatalf("Couldn't fromPair on a version 1 file: %v", err)
+	}
+
+	if !reflect.DeepEqual(f, f2) {
+		t.Errorf("version 1 file decoded to %#v, wanted %#v", f2, f)
+	}
+}
+
+func TestFileVersion2(t *testing.T) {
+	f := File{
+		Path:       "a",
+		Size:       3,
+		WriteTime:  12345,
+		DataChunks: 2,
+		Codec:      1,
+		LocalGroup: 2,
+		Locations:  [][16]byte{{1}, {2}, {3}},
+	}
+
+	pair := kvl.Pair{Key: fileKey(f.Path)}
+	pair.Value = tuple.MustAppend(nil,
+		2, f.Size, f.SHA256, f.WriteTime, f.PrefixID, f.DataChunks,
+		f.MappingValue, f.Codec, f.LocalGroup)
+	for _, loc := range f.Locations {
+		pair.Value = tuple.MustAppend(pair.Value, loc)
+	}
+
+	var f2 File
+	err := f2.fromPair(pair)
+	if err != nil {
+		t.Fatalf("Couldn't fromPair on a version 2 file: %v", err)
+	}
+
+	if !reflect.DeepEqual(f, f2) {
+		t.Errorf("version 2 file decoded to %#v, wanted %#v", f2, f)
+	}
+}
+
+func TestFileVersion3(t *testing.T) {
+	f := File{
+		Path:       "a",
+		Size:       3,
+		WriteTime:  12345,
+		DataChunks: 2,
+		Codec:      1,
+		Tier:       "ssd",
+		Locations:  [][16]byte{{1}, {2}, {3}},
+	}
+
+	pair := kvl.Pair{Key: fileKey(f.Path)}
+	pair.Value = tuple.MustAppend(nil,
+		3, f.Size, f.SHA256, f.WriteTime, f.PrefixID, f.DataChunks,
+		f.MappingValue, f.Codec, f.LocalGroup, f.Tier)
+	for _, loc := range f.Locations {
+		pair.Value = tuple.MustAppend(pair.Value, loc)
+	}
+
+	var f2 File
+	f2.Archived = true
+	err := f2.fromPair(pair)
+	if err != nil {
+		t.Fatalf("Couldn't fromPair on a version 3 file: %v", err)
+	}
+
+	if !reflect.DeepEqual(f, f2) {
+		t.Errorf("version 3 file decoded to %#v, wanted %#v", f2, f)
+	}
+}
+
+func TestFileWritesOldestVersion(t *testing.T) {
+	tests := []struct {
+		f       File
+		version int
+	}{
+		{File{Path: "a"}, 0},
+		{File{Path: "a", Codec: 1}, 1},
+		{File{Path: "a", Codec: 2, LocalGroup: 2}, 2},
+		{File{Path: "a", Tier: "ssd"}, 3},
+		{File{Path: "a", Archived: true}, 4},
+	}
+
+	for _, test := range tests {
+		var version int
+		_, err := tuple.UnpackIntoPartial(test.f.toPair().Value, &version)
+		if err != nil {
+			t.Fatalf("Couldn't unpack version: %v", err)
+		}
+		if version != test.version {
+			t.Errorf("%#v was written with version %v, wanted %v",
+				test.f, version, test.version)
+		}
+	}
+}
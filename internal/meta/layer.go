@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"time"
 
 	"github.com/encryptio/kvl"
@@ -250,9 +251,277 @@ func (l *Layer) SetFile(f *File) error {
 }
 
 func (l *Layer) RemoveFilePath(path string) error {
+	err := l.inner.Delete(accessKey(path))
+	if err != nil && err != kvl.ErrNotFound {
+		return err
+	}
+
 	return l.inner.Delete(fileKey(path))
 }
 
+func accessKey(path string) []byte {
+	return tuple.MustAppend(nil, "access", path)
+}
+
+// GetAccessTime returns the last time the file at path was read, in seconds
+// since the unix epoch, or 0 if no read was recorded.
+func (l *Layer) GetAccessTime(path string) (int64, error) {
+	p, err := l.inner.Get(accessKey(path))
+	if err != nil {
+		if err == kvl.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var t int64
+	err = tuple.UnpackInto(p.Value, &t)
+	if err != nil {
+		return 0, err
+	}
+	return t, nil
+}
+
+// SetAccessTime records that the file at path was read at t, unless a later
+// read was already recorded.
+func (l *Layer) SetAccessTime(path string, t int64) error {
+	old, err := l.GetAccessTime(path)
+	if err != nil {
+		return err
+	}
+	if old >= t {
+		return nil
+	}
+
+	return l.inner.Set(kvl.Pair{accessKey(path), tuple.MustAppend(nil, t)})
+}
+
+// RepairEntry is a file waiting in the repair queue.
+type RepairEntry struct {
+	Path string
+
+	// Margin is the number of chunks of the file that can still be lost
+	// before it can't be read: surviving chunks minus the chunks needed.
+	Margin int
+
+	// Bad holds the indices of chunks known to be bad in ways the location
+	// scrubber can't see, such as failing to read from a store that is online.
+	Bad []int
+}
+
+func repairQueueKey(margin int, path string) []byte {
+	return tuple.MustAppend(nil, "repairq", margin, path)
+}
+
+func repairPathKey(path string) []byte {
+	return tuple.MustAppend(nil, "repairpath", path)
+}
+
+func repairDepthKey(margin int) []byte {
+	return tuple.MustAppend(nil, "repairdepth", margin)
+}
+
+// QueueRepair adds the file at path to the repair queue, with the indices of
+// its chunks in bad (see RepairEntry.) If it is already queued, it keeps the
+// lower of the two margins, and the chunks from both. Margins below zero are
+// queued as zero.
+func (l *Layer) QueueRepair(path string, margin int, bad []int) error {
+	if margin < 0 {
+		margin = 0
+	}
+
+	p, err := l.inner.Get(repairPathKey(path))
+	if err != nil && err != kvl.ErrNotFound {
+		return err
+	}
+	if err == nil {
+		var old int
+		err = tuple.UnpackInto(p.Value, &old)
+		if err != nil {
+			return err
+		}
+
+		q, err := l.inner.Get(repairQueueKey(old, path))
+		if err != nil && err != kvl.ErrNotFound {
+			return err
+		}
+		if err == nil {
+			oldBad, err := unpackIndices(q.Value)
+			if err != nil {
+				return err
+			}
+			bad = mergeIndices(oldBad, bad)
+		}
+
+		if old < margin {
+			margin = old
+		}
+
+		err = l.removeRepair(path, old)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = l.inner.Set(kvl.Pair{repairQueueKey(margin, path), packIndices(bad)})
+	if err != nil {
+		return err
+	}
+
+	err = l.inner.Set(kvl.Pair{repairPathKey(path), tuple.MustAppend(nil, margin)})
+	if err != nil {
+		return err
+	}
+
+	return l.addRepairDepth(margin, 1)
+}
+
+// TakeRepairs removes up to count files from the repair queue and returns
+// them, those with the lowest margin first.
+func (l *Layer) TakeRepairs(count int) ([]RepairEntry, error) {
+	var rang kvl.RangeQuery
+	rang.Low, rang.High = keys.PrefixRange(tuple.MustAppend(nil, "repairq"))
+	rang.Limit = count
+
+	ps, err := l.inner.Range(rang)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]RepairEntry, 0, len(ps))
+	for _, p := range ps {
+		var typ string
+		var e RepairEntry
+		err := tuple.UnpackInto(p.Key, &typ, &e.Margin, &e.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Bad, err = unpackIndices(p.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		err = l.removeRepair(e.Path, e.Margin)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+func packIndices(idxs []int) []byte {
+	var data []byte
+	for _, i := range idxs {
+		data = tuple.MustAppend(data, i)
+	}
+	return data
+}
+
+func unpackIndices(data []byte) ([]int, error) {
+	var idxs []int
+	for len(data) > 0 {
+		var i int
+		var err error
+		data, err = tuple.UnpackIntoPartial(data, &i)
+		if err != nil {
+			return nil, err
+		}
+		idxs = append(idxs, i)
+	}
+	return idxs, nil
+}
+
+// mergeIndices returns the indices in either a or b, in increasing order.
+func mergeIndices(a, b []int) []int {
+	seen := make(map[int]bool, len(a)+len(b))
+	var ret []int
+	for _, list := range [][]int{a, b} {
+		for _, i := range list {
+			if !seen[i] {
+				seen[i] = true
+				ret = append(ret, i)
+			}
+		}
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+// RepairQueueDepth returns the number of files in the repair queue at each
+// margin. Margins with no files are left out.
+func (l *Layer) RepairQueueDepth() (map[int]int64, error) {
+	var rang kvl.RangeQuery
+	rang.Low, rang.High = keys.PrefixRange(tuple.MustAppend(nil, "repairdepth"))
+
+	ps, err := l.inner.Range(rang)
+	if err != nil {
+		return nil, err
+	}
+
+	depth := make(map[int]int64, len(ps))
+	for _, p := range ps {
+		var typ string
+		var margin int
+		err := tuple.UnpackInto(p.Key, &typ, &margin)
+		if err != nil {
+			return nil, err
+		}
+
+		var count int64
+		err = tuple.UnpackInto(p.Value, &count)
+		if err != nil {
+			return nil, err
+		}
+
+		depth[margin] = count
+	}
+
+	return depth, nil
+}
+
+func (l *Layer) removeRepair(path string, margin int) error {
+	err := l.inner.Delete(repairQueueKey(margin, path))
+	if err != nil {
+		return err
+	}
+
+	err = l.inner.Delete(repairPathKey(path))
+	if err != nil {
+		return err
+	}
+
+	return l.addRepairDepth(margin, -1)
+}
+
+func (l *Layer) addRepairDepth(margin int, delta int64) error {
+	var count int64
+	p, err := l.inner.Get(repairDepthKey(margin))
+	if err != nil && err != kvl.ErrNotFound {
+		return err
+	}
+	if err == nil {
+		err = tuple.UnpackInto(p.Value, &count)
+		if err != nil {
+			return err
+		}
+	}
+
+	count += delta
+	if count <= 0 {
+		err = l.inner.Delete(repairDepthKey(margin))
+		if err == kvl.ErrNotFound {
+			err = nil
+		}
+		return err
+	}
+
+	return l.inner.Set(kvl.Pair{repairDepthKey(margin), tuple.MustAppend(nil, count)})
+}
+
 func (l *Layer) GetFilesByLocation(id [16]byte, count int) ([]File, error) {
 	var rang kvl.RangeQuery
 	rang.Low, rang.High = keys.PrefixRange(tuple.MustAppend(nil,
@@ -501,3 +501,292 @@ func TestLayerWALConcurrent(t *testing.T) {
 		t.Fatalf("Couldn't run transaction: %v", err)
 	}
 }
+
+func TestLayerAccessTime(t *testing.T) {
+	db := ram.New()
+
+	err := db.RunTx(func(ctx kvl.Ctx) error {
+		l, err := Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		shouldAccessTime := func(want int64) {
+			got, err := l.GetAccessTime("a")
+			if err != nil {
+				t.Errorf("Couldn't get access time: %v", err)
+			} else if got != want {
+				t.Errorf("GetAccessTime returned %v, wanted %v", got, want)
+			}
+		}
+
+		shouldAccessTime(0)
+
+		for _, at := range []int64{100, 50, 200} {
+			err = l.SetAccessTime("a", at)
+			if err != nil {
+				t.Errorf("Couldn't set access time: %v", err)
+				return err
+			}
+		}
+		shouldAccessTime(200)
+
+		err = l.SetFile(&File{Path: "a", PrefixID: uuid.Gen4()})
+		if err != nil {
+			t.Errorf("Couldn't set file: %v", err)
+			return err
+		}
+
+		err = l.RemoveFilePath("a")
+		if err != nil {
+			t.Errorf("Couldn't remove file: %v", err)
+			return err
+		}
+		shouldAccessTime(0)
+
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Couldn't run transaction: %v", err)
+	}
+}
+
+func TestLayerRepairQueue(t *testing.T) {
+	db := ram.New()
+
+	err := db.RunTx(func(ctx kvl.Ctx) error {
+		l, err := Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		queue := []RepairEntry{
+			{"a", 2, []int{3}},
+			{"b", 1, nil},
+			{"c", 2, nil},
+			{"a", 0, []int{1, 3}}, // lowers a's margin, and adds chunk 1
+			{"b", 2, []int{0}},    // doesn't raise b's, but adds chunk 0
+			{"d", -1, nil},
+		}
+		for _, e := range queue {
+			err = l.QueueRepair(e.Path, e.Margin, e.Bad)
+			if err != nil {
+				t.Errorf("Couldn't queue repair: %v", err)
+				return err
+			}
+		}
+
+		depth, err := l.RepairQueueDepth()
+		if err != nil {
+			t.Errorf("Couldn't get repair queue depth: %v", err)
+			return err
+		}
+		wantDepth := map[int]int64{0: 2, 1: 1, 2: 1}
+		if !reflect.DeepEqual(depth, wantDepth) {
+			t.Errorf("RepairQueueDepth returned %v, wanted %v", depth, wantDepth)
+		}
+
+		entries, err := l.TakeRepairs(3)
+		if err != nil {
+			t.Errorf("Couldn't take repairs: %v", err)
+			return err
+		}
+		wantEntries := []RepairEntry{{"a", 0, []int{1, 3}}, {"d", 0, nil}, {"b", 1, []int{0}}}
+		if !reflect.DeepEqual(entries, wantEntries) {
+			t.Errorf("TakeRepairs returned %v, wanted %v", entries, wantEntries)
+		}
+
+		entries, err = l.TakeRepairs(3)
+		if err != nil {
+			t.Errorf("Couldn't take repairs: %v", err)
+			return err
+		}
+		wantEntries = []RepairEntry{{"c", 2, nil}}
+		if !reflect.DeepEqual(entries, wantEntries) {
+			t.Errorf("TakeRepairs returned %v, wanted %v", entries, wantEntries)
+		}
+
+		depth, err = l.RepairQueueDepth()
+		if err != nil {
+			t.Errorf("Couldn't get repair queue depth: %v", err)
+			return err
+		}
+		if len(depth) != 0 {
+			t.Errorf("RepairQueueDepth returned %v after emptying the queue", depth)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Couldn't run transaction: %v", err)
+	}
+}
+
+func TestLayerAudit(t *testing.T) {
+	db := ram.New()
+
+	err := db.RunTx(func(ctx kvl.Ctx) error {
+		l, err := Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		// entries share times in pairs, so pages split between them
+		var added []AuditEntry
+		for i := 1; i <= 5; i++ {
+			e := AuditEntry{
+				Time:   int64((i+1)/2) * 1000,
+				ID:     [16]byte{byte(i)},
+				Action: fmt.Sprintf("action%v", i),
+				User:   "someone",
+				Source: "127.0.0.1:1234",
+				Target: "target",
+				After:  `{"n":1}`,
+			}
+			err = l.AddAuditEntry(e)
+			if err != nil {
+				t.Errorf("Couldn't add audit entry: %v", err)
+				return err
+			}
+			added = append(added, e)
+		}
+
+		entries, err := l.AuditEntries(0, [16]byte{}, 2)
+		if err != nil {
+			t.Errorf("Couldn't get audit entries: %v", err)
+			return err
+		}
+		want := []AuditEntry{added[4], added[3]}
+		if !reflect.DeepEqual(entries, want) {
+			t.Errorf("AuditEntries(0, 2) returned %v, wanted %v", entries, want)
+		}
+
+		for _, want := range [][]AuditEntry{
+			{added[2], added[1]},
+			{added[0]},
+		} {
+			last := entries[len(entries)-1]
+			entries, err = l.AuditEntries(last.Time, last.ID, 2)
+			if err != nil {
+				t.Errorf("Couldn't get audit entries: %v", err)
+				return err
+			}
+			if !reflect.DeepEqual(entries, want) {
+				t.Errorf("AuditEntries after %v returned %v, wanted %v", last, entries, want)
+			}
+		}
+
+		_, err = l.AuditEntries(0, [16]byte{}, 0)
+		if err != ErrBadArgument {
+			t.Errorf("AuditEntries with zero limit returned %v, wanted %v",
+				err, ErrBadArgument)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Couldn't run transaction: %v", err)
+	}
+}
+
+func TestLayerQuotas(t *testing.T) {
+	db := ram.New()
+
+	err := db.RunTx(func(ctx kvl.Ctx) error {
+		l, err := Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = l.SetQuota(Quota{Prefix: "a", HardBytes: 100, SoftObjects: 2})
+		if err != nil {
+			t.Errorf("Couldn't set quota: %v", err)
+			return err
+		}
+		err = l.SetQuota(Quota{Prefix: "ab", HardObjects: 1})
+		if err != nil {
+			t.Errorf("Couldn't set quota: %v", err)
+			return err
+		}
+
+		err = l.ChargeUsage("ab1", 60, 1)
+		if err != nil {
+			t.Errorf("Couldn't charge usage: %v", err)
+			return err
+		}
+
+		// over the hard object limit on "ab"; nothing may change
+		err = l.ChargeUsage("ab2", 10, 1)
+		if err != ErrQuotaExceeded {
+			t.Errorf("ChargeUsage over hard limit returned %v, wanted %v", err, ErrQuotaExceeded)
+		}
+		u, err := l.GetUsage("a")
+		if err != nil {
+			t.Errorf("Couldn't get usage: %v", err)
+			return err
+		}
+		if u != (Usage{60, 1}) {
+			t.Errorf("Usage of a is %v after failed charge, wanted %v", u, Usage{60, 1})
+		}
+
+		// "b" has no quota
+		err = l.ChargeUsage("b", 1000, 1)
+		if err != nil {
+			t.Errorf("Couldn't charge usage: %v", err)
+			return err
+		}
+
+		err = l.CheckQuotas("a1", 50, 1)
+		if err != ErrQuotaExceeded {
+			t.Errorf("CheckQuotas over hard byte limit returned %v, wanted %v", err, ErrQuotaExceeded)
+		}
+
+		// crosses the soft object limit, then stays over it
+		err = l.ChargeUsage("a1", 10, 1)
+		if err != nil {
+			t.Errorf("Couldn't charge usage: %v", err)
+			return err
+		}
+		err = l.ChargeUsage("a2", 10, 1)
+		if err != ErrQuotaExceeded {
+			t.Errorf("ChargeUsage over soft limit returned %v, wanted %v", err, ErrQuotaExceeded)
+		}
+		err = l.ChargeUsage("a1", 5, 0)
+		if err != nil {
+			t.Errorf("Couldn't grow a file over the soft object limit: %v", err)
+		}
+		err = l.ChargeUsage("a1", -15, -1)
+		if err != nil {
+			t.Errorf("Couldn't charge usage: %v", err)
+		}
+
+		u, err = l.GetUsage("a")
+		if err != nil {
+			t.Errorf("Couldn't get usage: %v", err)
+			return err
+		}
+		if u != (Usage{60, 1}) {
+			t.Errorf("Usage of a is %v, wanted %v", u, Usage{60, 1})
+		}
+
+		err = l.RemoveQuota("ab")
+		if err != nil {
+			t.Errorf("Couldn't remove quota: %v", err)
+			return err
+		}
+		quotas, err := l.Quotas()
+		if err != nil {
+			t.Errorf("Couldn't list quotas: %v", err)
+			return err
+		}
+		want := []Quota{{Prefix: "a", HardBytes: 100, SoftObjects: 2}}
+		if !reflect.DeepEqual(quotas, want) {
+			t.Errorf("Quotas returned %v, wanted %v", quotas, want)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Couldn't run transaction: %v", err)
+	}
+}
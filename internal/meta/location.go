@@ -1,25 +1,122 @@
 package meta
 
 import (
+	"errors"
+
 	"github.com/encryptio/kvl"
 	"github.com/encryptio/kvl/tuple"
 )
 
+// Location modes, as recorded in Location.Mode.
+const (
+	// LocationNormal locations are read from and written to.
+	LocationNormal uint8 = 0
+
+	// LocationReadOnly locations are read from, but no new chunks are written
+	// to them. Chunks already there stay.
+	LocationReadOnly uint8 = 1
+
+	// LocationDraining locations are read from, but no new chunks are written
+	// to them, and the chunks already there are moved to other locations at
+	// up to Location.DrainRate bytes per second.
+	LocationDraining uint8 = 2
+)
+
+var ErrUnknownLocationMode = errors.New("unknown location mode")
+
+var locationModeNames = map[uint8]string{
+	LocationNormal:   "normal",
+	LocationReadOnly: "readonly",
+	LocationDraining: "draining",
+}
+
+// LocationModeName returns the human-readable name of a location mode.
+func LocationModeName(mode uint8) string {
+	if name, ok := locationModeNames[mode]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseLocationMode returns the location mode for a name returned by
+// LocationModeName.
+func ParseLocationMode(name string) (uint8, error) {
+	for mode, n := range locationModeNames {
+		if n == name {
+			return mode, nil
+		}
+	}
+	return 0, ErrUnknownLocationMode
+}
+
 type Location struct {
-	UUID       [16]byte
-	URL        string
-	Name       string
-	Dead       bool
-	LastSeen   int64 // seconds since unix epoch
+	UUID      [16]byte
+	URL       string
+	Name      string
+	Dead      bool
+	LastSeen  int64 // seconds since unix epoch
+	Mode      uint8
+	DrainRate int64  // bytes per second when draining; 0 is unlimited
+	Tier      string // label shared by locations of the same speed; "" is default
+
+	// Placement settings. New chunks are not written to the location once
+	// its free space drops below Reserved bytes, or once it is more than
+	// MaxFill percent full (0 is no limit.) Weight scales how much new data
+	// goes to it, in percent of normal; 0 means 100.
+	Reserved int64
+	MaxFill  uint8
+	Weight   uint16
+
 	AllocSplit []string
 }
 
+// Writable returns true if new chunks may be written to the location. It does
+// not consider how full the location is; see Available.
+func (l *Location) Writable() bool {
+	return !l.Dead && l.Mode == LocationNormal
+}
+
+// Available returns the number of bytes that may still be written to the
+// location, given its free space and its capacity (0 if unknown.) It is
+// negative if the location is over its limits.
+func (l *Location) Available(free, capacity int64) int64 {
+	avail := free - l.Reserved
+	if l.MaxFill > 0 && capacity > 0 {
+		fillAvail := capacity/100*int64(l.MaxFill) - (capacity - free)
+		if fillAvail < avail {
+			avail = fillAvail
+		}
+	}
+	return avail
+}
+
+// PlacementWeight returns Weight, with the default filled in.
+func (l *Location) PlacementWeight() int64 {
+	if l.Weight == 0 {
+		return 100
+	}
+	return int64(l.Weight)
+}
+
 func (l *Location) toPair() kvl.Pair {
 	var p kvl.Pair
 
 	p.Key = tuple.MustAppend(nil, "location", l.UUID)
 
-	p.Value = tuple.MustAppend(nil, 0, l.URL, l.Name, l.Dead, l.LastSeen)
+	// Write the oldest version that holds every setting, so that proxies that
+	// haven't been upgraded can still read locations left at the defaults.
+	version := l.version()
+	p.Value = tuple.MustAppend(nil, version, l.URL, l.Name, l.Dead, l.LastSeen)
+	switch version {
+	case 1:
+		p.Value = tuple.MustAppend(p.Value, l.Mode, l.DrainRate)
+	case 2:
+		p.Value = tuple.MustAppend(p.Value, l.Mode, l.DrainRate,
+			l.Reserved, l.MaxFill, l.Weight)
+	case 3:
+		p.Value = tuple.MustAppend(p.Value, l.Mode, l.DrainRate,
+			l.Reserved, l.MaxFill, l.Weight, l.Tier)
+	}
 	for _, split := range l.AllocSplit {
 		p.Value = tuple.MustAppend(p.Value, split)
 	}
@@ -27,6 +124,20 @@ func (l *Location) toPair() kvl.Pair {
 	return p
 }
 
+// version returns the lowest serialization version that can hold l.
+func (l *Location) version() int {
+	switch {
+	case l.Tier != "":
+		return 3
+	case l.Reserved != 0 || l.MaxFill != 0 || l.Weight != 0:
+		return 2
+	case l.Mode != LocationNormal || l.DrainRate != 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
 func (l *Location) fromPair(p kvl.Pair) error {
 	var typ string
 	err := tuple.UnpackInto(p.Key, &typ, &l.UUID)
@@ -44,7 +155,36 @@ func (l *Location) fromPair(p kvl.Pair) error {
 		return err
 	}
 
-	if version != 0 {
+	l.Mode = LocationNormal
+	l.DrainRate = 0
+	l.Reserved = 0
+	l.MaxFill = 0
+	l.Weight = 0
+	l.Tier = ""
+
+	switch version {
+	case 0:
+		// version 0 locations predate location modes
+	case 1:
+		// version 1 locations predate placement settings
+		left, err = tuple.UnpackIntoPartial(left, &l.Mode, &l.DrainRate)
+		if err != nil {
+			return err
+		}
+	case 2:
+		// version 2 locations predate tiers
+		left, err = tuple.UnpackIntoPartial(left, &l.Mode, &l.DrainRate,
+			&l.Reserved, &l.MaxFill, &l.Weight)
+		if err != nil {
+			return err
+		}
+	case 3:
+		left, err = tuple.UnpackIntoPartial(left, &l.Mode, &l.DrainRate,
+			&l.Reserved, &l.MaxFill, &l.Weight, &l.Tier)
+		if err != nil {
+			return err
+		}
+	default:
 		return ErrUnknownMetaVersion
 	}
 
@@ -4,6 +4,9 @@ import (
 	"reflect"
 	"testing"
 	"testing/quick"
+
+	"github.com/encryptio/kvl"
+	"github.com/encryptio/kvl/tuple"
 )
 
 func TestLocationSerialization(t *testing.T) {
@@ -40,3 +43,135 @@ func TestLocationSerialization(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestLocationVersion0(t *testing.T) {
+	l := Location{
+		UUID:       [16]byte{1, 2, 3},
+		URL:        "http://localhost:17941/",
+		Name:       "old",
+		LastSeen:   1234,
+		AllocSplit: []string{"a", "b"},
+	}
+
+	pair := kvl.Pair{Key: tuple.MustAppend(nil, "location", l.UUID)}
+	pair.Value = tuple.MustAppend(nil, 0, l.URL, l.Name, l.Dead, l.LastSeen)
+	for _, split := range l.AllocSplit {
+		pair.Value = tuple.MustAppend(pair.Value, split)
+	}
+
+	var l2 Location
+	err := l2.fromPair(pair)
+	if err != nil {
+		t.Fatalf("Couldn't fromPair on a version 0 location: %v", err)
+	}
+
+	if !reflect.DeepEqual(l, l2) {
+		t.Errorf("version 0 location decoded to %#v, wanted %#v", l2, l)
+	}
+	if !l2.Writable() {
+		t.Errorf("version 0 location is not writable")
+	}
+}
+
+func TestLocationVersion1(t *testing.T) {
+	l := Location{
+		UUID:      [16]byte{1, 2, 3},
+		URL:       "http://localhost:17941/",
+		Name:      "draining",
+		LastSeen:  1234,
+		Mode:      LocationDraining,
+		DrainRate: 1000,
+	}
+
+	pair := kvl.Pair{Key: tuple.MustAppend(nil, "location", l.UUID)}
+	pair.Value = tuple.MustAppend(nil, 1, l.URL, l.Name, l.Dead, l.LastSeen,
+		l.Mode, l.DrainRate)
+
+	var l2 Location
+	err := l2.fromPair(pair)
+	if err != nil {
+		t.Fatalf("Couldn't fromPair on a version 1 location: %v", err)
+	}
+
+	if !reflect.DeepEqual(l, l2) {
+		t.Errorf("version 1 location decoded to %#v, wanted %#v", l2, l)
+	}
+}
+
+func TestLocationAvailable(t *testing.T) {
+	tests := []struct {
+		reserved        int64
+		maxFill         uint8
+		free, capacity  int64
+		expectAvailable int64
+	}{
+		{0, 0, 500, 1000, 500},
+		{100, 0, 500, 1000, 400},
+		{600, 0, 500, 1000, -100},
+		{0, 90, 500, 1000, 400},
+		{0, 40, 500, 1000, -100},
+		{0, 90, 500, 0, 500}, // unknown capacity
+		{200, 90, 500, 1000, 300},
+		{0, 90, 50, 1000, -50},
+	}
+
+	for _, test := range tests {
+		l := Location{Reserved: test.reserved, MaxFill: test.maxFill}
+		got := l.Available(test.free, test.capacity)
+		if got != test.expectAvailable {
+			t.Errorf("Available(%v, %v) with reserved %v and max fill %v = %v, wanted %v",
+				test.free, test.capacity, test.reserved, test.maxFill, got, test.expectAvailable)
+		}
+	}
+}
+
+func TestLocationVersion2(t *testing.T) {
+	l := Location{
+		UUID:     [16]byte{1, 2, 3},
+		URL:      "http://localhost:17941/",
+		Name:     "limited",
+		LastSeen: 1234,
+		Reserved: 1000,
+		MaxFill:  90,
+		Weight:   200,
+	}
+
+	pair := kvl.Pair{Key: tuple.MustAppend(nil, "location", l.UUID)}
+	pair.Value = tuple.MustAppend(nil, 2, l.URL, l.Name, l.Dead, l.LastSeen,
+		l.Mode, l.DrainRate, l.Reserved, l.MaxFill, l.Weight)
+
+	var l2 Location
+	err := l2.fromPair(pair)
+	if err != nil {
+		t.Fatalf("Couldn't fromPair on a version 2 location: %v", err)
+	}
+
+	if !reflect.DeepEqual(l, l2) {
+		t.Errorf("version 2 location decoded to %#v, wanted %#v", l2, l)
+	}
+}
+
+func TestLocationWritesOldestVersion(t *testing.T) {
+	tests := []struct {
+		l       Location
+		version int
+	}{
+		{Location{URL: "a", LastSeen: 1234}, 0},
+		{Location{URL: "a", Mode: LocationDraining}, 1},
+		{Location{URL: "a", DrainRate: 1000}, 1},
+		{Location{URL: "a", Weight: 50}, 2},
+		{Location{URL: "a", Mode: LocationReadOnly, Tier: "ssd"}, 3},
+	}
+
+	for _, test := range tests {
+		var version int
+		_, err := tuple.UnpackIntoPartial(test.l.toPair().Value, &version)
+		if err != nil {
+			t.Fatalf("Couldn't unpack version: %v", err)
+		}
+		if version != test.version {
+			t.Errorf("%#v was written with version %v, wanted %v",
+				test.l, version, test.version)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package meta
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/encryptio/kvl"
+	"github.com/encryptio/kvl/keys"
+	"github.com/encryptio/kvl/tuple"
+)
+
+// ErrQuotaExceeded is returned from CheckQuotas and ChargeUsage when a change
+// would take the data under a prefix over its quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// quotaRecountBatch is the number of files read at a time when counting the
+// existing usage under a new quota's prefix.
+var quotaRecountBatch = 1000
+
+// A Quota limits the data stored under a key prefix. Zero limits are
+// unlimited.
+//
+// Once the usage is at or over a soft limit, changes that add to it fail; the
+// change that crosses it succeeds. Changes that would take the usage over a
+// hard limit fail. Changes that shrink the usage are always allowed.
+type Quota struct {
+	Prefix string
+
+	SoftBytes   int64
+	HardBytes   int64
+	SoftObjects int64
+	HardObjects int64
+}
+
+// Usage is the total size and number of the files under a quota's prefix.
+type Usage struct {
+	Bytes   int64
+	Objects int64
+}
+
+func quotaKey(prefix string) []byte {
+	return tuple.MustAppend(nil, "quota", prefix)
+}
+
+func usageKey(prefix string) []byte {
+	return tuple.MustAppend(nil, "usage", prefix)
+}
+
+// Quotas returns every quota, in order of prefix.
+func (l *Layer) Quotas() ([]Quota, error) {
+	var rang kvl.RangeQuery
+	rang.Low, rang.High = keys.PrefixRange(tuple.MustAppend(nil, "quota"))
+
+	ps, err := l.inner.Range(rang)
+	if err != nil {
+		return nil, err
+	}
+
+	quotas := make([]Quota, 0, len(ps))
+	for _, p := range ps {
+		var typ string
+		var q Quota
+		err := tuple.UnpackInto(p.Key, &typ, &q.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		if typ != "quota" {
+			return nil, ErrBadKeyType
+		}
+
+		var version int
+		err = tuple.UnpackInto(p.Value, &version,
+			&q.SoftBytes, &q.HardBytes, &q.SoftObjects, &q.HardObjects)
+		if err != nil {
+			return nil, err
+		}
+		if version != 0 {
+			return nil, ErrUnknownMetaVersion
+		}
+
+		quotas = append(quotas, q)
+	}
+
+	return quotas, nil
+}
+
+// SetQuota sets the quota on q.Prefix. If the prefix had no quota before, the
+// files already under it are counted to start its usage, which reads all of
+// them in this transaction.
+func (l *Layer) SetQuota(q Quota) error {
+	if q.SoftBytes < 0 || q.HardBytes < 0 || q.SoftObjects < 0 || q.HardObjects < 0 {
+		return ErrBadArgument
+	}
+
+	_, err := l.inner.Get(quotaKey(q.Prefix))
+	if err != nil {
+		if err != kvl.ErrNotFound {
+			return err
+		}
+
+		u, err := l.countUsage(q.Prefix)
+		if err != nil {
+			return err
+		}
+
+		err = l.setUsage(q.Prefix, u)
+		if err != nil {
+			return err
+		}
+	}
+
+	return l.inner.Set(kvl.Pair{
+		quotaKey(q.Prefix),
+		tuple.MustAppend(nil, 0, q.SoftBytes, q.HardBytes, q.SoftObjects, q.HardObjects),
+	})
+}
+
+// RemoveQuota removes the quota on prefix, along with its usage. It returns
+// kvl.ErrNotFound if there was none.
+func (l *Layer) RemoveQuota(prefix string) error {
+	err := l.inner.Delete(quotaKey(prefix))
+	if err != nil {
+		return err
+	}
+
+	err = l.inner.Delete(usageKey(prefix))
+	if err == kvl.ErrNotFound {
+		err = nil
+	}
+	return err
+}
+
+// GetUsage returns the usage under the prefix of a quota.
+func (l *Layer) GetUsage(prefix string) (Usage, error) {
+	var u Usage
+
+	p, err := l.inner.Get(usageKey(prefix))
+	if err != nil {
+		if err == kvl.ErrNotFound {
+			return u, nil
+		}
+		return u, err
+	}
+
+	var version int
+	err = tuple.UnpackInto(p.Value, &version, &u.Bytes, &u.Objects)
+	if err != nil {
+		return u, err
+	}
+	if version != 0 {
+		return u, ErrUnknownMetaVersion
+	}
+
+	return u, nil
+}
+
+func (l *Layer) setUsage(prefix string, u Usage) error {
+	return l.inner.Set(kvl.Pair{usageKey(prefix), tuple.MustAppend(nil, 0, u.Bytes, u.Objects)})
+}
+
+// countUsage adds up the files under prefix.
+func (l *Layer) countUsage(prefix string) (Usage, error) {
+	var u Usage
+
+	f, err := l.GetFile(prefix)
+	if err != nil {
+		return u, err
+	}
+	if f != nil {
+		u.Bytes += int64(f.Size)
+		u.Objects++
+	}
+
+	after := prefix
+	for {
+		files, err := l.ListFiles(after, quotaRecountBatch)
+		if err != nil {
+			return u, err
+		}
+
+		for _, f := range files {
+			if !strings.HasPrefix(f.Path, prefix) {
+				return u, nil
+			}
+			u.Bytes += int64(f.Size)
+			u.Objects++
+		}
+
+		if len(files) < quotaRecountBatch {
+			return u, nil
+		}
+		after = files[len(files)-1].Path
+	}
+}
+
+// CheckQuotas returns ErrQuotaExceeded if changing the size and number of
+// files at path by bytes and objects would break a quota on it.
+func (l *Layer) CheckQuotas(path string, bytes, objects int64) error {
+	return l.chargeUsage(path, bytes, objects, false)
+}
+
+// ChargeUsage changes the usage of every quota on path by bytes and objects,
+// or returns ErrQuotaExceeded without changing anything if that would break
+// one of them.
+func (l *Layer) ChargeUsage(path string, bytes, objects int64) error {
+	return l.chargeUsage(path, bytes, objects, true)
+}
+
+func (l *Layer) chargeUsage(path string, bytes, objects int64, apply bool) error {
+	if bytes == 0 && objects == 0 {
+		return nil
+	}
+
+	quotas, err := l.Quotas()
+	if err != nil {
+		return err
+	}
+
+	var matched []string
+	var usages []Usage
+	for _, q := range quotas {
+		if !strings.HasPrefix(path, q.Prefix) {
+			continue
+		}
+
+		u, err := l.GetUsage(q.Prefix)
+		if err != nil {
+			return err
+		}
+
+		if exceeds(u.Bytes, bytes, q.SoftBytes, q.HardBytes) ||
+			exceeds(u.Objects, objects, q.SoftObjects, q.HardObjects) {
+			return ErrQuotaExceeded
+		}
+
+		matched = append(matched, q.Prefix)
+		usages = append(usages, u)
+	}
+
+	if !apply {
+		return nil
+	}
+
+	for i, prefix := range matched {
+		u := usages[i]
+		u.Bytes += bytes
+		u.Objects += objects
+		err = l.setUsage(prefix, u)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exceeds returns whether adding delta to used breaks the soft or hard limit.
+func exceeds(used, delta, soft, hard int64) bool {
+	if delta <= 0 {
+		return false
+	}
+	if soft > 0 && used >= soft {
+		return true
+	}
+	if hard > 0 && used+delta > hard {
+		return true
+	}
+	return false
+}
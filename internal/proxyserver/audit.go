@@ -0,0 +1,322 @@
+package proxyserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/encryptio/slime/internal/httputil"
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/meta"
+	"github.com/encryptio/slime/internal/uuid"
+
+	"github.com/encryptio/kvl"
+)
+
+// UserHeader names the person or program making a request, for the audit log.
+const UserHeader = "X-Slime-User"
+
+var (
+	auditDefaultLimit = 100
+	auditMaxLimit     = 10000
+	auditBatch        = 1000
+)
+
+// requestUser returns who made r: the X-Slime-User header if present, or the
+// user name given with HTTP basic authentication.
+func requestUser(r *http.Request) string {
+	if user := r.Header.Get(UserHeader); user != "" {
+		return user
+	}
+	user, _, _ := r.BasicAuth()
+	return user
+}
+
+// auditJSON encodes v for the Before or After of an audit entry. A nil v is
+// recorded as nothing.
+func auditJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// auditEntry builds an audit entry for a change made by r.
+func auditEntry(r *http.Request, action, target string, before, after interface{}) meta.AuditEntry {
+	return meta.AuditEntry{
+		Time:   time.Now().UnixNano(),
+		ID:     uuid.Gen4(),
+		Action: action,
+		User:   requestUser(r),
+		Source: r.RemoteAddr,
+		Target: target,
+		Before: auditJSON(before),
+		After:  auditJSON(after),
+	}
+}
+
+// audit records a change made by r that has already happened, in its own
+// transaction. Failures are logged, since the change can't be taken back.
+// Changes made in a database transaction add their entry in it instead.
+func (h *Handler) audit(r *http.Request, action, target string, before, after interface{}) {
+	e := auditEntry(r, action, target, before, after)
+	err := h.db.RunTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+		return layer.AddAuditEntry(e)
+	})
+	if err != nil {
+		logging.Errorf("Couldn't add %v audit entry for %v: %v", action, target, err)
+	}
+}
+
+// SetAuditData sets whether data PUTs and DELETEs are recorded in the audit
+// log. Administrative changes are always recorded.
+func (h *Handler) SetAuditData(enabled bool) {
+	h.auditData = enabled
+}
+
+type auditObjectJSON struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+func (h *Handler) statForAudit(key string) interface{} {
+	st, err := h.dataStore.Stat(key, nil)
+	if err != nil {
+		return nil
+	}
+	return auditObjectJSON{
+		SHA256: hex.EncodeToString(st.SHA256[:]),
+		Size:   st.Size,
+	}
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusRecorder) CloseNotify() <-chan bool {
+	if cn, ok := s.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
+
+// serveAuditedData serves a data PUT or DELETE, recording it in the audit log
+// if it succeeds. The values before and after are read separately from the
+// write, so a concurrent write to the same key may be recorded in place of
+// one of them.
+func (h *Handler) serveAuditedData(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	before := h.statForAudit(key)
+
+	rec := &statusRecorder{ResponseWriter: w}
+	h.dataServer.ServeHTTP(rec, r)
+	if rec.code < 200 || rec.code >= 300 {
+		return
+	}
+
+	if r.Method == "PUT" {
+		h.audit(r, "data.put", key, before, h.statForAudit(key))
+	} else {
+		h.audit(r, "data.delete", key, before, nil)
+	}
+}
+
+type auditEntryJSON struct {
+	Time   time.Time       `json:"time"`
+	Cursor string          `json:"cursor"`
+	ID     string          `json:"id"`
+	Action string          `json:"action"`
+	User   string          `json:"user"`
+	Source string          `json:"source"`
+	Target string          `json:"target"`
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+func auditValueJSON(v string) json.RawMessage {
+	if v == "" {
+		return json.RawMessage("null")
+	}
+	if !json.Valid([]byte(v)) {
+		data, _ := json.Marshal(v)
+		return json.RawMessage(data)
+	}
+	return json.RawMessage(v)
+}
+
+// auditCursor returns the cursor clients page backwards from e with. It is the
+// entry's time and ID, since several entries may be made at the same time.
+func auditCursor(e meta.AuditEntry) string {
+	return strconv.FormatInt(e.Time, 10) + "." + uuid.Fmt(e.ID)
+}
+
+// parseAuditCursor reverses auditCursor.
+func parseAuditCursor(s string) (int64, [16]byte, error) {
+	var id [16]byte
+	i := strings.IndexByte(s, '.')
+	if i < 0 {
+		return 0, id, errors.New("bad cursor format")
+	}
+
+	t, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, id, err
+	}
+	if t <= 0 {
+		return 0, id, errors.New("bad cursor time")
+	}
+
+	id, err = uuid.Parse(s[i+1:])
+	return t, id, err
+}
+
+func (h *Handler) serveAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := auditDefaultLimit
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > auditMaxLimit {
+			httputil.RespondJSONError(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var beforeTime int64
+	var beforeID [16]byte
+	if s := r.FormValue("before"); s != "" {
+		var err error
+		beforeTime, beforeID, err = parseAuditCursor(s)
+		if err != nil {
+			httputil.RespondJSONError(w, "bad before cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// action matches exactly, or as a prefix if it ends in "."
+	action := r.FormValue("action")
+	matches := func(e meta.AuditEntry) bool {
+		if action == "" || e.Action == action {
+			return true
+		}
+		return strings.HasSuffix(action, ".") && strings.HasPrefix(e.Action, action)
+	}
+
+	ret := make([]auditEntryJSON, 0, limit)
+	for len(ret) < limit {
+		var entries []meta.AuditEntry
+		err := h.db.RunReadTx(func(ctx kvl.Ctx) error {
+			layer, err := meta.Open(ctx)
+			if err != nil {
+				return err
+			}
+
+			entries, err = layer.AuditEntries(beforeTime, beforeID, auditBatch)
+			return err
+		})
+		if err != nil {
+			httputil.RespondJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, e := range entries {
+			if !matches(e) {
+				continue
+			}
+			ret = append(ret, auditEntryJSON{
+				Time:   time.Unix(0, e.Time).UTC(),
+				Cursor: auditCursor(e),
+				ID:     uuid.Fmt(e.ID),
+				Action: e.Action,
+				User:   e.User,
+				Source: e.Source,
+				Target: e.Target,
+				Before: auditValueJSON(e.Before),
+				After:  auditValueJSON(e.After),
+			})
+			if len(ret) == limit {
+				break
+			}
+		}
+
+		if len(entries) < auditBatch {
+			break
+		}
+		last := entries[len(entries)-1]
+		beforeTime, beforeID = last.Time, last.ID
+	}
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// archiveSettings returns the settable fields of a, for the audit log.
+func archiveSettings(a archiveJSON) map[string]interface{} {
+	return map[string]interface{}{
+		"need":        a.Need,
+		"total":       a.Total,
+		"codec":       a.Codec,
+		"local_group": a.LocalGroup,
+		"after":       a.After,
+		"rate":        a.Rate,
+	}
+}
+
+// storeAuditJSON describes a store's settings for the audit log.
+type storeAuditJSON struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Dead      bool   `json:"dead"`
+	Mode      string `json:"mode"`
+	DrainRate int64  `json:"drain_rate"`
+	Tier      string `json:"tier"`
+	Reserved  int64  `json:"reserved"`
+	MaxFill   uint8  `json:"max_fill"`
+	Weight    int64  `json:"weight"`
+}
+
+func storeToAuditJSON(loc meta.Location) storeAuditJSON {
+	return storeAuditJSON{
+		Name:      loc.Name,
+		URL:       loc.URL,
+		Dead:      loc.Dead,
+		Mode:      meta.LocationModeName(loc.Mode),
+		DrainRate: loc.DrainRate,
+		Tier:      loc.Tier,
+		Reserved:  loc.Reserved,
+		MaxFill:   loc.MaxFill,
+		Weight:    loc.PlacementWeight(),
+	}
+}
@@ -3,10 +3,13 @@ package proxyserver
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/encryptio/slime/internal/events"
 	"github.com/encryptio/slime/internal/httputil"
 	"github.com/encryptio/slime/internal/meta"
 	"github.com/encryptio/slime/internal/store"
@@ -20,16 +23,33 @@ import (
 
 type Handler struct {
 	db         kvl.DB
+	dataStore  store.Store
 	dataServer *storehttp.Server
 	multi      *multi.Multi
 	finder     *multi.Finder
+	events     *events.Dispatcher
+	auditData  bool // set before serving; see SetAuditData
+
+	memoryCache *cache.Cache // nil if disabled
+	diskCache   *cache.Disk  // nil if disabled
+}
+
+// CacheConfig sizes the caches in front of the cluster's data. A cache with a
+// size of zero is not used.
+type CacheConfig struct {
+	MemorySize int    // bytes of values kept in memory
+	DiskDir    string // directory of the disk cache, typically on an SSD
+	DiskSize   int64  // bytes of values kept in DiskDir
 }
 
-func New(db kvl.DB, scrubbers int, cacheSize int) (*Handler, error) {
+// New creates a Handler. Cluster events are sent to d, which may be nil; the
+// Handler closes it when stopped.
+func New(db kvl.DB, scrubbers int, caches CacheConfig, limits multi.Limits, d *events.Dispatcher) (*Handler, error) {
 	finder, err := multi.NewFinder(db)
 	if err != nil {
 		return nil, err
 	}
+	finder.SetEvents(d)
 
 	multi, err := multi.NewMulti(db, finder, scrubbers)
 	if err != nil {
@@ -37,27 +57,62 @@ func New(db kvl.DB, scrubbers int, cacheSize int) (*Handler, error) {
 		return nil, err
 	}
 
+	multi.SetEvents(d)
+
+	err = multi.SetLimits(limits)
+	if err != nil {
+		multi.Close()
+		finder.Stop()
+		return nil, err
+	}
+
 	var dataStore store.Store = multi
-	if cacheSize > 0 {
-		dataStore = cache.New(cacheSize, multi)
+	var diskCache *cache.Disk
+	if caches.DiskSize > 0 {
+		diskCache, err = cache.OpenDisk(caches.DiskDir, caches.DiskSize, dataStore)
+		if err != nil {
+			multi.Close()
+			finder.Stop()
+			return nil, err
+		}
+		dataStore = diskCache
+	}
+
+	var memoryCache *cache.Cache
+	if caches.MemorySize > 0 {
+		memoryCache = cache.New(caches.MemorySize, dataStore)
+		dataStore = memoryCache
 	}
 
 	return &Handler{
-		db:         db,
-		dataServer: storehttp.NewServer(dataStore),
-		multi:      multi,
-		finder:     finder,
+		db:          db,
+		dataStore:   dataStore,
+		dataServer:  storehttp.NewServer(dataStore),
+		multi:       multi,
+		finder:      finder,
+		events:      d,
+		memoryCache: memoryCache,
+		diskCache:   diskCache,
 	}, nil
 }
 
 func (h *Handler) Stop() {
 	h.multi.Close()
 	h.finder.Stop()
+	h.events.Close()
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(r.URL.Path, "/data/") {
 		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/data")
+		if r.Method == "GET" && r.URL.Path != "/" {
+			// recorded here rather than in Multi so that cache hits count
+			h.multi.RecordAccess(strings.TrimPrefix(r.URL.Path, "/"))
+		}
+		if h.auditData && (r.Method == "PUT" || r.Method == "DELETE") && r.URL.Path != "/" {
+			h.serveAuditedData(w, r)
+			return
+		}
 		h.dataServer.ServeHTTP(w, r)
 		return
 	}
@@ -67,6 +122,32 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveRedundancy(w, r)
 	case "/stores":
 		h.serveStores(w, r)
+	case "/quarantine":
+		h.serveQuarantine(w, r)
+	case "/hashcheck":
+		h.serveHashcheck(w, r)
+	case "/deepscrub":
+		h.serveDeepScrub(w, r)
+	case "/archive":
+		h.serveArchive(w, r)
+	case "/limits":
+		h.serveLimits(w, r)
+	case "/tiering":
+		h.serveTiering(w, r)
+	case "/tiers":
+		h.serveTiers(w, r)
+	case "/repairqueue":
+		h.serveRepairQueue(w, r)
+	case "/readrepair":
+		h.serveReadRepair(w, r)
+	case "/health":
+		h.serveHealth(w, r)
+	case "/usage":
+		h.serveUsage(w, r)
+	case "/cache":
+		h.serveCache(w, r)
+	case "/audit":
+		h.serveAudit(w, r)
 	case "/":
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Hello from slime proxy server!"))
@@ -75,43 +156,760 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *Handler) serveRedundancy(w http.ResponseWriter, r *http.Request) {
-	redundancy := struct {
-		Need  int `json:"need"`
-		Total int `json:"total"`
-	}{}
+type redundancyJSON struct {
+	Need         int    `json:"need"`
+	Total        int    `json:"total"`
+	Codec        string `json:"codec"`
+	MigrateCodec bool   `json:"migrate_codec"`
+	LocalGroup   int    `json:"local_group"`
+}
 
+func layoutToJSON(l multi.Layout) redundancyJSON {
+	return redundancyJSON{
+		Need:         l.Need,
+		Total:        l.Total,
+		Codec:        multi.CodecName(l.Codec),
+		MigrateCodec: l.MigrateCodec,
+		LocalGroup:   l.LocalGroup,
+	}
+}
+
+func (h *Handler) serveRedundancy(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		// do nothing
 
 	case "POST":
+		// Fields missing from the request body keep their current values
+		redundancy := layoutToJSON(h.multi.GetLayout())
+		before := redundancy
+
 		err := json.NewDecoder(r.Body).Decode(&redundancy)
 		if err != nil {
 			httputil.RespondJSONError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		err = h.multi.SetRedundancy(redundancy.Need, redundancy.Total)
-		if err != nil {
-			status := http.StatusInternalServerError
-			if _, ok := err.(multi.BadConfigError); ok {
-				status = http.StatusBadRequest
-			}
-			httputil.RespondJSONError(w, err.Error(), status)
-			return
-		}
+		codec, err := multi.ParseCodec(redundancy.Codec)
+		if err == nil {
+			l := multi.Layout{
+				Need:         redundancy.Need,
+				Total:        redundancy.Total,
+				Codec:        codec,
+				MigrateCodec: redundancy.MigrateCodec,
+				LocalGroup:   redundancy.LocalGroup,
+			}
+			e := auditEntry(r, "redundancy", "", before, layoutToJSON(l))
+			err = h.multi.SetLayout(l, &e)
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			if _, ok := err.(multi.BadConfigError); ok {
+				status = http.StatusBadRequest
+			}
+			httputil.RespondJSONError(w, err.Error(), status)
+			return
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(layoutToJSON(h.multi.GetLayout()))
+}
+
+type deepScrubJSON struct {
+	Rate   int64 `json:"rate"`
+	Repair bool  `json:"repair"`
+
+	// read only
+	Position     string `json:"position"`
+	Files        int64  `json:"files"`
+	Bytes        int64  `json:"bytes"`
+	Inconsistent int64  `json:"inconsistent"`
+	Repaired     int64  `json:"repaired"`
+}
+
+func (h *Handler) serveDeepScrub(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		// do nothing
+
+	case "POST":
+		// Fields missing from the request body keep their current values
+		conf := h.multi.GetDeepScrub()
+		req := deepScrubJSON{Rate: conf.Rate, Repair: conf.Repair}
+
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			httputil.RespondJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		e := auditEntry(r, "deepscrub", "",
+			map[string]interface{}{"rate": conf.Rate, "repair": conf.Repair},
+			map[string]interface{}{"rate": req.Rate, "repair": req.Repair})
+		err = h.multi.SetDeepScrub(multi.DeepScrubConfig{
+			Rate:   req.Rate,
+			Repair: req.Repair,
+		}, &e)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if _, ok := err.(multi.BadConfigError); ok {
+				status = http.StatusBadRequest
+			}
+			httputil.RespondJSONError(w, err.Error(), status)
+			return
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	conf := h.multi.GetDeepScrub()
+	stats := h.multi.DeepScrubStats()
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(deepScrubJSON{
+		Rate:         conf.Rate,
+		Repair:       conf.Repair,
+		Position:     stats.Position,
+		Files:        stats.Files,
+		Bytes:        stats.Bytes,
+		Inconsistent: stats.Inconsistent,
+		Repaired:     stats.Repaired,
+	})
+}
+
+type archiveJSON struct {
+	Need       int    `json:"need"`
+	Total      int    `json:"total"`
+	Codec      string `json:"codec"`
+	LocalGroup int    `json:"local_group"`
+	After      string `json:"after"`
+	Rate       int64  `json:"rate"`
+
+	// read only
+	Position string `json:"position"`
+	Scanned  int64  `json:"scanned"`
+	Files    int64  `json:"files"`
+	Bytes    int64  `json:"bytes"`
+	Saved    int64  `json:"saved"`
+}
+
+func (h *Handler) serveArchive(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		// do nothing
+
+	case "POST":
+		// Fields missing from the request body keep their current values
+		conf := h.multi.GetArchive()
+		req := archiveJSON{
+			Need:       conf.Layout.Need,
+			Total:      conf.Layout.Total,
+			Codec:      multi.CodecName(conf.Layout.Codec),
+			LocalGroup: conf.Layout.LocalGroup,
+			After:      conf.After.String(),
+			Rate:       conf.Rate,
+		}
+		before := req
+
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			httputil.RespondJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		after, err := time.ParseDuration(req.After)
+		if err != nil {
+			httputil.RespondJSONError(w, "bad after: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		codec, err := multi.ParseCodec(req.Codec)
+		if err == nil {
+			e := auditEntry(r, "archive", "", archiveSettings(before), archiveSettings(req))
+			err = h.multi.SetArchive(multi.ArchiveConfig{
+				Layout: multi.Layout{
+					Need:       req.Need,
+					Total:      req.Total,
+					Codec:      codec,
+					LocalGroup: req.LocalGroup,
+				},
+				After: after,
+				Rate:  req.Rate,
+			}, &e)
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			if _, ok := err.(multi.BadConfigError); ok {
+				status = http.StatusBadRequest
+			}
+			httputil.RespondJSONError(w, err.Error(), status)
+			return
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	conf := h.multi.GetArchive()
+	stats := h.multi.ArchiveStats()
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(archiveJSON{
+		Need:       conf.Layout.Need,
+		Total:      conf.Layout.Total,
+		Codec:      multi.CodecName(conf.Layout.Codec),
+		LocalGroup: conf.Layout.LocalGroup,
+		After:      conf.After.String(),
+		Rate:       conf.Rate,
+		Position:   stats.Position,
+		Scanned:    stats.Scanned,
+		Files:      stats.Files,
+		Bytes:      stats.Bytes,
+		Saved:      stats.Saved,
+	})
+}
+
+type limitJSON struct {
+	BytesPerSecond int64 `json:"bytes_per_second"`
+	OpsPerSecond   int64 `json:"ops_per_second"`
+}
+
+type limitsJSON struct {
+	Scrub      limitJSON `json:"scrub"`
+	Rebuild    limitJSON `json:"rebuild"`
+	Rebalance  limitJSON `json:"rebalance"`
+	ReadRepair limitJSON `json:"read_repair"`
+	DeepScrub  limitJSON `json:"deep_scrub"`
+	Archive    limitJSON `json:"archive"`
+	Tiering    limitJSON `json:"tiering"`
+}
+
+func limitsToJSON(l multi.Limits) limitsJSON {
+	return limitsJSON{
+		Scrub:      limitJSON(l.Scrub),
+		Rebuild:    limitJSON(l.Rebuild),
+		Rebalance:  limitJSON(l.Rebalance),
+		ReadRepair: limitJSON(l.ReadRepair),
+		DeepScrub:  limitJSON(l.DeepScrub),
+		Archive:    limitJSON(l.Archive),
+		Tiering:    limitJSON(l.Tiering),
+	}
+}
+
+func (h *Handler) serveLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		// do nothing
+
+	case "POST":
+		// Fields missing from the request body keep their current values
+		req := limitsToJSON(h.multi.GetLimits())
+		before := req
+
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			httputil.RespondJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = h.multi.SetLimits(multi.Limits{
+			Scrub:      multi.Limit(req.Scrub),
+			Rebuild:    multi.Limit(req.Rebuild),
+			Rebalance:  multi.Limit(req.Rebalance),
+			ReadRepair: multi.Limit(req.ReadRepair),
+			DeepScrub:  multi.Limit(req.DeepScrub),
+			Archive:    multi.Limit(req.Archive),
+			Tiering:    multi.Limit(req.Tiering),
+		})
+		if err != nil {
+			status := http.StatusInternalServerError
+			if _, ok := err.(multi.BadConfigError); ok {
+				status = http.StatusBadRequest
+			}
+			httputil.RespondJSONError(w, err.Error(), status)
+			return
+		}
+
+		h.audit(r, "limits", "", before, limitsToJSON(h.multi.GetLimits()))
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(limitsToJSON(h.multi.GetLimits()))
+}
+
+type tieringJSON struct {
+	Hot         string `json:"hot"`
+	Cold        string `json:"cold"`
+	DemoteAfter string `json:"demote_after"`
+}
+
+func (h *Handler) serveTiering(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		// do nothing
+
+	case "POST":
+		// Fields missing from the request body keep their current values
+		conf := h.multi.GetTiering()
+		req := tieringJSON{
+			Hot:         conf.Hot,
+			Cold:        conf.Cold,
+			DemoteAfter: conf.DemoteAfter.String(),
+		}
+		before := req
+
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			httputil.RespondJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		demoteAfter, err := time.ParseDuration(req.DemoteAfter)
+		if err != nil {
+			httputil.RespondJSONError(w, "bad demote_after: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		e := auditEntry(r, "tiering", "", before, req)
+		err = h.multi.SetTiering(multi.TieringConfig{
+			Hot:         req.Hot,
+			Cold:        req.Cold,
+			DemoteAfter: demoteAfter,
+		}, &e)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if _, ok := err.(multi.BadConfigError); ok {
+				status = http.StatusBadRequest
+			}
+			httputil.RespondJSONError(w, err.Error(), status)
+			return
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	conf := h.multi.GetTiering()
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(tieringJSON{
+		Hot:         conf.Hot,
+		Cold:        conf.Cold,
+		DemoteAfter: conf.DemoteAfter.String(),
+	})
+}
+
+type tiersResponseEntry struct {
+	Tier     string `json:"tier"`
+	Stores   int    `json:"stores"`
+	Free     int64  `json:"free"`
+	Capacity int64  `json:"capacity"` // only of the stores that report it
+	Used     int64  `json:"used"`     // only of the stores that report capacity
+}
+
+type tiersResponseByTier []tiersResponseEntry
+
+func (l tiersResponseByTier) Len() int           { return len(l) }
+func (l tiersResponseByTier) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l tiersResponseByTier) Less(i, j int) bool { return l[i].Tier < l[j].Tier }
+
+func (h *Handler) serveTiers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	finderEntries := h.finder.Stores()
+
+	var locs []meta.Location
+	err := h.db.RunReadTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		locs, err = layer.AllLocations()
+		return err
+	})
+	if err != nil {
+		httputil.RespondJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tiers := make(map[string]*tiersResponseEntry)
+	for _, loc := range locs {
+		fe, connected := finderEntries[loc.UUID]
+		if !connected || loc.Dead {
+			continue
+		}
+
+		e := tiers[loc.Tier]
+		if e == nil {
+			e = &tiersResponseEntry{Tier: loc.Tier}
+			tiers[loc.Tier] = e
+		}
+
+		e.Stores++
+		e.Free += fe.Free
+		if fe.Capacity > 0 {
+			e.Capacity += fe.Capacity
+			e.Used += fe.Capacity - fe.Free
+		}
+	}
+
+	ret := make([]tiersResponseEntry, 0, len(tiers))
+	for _, e := range tiers {
+		ret = append(ret, *e)
+	}
+	sort.Sort(tiersResponseByTier(ret))
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(ret)
+}
+
+type repairQueueJSON struct {
+	Total   int64                   `json:"total"`
+	Margins []repairQueueMarginJSON `json:"margins"`
+}
+
+type repairQueueMarginJSON struct {
+	Margin int   `json:"margin"`
+	Files  int64 `json:"files"`
+}
+
+type repairQueueByMargin []repairQueueMarginJSON
+
+func (l repairQueueByMargin) Len() int           { return len(l) }
+func (l repairQueueByMargin) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l repairQueueByMargin) Less(i, j int) bool { return l[i].Margin < l[j].Margin }
+
+func (h *Handler) serveRepairQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	depth, err := h.multi.RepairQueueDepth()
+	if err != nil {
+		httputil.RespondJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ret := repairQueueJSON{Margins: make([]repairQueueMarginJSON, 0, len(depth))}
+	for margin, files := range depth {
+		ret.Total += files
+		ret.Margins = append(ret.Margins, repairQueueMarginJSON{
+			Margin: margin,
+			Files:  files,
+		})
+	}
+	sort.Sort(repairQueueByMargin(ret.Margins))
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(ret)
+}
+
+type readRepairJSON struct {
+	Scheduled    int64 `json:"scheduled"`
+	Deduplicated int64 `json:"deduplicated"`
+	Queued       int64 `json:"queued"`
+	Dropped      int64 `json:"dropped"`
+	Repaired     int64 `json:"repaired"`
+	Failed       int64 `json:"failed"`
+}
+
+func (h *Handler) serveReadRepair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(readRepairJSON(h.multi.ReadRepairStats()))
+}
+
+type quotaJSON struct {
+	Prefix      string `json:"prefix"`
+	SoftBytes   int64  `json:"soft_bytes"`
+	HardBytes   int64  `json:"hard_bytes"`
+	SoftObjects int64  `json:"soft_objects"`
+	HardObjects int64  `json:"hard_objects"`
+}
+
+type usageJSON struct {
+	quotaJSON
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+type usageRequest struct {
+	Operation   string `json:"operation"`
+	Prefix      string `json:"prefix"`
+	SoftBytes   int64  `json:"soft_bytes"`
+	HardBytes   int64  `json:"hard_bytes"`
+	SoftObjects int64  `json:"soft_objects"`
+	HardObjects int64  `json:"hard_objects"`
+}
+
+func (h *Handler) serveUsage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		// do nothing
+
+	case "POST":
+		var req usageRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			httputil.RespondJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Operation != "set" && req.Operation != "remove" {
+			httputil.RespondJSONError(w, "unsupported operation", http.StatusBadRequest)
+			return
+		}
+
+		err = h.db.RunTx(func(ctx kvl.Ctx) error {
+			layer, err := meta.Open(ctx)
+			if err != nil {
+				return err
+			}
+
+			var before interface{}
+			quotas, err := layer.Quotas()
+			if err != nil {
+				return err
+			}
+			for _, q := range quotas {
+				if q.Prefix == req.Prefix {
+					before = quotaToJSON(q)
+				}
+			}
+
+			q := meta.Quota{
+				Prefix:      req.Prefix,
+				SoftBytes:   req.SoftBytes,
+				HardBytes:   req.HardBytes,
+				SoftObjects: req.SoftObjects,
+				HardObjects: req.HardObjects,
+			}
+
+			var after interface{}
+			if req.Operation == "set" {
+				err = layer.SetQuota(q)
+				after = quotaToJSON(q)
+			} else {
+				err = layer.RemoveQuota(req.Prefix)
+			}
+			if err != nil {
+				return err
+			}
+
+			return layer.AddAuditEntry(auditEntry(r, "quota."+req.Operation,
+				req.Prefix, before, after))
+		})
+		if err != nil {
+			status := http.StatusInternalServerError
+			if err == meta.ErrBadArgument {
+				status = http.StatusBadRequest
+			} else if err == kvl.ErrNotFound {
+				status = http.StatusNotFound
+			}
+			httputil.RespondJSONError(w, err.Error(), status)
+			return
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ret []usageJSON
+	err := h.db.RunReadTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		quotas, err := layer.Quotas()
+		if err != nil {
+			return err
+		}
+
+		ret = make([]usageJSON, 0, len(quotas))
+		for _, q := range quotas {
+			u, err := layer.GetUsage(q.Prefix)
+			if err != nil {
+				return err
+			}
+
+			ret = append(ret, usageJSON{
+				quotaJSON: quotaToJSON(q),
+				Bytes:     u.Bytes,
+				Objects:   u.Objects,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		httputil.RespondJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(ret)
+}
+
+func quotaToJSON(q meta.Quota) quotaJSON {
+	return quotaJSON{
+		Prefix:      q.Prefix,
+		SoftBytes:   q.SoftBytes,
+		HardBytes:   q.HardBytes,
+		SoftObjects: q.SoftObjects,
+		HardObjects: q.HardObjects,
+	}
+}
+
+type cacheStatsJSON struct {
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	HitRate       float64 `json:"hit_rate"`
+	Invalidations int64   `json:"invalidations"`
+	Evictions     int64   `json:"evictions"`
+	Corrupt       int64   `json:"corrupt"`
+	Entries       int     `json:"entries"`
+	Used          int64   `json:"used"`
+	Size          int64   `json:"size"`
+}
+
+type cacheJSON struct {
+	Memory *cacheStatsJSON `json:"memory"`
+	Disk   *cacheStatsJSON `json:"disk"`
+}
+
+func cacheStatsToJSON(st cache.Stats) *cacheStatsJSON {
+	return &cacheStatsJSON{
+		Hits:          st.Hits,
+		Misses:        st.Misses,
+		HitRate:       st.HitRate(),
+		Invalidations: st.Invalidations,
+		Evictions:     st.Evictions,
+		Corrupt:       st.Corrupt,
+		Entries:       st.Entries,
+		Used:          st.Used,
+		Size:          st.Size,
+	}
+}
+
+func (h *Handler) serveCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ret cacheJSON
+	if h.memoryCache != nil {
+		ret.Memory = cacheStatsToJSON(h.memoryCache.Stats())
+	}
+	if h.diskCache != nil {
+		ret.Disk = cacheStatsToJSON(h.diskCache.Stats())
+	}
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(ret)
+}
+
+type healthJSON struct {
+	Status          string                  `json:"status"`
+	Locations       healthLocationsJSON     `json:"locations"`
+	Margins         []repairQueueMarginJSON `json:"margins"`
+	Unreadable      int64                   `json:"unreadable"`
+	UnreadablePaths []string                `json:"unreadable_paths"`
+	RepairBytes     int64                   `json:"repair_bytes"`
+	RepairRate      float64                 `json:"repair_rate"`
+	RepairETA       string                  `json:"repair_eta,omitempty"`
+}
 
-	default:
-		w.Header().Set("Allow", "GET, POST")
+type healthLocationsJSON struct {
+	Total   int `json:"total"`
+	Online  int `json:"online"`
+	Offline int `json:"offline"`
+	Dead    int `json:"dead"`
+}
+
+func (h *Handler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
 		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
 		return
 	}
 
-	redundancy.Need, redundancy.Total = h.multi.GetRedundancy()
+	report, err := h.multi.Health()
+	if err != nil {
+		httputil.RespondJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ret := healthJSON{
+		Status: "ok",
+		Locations: healthLocationsJSON{
+			Total:   report.Locations,
+			Online:  report.Online,
+			Offline: report.Offline,
+			Dead:    report.Dead,
+		},
+		Margins:         make([]repairQueueMarginJSON, 0, len(report.Margins)),
+		Unreadable:      report.Unreadable,
+		UnreadablePaths: report.UnreadablePaths,
+		RepairBytes:     report.RepairBytes,
+		RepairRate:      report.RepairRate,
+	}
+	if ret.UnreadablePaths == nil {
+		ret.UnreadablePaths = []string{}
+	}
+	if report.RepairETA > 0 {
+		ret.RepairETA = report.RepairETA.String()
+	}
+
+	for margin, files := range report.Margins {
+		ret.Margins = append(ret.Margins, repairQueueMarginJSON{
+			Margin: margin,
+			Files:  files,
+		})
+	}
+	sort.Sort(repairQueueByMargin(ret.Margins))
+
+	if report.Unreadable > 0 {
+		ret.Status = "unreadable"
+	} else if len(report.Margins) > 0 {
+		ret.Status = "degraded"
+	}
 
 	w.Header().Set("content-type", "application/json; charset=utf-8")
-	json.NewEncoder(w).Encode(redundancy)
+	json.NewEncoder(w).Encode(ret)
 }
 
 type storesResponseEntry struct {
@@ -119,9 +917,17 @@ type storesResponseEntry struct {
 	URL       string    `json:"url"`
 	Name      string    `json:"name"`
 	Dead      bool      `json:"dead"`
+	Mode      string    `json:"mode"`
+	DrainRate int64     `json:"drain_rate,omitempty"`
+	Tier      string    `json:"tier"`
+	Reserved  int64     `json:"reserved"`
+	MaxFill   uint8     `json:"max_fill"`
+	Weight    int64     `json:"weight"`
 	Connected bool      `json:"connected"`
 	LastSeen  time.Time `json:"last_seen"`
 	Free      int64     `json:"free,omitempty"`
+	Capacity  int64     `json:"capacity,omitempty"`
+	Full      bool      `json:"full,omitempty"`
 	Error     string    `json:"error,omitempty"`
 }
 
@@ -129,6 +935,12 @@ type storesRequest struct {
 	Operation string `json:"operation"`
 	URL       string `json:"url,omitempty"`
 	UUID      string `json:"uuid,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+	DrainRate int64  `json:"drain_rate,omitempty"`
+	Reserved  int64  `json:"reserved,omitempty"`
+	MaxFill   int64  `json:"max_fill,omitempty"`
+	Weight    int64  `json:"weight,omitempty"`
+	Tier      string `json:"tier,omitempty"`
 }
 
 func (h *Handler) serveStores(w http.ResponseWriter, r *http.Request) {
@@ -148,6 +960,7 @@ func (h *Handler) serveStores(w http.ResponseWriter, r *http.Request) {
 					http.StatusInternalServerError)
 				return
 			}
+			h.audit(r, "store.rescan", "", nil, nil)
 
 		case "scan":
 			err = h.finder.Scan(req.URL)
@@ -156,6 +969,7 @@ func (h *Handler) serveStores(w http.ResponseWriter, r *http.Request) {
 					http.StatusBadRequest)
 				return
 			}
+			h.audit(r, "store.scan", req.URL, nil, nil)
 
 		case "dead", "undead":
 			id, err := uuid.Parse(req.UUID)
@@ -164,6 +978,8 @@ func (h *Handler) serveStores(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			var name string
+
 			err = h.db.RunTx(func(ctx kvl.Ctx) error {
 				layer, err := meta.Open(ctx)
 				if err != nil {
@@ -178,8 +994,183 @@ func (h *Handler) serveStores(w http.ResponseWriter, r *http.Request) {
 				if loc == nil {
 					return kvl.ErrNotFound
 				}
+				before := storeToAuditJSON(*loc)
 
 				loc.Dead = req.Operation == "dead"
+				name = loc.Name
+
+				err = layer.AddAuditEntry(auditEntry(r, "store."+req.Operation,
+					uuid.Fmt(id), before, storeToAuditJSON(*loc)))
+				if err != nil {
+					return err
+				}
+
+				return layer.SetLocation(*loc)
+			})
+			if err != nil {
+				if err == kvl.ErrNotFound {
+					httputil.RespondJSONError(w, "No store with that UUID",
+						http.StatusBadRequest)
+					return
+				}
+				httputil.RespondJSONError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			e := events.Event{
+				Type:    events.StoreDead,
+				Message: fmt.Sprintf("store %v marked dead", name),
+				Store:   uuid.Fmt(id),
+			}
+			if req.Operation == "undead" {
+				e.Type = events.StoreUndead
+				e.Message = fmt.Sprintf("store %v marked undead", name)
+			}
+			h.events.Emit(e)
+
+		case "mode":
+			id, err := uuid.Parse(req.UUID)
+			if err != nil {
+				httputil.RespondJSONError(w, "Couldn't parse UUID", http.StatusBadRequest)
+				return
+			}
+
+			mode, err := meta.ParseLocationMode(req.Mode)
+			if err != nil {
+				httputil.RespondJSONError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if req.DrainRate < 0 {
+				httputil.RespondJSONError(w, "drain_rate is negative", http.StatusBadRequest)
+				return
+			}
+
+			err = h.db.RunTx(func(ctx kvl.Ctx) error {
+				layer, err := meta.Open(ctx)
+				if err != nil {
+					return err
+				}
+
+				loc, err := layer.GetLocation(id)
+				if err != nil {
+					return err
+				}
+
+				if loc == nil {
+					return kvl.ErrNotFound
+				}
+				before := storeToAuditJSON(*loc)
+
+				loc.Mode = mode
+				loc.DrainRate = req.DrainRate
+
+				err = layer.AddAuditEntry(auditEntry(r, "store."+req.Operation,
+					uuid.Fmt(id), before, storeToAuditJSON(*loc)))
+				if err != nil {
+					return err
+				}
+
+				return layer.SetLocation(*loc)
+			})
+			if err != nil {
+				if err == kvl.ErrNotFound {
+					httputil.RespondJSONError(w, "No store with that UUID",
+						http.StatusBadRequest)
+					return
+				}
+				httputil.RespondJSONError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+		case "placement":
+			id, err := uuid.Parse(req.UUID)
+			if err != nil {
+				httputil.RespondJSONError(w, "Couldn't parse UUID", http.StatusBadRequest)
+				return
+			}
+
+			if req.Reserved < 0 {
+				httputil.RespondJSONError(w, "reserved is negative", http.StatusBadRequest)
+				return
+			}
+			if req.MaxFill < 0 || req.MaxFill > 100 {
+				httputil.RespondJSONError(w, "max_fill is not between 0 and 100", http.StatusBadRequest)
+				return
+			}
+			if req.Weight < 0 || req.Weight > math.MaxUint16 {
+				httputil.RespondJSONError(w, "weight is out of range", http.StatusBadRequest)
+				return
+			}
+
+			err = h.db.RunTx(func(ctx kvl.Ctx) error {
+				layer, err := meta.Open(ctx)
+				if err != nil {
+					return err
+				}
+
+				loc, err := layer.GetLocation(id)
+				if err != nil {
+					return err
+				}
+
+				if loc == nil {
+					return kvl.ErrNotFound
+				}
+				before := storeToAuditJSON(*loc)
+
+				loc.Reserved = req.Reserved
+				loc.MaxFill = uint8(req.MaxFill)
+				loc.Weight = uint16(req.Weight)
+
+				err = layer.AddAuditEntry(auditEntry(r, "store."+req.Operation,
+					uuid.Fmt(id), before, storeToAuditJSON(*loc)))
+				if err != nil {
+					return err
+				}
+
+				return layer.SetLocation(*loc)
+			})
+			if err != nil {
+				if err == kvl.ErrNotFound {
+					httputil.RespondJSONError(w, "No store with that UUID",
+						http.StatusBadRequest)
+					return
+				}
+				httputil.RespondJSONError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+		case "tier":
+			id, err := uuid.Parse(req.UUID)
+			if err != nil {
+				httputil.RespondJSONError(w, "Couldn't parse UUID", http.StatusBadRequest)
+				return
+			}
+
+			err = h.db.RunTx(func(ctx kvl.Ctx) error {
+				layer, err := meta.Open(ctx)
+				if err != nil {
+					return err
+				}
+
+				loc, err := layer.GetLocation(id)
+				if err != nil {
+					return err
+				}
+
+				if loc == nil {
+					return kvl.ErrNotFound
+				}
+				before := storeToAuditJSON(*loc)
+
+				loc.Tier = req.Tier
+
+				err = layer.AddAuditEntry(auditEntry(r, "store."+req.Operation,
+					uuid.Fmt(id), before, storeToAuditJSON(*loc)))
+				if err != nil {
+					return err
+				}
 
 				return layer.SetLocation(*loc)
 			})
@@ -220,6 +1211,13 @@ func (h *Handler) serveStores(w http.ResponseWriter, r *http.Request) {
 				if loc == nil {
 					return kvl.ErrNotFound
 				}
+				before := storeToAuditJSON(*loc)
+
+				err = layer.AddAuditEntry(auditEntry(r, "store.delete",
+					uuid.Fmt(id), before, nil))
+				if err != nil {
+					return err
+				}
 
 				return layer.DeleteLocation(*loc)
 			})
@@ -262,14 +1260,27 @@ func (h *Handler) serveStores(w http.ResponseWriter, r *http.Request) {
 		for _, loc := range locs {
 			fe, connected := finderEntries[loc.UUID]
 
+			full := false
+			if connected {
+				full = loc.Available(fe.Free, fe.Capacity) <= 0
+			}
+
 			ret = append(ret, storesResponseEntry{
 				UUID:      uuid.Fmt(loc.UUID),
 				URL:       loc.URL,
 				Name:      loc.Name,
 				Dead:      loc.Dead,
+				Mode:      meta.LocationModeName(loc.Mode),
+				DrainRate: loc.DrainRate,
+				Tier:      loc.Tier,
+				Reserved:  loc.Reserved,
+				MaxFill:   loc.MaxFill,
+				Weight:    loc.PlacementWeight(),
 				Connected: connected,
 				LastSeen:  time.Unix(loc.LastSeen, 0).UTC(),
 				Free:      fe.Free,
+				Capacity:  fe.Capacity,
+				Full:      full,
 			})
 		}
 
@@ -284,3 +1295,178 @@ func (h *Handler) serveStores(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(ret)
 }
+
+type quarantineResponseEntry struct {
+	Key  string    `json:"key"`
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"`
+}
+
+func (h *Handler) serveQuarantine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := uuid.Parse(r.FormValue("uuid"))
+	if err != nil {
+		httputil.RespondJSONError(w, "Couldn't parse UUID", http.StatusBadRequest)
+		return
+	}
+
+	st := h.finder.StoreFor(id)
+	if st == nil {
+		httputil.RespondJSONError(w, "UUID not currently connected", http.StatusBadRequest)
+		return
+	}
+
+	ret := make([]quarantineResponseEntry, 0, 10)
+
+	if qs, ok := st.(store.QuarantineStore); ok {
+		entries, err := qs.ListQuarantine(nil)
+		if err != nil {
+			httputil.RespondJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, e := range entries {
+			ret = append(ret, quarantineResponseEntry{
+				Key:  e.Key,
+				Size: e.Size,
+				Time: time.Unix(e.Time, 0).UTC(),
+			})
+		}
+	}
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ret)
+}
+
+type hashcheckResponse struct {
+	UUID         string     `json:"uuid"`
+	Paused       bool       `json:"paused"`
+	Full         bool       `json:"full"`
+	Position     string     `json:"position"`
+	Good         int64      `json:"good"`
+	Bad          int64      `json:"bad"`
+	Remaining    int64      `json:"remaining"`
+	ETA          float64    `json:"eta_seconds"`
+	SleepPerFile string     `json:"sleep_per_file"`
+	SleepPerByte string     `json:"sleep_per_byte"`
+	LastGood     int64      `json:"last_good"`
+	LastBad      int64      `json:"last_bad"`
+	LastFinished *time.Time `json:"last_finished"`
+}
+
+type hashcheckRequest struct {
+	UUID         string `json:"uuid"`
+	Operation    string `json:"operation"`
+	SleepPerFile string `json:"sleep_per_file,omitempty"`
+	SleepPerByte string `json:"sleep_per_byte,omitempty"`
+}
+
+func (h *Handler) serveHashcheck(w http.ResponseWriter, r *http.Request) {
+	var req hashcheckRequest
+	switch r.Method {
+	case "GET":
+		req.UUID = r.FormValue("uuid")
+	case "POST":
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			httputil.RespondJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httputil.RespondJSONError(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := uuid.Parse(req.UUID)
+	if err != nil {
+		httputil.RespondJSONError(w, "Couldn't parse UUID", http.StatusBadRequest)
+		return
+	}
+
+	st := h.finder.StoreFor(id)
+	if st == nil {
+		httputil.RespondJSONError(w, "UUID not currently connected", http.StatusBadRequest)
+		return
+	}
+
+	hs, ok := st.(store.HashcheckStore)
+	if !ok {
+		httputil.RespondJSONError(w, store.ErrUnsupported.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var status store.HashcheckStatus
+	if r.Method == "GET" {
+		status, err = hs.HashcheckStatus(nil)
+	} else {
+		switch req.Operation {
+		case store.HashcheckStart, store.HashcheckPause, store.HashcheckResume, store.HashcheckThrottle:
+		default:
+			httputil.RespondJSONError(w, "unsupported operation", http.StatusBadRequest)
+			return
+		}
+
+		hreq := store.HashcheckRequest{Operation: req.Operation}
+		if req.Operation == store.HashcheckThrottle {
+			hreq.PerFileWait, err = time.ParseDuration(req.SleepPerFile)
+			if err == nil {
+				hreq.PerByteWait, err = time.ParseDuration(req.SleepPerByte)
+			}
+			if err != nil {
+				httputil.RespondJSONError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		status, err = hs.ControlHashcheck(hreq, nil)
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == store.ErrUnsupported {
+			code = http.StatusBadRequest
+		}
+		httputil.RespondJSONError(w, err.Error(), code)
+		return
+	}
+
+	if r.Method == "POST" {
+		var after interface{}
+		if req.Operation == store.HashcheckThrottle {
+			after = map[string]string{
+				"sleep_per_file": req.SleepPerFile,
+				"sleep_per_byte": req.SleepPerByte,
+			}
+		}
+		h.audit(r, "hashcheck."+req.Operation, uuid.Fmt(id), nil, after)
+	}
+
+	ret := hashcheckResponse{
+		UUID:         uuid.Fmt(id),
+		Paused:       status.Paused,
+		Full:         status.Full,
+		Position:     status.Position,
+		Good:         status.Good,
+		Bad:          status.Bad,
+		Remaining:    status.Remaining,
+		ETA:          status.ETA.Seconds(),
+		SleepPerFile: status.PerFileWait.String(),
+		SleepPerByte: status.PerByteWait.String(),
+		LastGood:     status.LastGood,
+		LastBad:      status.LastBad,
+	}
+	if status.LastFinished != 0 {
+		t := time.Unix(status.LastFinished, 0).UTC()
+		ret.LastFinished = &t
+	}
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ret)
+}
@@ -1,3 +1,7 @@
 // Package rs implements Reed-Solomon erasure coding using Vandermonde
-// coefficient matricies over GF(2^32-5).
+// coefficient matricies over GF(2^32-5) and over GF(2^8).
+//
+// The GF(2^32-5) functions operate on []uint32 vectors (see package gf for
+// mapping byte slices into the field.) The GF(2^8) functions, suffixed with
+// 256, operate on byte slices directly.
 package rs
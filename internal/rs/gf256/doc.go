@@ -0,0 +1,6 @@
+// Package gf256 implements galois field vector operations over GF(2^8), using
+// the reducing polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d).
+//
+// Multiplication is done through precomputed tables, so that multiplying a
+// vector by a constant is a single table lookup per byte.
+package gf256
@@ -0,0 +1,56 @@
+package gf256
+
+const polynomial = 0x11d
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+
+	// mulTable[a][b] = a*b
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= polynomial
+		}
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+// Mul returns the product of a and b in GF(2^8).
+func Mul(a, b byte) byte {
+	return mulTable[a][b]
+}
+
+// MInverse calculates the multiplicative inverse of the given nonzero element
+// of GF(2^8). In other words, Mul(MInverse(n), n) = 1.
+func MInverse(in byte) byte {
+	if in == 0 {
+		panic("gf256: inverse of zero")
+	}
+	return expTable[255-int(logTable[in])]
+}
+
+// Raise returns x to the power n in GF(2^8).
+func Raise(x byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if x == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[x])*n)%255]
+}
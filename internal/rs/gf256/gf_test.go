@@ -0,0 +1,90 @@
+package gf256
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// slowMul multiplies by shift-and-add, reducing by the field polynomial.
+func slowMul(a, b byte) byte {
+	var p int
+	x, y := int(a), int(b)
+	for y > 0 {
+		if y&1 != 0 {
+			p ^= x
+		}
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= polynomial
+		}
+		y >>= 1
+	}
+	return byte(p)
+}
+
+func TestMul(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			got := Mul(byte(a), byte(b))
+			want := slowMul(byte(a), byte(b))
+			if got != want {
+				t.Fatalf("Mul(%v, %v) = %v, wanted %v", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestMInverseRaise(t *testing.T) {
+	for v := 1; v < 256; v++ {
+		inv := MInverse(byte(v))
+		if Mul(byte(v), inv) != 1 {
+			t.Errorf("MInverse(%v) = %v, but %v*%v = %v",
+				v, inv, v, inv, Mul(byte(v), inv))
+		}
+
+		if inv != Raise(byte(v), 254) {
+			t.Errorf("Raise(%v, 254) = %v, wanted %v",
+				v, Raise(byte(v), 254), inv)
+		}
+	}
+}
+
+func TestMulSlice(t *testing.T) {
+	in := make([]byte, 37)
+	for i := range in {
+		in[i] = byte(rand.Int())
+	}
+
+	for c := 0; c < 256; c++ {
+		out := make([]byte, len(in))
+		MulSlice(byte(c), in, out)
+
+		acc := make([]byte, len(in))
+		copy(acc, in)
+		MulAddSlice(byte(c), in, acc)
+
+		for i := range in {
+			want := slowMul(byte(c), in[i])
+			if out[i] != want {
+				t.Fatalf("MulSlice(%v) at %v = %v, wanted %v", c, i, out[i], want)
+			}
+			if acc[i] != want^in[i] {
+				t.Fatalf("MulAddSlice(%v) at %v = %v, wanted %v", c, i, acc[i], want^in[i])
+			}
+		}
+	}
+}
+
+func BenchmarkMulAddSlice(b *testing.B) {
+	in := make([]byte, 65536)
+	out := make([]byte, 65536)
+	for i := range in {
+		in[i] = byte(rand.Int())
+	}
+	b.SetBytes(int64(len(in)))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		MulAddSlice(0x57, in, out)
+	}
+}
@@ -0,0 +1,68 @@
+package gf256
+
+// MulSlice sets out[i] = c*in[i] for every i. out must be at least as long as
+// in.
+func MulSlice(c byte, in, out []byte) {
+	out = out[:len(in)]
+
+	switch c {
+	case 0:
+		for i := range out {
+			out[i] = 0
+		}
+		return
+	case 1:
+		copy(out, in)
+		return
+	}
+
+	row := &mulTable[c]
+	for len(in) >= 8 {
+		out[0] = row[in[0]]
+		out[1] = row[in[1]]
+		out[2] = row[in[2]]
+		out[3] = row[in[3]]
+		out[4] = row[in[4]]
+		out[5] = row[in[5]]
+		out[6] = row[in[6]]
+		out[7] = row[in[7]]
+		in = in[8:]
+		out = out[8:]
+	}
+	for i := range in {
+		out[i] = row[in[i]]
+	}
+}
+
+// MulAddSlice sets out[i] = out[i] + c*in[i] for every i. out must be at least
+// as long as in.
+func MulAddSlice(c byte, in, out []byte) {
+	out = out[:len(in)]
+
+	switch c {
+	case 0:
+		return
+	case 1:
+		for i := range in {
+			out[i] ^= in[i]
+		}
+		return
+	}
+
+	row := &mulTable[c]
+	for len(in) >= 8 {
+		out[0] ^= row[in[0]]
+		out[1] ^= row[in[1]]
+		out[2] ^= row[in[2]]
+		out[3] ^= row[in[3]]
+		out[4] ^= row[in[4]]
+		out[5] ^= row[in[5]]
+		out[6] ^= row[in[6]]
+		out[7] ^= row[in[7]]
+		in = in[8:]
+		out = out[8:]
+	}
+	for i := range in {
+		out[i] ^= row[in[i]]
+	}
+}
@@ -0,0 +1,129 @@
+package rs
+
+import (
+	"github.com/encryptio/slime/internal/rs/gf256"
+)
+
+// vandermondeMatrix256 returns a Vandermonde matrix over GF(2^8) with d+p rows
+// and d columns.
+//
+// Unlike vandermondeMatrix, each row is a distinct evaluation point and each
+// column a power of it, so every set of d rows forms a square Vandermonde
+// matrix with distinct points, which is always invertible. This requires
+// d+p <= 256.
+func vandermondeMatrix256(d, p int) [][]byte {
+	if d+p > 256 {
+		panic("vandermondeMatrix256: too many rows for GF(2^8)")
+	}
+
+	underlying := make([]byte, d*(d+p))
+
+	m := make([][]byte, d+p)
+	for i := 0; i < len(m); i++ {
+		m[i] = underlying[:d]
+		underlying = underlying[d:]
+
+		for j := 0; j < len(m[i]); j++ {
+			m[i][j] = gf256.Raise(byte(i), j)
+		}
+	}
+
+	return m
+}
+
+// ParityMatrix256 returns a matrix over GF(2^8) with d+p rows and d columns
+// with the upper left d by d submatrix being the identity matrix, and such
+// that picking any d rows creates an invertible matrix.
+func ParityMatrix256(d, p int) [][]byte {
+	m := vandermondeMatrix256(d, p)
+	solveSubIdentity256(m)
+	return m
+}
+
+// solveSubIdentity256 solves the upper len(m[0]) x len(m[0]) submatrix for
+// the identity using column operations. panics if the matrix is singular.
+func solveSubIdentity256(m [][]byte) {
+	swap := func(m [][]byte, a, b int) {
+		for i := 0; i < len(m); i++ {
+			m[i][a], m[i][b] = m[i][b], m[i][a]
+		}
+	}
+
+	multiply := func(m [][]byte, a int, n byte) {
+		for i := 0; i < len(m); i++ {
+			m[i][a] = gf256.Mul(m[i][a], n)
+		}
+	}
+
+	addMultiple := func(m [][]byte, a, b int, n byte) {
+		for i := 0; i < len(m); i++ {
+			m[i][a] ^= gf256.Mul(m[i][b], n)
+		}
+	}
+
+	// Apply Gaussian elimination on the columns
+	for i := 0; i < len(m[0]); i++ {
+		// swap a column to the right of us if needed to ensure m[i][i] != 0
+		if m[i][i] == 0 {
+			for j := i + 1; j < len(m[0]); j++ {
+				if m[i][j] != 0 {
+					swap(m, i, j)
+					break
+				}
+			}
+
+			if m[i][i] == 0 {
+				panic("Couldn't ensure nonzero m[i][i]")
+			}
+		}
+
+		// divide this column by m[i][i]
+		if m[i][i] != 1 {
+			multiply(m, i, gf256.MInverse(m[i][i]))
+
+			if m[i][i] != 1 {
+				panic("Couldn't ensure one m[i][i]")
+			}
+		}
+
+		// ensure every other value in m[i] is 0 by adding a multiple of
+		// column i to them (addition and subtraction are the same here)
+		for j := 0; j < len(m[0]); j++ {
+			if j == i {
+				continue
+			}
+
+			if m[i][j] != 0 {
+				addMultiple(m, j, i, m[i][j])
+
+				if m[i][j] != 0 {
+					panic("Couldn't ensure zero m[i][j]")
+				}
+			}
+		}
+	}
+}
+
+func cloneMatrix256(m [][]byte) [][]byte {
+	underlying := make([]byte, len(m)*len(m[0]))
+
+	n := make([][]byte, len(m))
+	for i := range m {
+		n[i] = underlying[:len(m[i])]
+		underlying = underlying[len(m[i]):]
+		copy(n[i], m[i])
+	}
+
+	return n
+}
+
+func invertMatrix256(m [][]byte) [][]byte {
+	c := cloneMatrix256(m)
+	for i := 0; i < len(m[0]); i++ {
+		idRow := make([]byte, len(m[0]))
+		idRow[i] = 1
+		c = append(c, idRow)
+	}
+	solveSubIdentity256(c)
+	return c[len(c)-len(m[0]):]
+}
@@ -0,0 +1,100 @@
+package rs
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestParityMatrix256Identity(t *testing.T) {
+	for d := 1; d <= 10; d++ {
+		mat := ParityMatrix256(d, 5)
+		for i := 0; i < d; i++ {
+			for j := 0; j < d; j++ {
+				want := byte(0)
+				if i == j {
+					want = 1
+				}
+				if mat[i][j] != want {
+					t.Fatalf("ParityMatrix256(%v, 5)[%v][%v] = %v, wanted %v",
+						d, i, j, mat[i][j], want)
+				}
+			}
+		}
+	}
+}
+
+func testParityMatrix256NonSingularPart(t *testing.T, d, p int) {
+	defer func() {
+		if err := recover(); err != nil {
+			t.Fatalf("Matrix for %vx%v is non-singular: %v", d, p, err)
+		}
+	}()
+	mat := ParityMatrix256(d, p)
+
+	pick := make([]int, d)
+	for i := range pick {
+		pick[i] = i
+	}
+
+	for {
+		newMat := make([][]byte, d)
+		for i := range pick {
+			newMat[i] = mat[pick[i]]
+		}
+		newMat = cloneMatrix256(newMat)
+
+		solveSubIdentity256(newMat) // panics if the matrix is singular
+
+		// increment pick[] to point to the next subset
+		i := len(pick) - 1
+		for i >= 0 {
+			old := pick[i]
+			pick[i]++
+			if old < p+i {
+				break
+			}
+			i--
+		}
+		if i < 0 {
+			return
+		}
+		old := pick[i]
+		for j := i; j < d; j++ {
+			pick[j] = old + j - i
+		}
+	}
+}
+
+func TestParityMatrix256NonSingular(t *testing.T) {
+	size := 6
+
+	for d := 1; d <= size; d++ {
+		for p := 0; p <= size; p++ {
+			testParityMatrix256NonSingularPart(t, d, p)
+		}
+	}
+}
+
+func TestParityMatrix256NonSingularWide(t *testing.T) {
+	// exhaustive checks are too slow for wide layouts; try random subsets
+	for _, layout := range []struct{ d, p int }{{10, 4}, {17, 3}, {50, 50}} {
+		mat := ParityMatrix256(layout.d, layout.p)
+		for try := 0; try < 50; try++ {
+			rows := rand.Perm(layout.d + layout.p)[:layout.d]
+			newMat := make([][]byte, layout.d)
+			for i, row := range rows {
+				newMat[i] = mat[row]
+			}
+
+			func() {
+				defer func() {
+					if err := recover(); err != nil {
+						t.Fatalf("Rows %v of %vx%v matrix are singular: %v",
+							rows, layout.d, layout.p, err)
+					}
+				}()
+				solveSubIdentity256(cloneMatrix256(newMat))
+			}()
+		}
+	}
+}
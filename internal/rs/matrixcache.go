@@ -7,6 +7,9 @@ import (
 var parityCache = make(map[struct{ d, p int }][][]uint32)
 var parityCacheLock sync.RWMutex
 
+var parityCache256 = make(map[struct{ d, p int }][][]byte)
+var parityCache256Lock sync.RWMutex
+
 // ParityMatrixCached is a memoized version of ParityMatrix.
 func ParityMatrixCached(d, p int) [][]uint32 {
 	key := struct{ d, p int }{d, p}
@@ -27,3 +30,24 @@ func ParityMatrixCached(d, p int) [][]uint32 {
 
 	return v
 }
+
+// ParityMatrix256Cached is a memoized version of ParityMatrix256.
+func ParityMatrix256Cached(d, p int) [][]byte {
+	key := struct{ d, p int }{d, p}
+
+	parityCache256Lock.RLock()
+	v := parityCache256[key]
+	parityCache256Lock.RUnlock()
+
+	if v == nil {
+		parityCache256Lock.Lock()
+		v = parityCache256[key]
+		if v == nil {
+			v = ParityMatrix256(d, p)
+			parityCache256[key] = v
+		}
+		parityCache256Lock.Unlock()
+	}
+
+	return v
+}
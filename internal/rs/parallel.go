@@ -0,0 +1,117 @@
+package rs
+
+import (
+	"runtime"
+	"sync"
+)
+
+// minStripe is the smallest number of vector elements worth handing to
+// another goroutine. Below this the scheduling overhead dominates.
+const minStripe = 16 * 1024
+
+// stripeAlign keeps stripe boundaries aligned so that the unrolled loops in
+// gf256 stay on their fast path for every stripe but the last.
+const stripeAlign = 64
+
+var pool struct {
+	mu      sync.RWMutex
+	workers int
+	jobs    chan func()
+}
+
+func init() {
+	SetWorkers(0)
+}
+
+// SetWorkers sets the number of goroutines used to encode and decode vectors.
+// If n <= 0, runtime.NumCPU() is used. With n == 1, all work is done on the
+// calling goroutine.
+//
+// SetWorkers may be called at any time. It waits for encodes and decodes in
+// progress to finish before replacing the workers, and new ones wait for it.
+func SetWorkers(n int) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.jobs != nil {
+		close(pool.jobs)
+		pool.jobs = nil
+	}
+
+	pool.workers = n
+	if n > 1 {
+		pool.jobs = make(chan func())
+		for i := 0; i < n; i++ {
+			go worker(pool.jobs)
+		}
+	}
+}
+
+// Workers returns the number of goroutines used to encode and decode vectors.
+func Workers() int {
+	pool.mu.RLock()
+	n := pool.workers
+	pool.mu.RUnlock()
+	return n
+}
+
+func worker(jobs <-chan func()) {
+	for fn := range jobs {
+		fn()
+	}
+}
+
+// parallelize splits [0, length) into stripes and calls fn on each, using
+// the worker pool if the vector is long enough to benefit. It returns after
+// every call to fn has returned.
+func parallelize(length int, fn func(start, end int)) {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	stripes := pool.workers
+	if max := length / minStripe; stripes > max {
+		stripes = max
+	}
+	if stripes <= 1 || pool.jobs == nil {
+		fn(0, length)
+		return
+	}
+
+	size := (length + stripes - 1) / stripes
+	size = (size + stripeAlign - 1) / stripeAlign * stripeAlign
+
+	var wg sync.WaitGroup
+	for start := size; start < length; start += size {
+		end := start + size
+		if end > length {
+			end = length
+		}
+
+		start := start
+		job := func() {
+			fn(start, end)
+			wg.Done()
+		}
+
+		wg.Add(1)
+		select {
+		case pool.jobs <- job:
+		default:
+			// Every worker is busy with other requests; don't wait for them.
+			job()
+		}
+	}
+
+	// The calling goroutine takes the first stripe itself
+	end := size
+	if end > length {
+		end = length
+	}
+	fn(0, end)
+
+	wg.Wait()
+}
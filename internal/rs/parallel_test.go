@@ -0,0 +1,95 @@
+package rs
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func withWorkers(n int, fn func()) {
+	old := Workers()
+	SetWorkers(n)
+	defer SetWorkers(old)
+	fn()
+}
+
+func TestParallelize(t *testing.T) {
+	for _, workers := range []int{1, 2, 3, 8} {
+		for _, length := range []int{0, 1, minStripe - 1, minStripe * 2, minStripe*5 + 77} {
+			withWorkers(workers, func() {
+				seen := make([]int, length)
+				parallelize(length, func(start, end int) {
+					for i := start; i < end; i++ {
+						seen[i]++
+					}
+				})
+				for i, count := range seen {
+					if count != 1 {
+						t.Fatalf("parallelize(%v) with %v workers visited index %v %v times",
+							length, workers, i, count)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestParallelMatchesSerial(t *testing.T) {
+	length := minStripe*7 + 13
+
+	data := make([][]uint32, 3)
+	data256 := make([][]byte, 3)
+	for i := range data {
+		data[i] = genRandomGFVector(length)
+		data256[i] = genRandomBytes(length)
+	}
+
+	var serial []uint32
+	var serial256 []byte
+	withWorkers(1, func() {
+		serial = CreateParity(data, 4, nil)
+		serial256 = CreateParity256(data256, 4, nil)
+	})
+
+	withWorkers(4, func() {
+		parallel := CreateParity(data, 4, nil)
+		if !reflect.DeepEqual(parallel, serial) {
+			t.Errorf("parallel CreateParity did not match serial output")
+		}
+
+		parallel256 := CreateParity256(data256, 4, nil)
+		if !reflect.DeepEqual(parallel256, serial256) {
+			t.Errorf("parallel CreateParity256 did not match serial output")
+		}
+
+		recovered := RecoverData256([][]byte{data256[0], data256[2], parallel256}, []int{0, 2, 4})
+		if !reflect.DeepEqual(recovered, data256) {
+			t.Errorf("parallel RecoverData256 did not recover the data")
+		}
+	})
+}
+
+func benchmarkGeneration4M256(b *testing.B, workers int) {
+	data := make([][]byte, 4)
+	for i := range data {
+		data[i] = genRandomBytes(4 * 1024 * 1024)
+	}
+	b.SetBytes(int64(len(data[0]) * len(data)))
+
+	withWorkers(workers, func() {
+		out := CreateParity256(data, len(data), nil)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			out = CreateParity256(data, len(data), out)
+		}
+	})
+}
+
+func BenchmarkGeneration4M256Serial(b *testing.B) {
+	benchmarkGeneration4M256(b, 1)
+}
+
+func BenchmarkGeneration4M256Parallel(b *testing.B) {
+	benchmarkGeneration4M256(b, runtime.NumCPU())
+}
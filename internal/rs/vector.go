@@ -88,10 +88,20 @@ func RecoverData(chunks [][]uint32, indices []int) [][]uint32 {
 }
 
 func applyMatrix(mat [][]uint32, in, out [][]uint32) {
+	if len(out) == 0 {
+		return
+	}
+
+	parallelize(len(out[0]), func(start, end int) {
+		applyMatrixRange(mat, in, out, start, end)
+	})
+}
+
+func applyMatrixRange(mat [][]uint32, in, out [][]uint32, start, end int) {
 	// TODO(encryptio): optimize with high/low split, as described in
 	//                  http://www.lshift.net/blog/2006/11/29/gf232-5
 	for i := 0; i < len(out); i++ {
-		for b := 0; b < len(out[i]); b++ {
+		for b := start; b < end; b++ {
 			var o uint64
 			for j := 0; j < len(in); j++ {
 				o = ((uint64(in[j][b])*uint64(mat[i][j]))%gf.MaxVal + o) % gf.MaxVal
@@ -0,0 +1,103 @@
+package rs
+
+import (
+	"github.com/encryptio/slime/internal/rs/gf256"
+)
+
+// CreateParity256 is the GF(2^8) equivalent of CreateParity. It takes a slice
+// of data chunks, and target index to generate.
+//
+// The first len(data) indexes are exactly the data blocks, so it's only useful
+// to call this function with index >= len(data).
+//
+// The data chunks must be of the same length, and the parity output will also
+// be of that length.
+//
+// You may optionally passed an output slice, in which case it will be reused if
+// it is large enough.
+func CreateParity256(data [][]byte, index int, out []byte) []byte {
+	for i := 1; i < len(data); i++ {
+		if len(data[i]) != len(data[0]) {
+			panic("CreateParity256 called on data chunks of varying length")
+		}
+	}
+
+	if out == nil || cap(out) < len(data[0]) {
+		out = make([]byte, len(data[0]))
+	} else {
+		out = out[:len(data[0])]
+	}
+
+	p := 0
+	if index >= len(data) {
+		p = index - len(data) + 1
+	}
+
+	mat := ParityMatrix256Cached(len(data), p)
+
+	applyMatrix256([][]byte{mat[index]}, data, [][]byte{out})
+
+	return out
+}
+
+// RecoverData256 is the GF(2^8) equivalent of RecoverData. It takes a slice of
+// len(data) chunks (whose content is data or parity) as well as a slice of
+// indices (see docs on CreateParity256 for what the indices mean.)
+//
+// There must be exactly len(data) input chunks, as this is used to calculate
+// the width of the recovery matrix.
+func RecoverData256(chunks [][]byte, indices []int) [][]byte {
+	if len(chunks) != len(indices) {
+		panic("RecoverData256: len(chunks) != len(indices)")
+	}
+
+	if len(chunks) == 0 {
+		panic("RecoverData256: len(chunks) == 0")
+	}
+
+	maxIndex := -1
+	for _, index := range indices {
+		if index > maxIndex {
+			maxIndex = index
+		}
+	}
+	if maxIndex == -1 {
+		panic("RecoverData256: No indices given")
+	}
+
+	mat := ParityMatrix256Cached(len(chunks), maxIndex)
+
+	// gather the rows we have and find their inverse to the data rows
+	have := make([][]byte, len(chunks))
+	for i, index := range indices {
+		have[i] = mat[index]
+	}
+
+	inv := invertMatrix256(have)
+
+	// create empty data output chunks
+	data := make([][]byte, len(chunks))
+	for i := range data {
+		data[i] = make([]byte, len(chunks[0]))
+	}
+
+	applyMatrix256(inv, chunks, data)
+
+	return data
+}
+
+func applyMatrix256(mat [][]byte, in, out [][]byte) {
+	if len(out) == 0 {
+		return
+	}
+
+	parallelize(len(out[0]), func(start, end int) {
+		for i := 0; i < len(out); i++ {
+			o := out[i][start:end]
+			gf256.MulSlice(mat[i][0], in[0][start:end], o)
+			for j := 1; j < len(in); j++ {
+				gf256.MulAddSlice(mat[i][j], in[j][start:end], o)
+			}
+		}
+	})
+}
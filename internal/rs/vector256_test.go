@@ -0,0 +1,116 @@
+package rs
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func genRandomBytes(l int) []byte {
+	v := make([]byte, l)
+	for i := range v {
+		v[i] = byte(rand.Int())
+	}
+	return v
+}
+
+func TestParityData256(t *testing.T) {
+	data := [][]byte{
+		[]byte{0, 0, 0},
+		[]byte{1, 2, 3},
+	}
+
+	for i := range data {
+		out := CreateParity256(data, i, nil)
+		if !reflect.DeepEqual(out, data[i]) {
+			t.Errorf("CreateParity256(%v, %v, nil) = %v, wanted %v",
+				data, i, out, data[i])
+		}
+	}
+}
+
+func TestParityRecovery256(t *testing.T) {
+	for i := 1; i < 10; i++ {
+		data := make([][]byte, rand.Intn(20))
+		if len(data) == 0 {
+			continue
+		}
+
+		for j := range data {
+			data[j] = genRandomBytes(i)
+		}
+
+		var parity [][]byte
+		for j := 0; j < rand.Intn(20); j++ {
+			parity = append(parity, CreateParity256(data, len(data)+j, nil))
+		}
+
+		// mark len(data) things as "have"
+		have := make([]bool, len(data)+len(parity))
+		for i := 0; i < len(data); i++ {
+			for {
+				idx := rand.Intn(len(have))
+				if !have[idx] {
+					have[idx] = true
+					break
+				}
+			}
+		}
+
+		var recoveryInput [][]byte
+		var recoveryIndices []int
+		for i, h := range have {
+			if !h {
+				continue
+			}
+
+			recoveryIndices = append(recoveryIndices, i)
+			if i < len(data) {
+				recoveryInput = append(recoveryInput, data[i])
+			} else {
+				recoveryInput = append(recoveryInput, parity[i-len(data)])
+			}
+		}
+
+		recovered := RecoverData256(recoveryInput, recoveryIndices)
+		if !reflect.DeepEqual(recovered, data) {
+			t.Errorf("Couldn't recover")
+		}
+	}
+}
+
+func BenchmarkGeneration64k256(b *testing.B) {
+	data := make([][]byte, 4)
+	for i := range data {
+		data[i] = genRandomBytes(65536)
+	}
+	b.SetBytes(int64(len(data[0]) * len(data)))
+
+	out := CreateParity256(data, len(data), nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out = CreateParity256(data, len(data), out)
+	}
+}
+
+func BenchmarkRecovery64k256(b *testing.B) {
+	data := make([][]byte, 4)
+	for i := range data {
+		data[i] = genRandomBytes(65536)
+	}
+	b.SetBytes(int64(len(data[0]) * len(data)))
+
+	parity := CreateParity256(data, len(data), nil)
+
+	input := make([][]byte, 4)
+	copy(input, data)
+	input[0] = parity
+
+	indices := []int{4, 1, 2, 3}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		RecoverData256(input, indices)
+	}
+}
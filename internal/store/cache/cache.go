@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/tracing"
 )
 
 const (
@@ -23,11 +24,42 @@ type Cache struct {
 	mu      sync.Mutex
 	used    int
 	entries map[string]*cacheEntry
+	stats   Stats
+}
+
+// Stats are counters for a cache since it was created.
+type Stats struct {
+	Hits   int64 // Gets served from the cache
+	Misses int64 // Gets read from the inner store
+
+	// Invalidations are entries removed because the value changed, and
+	// Evictions are entries removed to make room for others.
+	Invalidations int64
+	Evictions     int64
+
+	// Corrupt are entries that failed their hash check when read back. Only
+	// a Disk counts these.
+	Corrupt int64
+
+	Entries int   // values in the cache now
+	Used    int64 // bytes used by the cache now
+	Size    int64 // most bytes the cache may use
+}
+
+// HitRate returns the fraction of Gets served from the cache, or 0 if there
+// were none.
+func (s Stats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
 }
 
 type cacheEntry struct {
-	Key      string
-	NoVerify bool
+	Key       string
+	NoVerify  bool
+	RequestID string              // of the Get that created the entry
+	Trace     tracing.SpanContext // of the Get that created the entry
 
 	// Writes to these happen in getWorker, and all are set to their final value
 	// before Ready is closed.
@@ -36,6 +68,12 @@ type cacheEntry struct {
 	Stat  store.Stat
 	Data  []byte
 
+	// The Stat of the key after Ready was closed, made once for all the Gets
+	// that joined the inner Get while it was in flight; see getUncopied.
+	joinedOnce sync.Once
+	joinedStat store.Stat
+	joinedErr  error
+
 	// Writes to these are protected by (*Cache).mu and happen in
 	// (*Cache).Get(). When waiters == 0, Cancel may be closed.
 	waiters  int
@@ -63,7 +101,7 @@ func (c *Cache) Name() string {
 }
 
 func (c *Cache) Get(key string, opts store.GetOptions) ([]byte, store.Stat, error) {
-	d, st, err := c.getUncopied(key, opts.Cancel, opts.NoVerify)
+	d, st, err := c.getUncopied(key, opts)
 	if err != nil {
 		return nil, store.Stat{}, err
 	}
@@ -73,7 +111,7 @@ func (c *Cache) Get(key string, opts store.GetOptions) ([]byte, store.Stat, erro
 }
 
 func (c *Cache) GetPartial(key string, start, length int64, opts store.GetOptions) ([]byte, store.Stat, error) {
-	d, st, err := c.getUncopied(key, opts.Cancel, opts.NoVerify)
+	d, st, err := c.getUncopied(key, opts)
 	if err != nil {
 		return nil, store.Stat{}, err
 	}
@@ -93,14 +131,10 @@ func (c *Cache) GetPartial(key string, start, length int64, opts store.GetOption
 	return d2, st, nil
 }
 
-func (c *Cache) getUncopied(
-	key string,
-	cancel <-chan struct{},
-	noverify bool) ([]byte, store.Stat, error) {
-
+func (c *Cache) getUncopied(key string, opts store.GetOptions) ([]byte, store.Stat, error) {
 	c.mu.Lock()
 	ce, ok := c.entries[key]
-	if ok && ce.NoVerify && !noverify {
+	if ok && ce.NoVerify && !opts.NoVerify {
 		// The existing cache entry was called with NoVerify, but this call
 		// wants verification. Delete the entry, we'll replace it below.
 
@@ -110,13 +144,19 @@ func (c *Cache) getUncopied(
 		ok = false
 		c.removeEntryLocked(key)
 	}
-	if !ok {
+	created := !ok
+	if ok {
+		c.stats.Hits++
+	} else {
 		// No cache entry; make one and spawn a getWorker.
+		c.stats.Misses++
 		ce = &cacheEntry{
-			Key:      key,
-			NoVerify: noverify,
-			Ready:    make(chan struct{}),
-			Cancel:   make(chan struct{}),
+			Key:       key,
+			NoVerify:  opts.NoVerify,
+			RequestID: opts.RequestID,
+			Trace:     opts.Trace,
+			Ready:     make(chan struct{}),
+			Cancel:    make(chan struct{}),
 		}
 		c.setEntryLocked(key, ce)
 		go c.getWorker(ce)
@@ -125,17 +165,16 @@ func (c *Cache) getUncopied(
 	ce.LastUsed = time.Now()
 	c.mu.Unlock()
 
-	// didWait allows us to skip the Stat call if we waited for a Get to finish
-	didWait := true
+	wasReady := false
 	select {
 	case <-ce.Ready:
-		didWait = false
+		wasReady = true
 	default:
 	}
 
 	select {
 	case <-ce.Ready:
-	case <-cancel:
+	case <-opts.Cancel:
 		c.mu.Lock()
 		ce.waiters--
 		if ce.waiters == 0 {
@@ -162,11 +201,28 @@ func (c *Cache) getUncopied(
 		return nil, store.Stat{}, ce.Error
 	}
 
-	if !didWait {
-		// This is a cached entry, not the result of a real Get. We need to Stat
-		// the key again to make sure it's still the same.
-
-		st, err := c.inner.Stat(key, cancel)
+	if !created {
+		// This is not the result of our own Get, so it may be stale, even if
+		// it was still being fetched when we found it: the inner Get may have
+		// read the value before a write made since, perhaps through another
+		// proxy. We need to Stat the key again to make sure it's still the
+		// same.
+		//
+		// The Gets that joined an in-flight fetch share a single Stat made
+		// after it finished, which is later than any of them joined.
+
+		var st store.Stat
+		var err error
+		inner := c.innerFor(opts.RequestID, opts.Trace)
+		if wasReady {
+			st, err = inner.Stat(key, opts.Cancel)
+		} else {
+			ce.joinedOnce.Do(func() {
+				// not cancelled with this Get, since others rely on it
+				ce.joinedStat, ce.joinedErr = inner.Stat(key, nil)
+			})
+			st, err = ce.joinedStat, ce.joinedErr
+		}
 		if err != nil {
 			return nil, store.Stat{}, err
 		}
@@ -176,12 +232,12 @@ func (c *Cache) getUncopied(
 			c.mu.Lock()
 			if c.entries[key] == ce {
 				c.removeEntryLocked(key)
+				c.stats.Invalidations++
 			}
+			// the retry counts as a miss
+			c.stats.Hits--
 			c.mu.Unlock()
-			return c.Get(key, store.GetOptions{
-				Cancel:   cancel,
-				NoVerify: noverify,
-			})
+			return c.Get(key, opts)
 		}
 	}
 
@@ -194,8 +250,10 @@ func (c *Cache) getWorker(ce *cacheEntry) {
 	defer close(ce.Ready)
 
 	data, stat, err := c.inner.Get(ce.Key, store.GetOptions{
-		Cancel:   ce.Cancel,
-		NoVerify: ce.NoVerify,
+		Cancel:    ce.Cancel,
+		NoVerify:  ce.NoVerify,
+		RequestID: ce.RequestID,
+		Trace:     ce.Trace,
 	})
 
 	c.mu.Lock()
@@ -237,6 +295,7 @@ func (c *Cache) garbageCollectLocked() {
 		}
 
 		c.removeEntryLocked(oldestKey)
+		c.stats.Evictions++
 	}
 }
 
@@ -249,7 +308,12 @@ func (c *Cache) FreeSpace(cancel <-chan struct{}) (int64, error) {
 }
 
 func (c *Cache) Stat(key string, cancel <-chan struct{}) (store.Stat, error) {
-	st, err := c.inner.Stat(key, cancel)
+	return c.stat(c.inner, key, cancel)
+}
+
+// stat is Stat, reading through the given view of the inner store.
+func (c *Cache) stat(inner store.Store, key string, cancel <-chan struct{}) (store.Stat, error) {
+	st, err := inner.Stat(key, cancel)
 	if err != nil {
 		return st, err
 	}
@@ -260,6 +324,7 @@ func (c *Cache) Stat(key string, cancel <-chan struct{}) (store.Stat, error) {
 		case <-ce.Ready:
 			if st != ce.Stat {
 				c.removeEntryLocked(key)
+				c.stats.Invalidations++
 			}
 		default:
 		}
@@ -270,7 +335,51 @@ func (c *Cache) Stat(key string, cancel <-chan struct{}) (store.Stat, error) {
 }
 
 func (c *Cache) CAS(key string, from, to store.CASV, cancel <-chan struct{}) error {
-	err := c.inner.CAS(key, from, to, cancel)
+	return c.cas(c.inner, key, from, to, cancel)
+}
+
+// WithRequestID returns a view of the Cache that passes id along with writes
+// and Stats to the inner store. The view shares its entries with c.
+func (c *Cache) WithRequestID(id string) store.Store {
+	return requestCache{c, id, tracing.SpanContext{}}
+}
+
+// WithTrace returns a view of the Cache that traces writes and Stats to the
+// inner store as children of sc. The view shares its entries with c.
+func (c *Cache) WithTrace(sc tracing.SpanContext) store.Store {
+	return requestCache{c, "", sc}
+}
+
+// innerFor returns the inner store tagged with a request ID and trace.
+func (c *Cache) innerFor(requestID string, trace tracing.SpanContext) store.Store {
+	return store.WithTrace(store.WithRequestID(c.inner, requestID), trace)
+}
+
+type requestCache struct {
+	*Cache
+	requestID string
+	trace     tracing.SpanContext
+}
+
+func (r requestCache) WithRequestID(id string) store.Store {
+	return requestCache{r.Cache, id, r.trace}
+}
+
+func (r requestCache) WithTrace(sc tracing.SpanContext) store.Store {
+	return requestCache{r.Cache, r.requestID, sc}
+}
+
+func (r requestCache) Stat(key string, cancel <-chan struct{}) (store.Stat, error) {
+	return r.stat(r.innerFor(r.requestID, r.trace), key, cancel)
+}
+
+func (r requestCache) CAS(key string, from, to store.CASV, cancel <-chan struct{}) error {
+	return r.cas(r.innerFor(r.requestID, r.trace), key, from, to, cancel)
+}
+
+// cas is CAS, writing through the given view of the inner store.
+func (c *Cache) cas(inner store.Store, key string, from, to store.CASV, cancel <-chan struct{}) error {
+	err := inner.CAS(key, from, to, cancel)
 	if err == nil {
 		c.mu.Lock()
 		if to.Present {
@@ -308,6 +417,18 @@ func (c *Cache) CAS(key string, from, to store.CASV, cancel <-chan struct{}) err
 	return err
 }
 
+// Stats returns counters for the Cache since it was created.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := c.stats
+	st.Entries = len(c.entries)
+	st.Used = int64(c.used)
+	st.Size = int64(c.size)
+	return st
+}
+
 func (c *Cache) Clear() {
 	c.mu.Lock()
 	for key := range c.entries {
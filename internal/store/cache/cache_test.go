@@ -80,6 +80,67 @@ func TestCacheCoalescesGets(t *testing.T) {
 	}
 }
 
+// gatedStore holds Gets after reading the value until gate is closed, so that
+// the value can change while they're in flight.
+type gatedStore struct {
+	*storetests.MockStore
+	read chan struct{}
+	gate chan struct{}
+}
+
+func (g *gatedStore) Get(key string, opts store.GetOptions) ([]byte, store.Stat, error) {
+	data, st, err := g.MockStore.Get(key, opts)
+	g.read <- struct{}{}
+	<-g.gate
+	return data, st, err
+}
+
+func TestCacheJoinedGetsSeeLaterWrites(t *testing.T) {
+	inner := &gatedStore{
+		MockStore: storetests.NewMockStore(0),
+		read:      make(chan struct{}, 10),
+		gate:      make(chan struct{}),
+	}
+	cache := New(1024, inner)
+
+	storetests.ShouldCAS(t, inner, "key", store.AnyV, store.DataV([]byte("old")))
+
+	first := make(chan []byte)
+	go func() {
+		data, _, _ := cache.Get("key", store.GetOptions{})
+		first <- data
+	}()
+	<-inner.read
+
+	// written elsewhere, after the first Get read the value but before it
+	// finished
+	storetests.ShouldCAS(t, inner, "key", store.AnyV, store.DataV([]byte("new")))
+
+	second := make(chan []byte)
+	go func() {
+		data, _, _ := cache.Get("key", store.GetOptions{})
+		second <- data
+	}()
+	for {
+		cache.mu.Lock()
+		waiters := cache.entries["key"].waiters
+		cache.mu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(inner.gate)
+
+	if data := <-first; string(data) != "old" {
+		t.Errorf("first Get returned %#v, wanted \"old\"", string(data))
+	}
+	if data := <-second; string(data) != "new" {
+		t.Errorf("Get started after a write returned %#v, wanted \"new\"", string(data))
+	}
+}
+
 func TestCacheEmptyHasCorrectUsed(t *testing.T) {
 	cache := New(1024, storetests.NewMockStore(0))
 	cache.assertUsedIsCorrect()
@@ -0,0 +1,581 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/tracing"
+)
+
+var _ store.RangeReadStore = &Disk{}
+
+var (
+	diskMagic = [8]byte{'s', 'l', 'i', 'm', 'e', 'c', 'a', '1'}
+
+	errDiskEntryCorrupt = errors.New("cache file is corrupt")
+	errDiskEntryChanged = errors.New("cache file was replaced")
+)
+
+// diskFills is the most values written to a Disk at once in the background.
+// Values fetched while that many are being written are not cached.
+var diskFills = 4
+
+// diskHeaderSize is the size of the header of a cache file, before its key:
+// magic, SHA256, size, write time, and key length.
+const diskHeaderSize = 8 + 32 + 8 + 8 + 4
+
+// A Disk caches values from an inner Store in files in a local directory,
+// typically on an SSD in front of a remote cluster. Unlike Cache, its contents
+// are kept across restarts.
+//
+// Every hit is checked with a Stat of the inner store, like Cache, and the data
+// read from disk is checked against its SHA256, so a Disk never returns a value
+// that has been changed or damaged. Values are written to the cache in the
+// background after being read from the inner store, and the least recently
+// used are removed to keep the directory under its size.
+type Disk struct {
+	dir   string
+	size  int64
+	inner store.Store
+
+	fills   chan struct{}
+	filling sync.WaitGroup
+
+	mu      sync.Mutex
+	used    int64
+	entries map[string]*list.Element // of *diskEntry
+	lru     *list.List               // most recently used at the front
+	stats   Stats
+}
+
+type diskEntry struct {
+	key  string
+	path string
+	stat store.Stat
+	size int64 // of the file, including its header
+	used time.Time
+}
+
+// OpenDisk opens a Disk caching values of inner in dir, using at most size
+// bytes. Files in dir from an earlier run are kept, to be checked when they are
+// used.
+func OpenDisk(dir string, size int64, inner store.Store) (*Disk, error) {
+	if size < 0 {
+		panic("size must be non-negative")
+	}
+
+	err := os.MkdirAll(filepath.Join(dir, "tmp"), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Disk{
+		dir:     dir,
+		size:    size,
+		inner:   inner,
+		fills:   make(chan struct{}, diskFills),
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+
+	err = d.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// load removes unfinished writes and indexes the cache files already in the
+// directory, oldest first.
+func (d *Disk) load() error {
+	tmps, err := ioutil.ReadDir(filepath.Join(d.dir, "tmp"))
+	if err != nil {
+		return err
+	}
+	for _, fi := range tmps {
+		os.Remove(filepath.Join(d.dir, "tmp", fi.Name()))
+	}
+
+	var entries []*diskEntry
+	dirs, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, dfi := range dirs {
+		if !dfi.IsDir() || len(dfi.Name()) != 2 {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(d.dir, dfi.Name()))
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			path := filepath.Join(d.dir, dfi.Name(), fi.Name())
+			e, err := readDiskHeader(path)
+			if err == nil && (d.pathFor(e.key) != path ||
+				fi.Size() != int64(diskHeaderSize+len(e.key))+e.stat.Size) {
+				err = errDiskEntryCorrupt
+			}
+			if err != nil {
+				logging.Warnf("Removing bad disk cache file %v: %v", path, err)
+				os.Remove(path)
+				continue
+			}
+			e.size = fi.Size()
+			e.used = fi.ModTime()
+			entries = append(entries, e)
+		}
+	}
+
+	sort.Sort(diskEntriesByUse(entries))
+
+	d.mu.Lock()
+	for _, e := range entries {
+		d.entries[e.key] = d.lru.PushFront(e)
+		d.used += e.size
+	}
+	d.evictLocked()
+	d.mu.Unlock()
+
+	return nil
+}
+
+type diskEntriesByUse []*diskEntry
+
+func (l diskEntriesByUse) Len() int           { return len(l) }
+func (l diskEntriesByUse) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l diskEntriesByUse) Less(i, j int) bool { return l[i].used.Before(l[j].used) }
+
+// pathFor returns the path of the cache file for key. Keys are hashed so that
+// any key makes a safe file name.
+func (d *Disk) pathFor(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(d.dir, name[:2], name)
+}
+
+func (d *Disk) UUID() [16]byte {
+	return d.inner.UUID()
+}
+
+func (d *Disk) Name() string {
+	return d.inner.Name()
+}
+
+func (d *Disk) Get(key string, opts store.GetOptions) ([]byte, store.Stat, error) {
+	inner := d.innerFor(opts.RequestID, opts.Trace)
+
+	data, st, ok := d.lookup(inner, key, opts)
+	if ok {
+		return data, st, nil
+	}
+
+	data, st, err := d.inner.Get(key, opts)
+	if err != nil {
+		return nil, store.Stat{}, err
+	}
+
+	select {
+	case d.fills <- struct{}{}:
+		// the caller owns data, and may change it while it's being written
+		fillData := make([]byte, len(data))
+		copy(fillData, data)
+
+		d.filling.Add(1)
+		go func() {
+			defer d.filling.Done()
+			d.fill(key, fillData, st)
+			<-d.fills
+		}()
+	default:
+	}
+
+	return data, st, nil
+}
+
+func (d *Disk) GetPartial(key string, start, length int64, opts store.GetOptions) ([]byte, store.Stat, error) {
+	data, st, err := d.Get(key, opts)
+	if err != nil {
+		return nil, store.Stat{}, err
+	}
+	if start < 0 {
+		start = 0
+	}
+	if length < 0 || start+length > int64(len(data)) {
+		length = int64(len(data)) - start
+	}
+	if length <= 0 {
+		return []byte{}, st, nil
+	}
+	return data[start : start+length], st, nil
+}
+
+// lookup returns the cached value of key if there is one and it is current,
+// removing it if it is not.
+func (d *Disk) lookup(inner store.Store, key string, opts store.GetOptions) ([]byte, store.Stat, bool) {
+	d.mu.Lock()
+	el, ok := d.entries[key]
+	if !ok {
+		d.stats.Misses++
+		d.mu.Unlock()
+		return nil, store.Stat{}, false
+	}
+	e := el.Value.(*diskEntry)
+	d.mu.Unlock()
+
+	// The value may have changed since it was cached, perhaps through another
+	// proxy or before a restart.
+	st, err := inner.Stat(key, opts.Cancel)
+	if err != nil || st != e.stat {
+		d.mu.Lock()
+		if err == nil || err == store.ErrNotFound {
+			if d.removeLocked(e) {
+				d.stats.Invalidations++
+			}
+		}
+		d.stats.Misses++
+		d.mu.Unlock()
+		return nil, store.Stat{}, false
+	}
+
+	data, err := readDiskEntry(e)
+	if err != nil {
+		d.mu.Lock()
+		if d.removeLocked(e) && err == errDiskEntryCorrupt {
+			logging.Warnf("Removed corrupt disk cache file %v for %#v", e.path, key)
+			d.stats.Corrupt++
+		}
+		d.stats.Misses++
+		d.mu.Unlock()
+		return nil, store.Stat{}, false
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	if d.entries[key] == el {
+		e.used = now
+		d.lru.MoveToFront(el)
+	}
+	d.stats.Hits++
+	d.mu.Unlock()
+
+	// so the order of use survives a restart
+	os.Chtimes(e.path, now, now)
+
+	return data, st, true
+}
+
+// fill writes a value just read from the inner store to the cache.
+func (d *Disk) fill(key string, data []byte, st store.Stat) {
+	e := &diskEntry{
+		key:  key,
+		path: d.pathFor(key),
+		stat: st,
+		size: int64(diskHeaderSize + len(key) + len(data)),
+		used: time.Now(),
+	}
+	if e.size > d.size {
+		return
+	}
+
+	tmp, err := writeDiskEntry(filepath.Join(d.dir, "tmp"), e, data)
+	if err != nil {
+		logging.Warnf("Couldn't write disk cache file for %#v: %v", key, err)
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(e.path), 0755)
+	if err != nil {
+		logging.Warnf("Couldn't write disk cache file for %#v: %v", key, err)
+		os.Remove(tmp)
+		return
+	}
+
+	// Renames and removals of cache files happen with the lock held, so
+	// that the file for a key always matches its entry.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.entries[key]; ok {
+		d.removeLocked(el.Value.(*diskEntry))
+	}
+
+	err = os.Rename(tmp, e.path)
+	if err != nil {
+		logging.Warnf("Couldn't write disk cache file for %#v: %v", key, err)
+		os.Remove(tmp)
+		return
+	}
+
+	d.entries[key] = d.lru.PushFront(e)
+	d.used += e.size
+	d.evictLocked()
+}
+
+// removeLocked removes e and its file, if it is still the entry for its key.
+// It returns whether it was.
+func (d *Disk) removeLocked(e *diskEntry) bool {
+	el, ok := d.entries[e.key]
+	if !ok || el.Value.(*diskEntry) != e {
+		return false
+	}
+
+	delete(d.entries, e.key)
+	d.lru.Remove(el)
+	d.used -= e.size
+
+	err := os.Remove(e.path)
+	if err != nil && !os.IsNotExist(err) {
+		logging.Warnf("Couldn't remove disk cache file %v: %v", e.path, err)
+	}
+	return true
+}
+
+func (d *Disk) evictLocked() {
+	for d.used > d.size {
+		el := d.lru.Back()
+		if el == nil {
+			break
+		}
+		d.removeLocked(el.Value.(*diskEntry))
+		d.stats.Evictions++
+	}
+}
+
+func (d *Disk) List(after string, limit int, cancel <-chan struct{}) ([]string, error) {
+	return d.inner.List(after, limit, cancel)
+}
+
+func (d *Disk) FreeSpace(cancel <-chan struct{}) (int64, error) {
+	return d.inner.FreeSpace(cancel)
+}
+
+func (d *Disk) Stat(key string, cancel <-chan struct{}) (store.Stat, error) {
+	return d.stat(d.inner, key, cancel)
+}
+
+// stat is Stat, reading through the given view of the inner store.
+func (d *Disk) stat(inner store.Store, key string, cancel <-chan struct{}) (store.Stat, error) {
+	st, err := inner.Stat(key, cancel)
+	if err != nil && err != store.ErrNotFound {
+		return st, err
+	}
+
+	d.mu.Lock()
+	if el, ok := d.entries[key]; ok {
+		e := el.Value.(*diskEntry)
+		if err == store.ErrNotFound || st != e.stat {
+			if d.removeLocked(e) {
+				d.stats.Invalidations++
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	return st, err
+}
+
+func (d *Disk) CAS(key string, from, to store.CASV, cancel <-chan struct{}) error {
+	return d.cas(d.inner, key, from, to, cancel)
+}
+
+// cas is CAS, writing through the given view of the inner store. Written
+// values are not cached until they are read.
+func (d *Disk) cas(inner store.Store, key string, from, to store.CASV, cancel <-chan struct{}) error {
+	err := inner.CAS(key, from, to, cancel)
+	if err == nil {
+		d.mu.Lock()
+		if el, ok := d.entries[key]; ok {
+			if d.removeLocked(el.Value.(*diskEntry)) {
+				d.stats.Invalidations++
+			}
+		}
+		d.mu.Unlock()
+	}
+	return err
+}
+
+// WithRequestID returns a view of the Disk that passes id along with writes
+// and Stats to the inner store. The view shares its entries with d.
+func (d *Disk) WithRequestID(id string) store.Store {
+	return requestDisk{d, id, tracing.SpanContext{}}
+}
+
+// WithTrace returns a view of the Disk that traces writes and Stats to the
+// inner store as children of sc. The view shares its entries with d.
+func (d *Disk) WithTrace(sc tracing.SpanContext) store.Store {
+	return requestDisk{d, "", sc}
+}
+
+// innerFor returns the inner store tagged with a request ID and trace.
+func (d *Disk) innerFor(requestID string, trace tracing.SpanContext) store.Store {
+	return store.WithTrace(store.WithRequestID(d.inner, requestID), trace)
+}
+
+type requestDisk struct {
+	*Disk
+	requestID string
+	trace     tracing.SpanContext
+}
+
+func (r requestDisk) WithRequestID(id string) store.Store {
+	return requestDisk{r.Disk, id, r.trace}
+}
+
+func (r requestDisk) WithTrace(sc tracing.SpanContext) store.Store {
+	return requestDisk{r.Disk, r.requestID, sc}
+}
+
+func (r requestDisk) Stat(key string, cancel <-chan struct{}) (store.Stat, error) {
+	return r.stat(r.innerFor(r.requestID, r.trace), key, cancel)
+}
+
+func (r requestDisk) CAS(key string, from, to store.CASV, cancel <-chan struct{}) error {
+	return r.cas(r.innerFor(r.requestID, r.trace), key, from, to, cancel)
+}
+
+// Stats returns counters for the Disk since it was opened.
+func (d *Disk) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	st := d.stats
+	st.Entries = len(d.entries)
+	st.Used = d.used
+	st.Size = d.size
+	return st
+}
+
+// Close waits for values being written to the cache, then closes the inner
+// store. The cache files are left for the next OpenDisk.
+func (d *Disk) Close() error {
+	d.filling.Wait()
+	return d.inner.Close()
+}
+
+// writeDiskEntry writes the cache file for e to a new file in dir, returning
+// its path.
+func writeDiskEntry(dir string, e *diskEntry, data []byte) (string, error) {
+	f, err := ioutil.TempFile(dir, "fill")
+	if err != nil {
+		return "", err
+	}
+
+	var header [diskHeaderSize]byte
+	copy(header[0:8], diskMagic[:])
+	copy(header[8:40], e.stat.SHA256[:])
+	binary.BigEndian.PutUint64(header[40:48], uint64(e.stat.Size))
+	binary.BigEndian.PutUint64(header[48:56], uint64(e.stat.WriteTime))
+	binary.BigEndian.PutUint32(header[56:60], uint32(len(e.key)))
+
+	_, err = f.Write(header[:])
+	if err == nil {
+		_, err = io.WriteString(f, e.key)
+	}
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// readDiskHeader reads the key and Stat of a cache file.
+func readDiskHeader(path string) (*diskEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	e, err := parseDiskHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	e.path = path
+	return e, nil
+}
+
+func parseDiskHeader(r io.Reader) (*diskEntry, error) {
+	var header [diskHeaderSize]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, errDiskEntryCorrupt
+	}
+	if !bytes.Equal(header[0:8], diskMagic[:]) {
+		return nil, errDiskEntryCorrupt
+	}
+
+	e := &diskEntry{}
+	copy(e.stat.SHA256[:], header[8:40])
+	e.stat.Size = int64(binary.BigEndian.Uint64(header[40:48]))
+	e.stat.WriteTime = int64(binary.BigEndian.Uint64(header[48:56]))
+
+	keyLen := binary.BigEndian.Uint32(header[56:60])
+	if keyLen > 1<<20 {
+		return nil, errDiskEntryCorrupt
+	}
+	key := make([]byte, keyLen)
+	_, err = io.ReadFull(r, key)
+	if err != nil {
+		return nil, errDiskEntryCorrupt
+	}
+	e.key = string(key)
+
+	return e, nil
+}
+
+// readDiskEntry reads the value cached for e, checking it against e's Stat.
+func readDiskEntry(e *diskEntry) ([]byte, error) {
+	f, err := os.Open(e.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errDiskEntryChanged
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	got, err := parseDiskHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	if got.key != e.key || got.stat != e.stat {
+		return nil, errDiskEntryChanged
+	}
+
+	data := make([]byte, e.stat.Size)
+	_, err = io.ReadFull(f, data)
+	if err != nil {
+		return nil, errDiskEntryCorrupt
+	}
+
+	if sha256.Sum256(data) != e.stat.SHA256 {
+		return nil, errDiskEntryCorrupt
+	}
+
+	return data, nil
+}
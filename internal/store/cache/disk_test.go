@@ -0,0 +1,187 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/store/storetests"
+)
+
+func makeDiskTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "slime_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	return dir
+}
+
+func openDiskOrDie(t *testing.T, dir string, size int64, inner store.Store) *Disk {
+	d, err := OpenDisk(dir, size, inner)
+	if err != nil {
+		t.Fatalf("Couldn't open disk cache: %v", err)
+	}
+	return d
+}
+
+func TestDiskGeneric(t *testing.T) {
+	dir := makeDiskTestDir(t)
+	defer os.RemoveAll(dir)
+
+	d := openDiskOrDie(t, dir, 1024*128, storetests.NewMockStore(0))
+	defer func() { d.filling.Wait() }()
+	storetests.TestStore(t, d)
+}
+
+func TestDiskCachesGets(t *testing.T) {
+	dir := makeDiskTestDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &CountingStore{MockStore: storetests.NewMockStore(0)}
+	d := openDiskOrDie(t, dir, 1024, inner)
+	defer func() { d.filling.Wait() }()
+
+	storetests.ShouldCAS(t, inner, "asdf", store.AnyV, store.DataV([]byte("hello")))
+
+	storetests.ShouldGet(t, d, "asdf", []byte("hello"))
+	d.filling.Wait()
+	for i := 0; i < 9; i++ {
+		storetests.ShouldGet(t, d, "asdf", []byte("hello"))
+	}
+
+	if inner.gets != 1 {
+		t.Errorf("wanted 1 inner Get, got %v", inner.gets)
+	}
+	if inner.stats != 9 {
+		t.Errorf("wanted 9 inner Stats, got %v", inner.stats)
+	}
+
+	st := d.Stats()
+	if st.Hits != 9 || st.Misses != 1 || st.Entries != 1 {
+		t.Errorf("wanted 9 hits and 1 miss of 1 entry, got %+v", st)
+	}
+	if st.HitRate() != 0.9 {
+		t.Errorf("wanted hit rate 0.9, got %v", st.HitRate())
+	}
+}
+
+func TestDiskPersists(t *testing.T) {
+	dir := makeDiskTestDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &CountingStore{MockStore: storetests.NewMockStore(0)}
+	storetests.ShouldCAS(t, inner, "asdf", store.AnyV, store.DataV([]byte("hello")))
+
+	d := openDiskOrDie(t, dir, 1024, inner)
+	defer func() { d.filling.Wait() }()
+	storetests.ShouldGet(t, d, "asdf", []byte("hello"))
+	d.filling.Wait()
+
+	d = openDiskOrDie(t, dir, 1024, inner)
+	storetests.ShouldGet(t, d, "asdf", []byte("hello"))
+
+	if inner.gets != 1 {
+		t.Errorf("wanted 1 inner Get, got %v", inner.gets)
+	}
+	if st := d.Stats(); st.Hits != 1 {
+		t.Errorf("wanted a hit after reopening, got %+v", st)
+	}
+}
+
+func TestDiskDetectsCorruption(t *testing.T) {
+	dir := makeDiskTestDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &CountingStore{MockStore: storetests.NewMockStore(0)}
+	d := openDiskOrDie(t, dir, 1024, inner)
+	defer func() { d.filling.Wait() }()
+
+	storetests.ShouldCAS(t, inner, "asdf", store.AnyV, store.DataV([]byte("hello")))
+	storetests.ShouldGet(t, d, "asdf", []byte("hello"))
+	d.filling.Wait()
+
+	path := d.pathFor("asdf")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Couldn't read cache file: %v", err)
+	}
+	data[len(data)-1] ^= 1
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatalf("Couldn't write cache file: %v", err)
+	}
+
+	storetests.ShouldGet(t, d, "asdf", []byte("hello"))
+
+	if inner.gets != 2 {
+		t.Errorf("wanted 2 inner Gets, got %v", inner.gets)
+	}
+	if st := d.Stats(); st.Corrupt != 1 {
+		t.Errorf("wanted 1 corrupt entry, got %+v", st)
+	}
+}
+
+func TestDiskInvalidates(t *testing.T) {
+	dir := makeDiskTestDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &CountingStore{MockStore: storetests.NewMockStore(0)}
+	d := openDiskOrDie(t, dir, 1024, inner)
+	defer func() { d.filling.Wait() }()
+
+	// known changes, through the Disk
+	storetests.ShouldCAS(t, d, "asdf", store.AnyV, store.DataV([]byte("hello")))
+	storetests.ShouldGet(t, d, "asdf", []byte("hello"))
+	d.filling.Wait()
+	storetests.ShouldCAS(t, d, "asdf", store.AnyV, store.DataV([]byte("world")))
+	if st := d.Stats(); st.Entries != 0 || st.Invalidations != 1 {
+		t.Errorf("wanted the entry to be invalidated by a CAS, got %+v", st)
+	}
+
+	// unknown changes, made elsewhere
+	storetests.ShouldGet(t, d, "asdf", []byte("world"))
+	d.filling.Wait()
+	storetests.ShouldCAS(t, inner, "asdf", store.AnyV, store.DataV([]byte("again")))
+	storetests.ShouldGet(t, d, "asdf", []byte("again"))
+
+	if inner.gets != 3 {
+		t.Errorf("wanted 3 inner Gets, got %v", inner.gets)
+	}
+	if st := d.Stats(); st.Invalidations != 2 {
+		t.Errorf("wanted 2 invalidations, got %+v", st)
+	}
+}
+
+func TestDiskEvicts(t *testing.T) {
+	dir := makeDiskTestDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := storetests.NewMockStore(0)
+	size := int64(10 * (diskHeaderSize + 2 + 100))
+	d := openDiskOrDie(t, dir, size, inner)
+	defer func() { d.filling.Wait() }()
+
+	for i := 10; i < 30; i++ {
+		key := strconv.Itoa(i)
+		storetests.ShouldCAS(t, inner, key, store.AnyV, store.DataV(make([]byte, 100)))
+		storetests.ShouldGet(t, d, key, make([]byte, 100))
+		d.filling.Wait()
+	}
+
+	st := d.Stats()
+	if st.Used > size || st.Entries != 10 || st.Evictions != 10 {
+		t.Errorf("wanted 10 entries in %v bytes after 10 evictions, got %+v", size, st)
+	}
+
+	// the oldest are gone, and the newest remain after reopening
+	d = openDiskOrDie(t, dir, size, inner)
+	d.mu.Lock()
+	_, haveOld := d.entries["10"]
+	_, haveNew := d.entries["29"]
+	d.mu.Unlock()
+	if haveOld || !haveNew {
+		t.Errorf("wanted only the newest entries kept, have 10: %v, have 29: %v", haveOld, haveNew)
+	}
+}
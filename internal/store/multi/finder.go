@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"strings"
 	"sync"
@@ -13,6 +12,8 @@ import (
 	"gopkg.in/tomb.v2"
 
 	"github.com/encryptio/kvl"
+	"github.com/encryptio/slime/internal/events"
+	"github.com/encryptio/slime/internal/logging"
 	"github.com/encryptio/slime/internal/meta"
 	"github.com/encryptio/slime/internal/store"
 	"github.com/encryptio/slime/internal/store/storehttp"
@@ -25,8 +26,10 @@ var TestIntervalBetween = time.Second * 5
 type FinderEntry struct {
 	Store     store.Store
 	Free      int64
+	Capacity  int64 // 0 if the store doesn't report it
 	LastCheck time.Time
 	Dead      bool
+	Mode      uint8 // one of the meta.Location* modes
 }
 
 // A Finder keeps track of all currently reachable meta.Locations and their
@@ -37,8 +40,14 @@ type Finder struct {
 
 	tomb tomb.Tomb
 
-	mu     sync.Mutex
-	stores map[[16]byte]FinderEntry
+	mu        sync.Mutex
+	stores    map[[16]byte]FinderEntry
+	latencies map[[16]byte]*storeLatency
+
+	// disconnected holds stores that have dropped out since they were found,
+	// so that finding them again is reported as a reconnect
+	disconnected map[[16]byte]bool
+	events       *events.Dispatcher
 }
 
 func NewFinder(db kvl.DB) (*Finder, error) {
@@ -47,7 +56,9 @@ func NewFinder(db kvl.DB) (*Finder, error) {
 		client: &http.Client{
 			Timeout: time.Second * 15,
 		},
-		stores: make(map[[16]byte]FinderEntry, 16),
+		stores:       make(map[[16]byte]FinderEntry, 16),
+		latencies:    make(map[[16]byte]*storeLatency, 16),
+		disconnected: make(map[[16]byte]bool),
 	}
 
 	f.tomb.Go(func() error {
@@ -59,6 +70,14 @@ func NewFinder(db kvl.DB) (*Finder, error) {
 	return f, nil
 }
 
+// SetEvents sets where the Finder reports stores disconnecting and
+// reconnecting. It may be nil.
+func (f *Finder) SetEvents(d *events.Dispatcher) {
+	f.mu.Lock()
+	f.events = d
+	f.mu.Unlock()
+}
+
 func (f *Finder) Stop() error {
 	f.tomb.Kill(nil)
 	return f.tomb.Wait()
@@ -85,7 +104,7 @@ func (f *Finder) scanLoop() error {
 	for {
 		err := f.Rescan()
 		if err != nil {
-			log.Printf("Couldn't scan for locations: %v", err)
+			logging.Errorf("Couldn't scan for locations: %v", err)
 		}
 
 		select {
@@ -166,21 +185,39 @@ func (f *Finder) Scan(url string) error {
 				return err
 			}
 
+			capacity := storeCapacity(st)
+
 			f.mu.Lock()
+			var reconnected bool
 			e, found = f.stores[id]
 			if !found {
-				dead, _ := f.checkDead(id)
+				dead, mode, _ := f.checkLocation(id)
 
 				e = FinderEntry{
 					Store:     st,
 					Free:      free,
+					Capacity:  capacity,
 					LastCheck: time.Now(),
 					Dead:      dead,
+					Mode:      mode,
 				}
 
 				f.stores[id] = e
+
+				reconnected = f.disconnected[id]
+				delete(f.disconnected, id)
 			}
+			d := f.events
 			f.mu.Unlock()
+
+			if reconnected {
+				d.Emit(events.Event{
+					Type:    events.StoreConnected,
+					Message: fmt.Sprintf("store %v reconnected", st.Name()),
+					Store:   uuid.Fmt(id),
+					Details: map[string]interface{}{"url": url},
+				})
+			}
 		}
 
 		err = f.markActive(url, e.Store.Name(), id)
@@ -192,10 +229,27 @@ func (f *Finder) Scan(url string) error {
 	return nil
 }
 
-func (f *Finder) checkDead(id [16]byte) (bool, error) {
+// storeCapacity returns the capacity of st, or 0 if it isn't known.
+func storeCapacity(st store.Store) int64 {
+	cs, ok := st.(store.CapacityStore)
+	if !ok {
+		return 0
+	}
+
+	capacity, err := cs.Capacity(nil)
+	if err != nil {
+		return 0
+	}
+
+	return capacity
+}
+
+func (f *Finder) checkLocation(id [16]byte) (bool, uint8, error) {
 	var dead bool
+	var mode uint8
 	err := f.db.RunReadTx(func(ctx kvl.Ctx) error {
 		dead = false
+		mode = meta.LocationNormal
 
 		layer, err := meta.Open(ctx)
 		if err != nil {
@@ -209,10 +263,11 @@ func (f *Finder) checkDead(id [16]byte) (bool, error) {
 
 		if loc != nil {
 			dead = loc.Dead
+			mode = loc.Mode
 		}
 		return nil
 	})
-	return dead, err
+	return dead, mode, err
 }
 
 func (f *Finder) markActive(url, name string, id [16]byte) error {
@@ -268,31 +323,46 @@ func (f *Finder) test(wait time.Duration) {
 	}
 
 	for id, fe := range f.Stores() {
-		dead, err := f.checkDead(id)
+		dead, mode, err := f.checkLocation(id)
 		if err != nil {
 			continue
 		}
 
 		free, err := fe.Store.FreeSpace(nil)
+		capacity := storeCapacity(fe.Store)
 
 		f.mu.Lock()
+		var disconnected bool
 		if err != nil {
 			e, ok := f.stores[id]
 			if ok {
 				e.Store.Close()
 				delete(f.stores, id)
+				f.disconnected[id] = true
+				disconnected = true
 			}
 		}
 
 		e, ok := f.stores[id]
 		if ok {
 			e.Free = free
+			e.Capacity = capacity
 			e.LastCheck = time.Now()
 			e.Dead = dead
+			e.Mode = mode
 			f.stores[id] = e
 		}
+		d := f.events
 		f.mu.Unlock()
 
+		if disconnected {
+			d.Emit(events.Event{
+				Type:    events.StoreDisconnected,
+				Message: fmt.Sprintf("store %v disconnected: %v", fe.Store.Name(), err),
+				Store:   uuid.Fmt(id),
+			})
+		}
+
 		select {
 		case <-f.tomb.Dying():
 			return
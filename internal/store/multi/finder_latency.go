@@ -0,0 +1,166 @@
+package multi
+
+import (
+	"time"
+)
+
+var (
+	// hedgeDelayDefault is used for stores we have no latency samples for.
+	hedgeDelayDefault = 250 * time.Millisecond
+
+	// hedgeDelayMin keeps a store with very consistent latency from causing
+	// hedged requests on every read.
+	hedgeDelayMin = 5 * time.Millisecond
+)
+
+// Latency is tracked separately for chunks of different sizes, so that the
+// estimate for large chunks isn't dominated by small ones. Bucket 0 holds
+// chunks under latencyBucketBase bytes, and each bucket after it holds chunks
+// up to latencyBucketGrowth times larger than the one before.
+const (
+	latencyBucketBase   = 64 * 1024
+	latencyBucketGrowth = 4
+	latencyBuckets      = 8
+)
+
+// latencyBucket returns the bucket for chunks of the given size.
+func latencyBucket(size int64) int {
+	limit := int64(latencyBucketBase)
+	for i := 0; i < latencyBuckets-1; i++ {
+		if size < limit {
+			return i
+		}
+		limit *= latencyBucketGrowth
+	}
+	return latencyBuckets - 1
+}
+
+// storeLatency holds the latency of a store's chunk reads, by size.
+type storeLatency [latencyBuckets]latencyStats
+
+// hedgeDelay returns how long to wait on a read of a chunk of the given size
+// from this store before assuming it is slow and asking other stores instead.
+// If there are no samples for chunks of that size, the estimate for the
+// nearest smaller size is scaled up to it, or failing that the estimate for
+// the nearest larger size is used as is; either way it errs towards waiting
+// longer.
+func (s *storeLatency) hedgeDelay(size int64) time.Duration {
+	if s == nil {
+		return clampHedgeDelay(hedgeDelayDefault)
+	}
+
+	bucket := latencyBucket(size)
+	if s[bucket].samples > 0 {
+		return s[bucket].hedgeDelay()
+	}
+
+	scale := time.Duration(1)
+	for i := bucket - 1; i >= 0; i-- {
+		scale *= latencyBucketGrowth
+		if s[i].samples > 0 {
+			return clampHedgeDelay(s[i].hedgeDelay() * scale)
+		}
+	}
+	for i := bucket + 1; i < latencyBuckets; i++ {
+		if s[i].samples > 0 {
+			return s[i].hedgeDelay()
+		}
+	}
+
+	return clampHedgeDelay(hedgeDelayDefault)
+}
+
+// latencyStats is a smoothed estimate of a store's chunk read latency and its
+// variation, updated in the same way as TCP's round trip time estimator (RFC
+// 6298).
+type latencyStats struct {
+	samples int
+	mean    time.Duration
+	dev     time.Duration
+}
+
+func (l *latencyStats) add(d time.Duration) {
+	if l.samples == 0 {
+		l.mean = d
+		l.dev = d / 2
+	} else {
+		diff := l.mean - d
+		if diff < 0 {
+			diff = -diff
+		}
+		l.dev += (diff - l.dev) / 4
+		l.mean += (d - l.mean) / 8
+	}
+	l.samples++
+}
+
+// addLowerBound adds a sample from a read that was cancelled or failed after d,
+// which only shows that the latency was at least d. It is left out unless d is
+// more than the current estimate, so that reads cancelled early don't make
+// the store look faster than it is.
+func (l *latencyStats) addLowerBound(d time.Duration) {
+	estimate := hedgeDelayDefault
+	if l.samples > 0 {
+		estimate = l.mean
+	}
+	if d > estimate {
+		l.add(d)
+	}
+}
+
+// hedgeDelay returns how long to wait on a read from this store before
+// assuming it is slow and asking other stores instead.
+func (l *latencyStats) hedgeDelay() time.Duration {
+	if l == nil || l.samples == 0 {
+		return clampHedgeDelay(hedgeDelayDefault)
+	}
+	return clampHedgeDelay(l.mean + 4*l.dev)
+}
+
+func clampHedgeDelay(d time.Duration) time.Duration {
+	if d < hedgeDelayMin {
+		d = hedgeDelayMin
+	}
+	if d > dataOnlyTimeout {
+		d = dataOnlyTimeout
+	}
+	return d
+}
+
+// RecordLatency adds a sample of how long a successful read of a chunk of the
+// given size took from the store with the given UUID.
+func (f *Finder) RecordLatency(id [16]byte, size int64, d time.Duration) {
+	f.mu.Lock()
+	l := f.latencies[id]
+	if l == nil {
+		l = &storeLatency{}
+		f.latencies[id] = l
+	}
+	bucket := latencyBucket(size)
+	l[bucket].add(d)
+	f.mu.Unlock()
+}
+
+// RecordLatencyBound notes that a read of a chunk of the given size from the
+// store with the given UUID was cancelled or failed after d, so its latency is
+// at least that.
+func (f *Finder) RecordLatencyBound(id [16]byte, size int64, d time.Duration) {
+	f.mu.Lock()
+	l := f.latencies[id]
+	if l == nil {
+		l = &storeLatency{}
+		f.latencies[id] = l
+	}
+	l[latencyBucket(size)].addLowerBound(d)
+	f.mu.Unlock()
+}
+
+// HedgeDelay returns how long a read of a chunk of the given size from the
+// store with the given UUID may take before it should be considered slow,
+// based on its recent latency for chunks of about that size.
+func (f *Finder) HedgeDelay(id [16]byte, size int64) time.Duration {
+	f.mu.Lock()
+	d := f.latencies[id].hedgeDelay(size)
+	f.mu.Unlock()
+	return d
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/encryptio/slime/internal/chunkserver"
 	"github.com/encryptio/slime/internal/meta"
@@ -93,3 +94,90 @@ func TestFinderScan(t *testing.T) {
 		t.Fatalf("Finder did not find uuid of directory store after resurrection")
 	}
 }
+
+func TestLatencyStatsHedgeDelay(t *testing.T) {
+	var l *latencyStats
+	if d := l.hedgeDelay(); d != hedgeDelayDefault {
+		t.Errorf("hedge delay with no samples is %v, wanted %v", d, hedgeDelayDefault)
+	}
+
+	l = &latencyStats{}
+	for i := 0; i < 50; i++ {
+		l.add(20 * time.Millisecond)
+	}
+	if d := l.hedgeDelay(); d < 20*time.Millisecond || d > 25*time.Millisecond {
+		t.Errorf("hedge delay with steady 20ms samples is %v", d)
+	}
+
+	steady := l.hedgeDelay()
+	for i := 0; i < 10; i++ {
+		l.add(5 * time.Millisecond)
+		l.add(80 * time.Millisecond)
+	}
+	if d := l.hedgeDelay(); d <= steady {
+		t.Errorf("hedge delay with jittery samples is %v, wanted more than %v", d, steady)
+	}
+
+	for i := 0; i < 50; i++ {
+		l.add(time.Hour)
+	}
+	if d := l.hedgeDelay(); d != dataOnlyTimeout {
+		t.Errorf("hedge delay for a very slow store is %v, wanted %v", d, dataOnlyTimeout)
+	}
+}
+
+func TestLatencyStatsLowerBound(t *testing.T) {
+	l := &latencyStats{}
+	for i := 0; i < 50; i++ {
+		l.add(10 * time.Millisecond)
+	}
+	fast := l.hedgeDelay()
+
+	// reads cancelled sooner than usual say nothing
+	for i := 0; i < 10; i++ {
+		l.addLowerBound(time.Millisecond)
+	}
+	if d := l.hedgeDelay(); d != fast {
+		t.Errorf("hedge delay changed from %v to %v after reads cancelled early", fast, d)
+	}
+
+	// but a store that slowed down, and only has its reads cancelled, must
+	// stop looking fast
+	for i := 0; i < 10; i++ {
+		l.addLowerBound(100 * time.Millisecond)
+	}
+	if d := l.hedgeDelay(); d < 50*time.Millisecond {
+		t.Errorf("hedge delay after slow cancelled reads is %v, wanted at least 50ms", d)
+	}
+}
+
+func TestStoreLatencyBySize(t *testing.T) {
+	var l *storeLatency
+	if d := l.hedgeDelay(1024); d != hedgeDelayDefault {
+		t.Errorf("hedge delay with no samples is %v, wanted %v", d, hedgeDelayDefault)
+	}
+
+	l = &storeLatency{}
+	small := latencyBucket(1024)
+	for i := 0; i < 50; i++ {
+		l[small].add(10 * time.Millisecond)
+	}
+	smallDelay := l.hedgeDelay(1024)
+
+	// large chunks with no samples of their own wait longer than small ones
+	if d := l.hedgeDelay(1024 * 1024); d <= smallDelay {
+		t.Errorf("hedge delay for unsampled large chunks is %v, wanted more than %v", d, smallDelay)
+	}
+
+	// and once sampled, large chunks don't change the estimate for small ones
+	large := latencyBucket(1024 * 1024)
+	for i := 0; i < 50; i++ {
+		l[large].add(200 * time.Millisecond)
+	}
+	if d := l.hedgeDelay(1024 * 1024); d < 200*time.Millisecond {
+		t.Errorf("hedge delay for large chunks is %v, wanted at least 200ms", d)
+	}
+	if d := l.hedgeDelay(1024); d != smallDelay {
+		t.Errorf("hedge delay for small chunks changed from %v to %v", smallDelay, d)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"gopkg.in/tomb.v2"
 
 	"github.com/encryptio/kvl"
+	"github.com/encryptio/slime/internal/events"
 	"github.com/encryptio/slime/internal/meta"
 )
 
@@ -20,14 +21,24 @@ type Multi struct {
 
 	freeMapChannel chan map[[16]byte]int64
 	asyncDeletions chan *meta.File
+	readRepairs    chan readRepair
+	readOverflow   chan readRepair
 
 	// used for test suite only
 	asyncDeletionsReading chan struct{}
 
 	tomb tomb.Tomb
 
+	deepScrub   deepScrubState
+	archive     archiveState
+	limiters    limiters
+	access      accessState
+	readRepair  readRepairState
+	repairMeter repairMeter
+
 	mu     sync.Mutex
 	config multiConfig
+	events *events.Dispatcher
 }
 
 func NewMulti(db kvl.DB, finder *Finder, scrubbers int) (*Multi, error) {
@@ -36,7 +47,10 @@ func NewMulti(db kvl.DB, finder *Finder, scrubbers int) (*Multi, error) {
 		finder:         finder,
 		freeMapChannel: make(chan map[[16]byte]int64),
 		asyncDeletions: make(chan *meta.File, 1000),
+		readRepairs:    make(chan readRepair, readRepairBuffer),
+		readOverflow:   make(chan readRepair, readRepairBuffer),
 	}
+	m.readRepair.pending = make(map[string]bool)
 
 	err := m.loadUUID()
 	if err != nil {
@@ -59,16 +73,50 @@ func NewMulti(db kvl.DB, finder *Finder, scrubbers int) (*Multi, error) {
 
 		if scrubbers > 0 {
 			m.tomb.Go(m.scrubWALLoop)
+			m.tomb.Go(m.quarantineLoop)
+			m.tomb.Go(m.deepScrubLoop)
+			m.tomb.Go(m.drainLoop)
+			m.tomb.Go(m.tieringLoop)
+			m.tomb.Go(m.archiveLoop)
+			m.tomb.Go(m.repairFeedLoop)
 		}
 
+		m.tomb.Go(m.accessFlushLoop)
+
 		m.tomb.Go(m.asyncDeletionLoop)
 
+		m.tomb.Go(m.readRepairLoop)
+		m.tomb.Go(m.readOverflowLoop)
+
 		return nil
 	})
 
 	return m, nil
 }
 
+// SetEvents sets where the Multi reports files at risk, corruption, and
+// redundancy changes. It may be nil.
+func (m *Multi) SetEvents(d *events.Dispatcher) {
+	m.mu.Lock()
+	m.events = d
+	m.mu.Unlock()
+}
+
+func (m *Multi) emit(e events.Event) {
+	m.mu.Lock()
+	d := m.events
+	m.mu.Unlock()
+	d.Emit(e)
+}
+
+// emitAll emits each event in es, such as those collected in a transaction
+// once it has committed.
+func (m *Multi) emitAll(es []events.Event) {
+	for _, e := range es {
+		m.emit(e)
+	}
+}
+
 func (m *Multi) Close() error {
 	m.tomb.Kill(nil)
 	return m.tomb.Wait()
@@ -77,4 +125,5 @@ func (m *Multi) Close() error {
 func (m *Multi) scrubAll() {
 	m.scrubFilesAll()
 	m.scrubLocationsAll()
+	m.repairQueueAll()
 }
@@ -0,0 +1,367 @@
+package multi
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/meta"
+	"github.com/encryptio/slime/internal/store"
+
+	"github.com/encryptio/kvl"
+)
+
+var (
+	archiveIdleWait = time.Minute
+	archiveCount    = 20
+)
+
+// ArchiveConfig controls re-encoding of old files into a space-efficient
+// layout, such as moving from 2 of 3 to 8 of 11. Files written more than After
+// ago are rewritten with Layout and marked archived in their meta.File; the
+// scrubber then keeps them in Layout rather than the write layout.
+type ArchiveConfig struct {
+	// Layout is the layout archived files use. MigrateCodec is ignored;
+	// archived files are always rewritten to match all of Layout.
+	Layout Layout
+
+	// After is how long after being written files are archived. Zero disables
+	// archiving, and the scrubber rewrites archived files with the write
+	// layout again.
+	After time.Duration
+
+	// Rate is the number of file bytes each proxy re-encodes per second. Zero
+	// is unlimited.
+	Rate int64
+}
+
+func (c ArchiveConfig) enabled() bool {
+	return c.After > 0
+}
+
+// ArchiveStats counts the work the archiver has done since the Multi was
+// created.
+type ArchiveStats struct {
+	// The path of the last file checked, shared between all proxies.
+	Position string
+
+	Scanned int64 // files checked
+	Files   int64 // files archived
+	Bytes   int64 // size of the files archived
+
+	// Saved is the number of chunk bytes no longer stored because of
+	// archiving. Files whose archive layout is wider than their old one add
+	// nothing.
+	Saved int64
+}
+
+type archiveState struct {
+	mu    sync.Mutex
+	stats ArchiveStats
+}
+
+// GetArchive returns the archive configuration.
+func (m *Multi) GetArchive() ArchiveConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return ArchiveConfig{
+		Layout: Layout{
+			Need:       m.config.ArchiveNeed,
+			Total:      m.config.ArchiveTotal,
+			Codec:      m.config.ArchiveCodec,
+			LocalGroup: m.config.ArchiveLocalGroup,
+		},
+		After: m.config.ArchiveAfter,
+		Rate:  m.config.ArchiveRate,
+	}
+}
+
+// SetArchive changes the archive configuration for all proxies. If audit is not
+// nil, it is added to the audit log in the same transaction.
+func (m *Multi) SetArchive(c ArchiveConfig, audit *meta.AuditEntry) error {
+	m.mu.Lock()
+	conf := m.config
+	m.mu.Unlock()
+
+	conf.ArchiveNeed = c.Layout.Need
+	conf.ArchiveTotal = c.Layout.Total
+	conf.ArchiveCodec = c.Layout.Codec
+	conf.ArchiveLocalGroup = c.Layout.LocalGroup
+	conf.ArchiveAfter = c.After
+	conf.ArchiveRate = c.Rate
+
+	err := checkConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	err = m.db.RunTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = layer.SetConfig("archive-need", strconv.AppendInt(nil, int64(conf.ArchiveNeed), 10))
+		if err != nil {
+			return err
+		}
+		err = layer.SetConfig("archive-total", strconv.AppendInt(nil, int64(conf.ArchiveTotal), 10))
+		if err != nil {
+			return err
+		}
+		err = layer.SetConfig("archive-codec", strconv.AppendInt(nil, int64(conf.ArchiveCodec), 10))
+		if err != nil {
+			return err
+		}
+		err = layer.SetConfig("archive-local-group", strconv.AppendInt(nil, int64(conf.ArchiveLocalGroup), 10))
+		if err != nil {
+			return err
+		}
+		err = layer.SetConfig("archive-after",
+			strconv.AppendInt(nil, int64(conf.ArchiveAfter/time.Second), 10))
+		if err != nil {
+			return err
+		}
+		err = layer.SetConfig("archive-rate", strconv.AppendInt(nil, conf.ArchiveRate, 10))
+		if err != nil {
+			return err
+		}
+		return addAudit(layer, audit)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.config.ArchiveNeed = conf.ArchiveNeed
+	m.config.ArchiveTotal = conf.ArchiveTotal
+	m.config.ArchiveCodec = conf.ArchiveCodec
+	m.config.ArchiveLocalGroup = conf.ArchiveLocalGroup
+	m.config.ArchiveAfter = conf.ArchiveAfter
+	m.config.ArchiveRate = conf.ArchiveRate
+	m.mu.Unlock()
+
+	return nil
+}
+
+// ArchiveStats returns counters for the archiver on this proxy.
+func (m *Multi) ArchiveStats() ArchiveStats {
+	m.archive.mu.Lock()
+	defer m.archive.mu.Unlock()
+	return m.archive.stats
+}
+
+func loadArchiveConfig(layer *meta.Layer, conf *multiConfig) error {
+	need, err := loadIntConfig(layer, "archive-need")
+	if err != nil {
+		return err
+	}
+	conf.ArchiveNeed = int(need)
+
+	total, err := loadIntConfig(layer, "archive-total")
+	if err != nil {
+		return err
+	}
+	conf.ArchiveTotal = int(total)
+
+	codec, err := loadIntConfig(layer, "archive-codec")
+	if err != nil {
+		return err
+	}
+	conf.ArchiveCodec = uint8(codec)
+
+	localGroup, err := loadIntConfig(layer, "archive-local-group")
+	if err != nil {
+		return err
+	}
+	conf.ArchiveLocalGroup = int(localGroup)
+
+	after, err := loadIntConfig(layer, "archive-after")
+	if err != nil {
+		return err
+	}
+	conf.ArchiveAfter = time.Duration(after) * time.Second
+
+	conf.ArchiveRate, err = loadIntConfig(layer, "archive-rate")
+	return err
+}
+
+// loadIntConfig returns the integer stored in the config key, or zero if it is
+// not set.
+func loadIntConfig(layer *meta.Layer, key string) (int64, error) {
+	data, err := layer.GetConfig(key)
+	if err != nil || data == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+func (m *Multi) archiveLoop() error {
+	for {
+		if !m.GetArchive().enabled() {
+			select {
+			case <-m.tomb.Dying():
+				return nil
+			case <-time.After(jitterDuration(archiveIdleWait)):
+				continue
+			}
+		}
+
+		files, err := m.archiveNextFiles()
+		if err != nil {
+			logging.Errorf("Couldn't get files to archive: %v", err)
+		}
+
+		if len(files) == 0 {
+			select {
+			case <-m.tomb.Dying():
+				return nil
+			case <-time.After(jitterDuration(archiveIdleWait)):
+			}
+			continue
+		}
+
+		for i := range files {
+			written := m.archiveFile(&files[i])
+
+			// rate may have changed since the last file
+			if written > 0 {
+				m.setSharedRate(&m.limiters.archive, m.GetArchive().Rate)
+				m.throttle(&m.limiters.archive, 1, written)
+			}
+
+			select {
+			case <-m.tomb.Dying():
+				return nil
+			default:
+			}
+		}
+	}
+}
+
+// archiveNextFiles returns the next batch of files to check for archiving, and
+// moves the shared position past them. It returns no files when it wraps
+// around to the beginning.
+func (m *Multi) archiveNextFiles() ([]meta.File, error) {
+	var files []meta.File
+	err := m.db.RunTx(func(ctx kvl.Ctx) error {
+		files = nil
+
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		startKey, err := layer.GetConfig("archivepos")
+		if err != nil {
+			return err
+		}
+
+		files, err = layer.ListFiles(string(startKey), archiveCount)
+		if err != nil {
+			return err
+		}
+
+		var pos []byte
+		if len(files) > 0 {
+			pos = []byte(files[len(files)-1].Path)
+		}
+		return layer.SetConfig("archivepos", pos)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) > 0 {
+		m.archive.mu.Lock()
+		m.archive.stats.Position = files[len(files)-1].Path
+		m.archive.mu.Unlock()
+	}
+
+	return files, nil
+}
+
+// archiveAll checks every file once, ignoring the rate. Used in tests.
+func (m *Multi) archiveAll() {
+	m.db.RunTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+		return layer.SetConfig("archivepos", nil)
+	})
+
+	for {
+		files, err := m.archiveNextFiles()
+		if err != nil {
+			logging.Errorf("Couldn't get files to archive: %v", err)
+			return
+		}
+		if len(files) == 0 {
+			return
+		}
+		for i := range files {
+			m.archiveFile(&files[i])
+		}
+	}
+}
+
+// archiveFile rewrites f with the archive layout if it is old enough and not
+// archived already. It returns the size of the file if it was rewritten, and
+// zero otherwise.
+func (m *Multi) archiveFile(f *meta.File) int64 {
+	conf := m.GetArchive()
+
+	m.archive.mu.Lock()
+	m.archive.stats.Scanned++
+	m.archive.mu.Unlock()
+
+	if !conf.enabled() || f.Archived {
+		return 0
+	}
+	if time.Since(time.Unix(f.WriteTime, 0)) < conf.After {
+		return 0
+	}
+
+	err := m.rewrite(f, writeOptions{
+		tier:      f.Tier,
+		archived:  true,
+		writeTime: f.WriteTime,
+	})
+	if err == store.ErrCASFailure {
+		// written since it was listed, so it isn't old any more
+		return 0
+	}
+	if err != nil {
+		logging.Errorf("Couldn't archive %v: %v", f.Path, err)
+		return 0
+	}
+
+	before := storedSize(f.Size, int(f.DataChunks), len(f.Locations))
+	after := storedSize(f.Size, conf.Layout.Need, conf.Layout.Total)
+
+	m.archive.mu.Lock()
+	m.archive.stats.Files++
+	m.archive.stats.Bytes += int64(f.Size)
+	if before > after {
+		m.archive.stats.Saved += before - after
+	}
+	m.archive.mu.Unlock()
+
+	log.Printf("Archived %v from %v of %v to %v of %v", f.Path,
+		f.DataChunks, len(f.Locations), conf.Layout.Need, conf.Layout.Total)
+
+	return int64(f.Size)
+}
+
+// storedSize estimates the number of chunk bytes used to store a file of the
+// given size split into total chunks, any need of which can rebuild it.
+func storedSize(size uint64, need, total int) int64 {
+	if need <= 0 {
+		return 0
+	}
+	chunk := (int64(size) + int64(need) - 1) / int64(need)
+	return chunk * int64(total)
+}
@@ -1,8 +1,9 @@
 package multi
 
 import (
-	"log"
 	"time"
+
+	"github.com/encryptio/slime/internal/logging"
 )
 
 func (m *Multi) asyncDeletionLoop() error {
@@ -15,7 +16,7 @@ func (m *Multi) asyncDeletionLoop() error {
 		case file := <-m.asyncDeletions:
 			err := m.deleteChunks(file)
 			if err != nil {
-				log.Printf("Couldn't run delete chunks: %v", err)
+				logging.Errorf("Couldn't run delete chunks: %v", err)
 			}
 		case m.asyncDeletionsReading <- struct{}{}:
 		}
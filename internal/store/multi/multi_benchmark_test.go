@@ -9,29 +9,55 @@ import (
 )
 
 func BenchmarkMultiGet6Way1MB(b *testing.B) {
-	benchMultiGet(b, 6, 1024*1024, false)
+	benchMultiGet(b, 6, 1024*1024, false, DefaultCodec)
 }
 
 func BenchmarkMultiGet6Way1MBNoVerify(b *testing.B) {
-	benchMultiGet(b, 6, 1024*1024, true)
+	benchMultiGet(b, 6, 1024*1024, true, DefaultCodec)
 }
 
 func BenchmarkMultiGet6Way50MB(b *testing.B) {
-	benchMultiGet(b, 6, 50*1024*1024, false)
+	benchMultiGet(b, 6, 50*1024*1024, false, DefaultCodec)
 }
 
 func BenchmarkMultiGet6Way50MBNoVerify(b *testing.B) {
-	benchMultiGet(b, 6, 50*1024*1024, true)
+	benchMultiGet(b, 6, 50*1024*1024, true, DefaultCodec)
 }
 
-func benchMultiGet(b *testing.B, width int, size int, noverify bool) {
-	_, multi, _, done := prepareMultiTest(b, width, width+2, width+2)
-	defer done()
+func BenchmarkMultiGet6Way50MBPrime(b *testing.B) {
+	benchMultiGet(b, 6, 50*1024*1024, false, CodecPrime)
+}
+
+func BenchmarkMultiGet6Way50MBDegraded(b *testing.B) {
+	benchMultiGetDegraded(b, 6, 50*1024*1024)
+}
+
+func BenchmarkMultiPut6Way50MB(b *testing.B) {
+	benchMultiPut(b, 6, 50*1024*1024, DefaultCodec)
+}
 
+func BenchmarkMultiPut6Way50MBPrime(b *testing.B) {
+	benchMultiPut(b, 6, 50*1024*1024, CodecPrime)
+}
+
+func randomValue(size int) []byte {
 	value := make([]byte, size)
 	for i := range value {
 		value[i] = byte(rand.Int())
 	}
+	return value
+}
+
+func benchMultiGet(b *testing.B, width int, size int, noverify bool, codec uint8) {
+	_, multi, _, done := prepareMultiTest(b, width, width+2, width+2)
+	defer done()
+
+	err := multi.SetCodec(codec, false)
+	if err != nil {
+		b.Fatalf("Couldn't set codec: %v", err)
+	}
+
+	value := randomValue(size)
 	storetests.ShouldCAS(b, multi, "key", store.MissingV, store.DataV(value))
 
 	b.SetBytes(int64(size))
@@ -45,3 +71,54 @@ func benchMultiGet(b *testing.B, width int, size int, noverify bool) {
 	}
 	b.StopTimer() // done() should not be benchmarked
 }
+
+// benchMultiGetDegraded is like benchMultiGet, but with the store holding the
+// first data chunk unavailable, so every Get must reconstruct from parity.
+func benchMultiGetDegraded(b *testing.B, width int, size int) {
+	killers, multi, mocks, done := prepareMultiTest(b, width, width+2, width+2)
+	defer done()
+
+	value := randomValue(size)
+	storetests.ShouldCAS(b, multi, "key", store.MissingV, store.DataV(value))
+
+	f, err := multi.getFile("key")
+	if err != nil {
+		b.Fatalf("Couldn't get file: %v", err)
+	}
+	for i, mock := range mocks {
+		if mock.UUID() == f.Locations[0] {
+			killers[i].setKilled(true)
+		}
+	}
+
+	b.SetBytes(int64(size))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := multi.Get("key", store.GetOptions{})
+		if err != nil {
+			b.Fatalf("Couldn't Get key: %v", err)
+		}
+	}
+	b.StopTimer() // done() should not be benchmarked
+}
+
+func benchMultiPut(b *testing.B, width int, size int, codec uint8) {
+	_, multi, _, done := prepareMultiTest(b, width, width+2, width+2)
+	defer done()
+
+	err := multi.SetCodec(codec, false)
+	if err != nil {
+		b.Fatalf("Couldn't set codec: %v", err)
+	}
+
+	value := store.DataV(randomValue(size))
+
+	b.SetBytes(int64(size))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		storetests.ShouldCAS(b, multi, "key", store.AnyV, value)
+	}
+	b.StopTimer() // done() should not be benchmarked
+}
@@ -0,0 +1,616 @@
+package multi
+
+import (
+	"fmt"
+
+	"github.com/encryptio/slime/internal/meta"
+	"github.com/encryptio/slime/internal/rs"
+	"github.com/encryptio/slime/internal/rs/gf"
+	"github.com/encryptio/slime/internal/rs/gf256"
+)
+
+// Codec IDs, as recorded in meta.File.Codec.
+const (
+	// CodecPrime is Reed-Solomon over GF(2^32-5). Data is mapped into the
+	// field with gf.MapToGF, so the mapping value must be stored alongside it.
+	CodecPrime uint8 = 0
+
+	// CodecGF256 is Reed-Solomon over GF(2^8). Chunks are plain byte slices.
+	CodecGF256 uint8 = 1
+
+	// CodecLRC is a Local Reconstruction Code: CodecGF256 global parity, plus
+	// one XOR parity chunk per group of meta.File.LocalGroup data chunks. A
+	// single lost chunk can be rebuilt from its group alone. See lrcLayout.
+	CodecLRC uint8 = 2
+)
+
+// DefaultCodec is the codec used for new writes when none has been
+// configured. It stays CodecPrime so that clusters from before codec selection
+// keep writing files that proxies of that era can read.
+const DefaultCodec = CodecPrime
+
+var codecNames = map[uint8]string{
+	CodecPrime: "prime",
+	CodecGF256: "gf256",
+	CodecLRC:   "lrc",
+}
+
+// CodecName returns the human-readable name of a codec ID.
+func CodecName(codec uint8) string {
+	if name, ok := codecNames[codec]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseCodec returns the codec ID for a name returned by CodecName.
+func ParseCodec(name string) (uint8, error) {
+	for codec, n := range codecNames {
+		if n == name {
+			return codec, nil
+		}
+	}
+	return 0, BadConfigError("unknown codec " + name)
+}
+
+// lrcLayout describes where the chunks of a CodecLRC file live. Chunks are
+// ordered as data, then global parity, then one local parity per group:
+//
+//	[0, need)                    data
+//	[need, need+global)          global (Reed-Solomon) parity
+//	[need+global, total)         local parity for groups 0..groups-1
+//
+// Data chunk i is a member of group i/group.
+type lrcLayout struct {
+	need, total, group int
+}
+
+func lrcLayoutFor(f *meta.File) lrcLayout {
+	return lrcLayout{int(f.DataChunks), len(f.Locations), int(f.LocalGroup)}
+}
+
+func (l lrcLayout) groups() int {
+	return (l.need + l.group - 1) / l.group
+}
+
+func (l lrcLayout) global() int {
+	return l.total - l.need - l.groups()
+}
+
+func (l lrcLayout) valid() bool {
+	return l.need > 0 && l.group > 0 && l.global() >= 0
+}
+
+// groupOf returns the local group chunk idx belongs to, or -1 for global
+// parity chunks.
+func (l lrcLayout) groupOf(idx int) int {
+	switch {
+	case idx < l.need:
+		return idx / l.group
+	case idx < l.need+l.global():
+		return -1
+	default:
+		return idx - l.need - l.global()
+	}
+}
+
+// members returns the indices of every chunk in group g, data chunks first
+// and the local parity chunk last.
+func (l lrcLayout) members(g int) []int {
+	var ret []int
+	for i := g * l.group; i < (g+1)*l.group && i < l.need; i++ {
+		ret = append(ret, i)
+	}
+	return append(ret, l.need+l.global()+g)
+}
+
+// xorChunks returns the XOR of chunks, which must all have the same length.
+func xorChunks(chunks [][]byte) []byte {
+	out := make([]byte, len(chunks[0]))
+	for _, chunk := range chunks {
+		gf256.MulAddSlice(1, chunk, out)
+	}
+	return out
+}
+
+// encodeChunks splits data into need data chunks followed by total-need
+// parity chunks, all of the same length. The mapping value returned must be
+// stored in meta.File.MappingValue. localGroup is only used by CodecLRC.
+func encodeChunks(codec uint8, data []byte, need, total, localGroup int) (uint32, [][]byte) {
+	switch codec {
+	case CodecPrime:
+		mapping, all := gf.MapToGF(data)
+		parts := splitVector(all, need)
+		parityParts := make([][]uint32, total-need)
+		for i := range parityParts {
+			parityParts[i] = rs.CreateParity(parts, i+len(parts), nil)
+		}
+		parts = append(parts, parityParts...)
+
+		chunks := make([][]byte, len(parts))
+		for i, part := range parts {
+			chunks[i] = gf.MapFromGF(mapping, part)
+		}
+		return mapping, chunks
+
+	case CodecGF256:
+		chunks := splitBytes(data, need)
+		for i := need; i < total; i++ {
+			chunks = append(chunks, rs.CreateParity256(chunks[:need], i, nil))
+		}
+		return 0, chunks
+
+	case CodecLRC:
+		layout := lrcLayout{need, total, localGroup}
+		chunks := splitBytes(data, need)
+		for i := need; i < need+layout.global(); i++ {
+			chunks = append(chunks, rs.CreateParity256(chunks[:need], i, nil))
+		}
+		for g := 0; g < layout.groups(); g++ {
+			members := layout.members(g)
+			group := make([][]byte, 0, len(members)-1)
+			for _, idx := range members[:len(members)-1] {
+				group = append(group, chunks[idx])
+			}
+			chunks = append(chunks, xorChunks(group))
+		}
+		return 0, chunks
+
+	default:
+		panic("encodeChunks: unknown codec")
+	}
+}
+
+// encodeChunkIndices regenerates chunks idxs of f from its full contents,
+// producing the same bytes encodeChunks did when f was written.
+func encodeChunkIndices(f *meta.File, data []byte, idxs []int) ([][]byte, error) {
+	need := int(f.DataChunks)
+	for _, idx := range idxs {
+		if idx < 0 || idx >= len(f.Locations) {
+			return nil, fmt.Errorf("chunk index %v out of range", idx)
+		}
+	}
+
+	out := make([][]byte, len(idxs))
+	switch f.Codec {
+	case CodecPrime:
+		parts := splitVector(gf.MapToGFWith(data, f.MappingValue), need)
+		for i, idx := range idxs {
+			var vec []uint32
+			if idx < need {
+				vec = parts[idx]
+			} else {
+				vec = rs.CreateParity(parts, idx, nil)
+			}
+			out[i] = gf.MapFromGF(f.MappingValue, vec)
+		}
+
+	case CodecGF256:
+		parts := splitBytes(data, need)
+		for i, idx := range idxs {
+			if idx < need {
+				out[i] = parts[idx]
+			} else {
+				out[i] = rs.CreateParity256(parts, idx, nil)
+			}
+		}
+
+	case CodecLRC:
+		layout := lrcLayoutFor(f)
+		if !layout.valid() {
+			return nil, ErrUnknownCodec
+		}
+
+		parts := splitBytes(data, need)
+		for i, idx := range idxs {
+			g := layout.groupOf(idx)
+			switch {
+			case idx < need:
+				out[i] = parts[idx]
+			case g == -1:
+				out[i] = rs.CreateParity256(parts, idx, nil)
+			default:
+				members := layout.members(g)
+				group := make([][]byte, 0, len(members)-1)
+				for _, member := range members[:len(members)-1] {
+					group = append(group, parts[member])
+				}
+				out[i] = xorChunks(group)
+			}
+		}
+
+	default:
+		return nil, ErrUnknownCodec
+	}
+
+	return out, nil
+}
+
+// canDecode reports whether decodeChunks could reassemble f from the chunks
+// marked in have, which has one entry per location in f.
+func canDecode(f *meta.File, have []bool) bool {
+	if f.Codec != CodecLRC {
+		count := 0
+		for _, h := range have {
+			if h {
+				count++
+			}
+		}
+		return count >= int(f.DataChunks)
+	}
+
+	layout := lrcLayoutFor(f)
+	if !layout.valid() {
+		return false
+	}
+
+	return layout.usable(have) >= layout.need
+}
+
+// usable returns how many of the need independent chunks a decode requires can
+// be had from the chunks marked in have. Each global parity chunk counts, and
+// so does each data chunk; a group's local parity stands in for one missing
+// data chunk of its group.
+func (l lrcLayout) usable(have []bool) int {
+	count := 0
+	for i := l.need; i < l.need+l.global(); i++ {
+		if have[i] {
+			count++
+		}
+	}
+	for g := 0; g < l.groups(); g++ {
+		data, size := l.groupData(g, have)
+		count += groupUsable(data, size, have[l.need+l.global()+g])
+	}
+	return count
+}
+
+// groupData returns how many data chunks of group g are marked in have, and how
+// many data chunks the group has.
+func (l lrcLayout) groupData(g int, have []bool) (data, size int) {
+	for i := g * l.group; i < (g+1)*l.group && i < l.need; i++ {
+		size++
+		if have[i] {
+			data++
+		}
+	}
+	return data, size
+}
+
+func groupUsable(data, size int, local bool) int {
+	if local && data == size-1 {
+		return size
+	}
+	return data
+}
+
+// decodeMargin returns how many more of the chunks marked in have can be lost,
+// in the worst case, before canDecode fails. If it fails already, it returns
+// minus the number of chunks that would have to come back first.
+func decodeMargin(f *meta.File, have []bool) int {
+	if f.Codec != CodecLRC {
+		count := 0
+		for _, h := range have {
+			if h {
+				count++
+			}
+		}
+		return count - int(f.DataChunks)
+	}
+
+	layout := lrcLayoutFor(f)
+	if !layout.valid() {
+		return -len(have)
+	}
+
+	if canDecode(f, have) {
+		return layout.flipsToChangeDecode(have, true) - 1
+	}
+	n := layout.flipsToChangeDecode(have, false)
+	if n < 0 {
+		return -len(have)
+	}
+	return -n
+}
+
+// flipsToChangeDecode returns the fewest chunks that must be lost (if lose is
+// set) or recovered (if not) to change whether usable reaches need, or -1 if no
+// number will.
+//
+// Which chunks are lost matters with local groups, so this finds, for the
+// global parity and for each group separately, how far each number of flips
+// there can move usable, then combines the groups like a knapsack.
+func (l lrcLayout) flipsToChangeDecode(have []bool, lose bool) int {
+	count := l.usable(have)
+	want := l.need - count // how far usable must rise
+	if lose {
+		want = count - l.need + 1 // how far usable must fall
+	}
+	if want <= 0 {
+		return 0
+	}
+
+	const unreachable = int(^uint(0) >> 1)
+
+	// best[r] is the fewest flips moving usable by at least r, capped at want
+	best := make([]int, want+1)
+	for r := 1; r <= want; r++ {
+		best[r] = unreachable
+	}
+
+	combine := func(moves []int) {
+		next := append([]int(nil), best...)
+		for r, flips := range best {
+			if flips == unreachable {
+				continue
+			}
+			for n := 1; n < len(moves); n++ {
+				to := r + moves[n]
+				if to > want {
+					to = want
+				}
+				if to >= 0 && flips+n < next[to] {
+					next[to] = flips + n
+				}
+			}
+		}
+		best = next
+	}
+
+	// moves[n] is the most usable can move by flipping n chunks of one part
+	var globalMoves []int
+	for i := l.need; i < l.need+l.global(); i++ {
+		if have[i] == lose {
+			globalMoves = append(globalMoves, len(globalMoves))
+		}
+	}
+	combine(append(globalMoves, len(globalMoves)))
+
+	for g := 0; g < l.groups(); g++ {
+		data, size := l.groupData(g, have)
+		local := have[l.need+l.global()+g]
+		was := groupUsable(data, size, local)
+
+		dataFlips := size - data
+		if lose {
+			dataFlips = data
+		}
+		localFlips := 0
+		if local == lose {
+			localFlips = 1
+		}
+
+		moves := make([]int, dataFlips+localFlips+1)
+		for i := range moves {
+			moves[i] = -size - 1
+		}
+		for x := 0; x <= dataFlips; x++ {
+			for y := 0; y <= localFlips; y++ {
+				newData, newLocal := data+x, local
+				if lose {
+					newData = data - x
+				}
+				if y == 1 {
+					newLocal = !local
+				}
+
+				moved := groupUsable(newData, size, newLocal) - was
+				if lose {
+					moved = -moved
+				}
+				if moved > moves[x+y] {
+					moves[x+y] = moved
+				}
+			}
+		}
+		combine(moves)
+	}
+
+	if best[want] == unreachable {
+		return -1
+	}
+	return best[want]
+}
+
+// decodeChunks reassembles the contents of f from its chunks. chunkData must
+// have one entry per location in f, with unavailable chunks set to nil.
+func decodeChunks(f *meta.File, chunkData [][]byte) ([]byte, error) {
+	rawDataAvailable := f.MappingValue == 0
+	if rawDataAvailable {
+		for i := 0; i < int(f.DataChunks); i++ {
+			if chunkData[i] == nil {
+				rawDataAvailable = false
+				break
+			}
+		}
+	}
+
+	data := make([]byte, 0, int(f.Size)+16)
+	if rawDataAvailable {
+		// fast path:
+		// - chunkData[0..f.DataChunks-1] are non-nil
+		// - f.MappingValue == 0 (always true for CodecGF256)
+
+		// TODO: fast path when f.MappingValue != 0
+		for i := 0; i < int(f.DataChunks); i++ {
+			data = append(data, chunkData[i]...)
+		}
+		if len(data) < int(f.Size) {
+			return nil, ErrInsufficientChunks
+		}
+		return data[:int(f.Size)], nil
+	}
+
+	// slow path: full reconstruction
+
+	switch f.Codec {
+	case CodecPrime:
+		indicies := make([]int, 0, len(chunkData))
+		chunks := make([][]uint32, 0, len(chunkData))
+		for i, data := range chunkData {
+			if data == nil {
+				continue
+			}
+			chunk := gf.MapToGFWith(data, f.MappingValue)
+
+			indicies = append(indicies, i)
+			chunks = append(chunks, chunk)
+		}
+
+		if len(chunks) < int(f.DataChunks) {
+			return nil, ErrInsufficientChunks
+		}
+
+		chunks = chunks[:int(f.DataChunks)]
+		indicies = indicies[:int(f.DataChunks)]
+
+		dataVecs := rs.RecoverData(chunks, indicies)
+		for _, vec := range dataVecs {
+			data = append(data, gf.MapFromGF(f.MappingValue, vec)...)
+		}
+
+	case CodecGF256:
+		indicies := make([]int, 0, len(chunkData))
+		chunks := make([][]byte, 0, len(chunkData))
+		for i, data := range chunkData {
+			if data == nil {
+				continue
+			}
+			if len(chunks) > 0 && len(data) != len(chunks[0]) {
+				return nil, ErrBadChunkLength
+			}
+
+			indicies = append(indicies, i)
+			chunks = append(chunks, data)
+		}
+
+		if len(chunks) < int(f.DataChunks) {
+			return nil, ErrInsufficientChunks
+		}
+
+		chunks = chunks[:int(f.DataChunks)]
+		indicies = indicies[:int(f.DataChunks)]
+
+		for _, vec := range rs.RecoverData256(chunks, indicies) {
+			data = append(data, vec...)
+		}
+
+	case CodecLRC:
+		layout := lrcLayoutFor(f)
+		if !layout.valid() {
+			return nil, ErrUnknownCodec
+		}
+
+		chunkLen := -1
+		for _, data := range chunkData {
+			if data == nil {
+				continue
+			}
+			if chunkLen != -1 && len(data) != chunkLen {
+				return nil, ErrBadChunkLength
+			}
+			chunkLen = len(data)
+		}
+
+		// Fill in what we can from the local groups first; they're cheap.
+		chunkData = append([][]byte(nil), chunkData...)
+		for g := 0; g < layout.groups(); g++ {
+			missing := -1
+			var have [][]byte
+			for _, idx := range layout.members(g) {
+				if chunkData[idx] == nil {
+					if missing != -1 {
+						missing = -2
+						break
+					}
+					missing = idx
+				} else {
+					have = append(have, chunkData[idx])
+				}
+			}
+			if missing >= 0 && missing < layout.need {
+				chunkData[missing] = xorChunks(have)
+			}
+		}
+
+		// Then use the global parity for anything left.
+		indicies := make([]int, 0, layout.need)
+		chunks := make([][]byte, 0, layout.need)
+		for i := 0; i < layout.need+layout.global() && len(chunks) < layout.need; i++ {
+			if chunkData[i] != nil {
+				indicies = append(indicies, i)
+				chunks = append(chunks, chunkData[i])
+			}
+		}
+
+		if len(chunks) < layout.need {
+			return nil, ErrInsufficientChunks
+		}
+
+		if indicies[layout.need-1] == layout.need-1 {
+			// every data chunk is present now
+			for _, vec := range chunks {
+				data = append(data, vec...)
+			}
+		} else {
+			for _, vec := range rs.RecoverData256(chunks, indicies) {
+				data = append(data, vec...)
+			}
+		}
+
+	default:
+		return nil, ErrUnknownCodec
+	}
+
+	if len(data) < int(f.Size) {
+		return nil, ErrInsufficientChunks
+	}
+	return data[:int(f.Size)], nil
+}
+
+func splitVector(data []uint32, count int) [][]uint32 {
+	perVector := (len(data) + count - 1) / count
+
+	parts := make([][]uint32, count)
+	for i := range parts {
+		if len(data) >= perVector {
+			parts[i] = data[:perVector]
+			data = data[perVector:]
+		} else {
+			n := make([]uint32, perVector)
+			copy(n, data)
+			parts[i] = n
+			data = nil
+		}
+	}
+
+	if len(data) > 0 {
+		panic("splitVector has leftovers")
+	}
+
+	// pad the last with zeroes if needed
+	if len(parts[len(parts)-1]) != perVector {
+		n := make([]uint32, perVector)
+		copy(n, parts[len(parts)-1])
+		parts[len(parts)-1] = n
+	}
+
+	return parts
+}
+
+// splitBytes splits data into count slices of equal length, padding the last
+// ones with zeroes as needed. Each slice is a copy, so that the caller may
+// append parity chunks to the returned slice.
+func splitBytes(data []byte, count int) [][]byte {
+	perChunk := (len(data) + count - 1) / count
+
+	underlying := make([]byte, perChunk*count)
+	copy(underlying, data)
+
+	parts := make([][]byte, count, count*2)
+	for i := range parts {
+		parts[i] = underlying[i*perChunk : (i+1)*perChunk]
+	}
+
+	return parts
+}
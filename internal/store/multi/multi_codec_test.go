@@ -0,0 +1,265 @@
+package multi
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/encryptio/slime/internal/meta"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		Codec       uint8
+		Need, Total int
+		LocalGroup  int
+	}{
+		{CodecPrime, 3, 5, 0},
+		{CodecGF256, 3, 5, 0},
+		{CodecGF256, 10, 14, 0},
+		{CodecLRC, 4, 8, 2},
+		{CodecLRC, 5, 9, 3},
+		{CodecLRC, 10, 14, 5},
+	}
+
+	for _, test := range tests {
+		for _, size := range []int{0, 1, 17, 1000} {
+			data := randomValue(size)
+			mapping, chunks := encodeChunks(test.Codec, data, test.Need, test.Total, test.LocalGroup)
+			if len(chunks) != test.Total {
+				t.Fatalf("encodeChunks(%v, %v of %v) made %v chunks",
+					CodecName(test.Codec), test.Need, test.Total, len(chunks))
+			}
+
+			f := &meta.File{
+				Size:         uint64(size),
+				DataChunks:   uint16(test.Need),
+				MappingValue: mapping,
+				Codec:        test.Codec,
+				LocalGroup:   uint16(test.LocalGroup),
+				Locations:    make([][16]byte, test.Total),
+			}
+
+			// Every pair of missing chunks must be recoverable.
+			for i := 0; i < test.Total; i++ {
+				for j := i; j < test.Total; j++ {
+					chunkData := make([][]byte, len(chunks))
+					copy(chunkData, chunks)
+					chunkData[i] = nil
+					chunkData[j] = nil
+
+					got, err := decodeChunks(f, chunkData)
+					if err != nil {
+						t.Errorf("%v %v of %v, size %v: couldn't decode without chunks %v and %v: %v",
+							CodecName(test.Codec), test.Need, test.Total, size, i, j, err)
+						continue
+					}
+					if !bytes.Equal(got, data) {
+						t.Errorf("%v %v of %v: decode without chunks %v and %v returned wrong data",
+							CodecName(test.Codec), test.Need, test.Total, i, j)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCodecLRCLocalParity(t *testing.T) {
+	layout := lrcLayout{need: 5, total: 9, group: 2}
+	if layout.groups() != 3 || layout.global() != 1 {
+		t.Fatalf("layout has %v groups and %v global parity, wanted 3 and 1",
+			layout.groups(), layout.global())
+	}
+
+	_, chunks := encodeChunks(CodecLRC, randomValue(1000), 5, 9, 2)
+
+	for g := 0; g < layout.groups(); g++ {
+		var group [][]byte
+		for _, idx := range layout.members(g) {
+			if layout.groupOf(idx) != g {
+				t.Errorf("chunk %v is a member of group %v, but groupOf returned %v",
+					idx, g, layout.groupOf(idx))
+			}
+			group = append(group, chunks[idx])
+		}
+
+		for _, b := range xorChunks(group) {
+			if b != 0 {
+				t.Errorf("group %v does not XOR to zero", g)
+				break
+			}
+		}
+	}
+
+	if layout.groupOf(5) != -1 {
+		t.Errorf("global parity chunk 5 is in group %v", layout.groupOf(5))
+	}
+}
+
+func TestCodecDecodeMargin(t *testing.T) {
+	tests := []struct {
+		Codec       uint8
+		Need, Total int
+		LocalGroup  int
+		Lost        []int
+		Margin      int
+	}{
+		{CodecGF256, 3, 5, 0, nil, 2},
+		{CodecGF256, 3, 5, 0, []int{0, 1, 2}, -1},
+		{CodecLRC, 4, 7, 2, nil, 1},
+		{CodecLRC, 4, 7, 2, []int{4}, 1},
+		{CodecLRC, 4, 7, 2, []int{0}, 0},
+		// both data chunks of a group; more chunks survive than are needed,
+		// but not the right ones
+		{CodecLRC, 4, 7, 2, []int{0, 1}, -1},
+	}
+
+	for _, test := range tests {
+		f := &meta.File{
+			DataChunks: uint16(test.Need),
+			Codec:      test.Codec,
+			LocalGroup: uint16(test.LocalGroup),
+			Locations:  make([][16]byte, test.Total),
+		}
+
+		have := make([]bool, test.Total)
+		for i := range have {
+			have[i] = true
+		}
+		for _, i := range test.Lost {
+			have[i] = false
+		}
+
+		margin := decodeMargin(f, have)
+		if margin != test.Margin {
+			t.Errorf("%v %v of %v without chunks %v: decodeMargin returned %v, wanted %v",
+				CodecName(test.Codec), test.Need, test.Total, test.Lost, margin, test.Margin)
+		}
+		if (margin >= 0) != canDecode(f, have) {
+			t.Errorf("%v %v of %v without chunks %v: decodeMargin returned %v, but canDecode returned %v",
+				CodecName(test.Codec), test.Need, test.Total, test.Lost, margin, canDecode(f, have))
+		}
+	}
+}
+
+// bruteForceMargin finds decodeMargin by trying every set of chunks to lose
+// or recover, in increasing size.
+func bruteForceMargin(f *meta.File, have []bool) int {
+	was := canDecode(f, have)
+
+	var candidates []int
+	for i, h := range have {
+		if h == was {
+			candidates = append(candidates, i)
+		}
+	}
+
+	trial := append([]bool(nil), have...)
+	var try func(start, left int) bool
+	try = func(start, left int) bool {
+		if left == 0 {
+			return canDecode(f, trial) != was
+		}
+		for j := start; j <= len(candidates)-left; j++ {
+			trial[candidates[j]] = !was
+			changed := try(j+1, left-1)
+			trial[candidates[j]] = was
+			if changed {
+				return true
+			}
+		}
+		return false
+	}
+
+	for n := 1; n <= len(candidates); n++ {
+		if try(0, n) {
+			if was {
+				return n - 1
+			}
+			return -n
+		}
+	}
+	return -len(have)
+}
+
+func TestCodecDecodeMarginLRC(t *testing.T) {
+	layouts := []struct{ Need, Total, LocalGroup int }{
+		{4, 7, 2},
+		{4, 8, 2},
+		{5, 9, 3},
+		{6, 9, 3},
+		{3, 6, 4},
+	}
+
+	for _, l := range layouts {
+		f := &meta.File{
+			DataChunks: uint16(l.Need),
+			Codec:      CodecLRC,
+			LocalGroup: uint16(l.LocalGroup),
+			Locations:  make([][16]byte, l.Total),
+		}
+
+		have := make([]bool, l.Total)
+		for bits := 0; bits < 1<<uint(l.Total); bits++ {
+			for i := range have {
+				have[i] = bits&(1<<uint(i)) != 0
+			}
+
+			got := decodeMargin(f, have)
+			want := bruteForceMargin(f, have)
+			if got != want {
+				t.Errorf("%v of %v (group %v) with chunks %v: decodeMargin returned %v, wanted %v",
+					l.Need, l.Total, l.LocalGroup, have, got, want)
+			}
+		}
+	}
+
+	// wide layouts must not search every set of chunks
+	f := &meta.File{
+		DataChunks: 80,
+		Codec:      CodecLRC,
+		LocalGroup: 8,
+		Locations:  make([][16]byte, 100),
+	}
+	have := make([]bool, 100)
+	for i := range have {
+		have[i] = true
+	}
+	if margin := decodeMargin(f, have); margin != 10 {
+		t.Errorf("80 of 100 (group 8) with every chunk: decodeMargin returned %v, wanted 10", margin)
+	}
+}
+
+func TestCodecEncodeChunkIndices(t *testing.T) {
+	for _, codec := range []uint8{CodecPrime, CodecGF256, CodecLRC} {
+		need, total, group := 3, 7, 0
+		if codec == CodecLRC {
+			group = 2
+		}
+
+		for _, size := range []int{0, 5, 1000} {
+			data := randomValue(size)
+			mapping, chunks := encodeChunks(codec, data, need, total, group)
+
+			f := &meta.File{
+				DataChunks:   uint16(need),
+				MappingValue: mapping,
+				Codec:        codec,
+				LocalGroup:   uint16(group),
+				Locations:    make([][16]byte, total),
+			}
+
+			idxs := []int{6, 0, 4, 3}
+			regenerated, err := encodeChunkIndices(f, data, idxs)
+			if err != nil {
+				t.Fatalf("Couldn't encodeChunkIndices: %v", err)
+			}
+
+			for i, idx := range idxs {
+				if !bytes.Equal(regenerated[i], chunks[idx]) {
+					t.Errorf("%v, size %v: regenerated chunk %v does not match original",
+						CodecName(codec), size, idx)
+				}
+			}
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package multi
 
 import (
-	"log"
+	"fmt"
 	"strconv"
 	"time"
 
+	"github.com/encryptio/slime/internal/events"
+	"github.com/encryptio/slime/internal/logging"
 	"github.com/encryptio/slime/internal/meta"
 	"github.com/encryptio/slime/internal/uuid"
 
@@ -24,24 +26,105 @@ func (e BadConfigError) Error() string {
 type multiConfig struct {
 	Need  int
 	Total int
+
+	// Codec is the codec used for new writes. If MigrateCodec is set, the
+	// scrubber rewrites files stored with any other codec.
+	Codec        uint8
+	MigrateCodec bool
+
+	// LocalGroup is the number of data chunks per local parity group. It is
+	// only used (and required) by CodecLRC.
+	LocalGroup int
+
+	// See DeepScrubConfig.
+	DeepScrubRate   int64
+	DeepScrubRepair bool
+
+	// See TieringConfig.
+	HotTier     string
+	ColdTier    string
+	DemoteAfter time.Duration
+
+	// See ArchiveConfig.
+	ArchiveNeed       int
+	ArchiveTotal      int
+	ArchiveCodec      uint8
+	ArchiveLocalGroup int
+	ArchiveAfter      time.Duration
+	ArchiveRate       int64
 }
 
 func checkConfig(config multiConfig) error {
-	if config.Need <= 0 {
+	err := checkLayout(config.Need, config.Total, config.Codec, config.LocalGroup)
+	if err != nil {
+		return err
+	}
+
+	if config.ArchiveAfter < 0 {
+		return BadConfigError("archive after is negative")
+	}
+	if config.ArchiveRate < 0 {
+		return BadConfigError("archive rate is negative")
+	}
+	if config.ArchiveAfter > 0 {
+		err = checkLayout(config.ArchiveNeed, config.ArchiveTotal,
+			config.ArchiveCodec, config.ArchiveLocalGroup)
+		if err != nil {
+			return BadConfigError("archive layout: " + string(err.(BadConfigError)))
+		}
+	}
+
+	return nil
+}
+
+func checkLayout(need, total int, codec uint8, localGroup int) error {
+	if need <= 0 {
 		return BadConfigError("need is non-positive")
 	}
-	if config.Total <= 0 {
+	if total <= 0 {
 		return BadConfigError("total is non-positive")
 	}
-	if config.Need > config.Total {
+	if need > total {
 		return BadConfigError("need is greater than total")
 	}
-	if config.Total > 100 {
+	if total > 100 {
 		return BadConfigError("total is too large")
 	}
+	if _, ok := codecNames[codec]; !ok {
+		return BadConfigError("unknown codec")
+	}
+	if codec == CodecLRC {
+		if localGroup <= 0 {
+			return BadConfigError("lrc codec requires a positive local group size")
+		}
+		if localGroup > need {
+			return BadConfigError("local group size is greater than need")
+		}
+		layout := lrcLayout{need, total, localGroup}
+		if !layout.valid() {
+			return BadConfigError("total is too small to hold the local parity chunks")
+		}
+	} else if localGroup != 0 {
+		return BadConfigError("local group size is only used by the lrc codec")
+	}
 	return nil
 }
 
+// Layout describes how new files are split into chunks.
+type Layout struct {
+	Need  int
+	Total int
+
+	Codec        uint8
+	MigrateCodec bool
+
+	// LocalGroup is the number of data chunks per local parity group when
+	// Codec is CodecLRC, and zero otherwise.
+	LocalGroup int
+}
+
+// GetRedundancy returns the number of chunks new writes are split into, and
+// how many of them are needed to read the file back.
 func (m *Multi) GetRedundancy() (need, total int) {
 	m.mu.Lock()
 	need = m.config.Need
@@ -50,13 +133,70 @@ func (m *Multi) GetRedundancy() (need, total int) {
 	return
 }
 
+// SetRedundancy changes the number of chunks new writes use, keeping the rest
+// of the layout. To change the codec along with it, use SetLayout, which
+// stores the whole layout in one transaction.
 func (m *Multi) SetRedundancy(need, total int) error {
+	l := m.GetLayout()
+	l.Need = need
+	l.Total = total
+	return m.SetLayout(l, nil)
+}
+
+// GetCodec returns the codec used for new writes, and whether existing files
+// are being migrated to it.
+func (m *Multi) GetCodec() (codec uint8, migrate bool) {
+	m.mu.Lock()
+	codec = m.config.Codec
+	migrate = m.config.MigrateCodec
+	m.mu.Unlock()
+	return
+}
+
+// SetCodec changes the codec used for new writes. If migrate is true, the
+// scrubber will also rewrite existing files that use a different codec.
+//
+// Switching to CodecLRC requires a local group size; use SetLayout for that.
+func (m *Multi) SetCodec(codec uint8, migrate bool) error {
+	l := m.GetLayout()
+	l.Codec = codec
+	l.MigrateCodec = migrate
+	if codec != CodecLRC {
+		l.LocalGroup = 0
+	}
+	return m.SetLayout(l, nil)
+}
+
+// GetLayout returns the full layout used for new writes.
+func (m *Multi) GetLayout() Layout {
 	m.mu.Lock()
 	conf := m.config
 	m.mu.Unlock()
 
-	conf.Need = need
-	conf.Total = total
+	return Layout{
+		Need:         conf.Need,
+		Total:        conf.Total,
+		Codec:        conf.Codec,
+		MigrateCodec: conf.MigrateCodec,
+		LocalGroup:   conf.LocalGroup,
+	}
+}
+
+// SetLayout changes every part of the layout at once. Use this rather than a
+// series of SetRedundancy and SetCodec calls when moving between layouts that
+// aren't valid halfway through, such as to or from CodecLRC.
+//
+// If audit is not nil, it is added to the audit log in the same transaction.
+func (m *Multi) SetLayout(l Layout, audit *meta.AuditEntry) error {
+	m.mu.Lock()
+	conf := m.config
+	m.mu.Unlock()
+
+	conf.Need = l.Need
+	conf.Total = l.Total
+	conf.Codec = l.Codec
+	conf.MigrateCodec = l.MigrateCodec
+	conf.LocalGroup = l.LocalGroup
 
 	err := checkConfig(conf)
 	if err != nil {
@@ -77,17 +217,57 @@ func (m *Multi) SetRedundancy(need, total int) error {
 		if err != nil {
 			return err
 		}
+		err = layer.SetConfig("codec", strconv.AppendInt(nil, int64(conf.Codec), 10))
+		if err != nil {
+			return err
+		}
+		err = layer.SetConfig("codec-migrate", strconv.AppendBool(nil, conf.MigrateCodec))
+		if err != nil {
+			return err
+		}
+		err = layer.SetConfig("local-group", strconv.AppendInt(nil, int64(conf.LocalGroup), 10))
+		if err != nil {
+			return err
+		}
 
-		return nil
+		return addAudit(layer, audit)
 	})
+	if err != nil {
+		return err
+	}
 
 	m.mu.Lock()
+	old := m.config
 	m.config = conf
 	m.mu.Unlock()
 
+	if old.Need != conf.Need || old.Total != conf.Total || old.Codec != conf.Codec ||
+		old.LocalGroup != conf.LocalGroup {
+		m.emit(events.Event{
+			Type: events.RedundancyChanged,
+			Message: fmt.Sprintf("redundancy changed from %v of %v (%v) to %v of %v (%v)",
+				old.Need, old.Total, CodecName(old.Codec),
+				conf.Need, conf.Total, CodecName(conf.Codec)),
+			Details: map[string]interface{}{
+				"need":        conf.Need,
+				"total":       conf.Total,
+				"codec":       CodecName(conf.Codec),
+				"local_group": conf.LocalGroup,
+			},
+		})
+	}
+
 	return nil
 }
 
+// addAudit adds e to the audit log, if it is not nil.
+func addAudit(layer *meta.Layer, e *meta.AuditEntry) error {
+	if e == nil {
+		return nil
+	}
+	return layer.AddAuditEntry(*e)
+}
+
 func (m *Multi) loadUUID() error {
 	var id []byte
 	err := m.db.RunTx(func(ctx kvl.Ctx) error {
@@ -157,6 +337,59 @@ func (m *Multi) loadConfig() error {
 		}
 		conf.Total = int(total)
 
+		codecBytes, err := layer.GetConfig("codec")
+		if err != nil {
+			return err
+		}
+		if codecBytes == nil {
+			codecBytes = strconv.AppendInt(nil, int64(DefaultCodec), 10)
+		}
+		codec, err := strconv.ParseUint(string(codecBytes), 10, 8)
+		if err != nil {
+			return err
+		}
+		conf.Codec = uint8(codec)
+
+		migrateBytes, err := layer.GetConfig("codec-migrate")
+		if err != nil {
+			return err
+		}
+		conf.MigrateCodec = false
+		if migrateBytes != nil {
+			conf.MigrateCodec, err = strconv.ParseBool(string(migrateBytes))
+			if err != nil {
+				return err
+			}
+		}
+
+		localGroupBytes, err := layer.GetConfig("local-group")
+		if err != nil {
+			return err
+		}
+		conf.LocalGroup = 0
+		if localGroupBytes != nil {
+			localGroup, err := strconv.ParseInt(string(localGroupBytes), 10, 0)
+			if err != nil {
+				return err
+			}
+			conf.LocalGroup = int(localGroup)
+		}
+
+		err = loadDeepScrubConfig(layer, &conf)
+		if err != nil {
+			return err
+		}
+
+		err = loadTieringConfig(layer, &conf)
+		if err != nil {
+			return err
+		}
+
+		err = loadArchiveConfig(layer, &conf)
+		if err != nil {
+			return err
+		}
+
 		err = checkConfig(conf)
 		if err != nil {
 			return err
@@ -179,7 +412,7 @@ func (m *Multi) loadConfigLoop() error {
 		case <-time.After(jitterDuration(loadConfigInterval)):
 			err := m.loadConfig()
 			if err != nil {
-				log.Printf("Couldn't load config: %v", err)
+				logging.Errorf("Couldn't load config: %v", err)
 			}
 		}
 	}
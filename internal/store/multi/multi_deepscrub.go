@@ -0,0 +1,357 @@
+package multi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/encryptio/slime/internal/events"
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/meta"
+	"github.com/encryptio/slime/internal/store"
+
+	"github.com/encryptio/kvl"
+)
+
+var (
+	deepScrubIdleWait = time.Minute
+	deepScrubCount    = 20
+)
+
+// DeepScrubConfig controls the deep scrubber, which reads every chunk of every
+// file and checks that the parity chunks agree with the data chunks.
+type DeepScrubConfig struct {
+	// Rate is the number of chunk bytes each proxy reads per second. Zero
+	// disables the deep scrubber.
+	Rate int64
+
+	// If Repair is true, chunks found inconsistent are rewritten. Otherwise
+	// they are only logged and counted.
+	Repair bool
+}
+
+// DeepScrubStats counts the work the deep scrubber has done since the Multi
+// was created.
+type DeepScrubStats struct {
+	// The path of the last file checked, shared between all proxies.
+	Position string
+
+	Files        int64
+	Bytes        int64
+	Inconsistent int64 // files with at least one inconsistent chunk
+	Repaired     int64
+}
+
+type deepScrubState struct {
+	mu    sync.Mutex
+	stats DeepScrubStats
+}
+
+// GetDeepScrub returns the deep scrubber configuration.
+func (m *Multi) GetDeepScrub() DeepScrubConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return DeepScrubConfig{
+		Rate:   m.config.DeepScrubRate,
+		Repair: m.config.DeepScrubRepair,
+	}
+}
+
+// SetDeepScrub changes the deep scrubber configuration for all proxies. If
+// audit is not nil, it is added to the audit log in the same transaction.
+func (m *Multi) SetDeepScrub(c DeepScrubConfig, audit *meta.AuditEntry) error {
+	if c.Rate < 0 {
+		return BadConfigError("deep scrub rate is negative")
+	}
+
+	err := m.db.RunTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = layer.SetConfig("deepscrub-rate", strconv.AppendInt(nil, c.Rate, 10))
+		if err != nil {
+			return err
+		}
+		err = layer.SetConfig("deepscrub-repair", strconv.AppendBool(nil, c.Repair))
+		if err != nil {
+			return err
+		}
+		return addAudit(layer, audit)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.config.DeepScrubRate = c.Rate
+	m.config.DeepScrubRepair = c.Repair
+	m.mu.Unlock()
+
+	return nil
+}
+
+// DeepScrubStats returns counters for the deep scrubber on this proxy.
+func (m *Multi) DeepScrubStats() DeepScrubStats {
+	m.deepScrub.mu.Lock()
+	defer m.deepScrub.mu.Unlock()
+	return m.deepScrub.stats
+}
+
+func loadDeepScrubConfig(layer *meta.Layer, conf *multiConfig) error {
+	rateBytes, err := layer.GetConfig("deepscrub-rate")
+	if err != nil {
+		return err
+	}
+	conf.DeepScrubRate = 0
+	if rateBytes != nil {
+		conf.DeepScrubRate, err = strconv.ParseInt(string(rateBytes), 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+
+	repairBytes, err := layer.GetConfig("deepscrub-repair")
+	if err != nil {
+		return err
+	}
+	conf.DeepScrubRepair = false
+	if repairBytes != nil {
+		conf.DeepScrubRepair, err = strconv.ParseBool(string(repairBytes))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Multi) deepScrubLoop() error {
+	for {
+		conf := m.GetDeepScrub()
+		if conf.Rate <= 0 {
+			select {
+			case <-m.tomb.Dying():
+				return nil
+			case <-time.After(jitterDuration(deepScrubIdleWait)):
+				continue
+			}
+		}
+
+		files, err := m.deepScrubNextFiles()
+		if err != nil {
+			logging.Errorf("Couldn't get files to deep scrub: %v", err)
+		}
+
+		if len(files) == 0 {
+			select {
+			case <-m.tomb.Dying():
+				return nil
+			case <-time.After(jitterDuration(deepScrubIdleWait)):
+			}
+			continue
+		}
+
+		for i := range files {
+			read := m.deepScrubFile(&files[i])
+
+			// rate may have changed since the last file
+			m.setSharedRate(&m.limiters.deepScrub, m.GetDeepScrub().Rate)
+			m.throttle(&m.limiters.deepScrub, 1, read)
+
+			select {
+			case <-m.tomb.Dying():
+				return nil
+			default:
+			}
+		}
+	}
+}
+
+// deepScrubNextFiles returns the next batch of files to deep scrub, and moves
+// the shared position past them. It returns no files when it wraps around to
+// the beginning.
+func (m *Multi) deepScrubNextFiles() ([]meta.File, error) {
+	var files []meta.File
+	err := m.db.RunTx(func(ctx kvl.Ctx) error {
+		files = nil
+
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		startKey, err := layer.GetConfig("deepscrubpos")
+		if err != nil {
+			return err
+		}
+
+		files, err = layer.ListFiles(string(startKey), deepScrubCount)
+		if err != nil {
+			return err
+		}
+
+		var pos []byte
+		if len(files) > 0 {
+			pos = []byte(files[len(files)-1].Path)
+		}
+		return layer.SetConfig("deepscrubpos", pos)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) > 0 {
+		m.deepScrub.mu.Lock()
+		m.deepScrub.stats.Position = files[len(files)-1].Path
+		m.deepScrub.mu.Unlock()
+	}
+
+	return files, nil
+}
+
+// deepScrubAll deep scrubs every file once, ignoring the rate. Used in tests.
+func (m *Multi) deepScrubAll() {
+	m.db.RunTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+		return layer.SetConfig("deepscrubpos", nil)
+	})
+
+	for {
+		files, err := m.deepScrubNextFiles()
+		if err != nil {
+			logging.Errorf("Couldn't get files to deep scrub: %v", err)
+			return
+		}
+		if len(files) == 0 {
+			return
+		}
+		for i := range files {
+			m.deepScrubFile(&files[i])
+		}
+	}
+}
+
+// deepScrubFile reads every chunk of f, and checks that they all agree with
+// the file's contents. It returns the number of chunk bytes read.
+func (m *Multi) deepScrubFile(f *meta.File) int64 {
+	chunkData := make([][]byte, len(f.Locations))
+	var have []int
+	var read int64
+	for i, id := range f.Locations {
+		st := m.finder.StoreFor(id)
+		if st == nil {
+			// missing chunks are the location scrubber's job
+			continue
+		}
+
+		data, _, err := st.Get(localKeyFor(f, i), store.GetOptions{})
+		if err != nil {
+			continue
+		}
+
+		chunkData[i] = data
+		have = append(have, i)
+		read += int64(len(data))
+	}
+
+	bad, err := findInconsistentChunks(f, chunkData, have)
+
+	m.deepScrub.mu.Lock()
+	m.deepScrub.stats.Files++
+	m.deepScrub.stats.Bytes += read
+	if len(bad) > 0 || err != nil {
+		m.deepScrub.stats.Inconsistent++
+	}
+	m.deepScrub.mu.Unlock()
+
+	if err != nil {
+		logging.Errorf("deep scrub on %v: %v", f.Path, err)
+		return read
+	}
+	if len(bad) == 0 {
+		return read
+	}
+
+	logging.Warnf("deep scrub on %v: chunks %v are inconsistent with the rest", f.Path, bad)
+
+	m.emit(events.Event{
+		Type:    events.CorruptionFound,
+		Message: fmt.Sprintf("deep scrub found chunks %v of %v inconsistent with the rest", bad, f.Path),
+		Path:    f.Path,
+		Details: map[string]interface{}{"chunks": bad},
+	})
+
+	if !m.GetDeepScrub().Repair {
+		return read
+	}
+
+	err = m.repairOrRebuild(f.Path, f.PrefixID, bad)
+	if err != nil {
+		logging.Errorf("deep scrub on %v: couldn't repair: %v", f.Path, err)
+		return read
+	}
+
+	m.deepScrub.mu.Lock()
+	m.deepScrub.stats.Repaired++
+	m.deepScrub.mu.Unlock()
+
+	log.Printf("deep scrub on %v: successfully repaired", f.Path)
+
+	return read
+}
+
+// findInconsistentChunks returns the indices of the chunks in chunkData that
+// don't match what f's codec would produce for its contents. have lists the
+// indices of the chunks that were read; the others are nil and not checked.
+//
+// If the chunks don't decode to the file's SHA256, each chunk in turn is left
+// out to find a single bad one. ErrBadHash is returned if that fails.
+func findInconsistentChunks(f *meta.File, chunkData [][]byte, have []int) ([]int, error) {
+	data, err := decodeChunks(f, chunkData)
+	if err == ErrInsufficientChunks {
+		// can't check anything; the location scrubber will rebuild it
+		return nil, nil
+	}
+
+	if err != nil || sha256.Sum256(data) != f.SHA256 {
+		data = nil
+		for _, skip := range have {
+			without := make([][]byte, len(chunkData))
+			copy(without, chunkData)
+			without[skip] = nil
+
+			d, err := decodeChunks(f, without)
+			if err == nil && sha256.Sum256(d) == f.SHA256 {
+				data = d
+				break
+			}
+		}
+
+		if data == nil {
+			return nil, ErrBadHash
+		}
+	}
+
+	expected, err := encodeChunkIndices(f, data, have)
+	if err != nil {
+		return nil, err
+	}
+
+	var bad []int
+	for i, idx := range have {
+		if !bytes.Equal(expected[i], chunkData[idx]) {
+			bad = append(bad, idx)
+		}
+	}
+
+	return bad, nil
+}
@@ -0,0 +1,194 @@
+package multi
+
+import (
+	"log"
+	"time"
+
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/meta"
+	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/uuid"
+
+	"github.com/encryptio/kvl"
+)
+
+var drainWait = time.Second * 30
+
+const drainFileCount = 20
+
+func (m *Multi) drainLoop() error {
+	for {
+		select {
+		case <-m.tomb.Dying():
+			return nil
+		case <-time.After(jitterDuration(drainWait)):
+		}
+
+		// keep going without waiting while there's work to do
+		for m.drainStep(m.tomb.Dying()) > 0 {
+			select {
+			case <-m.tomb.Dying():
+				return nil
+			default:
+			}
+		}
+	}
+}
+
+// drainStep moves chunks off of every online store marked as draining, up to
+// drainFileCount files per store, keeping under each location's DrainRate.
+// It returns the number of chunks moved; it stops early if dying is closed.
+func (m *Multi) drainStep(dying <-chan struct{}) int {
+	finderEntries := m.finder.Stores()
+
+	locs := make(map[[16]byte]meta.Location)
+	err := m.db.RunReadTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		all, err := layer.AllLocations()
+		if err != nil {
+			return err
+		}
+
+		for _, loc := range all {
+			locs[loc.UUID] = loc
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Errorf("Couldn't get locations to drain: %v", err)
+		return 0
+	}
+
+	moved := 0
+	for id := range finderEntries {
+		loc, ok := locs[id]
+		if !ok || loc.Dead || loc.Mode != meta.LocationDraining {
+			continue
+		}
+
+		var files []meta.File
+		err := m.db.RunReadTx(func(ctx kvl.Ctx) error {
+			layer, err := meta.Open(ctx)
+			if err != nil {
+				return err
+			}
+
+			files, err = layer.GetFilesByLocation(id, drainFileCount)
+			return err
+		})
+		if err != nil {
+			logging.Errorf("Couldn't get files to drain from %v: %v", uuid.Fmt(id), err)
+			continue
+		}
+
+		for _, f := range files {
+			size, err := m.drainFile(f, id, locs, finderEntries)
+			if err != nil {
+				logging.Errorf("Couldn't drain %v from %v: %v", f.Path, uuid.Fmt(id), err)
+				continue
+			}
+			if size == 0 {
+				continue
+			}
+			moved++
+
+			var wait time.Duration
+			if loc.DrainRate > 0 {
+				wait = time.Duration(float64(size) / float64(loc.DrainRate) * float64(time.Second))
+			}
+
+			select {
+			case <-dying:
+				return moved
+			case <-time.After(wait):
+			}
+		}
+	}
+
+	if moved > 0 {
+		log.Printf("Drained %v chunks", moved)
+	}
+
+	return moved
+}
+
+// drainFile moves the chunk of f on the store with the given id to the
+// writable store with the most room that holds no other chunk of f, preferring
+// stores outside the failure domains of the rest of its local group. It returns
+// the size of the chunk moved, or zero if f has no chunk on the store.
+func (m *Multi) drainFile(f meta.File, id [16]byte, locs map[[16]byte]meta.Location, finderEntries map[[16]byte]FinderEntry) (int64, error) {
+	idx := -1
+	for i, locid := range f.Locations {
+		if locid == id {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return 0, nil
+	}
+
+	// Prefer targets outside the failure domains that hold the rest of the
+	// chunk's local group, but drain regardless if there are none.
+	avoid := groupDomains(&f, idx, locs)
+
+	var target FinderEntry
+	var targetScore int64
+	var targetAvoided bool
+	found := false
+	for tid, fe := range finderEntries {
+		loc, ok := locs[tid]
+		if !ok || !loc.Writable() || loc.Tier != f.Tier {
+			continue
+		}
+
+		score := placementScore(loc, fe)
+		if score <= 0 {
+			continue
+		}
+
+		used := false
+		for _, locid := range f.Locations {
+			if locid == tid {
+				used = true
+				break
+			}
+		}
+		if used {
+			continue
+		}
+
+		avoided := avoid[failureDomain(loc)]
+		if !found || (targetAvoided && !avoided) ||
+			(targetAvoided == avoided && targetScore < score) {
+			target = fe
+			targetScore = score
+			targetAvoided = avoided
+			found = true
+		}
+	}
+
+	if !found {
+		return 0, store.ErrFull
+	}
+
+	size, err := m.moveChunk(f, idx, finderEntries[id].Store, target.Store)
+	if err != nil {
+		return 0, err
+	}
+
+	fe := finderEntries[id]
+	fe.Free += size
+	finderEntries[id] = fe
+
+	tid := target.Store.UUID()
+	fe = finderEntries[tid]
+	fe.Free -= size
+	finderEntries[tid] = fe
+
+	return size, nil
+}
@@ -0,0 +1,217 @@
+package multi
+
+import (
+	"sync"
+	"time"
+
+	"github.com/encryptio/slime/internal/meta"
+
+	"github.com/encryptio/kvl"
+)
+
+var (
+	healthBatch           = 1000
+	healthUnreadableLimit = 100
+)
+
+const repairMeterMinutes = 10
+
+// HealthReport describes how close the data in a Multi is to being lost.
+//
+// Only files with chunks on unavailable (offline or dead) locations are
+// examined, using the index of chunks on each location; every other file has
+// all of its chunks available.
+type HealthReport struct {
+	Locations int // known locations
+	Online    int // locations whose stores are connected, and not dead
+	Offline   int // locations that are not dead, but not connected
+	Dead      int // locations marked dead
+
+	// Margins counts the files with chunks on unavailable locations by how
+	// many more chunks each can lose, in the worst case, before it can't be
+	// read. Negative margins are files that can't be read right now.
+	Margins map[int]int64
+
+	// Unreadable is the number of files whose available chunks can't be
+	// decoded. UnreadablePaths holds some of their paths.
+	Unreadable      int64
+	UnreadablePaths []string
+
+	// RepairBytes is the number of chunk bytes on dead locations, which must
+	// be written elsewhere to restore full redundancy.
+	RepairBytes int64
+
+	// RepairRate is the number of chunk bytes per second this proxy has
+	// repaired or rebuilt, averaged over the last few minutes.
+	RepairRate float64
+
+	// RepairETA estimates how long repairing RepairBytes will take at
+	// RepairRate. It is zero if there is nothing to repair, or nothing has
+	// been repaired recently to estimate from.
+	RepairETA time.Duration
+}
+
+// repairMeter counts the chunk bytes written by repairs and rebuilds in each
+// of the last few minutes.
+type repairMeter struct {
+	mu      sync.Mutex
+	minutes [repairMeterMinutes]int64
+	bytes   [repairMeterMinutes]int64
+}
+
+func (r *repairMeter) add(bytes int64, now time.Time) {
+	minute := now.Unix() / 60
+	i := minute % repairMeterMinutes
+
+	r.mu.Lock()
+	if r.minutes[i] != minute {
+		r.minutes[i] = minute
+		r.bytes[i] = 0
+	}
+	r.bytes[i] += bytes
+	r.mu.Unlock()
+}
+
+// rate returns the average bytes per second over the last repairMeterMinutes
+// minutes.
+func (r *repairMeter) rate(now time.Time) float64 {
+	minute := now.Unix() / 60
+
+	var total int64
+	r.mu.Lock()
+	for i := range r.minutes {
+		if r.minutes[i] > minute-repairMeterMinutes {
+			total += r.bytes[i]
+		}
+	}
+	r.mu.Unlock()
+
+	return float64(total) / (repairMeterMinutes * 60)
+}
+
+// Health examines the files on unavailable locations and reports how much
+// redundancy they have left.
+func (m *Multi) Health() (HealthReport, error) {
+	report := HealthReport{Margins: make(map[int]int64)}
+
+	var locs map[[16]byte]meta.Location
+	err := m.db.RunReadTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		locs, err = locationsByUUID(layer)
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+
+	var unavailable [][16]byte
+	for id, loc := range locs {
+		report.Locations++
+		switch {
+		case loc.Dead:
+			report.Dead++
+			unavailable = append(unavailable, id)
+		case m.finder.StoreFor(id) == nil:
+			report.Offline++
+			unavailable = append(unavailable, id)
+		default:
+			report.Online++
+		}
+	}
+
+	seen := make(map[[16]byte]bool)
+	for _, id := range unavailable {
+		after := ""
+		for {
+			var chunks []string
+			var files []*meta.File
+			err := m.db.RunReadTx(func(ctx kvl.Ctx) error {
+				files = nil
+				batchSeen := make(map[[16]byte]bool)
+
+				layer, err := meta.Open(ctx)
+				if err != nil {
+					return err
+				}
+
+				chunks, err = layer.GetLocationContents(id, after, healthBatch)
+				if err != nil {
+					return err
+				}
+
+				for _, chunk := range chunks {
+					pid, err := prefixIDFromLocalKey(chunk)
+					if err != nil || seen[pid] || batchSeen[pid] {
+						continue
+					}
+					batchSeen[pid] = true
+
+					path, err := layer.PathForPrefixID(pid)
+					if err != nil {
+						if err == kvl.ErrNotFound {
+							continue
+						}
+						return err
+					}
+
+					f, err := layer.GetFile(path)
+					if err != nil {
+						return err
+					}
+					if f == nil || f.PrefixID != pid {
+						continue
+					}
+
+					files = append(files, f)
+				}
+
+				return nil
+			})
+			if err != nil {
+				return report, err
+			}
+
+			for _, f := range files {
+				seen[f.PrefixID] = true
+				m.addFileHealth(&report, f, locs)
+			}
+
+			if len(chunks) == 0 {
+				break
+			}
+			after = chunks[len(chunks)-1]
+		}
+	}
+
+	report.RepairRate = m.repairMeter.rate(time.Now())
+	if report.RepairBytes > 0 && report.RepairRate > 0 {
+		report.RepairETA = time.Duration(
+			float64(report.RepairBytes) / report.RepairRate * float64(time.Second))
+	}
+
+	return report, nil
+}
+
+func (m *Multi) addFileHealth(report *HealthReport, f *meta.File, locs map[[16]byte]meta.Location) {
+	have := m.availableChunks(f, locs, nil)
+	report.Margins[decodeMargin(f, have)]++
+
+	if !canDecode(f, have) {
+		report.Unreadable++
+		if len(report.UnreadablePaths) < healthUnreadableLimit {
+			report.UnreadablePaths = append(report.UnreadablePaths, f.Path)
+		}
+	}
+
+	chunkSize := storedSize(f.Size, int(f.DataChunks), 1)
+	for _, id := range f.Locations {
+		loc, ok := locs[id]
+		if !ok || loc.Dead {
+			report.RepairBytes += chunkSize
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package multi
+
+import (
+	"sync"
+	"time"
+)
+
+// Limit is a rate limit on a background activity. Zero values are unlimited.
+type Limit struct {
+	BytesPerSecond int64
+	OpsPerSecond   int64
+}
+
+// Limits are the rate limits on the background activities of a Multi, to
+// keep them from taking chunk server bandwidth away from foreground requests.
+// They apply to each proxy separately.
+type Limits struct {
+	// Scrub limits the files checked by the file scrubber and the chunks
+	// checked by the location scrubber.
+	Scrub Limit
+
+	// Rebuild limits rewriting and repairing damaged or out of date files.
+	// Bytes are counted by file size.
+	Rebuild Limit
+
+	// Rebalance limits moving chunks between stores to even out free space.
+	Rebalance Limit
+
+	// ReadRepair limits repairing files after reads had to reconstruct them.
+	// Bytes are counted by file size. Read repairs count as rebuilds too.
+	ReadRepair Limit
+
+	// DeepScrub limits the files read by the deep scrubber. Bytes are counted
+	// by chunk bytes read. DeepScrubConfig.Rate applies as well.
+	DeepScrub Limit
+
+	// Archive limits re-encoding old files into the archive layout. Bytes are
+	// counted by file size. ArchiveConfig.Rate applies as well.
+	Archive Limit
+
+	// Tiering limits moving files between tiers. Bytes are counted by file
+	// size.
+	Tiering Limit
+}
+
+// tokenBucket is a token bucket holding up to one second of tokens. Takers
+// may go into debt, and wait for it to be paid off.
+type tokenBucket struct {
+	rate   float64 // tokens per second; not positive is unlimited
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.rate = float64(rate)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// take removes n tokens from the bucket, and returns how long to wait before
+// using them.
+func (b *tokenBucket) take(n int64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	} else {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type activityLimiter struct {
+	bytes tokenBucket
+	ops   tokenBucket
+
+	// shared limits bytes by a rate set in the configuration shared between
+	// all proxies, such as DeepScrubConfig.Rate
+	shared tokenBucket
+}
+
+func (a *activityLimiter) set(l Limit) {
+	a.bytes.setRate(l.BytesPerSecond)
+	a.ops.setRate(l.OpsPerSecond)
+}
+
+type limiters struct {
+	mu         sync.Mutex
+	limits     Limits
+	scrub      activityLimiter
+	rebuild    activityLimiter
+	rebalance  activityLimiter
+	readRepair activityLimiter
+	deepScrub  activityLimiter
+	archive    activityLimiter
+	tiering    activityLimiter
+}
+
+// GetLimits returns the rate limits on background activities on this proxy.
+func (m *Multi) GetLimits() Limits {
+	m.limiters.mu.Lock()
+	defer m.limiters.mu.Unlock()
+	return m.limiters.limits
+}
+
+// SetLimits changes the rate limits on background activities on this proxy.
+// Unlike most configuration, they are not shared with other proxies.
+func (m *Multi) SetLimits(l Limits) error {
+	for _, limit := range []Limit{l.Scrub, l.Rebuild, l.Rebalance, l.ReadRepair,
+		l.DeepScrub, l.Archive, l.Tiering} {
+		if limit.BytesPerSecond < 0 || limit.OpsPerSecond < 0 {
+			return BadConfigError("limit is negative")
+		}
+	}
+
+	m.limiters.mu.Lock()
+	m.limiters.limits = l
+	m.limiters.scrub.set(l.Scrub)
+	m.limiters.rebuild.set(l.Rebuild)
+	m.limiters.rebalance.set(l.Rebalance)
+	m.limiters.readRepair.set(l.ReadRepair)
+	m.limiters.deepScrub.set(l.DeepScrub)
+	m.limiters.archive.set(l.Archive)
+	m.limiters.tiering.set(l.Tiering)
+	m.limiters.mu.Unlock()
+
+	return nil
+}
+
+// setSharedRate sets the rate in bytes per second from the shared
+// configuration that the activity is limited to. Zero is unlimited.
+func (m *Multi) setSharedRate(a *activityLimiter, rate int64) {
+	m.limiters.mu.Lock()
+	a.shared.setRate(rate)
+	m.limiters.mu.Unlock()
+}
+
+// throttle waits until the activity may do ops operations using the given
+// number of bytes, or until the Multi is closing.
+func (m *Multi) throttle(a *activityLimiter, ops, bytes int64) {
+	now := time.Now()
+
+	m.limiters.mu.Lock()
+	wait := a.ops.take(ops, now)
+	if w := a.bytes.take(bytes, now); w > wait {
+		wait = w
+	}
+	if w := a.shared.take(bytes, now); w > wait {
+		wait = w
+	}
+	m.limiters.mu.Unlock()
+
+	if wait <= 0 {
+		return
+	}
+
+	select {
+	case <-m.tomb.Dying():
+	case <-time.After(wait):
+	}
+}
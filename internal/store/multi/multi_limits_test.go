@@ -0,0 +1,69 @@
+package multi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	start := time.Unix(1000, 0)
+
+	if wait := b.take(1000000, start); wait != 0 {
+		t.Fatalf("Unlimited bucket waited %v", wait)
+	}
+
+	b.setRate(100)
+
+	tests := []struct {
+		after time.Duration
+		n     int64
+		wait  time.Duration
+	}{
+		{0, 50, 0},                      // starts full
+		{0, 50, 0},                      // now empty
+		{0, 50, 500 * time.Millisecond}, // goes into debt
+		{500 * time.Millisecond, 0, 0},  // debt paid off
+		{10 * time.Second, 150, 500 * time.Millisecond}, // refills to one second only
+	}
+
+	now := start
+	for i, test := range tests {
+		now = now.Add(test.after)
+		wait := b.take(test.n, now)
+		if wait != test.wait {
+			t.Errorf("Step %v: take(%v) waited %v, wanted %v", i, test.n, wait, test.wait)
+		}
+	}
+}
+
+func TestMultiSetLimits(t *testing.T) {
+	_, multi, _, done := prepareMultiTest(t, 2, 3, 3)
+	defer done()
+
+	l := Limits{
+		Rebuild:   Limit{BytesPerSecond: 1048576, OpsPerSecond: 10},
+		Rebalance: Limit{BytesPerSecond: 65536},
+		Tiering:   Limit{OpsPerSecond: 5},
+	}
+	err := multi.SetLimits(l)
+	if err != nil {
+		t.Fatalf("Couldn't set limits: %v", err)
+	}
+	if got := multi.GetLimits(); got != l {
+		t.Errorf("GetLimits returned %#v, wanted %#v", got, l)
+	}
+
+	for _, bad := range []Limits{
+		{Scrub: Limit{OpsPerSecond: -1}},
+		{Archive: Limit{BytesPerSecond: -1}},
+	} {
+		err = multi.SetLimits(bad)
+		if _, ok := err.(BadConfigError); !ok {
+			t.Errorf("SetLimits(%#v) returned %v, wanted a BadConfigError", bad, err)
+		}
+		if got := multi.GetLimits(); got != l {
+			t.Errorf("Failed SetLimits changed limits to %#v", got)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package multi
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/encryptio/slime/internal/events"
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/meta"
+	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/uuid"
+
+	"github.com/encryptio/kvl"
+)
+
+var quarantineScanInterval = time.Second * 30
+
+// quarantineLoop repairs chunks that stores have quarantined as soon as they
+// show up, rather than waiting for the location scrubber to notice that they
+// are missing.
+func (m *Multi) quarantineLoop() error {
+	// entries already handled, by store and key, mapped to the time they were
+	// quarantined
+	seen := make(map[[16]byte]map[string]int64)
+
+	// entries already reported, in the same form; these may not have been
+	// handled yet
+	reported := make(map[[16]byte]map[string]int64)
+
+	for {
+		select {
+		case <-m.tomb.Dying():
+			return nil
+		case <-time.After(jitterDuration(quarantineScanInterval)):
+			m.rebuildQuarantined(seen, reported)
+		}
+	}
+}
+
+// rebuildQuarantined checks every connected store for quarantined chunks that
+// are still missing, and repairs them. seen is updated with the entries that
+// were handled, and those entries are skipped on later calls. reported is
+// updated with the entries reported as corruption events, so that entries that
+// couldn't be handled aren't reported again. Either may be nil.
+func (m *Multi) rebuildQuarantined(seen, reported map[[16]byte]map[string]int64) {
+	for id, fe := range m.finder.Stores() {
+		qs, ok := fe.Store.(store.QuarantineStore)
+		if !ok {
+			continue
+		}
+
+		entries, err := qs.ListQuarantine(nil)
+		if err != nil {
+			logging.Errorf("Couldn't list quarantine on %v: %v", uuid.Fmt(id), err)
+			continue
+		}
+
+		storeSeen := make(map[string]int64, len(entries))
+		storeReported := make(map[string]int64, len(entries))
+		for _, e := range entries {
+			if seen != nil && seen[id][e.Key] == e.Time {
+				storeSeen[e.Key] = e.Time
+				continue
+			}
+
+			if reported == nil || reported[id][e.Key] != e.Time {
+				m.emit(events.Event{
+					Type: events.CorruptionFound,
+					Message: fmt.Sprintf("store %v quarantined corrupt chunk %v",
+						fe.Store.Name(), e.Key),
+					Store:   uuid.Fmt(id),
+					Details: map[string]interface{}{"key": e.Key},
+				})
+			}
+			storeReported[e.Key] = e.Time
+
+			err := m.rebuildQuarantinedChunk(id, fe.Store, e.Key)
+			if err != nil {
+				logging.Errorf("Couldn't rebuild quarantined chunk %v on %v: %v",
+					e.Key, uuid.Fmt(id), err)
+				continue
+			}
+
+			storeSeen[e.Key] = e.Time
+		}
+
+		if seen != nil {
+			seen[id] = storeSeen
+		}
+		if reported != nil {
+			reported[id] = storeReported
+		}
+	}
+}
+
+// rebuildQuarantinedChunk repairs the chunk with the given local key on st, if
+// it is still missing there and the file it belongs to expects it there.
+func (m *Multi) rebuildQuarantinedChunk(id [16]byte, st store.Store, key string) error {
+	_, err := st.Stat(key, nil)
+	if err == nil {
+		// already rewritten
+		return nil
+	}
+	if err != store.ErrNotFound {
+		return err
+	}
+
+	pid, err := prefixIDFromLocalKey(key)
+	if err != nil {
+		// not a chunk we wrote
+		return nil
+	}
+
+	idx, err := chunkIndexFromLocalKey(key)
+	if err != nil {
+		return nil
+	}
+
+	var f *meta.File
+	var inWAL bool
+	err = m.db.RunTx(func(ctx kvl.Ctx) error {
+		f = nil
+
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		inWAL, err = layer.WALCheck(pid)
+		if err != nil || inWAL {
+			return err
+		}
+
+		path, err := layer.PathForPrefixID(pid)
+		if err != nil {
+			if err == kvl.ErrNotFound {
+				err = nil
+			}
+			return err
+		}
+
+		f, err = layer.GetFile(path)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if inWAL || f == nil || f.PrefixID != pid {
+		// being written, or no longer referenced; the location scrubber will
+		// clean up after it if needed
+		return nil
+	}
+
+	if idx >= len(f.Locations) || f.Locations[idx] != id {
+		return nil
+	}
+
+	logging.Warnf("rebuilding quarantined chunk %v on %v", key, uuid.Fmt(id))
+
+	err = m.repairOrRebuild(f.Path, pid, []int{idx})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("successfully rebuilt %v", f.Path)
+
+	return nil
+}
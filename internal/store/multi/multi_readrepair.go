@@ -0,0 +1,174 @@
+package multi
+
+import (
+	"sync"
+
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/meta"
+	"github.com/encryptio/slime/internal/store"
+)
+
+// readRepairBuffer is the number of read repairs that may wait for the read
+// repair loop before further ones go to the repair queue instead, and the
+// number that may wait to be put in the repair queue before further ones are
+// dropped.
+var readRepairBuffer = 100
+
+// ReadRepairStats counts read repairs since the Multi was created. A read
+// repair is scheduled when a read has to reconstruct a file around chunks that
+// failed to read from stores that are online.
+type ReadRepairStats struct {
+	Scheduled    int64 // files scheduled for read repair
+	Deduplicated int64 // reads of files that were already scheduled
+	Queued       int64 // files put in the repair queue because too many were scheduled
+	Dropped      int64 // files left for the scrubbers because the repair queue was behind too
+	Repaired     int64 // files with chunks repaired
+	Failed       int64 // files that couldn't be repaired
+}
+
+type readRepair struct {
+	file   meta.File
+	failed []int // indices of the chunks that failed to read
+}
+
+type readRepairState struct {
+	mu      sync.Mutex
+	pending map[string]bool
+	stats   ReadRepairStats
+}
+
+// ReadRepairStats returns counters for read repairs on this proxy.
+func (m *Multi) ReadRepairStats() ReadRepairStats {
+	m.readRepair.mu.Lock()
+	defer m.readRepair.mu.Unlock()
+	return m.readRepair.stats
+}
+
+// scheduleReadRepair arranges for the chunks of f at the indices failed to be
+// checked and repaired in the background, unless f is already scheduled.
+func (m *Multi) scheduleReadRepair(f meta.File, failed []int) {
+	m.readRepair.mu.Lock()
+	if m.readRepair.pending[f.Path] {
+		m.readRepair.stats.Deduplicated++
+		m.readRepair.mu.Unlock()
+		return
+	}
+
+	select {
+	case m.readRepairs <- readRepair{f, failed}:
+		m.readRepair.pending[f.Path] = true
+		m.readRepair.stats.Scheduled++
+		m.readRepair.mu.Unlock()
+
+		logging.Warnf("Scheduled read repair of %v after chunks %v failed to read",
+			f.Path, failed)
+
+	default:
+		select {
+		case m.readOverflow <- readRepair{f, failed}:
+			m.readRepair.stats.Queued++
+			m.readRepair.mu.Unlock()
+
+			logging.Warnf("Too many read repairs scheduled, queueing %v for repair", f.Path)
+
+		default:
+			m.readRepair.stats.Dropped++
+			m.readRepair.mu.Unlock()
+
+			logging.Warnf("Too many read repairs scheduled, leaving %v for the scrubbers", f.Path)
+		}
+	}
+}
+
+// readOverflowLoop puts the read repairs that didn't fit in the read repair
+// loop's buffer in the repair queue.
+func (m *Multi) readOverflowLoop() error {
+	for {
+		select {
+		case <-m.tomb.Dying():
+			return nil
+		case r := <-m.readOverflow:
+			m.queueReadFailures(r.file, r.failed)
+		}
+	}
+}
+
+func (m *Multi) readRepairLoop() error {
+	for {
+		select {
+		case <-m.tomb.Dying():
+			// NB: anything left unrepaired is found later by the scrubbers
+			return nil
+		case r := <-m.readRepairs:
+			m.throttle(&m.limiters.readRepair, 1, int64(r.file.Size))
+
+			err := m.readRepairFile(r)
+
+			m.readRepair.mu.Lock()
+			delete(m.readRepair.pending, r.file.Path)
+			if err != nil {
+				m.readRepair.stats.Failed++
+			}
+			m.readRepair.mu.Unlock()
+
+			if err != nil {
+				logging.Errorf("Couldn't read repair %v: %v", r.file.Path, err)
+			}
+		}
+	}
+}
+
+// readRepairFile reads the chunks that failed again, and repairs those that
+// still fail. Chunks that read fine the second time were transient failures,
+// and are left alone.
+func (m *Multi) readRepairFile(r readRepair) error {
+	f, err := m.getFile(r.file.Path)
+	if err != nil {
+		return err
+	}
+	if f == nil || f.PrefixID != r.file.PrefixID {
+		// rewritten since it was read
+		return nil
+	}
+
+	bad := m.rereadChunks(f, r.failed)
+	if len(bad) == 0 {
+		logging.Infof("Read repair of %v found no bad chunks", f.Path)
+		return nil
+	}
+
+	err = m.repairOrRebuild(f.Path, f.PrefixID, bad)
+	if err != nil {
+		return err
+	}
+
+	m.readRepair.mu.Lock()
+	m.readRepair.stats.Repaired++
+	m.readRepair.mu.Unlock()
+
+	logging.Infof("Read repaired chunks %v of %v", bad, f.Path)
+	return nil
+}
+
+// rereadChunks reads the chunks of f at the indices in idxs again, and returns
+// the indices of those that still fail. Chunks on offline stores are left out;
+// nothing can be done about them until they're back or dead.
+func (m *Multi) rereadChunks(f *meta.File, idxs []int) []int {
+	var bad []int
+	for _, i := range idxs {
+		if i < 0 || i >= len(f.Locations) {
+			continue
+		}
+
+		st := m.finder.StoreFor(f.Locations[i])
+		if st == nil {
+			continue
+		}
+
+		_, _, err := st.Get(localKeyFor(f, i), store.GetOptions{})
+		if err != nil {
+			bad = append(bad, i)
+		}
+	}
+	return bad
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/encryptio/slime/internal/logging"
 	"github.com/encryptio/slime/internal/meta"
 	"github.com/encryptio/slime/internal/store"
 	"github.com/encryptio/slime/internal/uuid"
@@ -34,33 +35,70 @@ func (m *Multi) rebalanceLoop() error {
 		case <-time.After(jitterDuration(rebalanceWait)):
 			err := m.rebalanceStep()
 			if err != nil {
-				log.Printf("Couldn't run rebalance step: %v", err)
+				logging.Errorf("Couldn't run rebalance step: %v", err)
 			}
 		}
 	}
 }
 
+// rebalanceRoom returns the space left on a store before it reaches its
+// limits, scaled by its weight, and false if chunks on the store should not be
+// rebalanced: chunks on read only stores stay put, and draining stores are
+// emptied by the drain loop.
+func rebalanceRoom(locs map[[16]byte]meta.Location, id [16]byte, fe FinderEntry) (int64, bool) {
+	loc, ok := locs[id]
+	if !ok || !loc.Writable() {
+		return 0, false
+	}
+	return loc.Available(fe.Free, fe.Capacity) / 100 * loc.PlacementWeight(), true
+}
+
 func (m *Multi) rebalanceStep() error {
 	finderEntries := m.finder.Stores()
 
+	locs := make(map[[16]byte]meta.Location)
+	err := m.db.RunReadTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		all, err := layer.AllLocations()
+		if err != nil {
+			return err
+		}
+
+		for _, loc := range all {
+			locs[loc.UUID] = loc
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
 	// bail out early if there's no rebalancing possible
-	mostFree := int64(0)
-	leastFree := int64(0)
+	mostRoom := int64(0)
+	leastRoom := int64(0)
 	markedOne := false
-	for _, fe := range finderEntries {
+	for id, fe := range finderEntries {
+		room, ok := rebalanceRoom(locs, id, fe)
+		if !ok {
+			continue
+		}
 		if !markedOne {
 			markedOne = true
-			mostFree = fe.Free
-			leastFree = fe.Free
+			mostRoom = room
+			leastRoom = room
 		}
-		if fe.Free > mostFree {
-			mostFree = fe.Free
+		if room > mostRoom {
+			mostRoom = room
 		}
-		if fe.Free < leastFree {
-			leastFree = fe.Free
+		if room < leastRoom {
+			leastRoom = room
 		}
 	}
-	if mostFree-leastFree < rebalanceMinDifference {
+	if mostRoom-leastRoom < rebalanceMinDifference {
 		return nil
 	}
 
@@ -110,9 +148,9 @@ func (m *Multi) rebalanceStep() error {
 		}
 
 		for _, f := range files {
-			did, err := m.rebalanceFile(f, finderEntries)
+			did, err := m.rebalanceFile(f, locs, finderEntries)
 			if err != nil {
-				log.Printf("Failed to rebalance %v: %v", f.Path, err)
+				logging.Errorf("Failed to rebalance %v: %v", f.Path, err)
 			}
 			scanned++
 			if did {
@@ -130,8 +168,8 @@ func (m *Multi) rebalanceStep() error {
 	return nil
 }
 
-func (m *Multi) rebalanceFile(f meta.File, finderEntries map[[16]byte]FinderEntry) (bool, error) {
-	// search for the lowest free location that this file is stored on
+func (m *Multi) rebalanceFile(f meta.File, locs map[[16]byte]meta.Location, finderEntries map[[16]byte]FinderEntry) (bool, error) {
+	// search for the location with the least room that this file is stored on
 	var minI int
 	var minF int64
 	var minS store.Store
@@ -141,9 +179,14 @@ func (m *Multi) rebalanceFile(f meta.File, finderEntries map[[16]byte]FinderEntr
 			continue
 		}
 
-		if minS == nil || minF > fe.Free {
+		room, ok := rebalanceRoom(locs, l, fe)
+		if !ok {
+			continue
+		}
+
+		if minS == nil || minF > room {
 			minS = fe.Store
-			minF = fe.Free
+			minF = room
 			minI = i
 		}
 	}
@@ -152,11 +195,15 @@ func (m *Multi) rebalanceFile(f meta.File, finderEntries map[[16]byte]FinderEntr
 		return false, nil
 	}
 
-	// search for the highest free location that this file is NOT stored on
+	// search for the location with the most room that this file is NOT
+	// stored on, and that doesn't share a failure domain with the rest of
+	// the chunk's local group
+	avoid := groupDomains(&f, minI, locs)
 	var maxF int64
 	var maxS store.Store
 	for id, fe := range finderEntries {
-		if fe.Dead {
+		room, ok := rebalanceRoom(locs, id, fe)
+		if !ok || room <= 0 || locs[id].Tier != f.Tier || avoid[failureDomain(locs[id])] {
 			continue
 		}
 
@@ -171,8 +218,8 @@ func (m *Multi) rebalanceFile(f meta.File, finderEntries map[[16]byte]FinderEntr
 			continue
 		}
 
-		if maxS == nil || maxF < fe.Free {
-			maxF = fe.Free
+		if maxS == nil || maxF < room {
+			maxF = room
 			maxS = fe.Store
 		}
 	}
@@ -186,7 +233,27 @@ func (m *Multi) rebalanceFile(f meta.File, finderEntries map[[16]byte]FinderEntr
 	}
 
 	// we should move chunk minI on minS to maxS
+	m.throttle(&m.limiters.rebalance, 1, int64(f.Size)/int64(f.DataChunks))
 
+	size, err := m.moveChunk(f, minI, minS, maxS)
+	if err != nil {
+		return false, err
+	}
+
+	fe := finderEntries[minS.UUID()]
+	fe.Free += size
+	finderEntries[minS.UUID()] = fe
+
+	fe = finderEntries[maxS.UUID()]
+	fe.Free -= size
+	finderEntries[maxS.UUID()] = fe
+
+	return true, nil
+}
+
+// moveChunk copies chunk idx of f from one store to another, points f at the
+// new copy, and removes the old one. It returns the size of the chunk.
+func (m *Multi) moveChunk(f meta.File, idx int, from, to store.Store) (int64, error) {
 	err := m.db.RunTx(func(ctx kvl.Ctx) error {
 		l, err := meta.Open(ctx)
 		if err != nil {
@@ -196,7 +263,7 @@ func (m *Multi) rebalanceFile(f meta.File, finderEntries map[[16]byte]FinderEntr
 		return l.WALMark(f.PrefixID)
 	})
 	if err != nil {
-		return false, err
+		return 0, err
 	}
 	defer func() {
 		// TODO: how to handle errors here?
@@ -210,10 +277,10 @@ func (m *Multi) rebalanceFile(f meta.File, finderEntries map[[16]byte]FinderEntr
 		})
 	}()
 
-	localKey := localKeyFor(&f, minI)
-	data, st, err := minS.Get(localKey, store.GetOptions{})
+	localKey := localKeyFor(&f, idx)
+	data, st, err := from.Get(localKey, store.GetOptions{})
 	if err != nil {
-		return false, err
+		return 0, err
 	}
 
 	setCASV := store.CASV{
@@ -222,15 +289,15 @@ func (m *Multi) rebalanceFile(f meta.File, finderEntries map[[16]byte]FinderEntr
 		Data:    data,
 	}
 
-	err = maxS.CAS(localKey, store.MissingV, setCASV, nil)
+	err = to.CAS(localKey, store.MissingV, setCASV, nil)
 	if err != nil {
-		return false, err
+		return 0, err
 	}
 
 	newF := f
 	newF.Locations = make([][16]byte, len(f.Locations))
 	copy(newF.Locations, f.Locations)
-	newF.Locations[minI] = maxS.UUID()
+	newF.Locations[idx] = to.UUID()
 
 	err = m.db.RunTx(func(ctx kvl.Ctx) error {
 		l, err := meta.Open(ctx)
@@ -243,7 +310,7 @@ func (m *Multi) rebalanceFile(f meta.File, finderEntries map[[16]byte]FinderEntr
 			return err
 		}
 
-		if f2.PrefixID != f.PrefixID {
+		if f2 == nil || f2.PrefixID != f.PrefixID {
 			return errModifiedDuringBalance
 		}
 
@@ -265,23 +332,15 @@ func (m *Multi) rebalanceFile(f meta.File, finderEntries map[[16]byte]FinderEntr
 		return nil
 	})
 	if err != nil {
-		maxS.CAS(localKey, setCASV, store.MissingV, nil) // ignore error
-		return false, err
+		to.CAS(localKey, setCASV, store.MissingV, nil) // ignore error
+		return 0, err
 	}
 
-	err = minS.CAS(localKey, setCASV, store.MissingV, nil)
+	err = from.CAS(localKey, setCASV, store.MissingV, nil)
 	if err != nil {
-		log.Printf("Couldn't remove rebalanced chunk from old location %v: %v",
-			uuid.Fmt(maxS.UUID()), err)
+		logging.Errorf("Couldn't remove moved chunk from old location %v: %v",
+			uuid.Fmt(from.UUID()), err)
 	}
 
-	fe := finderEntries[minS.UUID()]
-	fe.Free += int64(len(data))
-	finderEntries[minS.UUID()] = fe
-
-	fe = finderEntries[maxS.UUID()]
-	fe.Free -= int64(len(data))
-	finderEntries[maxS.UUID()] = fe
-
-	return true, nil
+	return int64(len(data)), nil
 }
@@ -0,0 +1,351 @@
+package multi
+
+import (
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/meta"
+	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/uuid"
+
+	"github.com/encryptio/kvl"
+)
+
+var (
+	errNoLocalRepair        = errors.New("chunk can't be repaired from its local group")
+	errModifiedDuringRepair = errors.New("file modified during repair")
+)
+
+// repairOrRebuild restores the chunks at indices bad of the file at path with
+// repairChunks, falling back to a full rebuild if that fails.
+func (m *Multi) repairOrRebuild(path string, prefixID [16]byte, bad []int) error {
+	err := m.repairChunks(path, prefixID, bad)
+	if err == errModifiedDuringRepair {
+		// someone else rewrote the file; there is nothing left to repair
+		return nil
+	}
+	if err != nil {
+		logging.Warnf("Couldn't repair chunks %v of %v, rebuilding: %v",
+			bad, path, err)
+		return m.rebuild(path)
+	}
+	return nil
+}
+
+// repairChunks regenerates the chunks at indices bad of the file at path,
+// writes them to stores, and points only those entries of the file's
+// Locations at the new copies. The rest of the file, including its prefix ID,
+// is left alone.
+//
+// For CodecLRC files, each chunk is rebuilt from its local group if possible,
+// which reads far less data. Otherwise, enough surviving chunks are read to
+// reconstruct the file, and only the missing chunks are encoded again.
+func (m *Multi) repairChunks(path string, prefixID [16]byte, bad []int) error {
+	f, err := m.getFile(path)
+	if err != nil {
+		return err
+	}
+	if f == nil || f.PrefixID != prefixID {
+		return errModifiedDuringRepair
+	}
+
+	for _, idx := range bad {
+		if idx < 0 || idx >= len(f.Locations) {
+			return errModifiedDuringRepair
+		}
+	}
+
+	m.throttle(&m.limiters.rebuild, 1, int64(f.Size))
+
+	chunks := make(map[int][]byte, len(bad))
+	var remaining []int
+	for _, idx := range bad {
+		chunk, err := m.localRepairChunk(f, idx)
+		if err != nil {
+			if err != errNoLocalRepair {
+				logging.Warnf("Couldn't repair chunk %v of %v from its local group: %v",
+					idx, path, err)
+			}
+			remaining = append(remaining, idx)
+			continue
+		}
+		chunks[idx] = chunk
+	}
+
+	if len(remaining) > 0 {
+		// don't trust the chunks we're replacing, even if they're readable
+		chunkData := m.getChunkDataExcept(f, store.GetOptions{}, bad)
+
+		data, err := decodeChunks(f, chunkData)
+		if err != nil {
+			return err
+		}
+
+		if sha256.Sum256(data) != f.SHA256 {
+			return ErrBadHash
+		}
+
+		regenerated, err := encodeChunkIndices(f, data, remaining)
+		if err != nil {
+			return err
+		}
+
+		for i, idx := range remaining {
+			chunks[idx] = regenerated[i]
+		}
+	}
+
+	err = m.replaceChunks(f, chunks)
+	if err != nil {
+		return err
+	}
+
+	var written int64
+	for _, chunk := range chunks {
+		written += int64(len(chunk))
+	}
+	m.repairMeter.add(written, time.Now())
+
+	return nil
+}
+
+// localRepairChunk regenerates chunk idx of a CodecLRC file by XORing the
+// other members of its local parity group.
+//
+// Returns errNoLocalRepair if the file doesn't use CodecLRC, or if the chunk
+// is a global parity chunk, or if another member of the group is offline.
+func (m *Multi) localRepairChunk(f *meta.File, idx int) ([]byte, error) {
+	if f.Codec != CodecLRC {
+		return nil, errNoLocalRepair
+	}
+
+	layout := lrcLayoutFor(f)
+	if !layout.valid() {
+		return nil, errNoLocalRepair
+	}
+
+	g := layout.groupOf(idx)
+	if g < 0 {
+		return nil, errNoLocalRepair
+	}
+
+	var groupData [][]byte
+	for _, member := range layout.members(g) {
+		if member == idx {
+			continue
+		}
+
+		st := m.finder.StoreFor(f.Locations[member])
+		if st == nil {
+			return nil, errNoLocalRepair
+		}
+
+		data, _, err := st.Get(localKeyFor(f, member), store.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if len(groupData) > 0 && len(data) != len(groupData[0]) {
+			return nil, ErrBadChunkLength
+		}
+		groupData = append(groupData, data)
+	}
+
+	return xorChunks(groupData), nil
+}
+
+// replaceChunks writes the given chunks of f to stores, then updates f's
+// Locations for those indices in a transaction that fails with
+// errModifiedDuringRepair if f changed in the meantime.
+func (m *Multi) replaceChunks(f *meta.File, chunks map[int][]byte) error {
+	targets, err := m.repairTargets(f, chunks)
+	if err != nil {
+		return err
+	}
+
+	err = m.db.RunTx(func(ctx kvl.Ctx) error {
+		l, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		return l.WALMark(f.PrefixID)
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// TODO: how to handle errors here?
+		m.db.RunTx(func(ctx kvl.Ctx) error {
+			l, err := meta.Open(ctx)
+			if err != nil {
+				return err
+			}
+
+			return l.WALClear(f.PrefixID)
+		})
+	}()
+
+	newF := *f
+	newF.Locations = make([][16]byte, len(f.Locations))
+	copy(newF.Locations, f.Locations)
+
+	written := make(map[int]store.CASV, len(chunks))
+	cleanup := func() {
+		for idx, casv := range written {
+			if targets[idx].UUID() != f.Locations[idx] {
+				targets[idx].CAS(localKeyFor(f, idx), casv, store.MissingV, nil) // ignore error
+			}
+		}
+	}
+
+	for idx, chunk := range chunks {
+		dataV := store.DataV(chunk)
+		err = targets[idx].CAS(localKeyFor(f, idx), store.AnyV, dataV, nil)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		written[idx] = dataV
+		newF.Locations[idx] = targets[idx].UUID()
+	}
+
+	err = m.db.RunTx(func(ctx kvl.Ctx) error {
+		l, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		f2, err := l.GetFile(f.Path)
+		if err != nil {
+			return err
+		}
+
+		if f2 == nil || f2.PrefixID != f.PrefixID {
+			return errModifiedDuringRepair
+		}
+
+		if len(f2.Locations) != len(f.Locations) {
+			return errModifiedDuringRepair
+		}
+
+		for i, floc := range f.Locations {
+			if floc != f2.Locations[i] {
+				return errModifiedDuringRepair
+			}
+		}
+
+		return l.SetFile(&newF)
+	})
+	if err != nil {
+		cleanup()
+		return err
+	}
+
+	for idx := range chunks {
+		if newF.Locations[idx] == f.Locations[idx] {
+			continue
+		}
+
+		old := m.finder.StoreFor(f.Locations[idx])
+		if old != nil {
+			// The old copy is usually gone already, but might not be if the
+			// store was marked dead while still online.
+			err = old.CAS(localKeyFor(f, idx), store.AnyV, store.MissingV, nil)
+			if err != nil && err != store.ErrNotFound {
+				logging.Errorf("Couldn't remove repaired chunk from old location %v: %v",
+					uuid.Fmt(f.Locations[idx]), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// repairTargets picks the store to write each repaired chunk of f to. A
+// chunk's current store is reused if it is still healthy. Otherwise, the new
+// store must not hold any other chunk of f: every chunk must be on a
+// different store, or one store failure could take out more than one chunk
+// (or more than one member of an LRC local group.) Where possible, the members
+// of a local group are also kept in different failure domains.
+func (m *Multi) repairTargets(f *meta.File, chunks map[int][]byte) (map[int]store.Store, error) {
+	var locs []meta.Location
+	err := m.db.RunReadTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		locs, err = layer.AllLocations()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	writable := make(map[[16]byte]bool, len(locs))
+	for _, loc := range locs {
+		writable[loc.UUID] = loc.Writable() && loc.Tier == f.Tier
+	}
+
+	used := make(map[[16]byte]bool, len(f.Locations))
+	for _, loc := range f.Locations {
+		used[loc] = true
+	}
+
+	targets := make(map[int]store.Store, len(chunks))
+	var moving []int
+	for idx := range chunks {
+		current := m.finder.StoreFor(f.Locations[idx])
+		if current != nil && writable[f.Locations[idx]] {
+			targets[idx] = current
+		} else {
+			moving = append(moving, idx)
+		}
+	}
+
+	if len(moving) == 0 {
+		return targets, nil
+	}
+
+	stores, orderLocs, err := m.orderTargets(f.Tier, len(f.Locations))
+	if err != nil {
+		return nil, err
+	}
+
+	// placed tracks where each chunk will be once the repair is done
+	placed := *f
+	placed.Locations = append([][16]byte(nil), f.Locations...)
+
+	for _, idx := range moving {
+		// Keep the chunk off the failure domains that hold the rest of its
+		// local group, if there's anywhere else to put it.
+		avoid := groupDomains(&placed, idx, orderLocs)
+		var target, fallback store.Store
+		for _, st := range stores {
+			if used[st.UUID()] {
+				continue
+			}
+			if !avoid[failureDomain(orderLocs[st.UUID()])] {
+				target = st
+				break
+			}
+			if fallback == nil {
+				fallback = st
+			}
+		}
+		if target == nil {
+			target = fallback
+		}
+		if target == nil {
+			return nil, ErrInsufficientStores
+		}
+
+		targets[idx] = target
+		used[target.UUID()] = true
+		placed.Locations[idx] = target.UUID()
+	}
+
+	return targets, nil
+}
@@ -0,0 +1,443 @@
+package multi
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/encryptio/slime/internal/events"
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/meta"
+	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/uuid"
+
+	"github.com/encryptio/kvl"
+)
+
+var (
+	repairQueueCount = 10
+	repairFeedWait   = time.Second * 30
+	repairFeedCount  = 100
+	repairFeedBudget = time.Second * 10
+)
+
+// The repair queue holds files known to have lost chunks, so that they are
+// repaired before the file scrubber would get to them, those closest to being
+// lost first. It is fed by the location scrubber, by stores going offline or
+// being marked dead, and by reads that had to reconstruct around bad chunks
+// when there are too many read repairs waiting.
+
+// fileMargin returns how many more chunks of f can be lost, in the worst case,
+// before it can't be read (see decodeMargin.) Chunks on missing, dead, or
+// offline locations count as lost, as do the chunks at the indices in bad,
+// which are known to be lost some other way.
+func (m *Multi) fileMargin(f *meta.File, locs map[[16]byte]meta.Location, bad []int) int {
+	return decodeMargin(f, m.availableChunks(f, locs, bad))
+}
+
+// availableChunks returns which chunks of f are on available locations, other
+// than those at the indices in bad.
+func (m *Multi) availableChunks(f *meta.File, locs map[[16]byte]meta.Location, bad []int) []bool {
+	have := make([]bool, len(f.Locations))
+	for i, id := range f.Locations {
+		loc, ok := locs[id]
+		have[i] = ok && !loc.Dead && m.finder.StoreFor(id) != nil
+	}
+	for _, i := range bad {
+		have[i] = false
+	}
+	return have
+}
+
+func locationsByUUID(layer *meta.Layer) (map[[16]byte]meta.Location, error) {
+	all, err := layer.AllLocations()
+	if err != nil {
+		return nil, err
+	}
+
+	locs := make(map[[16]byte]meta.Location, len(all))
+	for _, loc := range all {
+		locs[loc.UUID] = loc
+	}
+	return locs, nil
+}
+
+// RepairQueueDepth returns the number of files waiting in the repair queue
+// at each margin (see meta.RepairEntry.)
+func (m *Multi) RepairQueueDepth() (map[int]int64, error) {
+	var depth map[int]int64
+	err := m.db.RunReadTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		depth, err = layer.RepairQueueDepth()
+		return err
+	})
+	return depth, err
+}
+
+// queueReadFailures adds f to the repair queue after the chunks at the indices
+// in bad couldn't be read from stores that are online.
+func (m *Multi) queueReadFailures(f meta.File, bad []int) {
+	var atRisk []events.Event
+	err := m.db.RunTx(func(ctx kvl.Ctx) error {
+		atRisk = nil
+
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		cur, err := layer.GetFile(f.Path)
+		if err != nil {
+			return err
+		}
+		if cur == nil || cur.PrefixID != f.PrefixID {
+			// rewritten since it was read
+			return nil
+		}
+
+		locs, err := locationsByUUID(layer)
+		if err != nil {
+			return err
+		}
+
+		return m.queueRepair(layer, cur, m.fileMargin(cur, locs, bad), bad, &atRisk)
+	})
+	if err != nil {
+		logging.Errorf("Couldn't queue repair of %v: %v", f.Path, err)
+		return
+	}
+	m.emitAll(atRisk)
+}
+
+// repairQueueStep repairs the next few files in the repair queue. Files that
+// couldn't be repaired go back in the queue at the same margin. It returns the
+// number of files repaired, so that callers stop when only failures are left.
+func (m *Multi) repairQueueStep() int {
+	var entries []meta.RepairEntry
+	var locs map[[16]byte]meta.Location
+	err := m.db.RunTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		entries, err = layer.TakeRepairs(repairQueueCount)
+		if err != nil {
+			return err
+		}
+
+		locs, err = locationsByUUID(layer)
+		return err
+	})
+	if err != nil {
+		logging.Errorf("Couldn't take files from the repair queue: %v", err)
+		return 0
+	}
+
+	repaired := 0
+	for _, e := range entries {
+		err := m.repairQueued(e, locs)
+		if err == nil {
+			repaired++
+			continue
+		}
+
+		logging.Errorf("Couldn't repair %v (margin %v) from the repair queue: %v",
+			e.Path, e.Margin, err)
+
+		err = m.db.RunTx(func(ctx kvl.Ctx) error {
+			layer, err := meta.Open(ctx)
+			if err != nil {
+				return err
+			}
+			return layer.QueueRepair(e.Path, e.Margin, e.Bad)
+		})
+		if err != nil {
+			// it'll be found again by the scrubbers if it still needs work
+			logging.Errorf("Couldn't put %v back in the repair queue: %v", e.Path, err)
+		}
+	}
+
+	return repaired
+}
+
+// repairQueueAll repairs everything in the repair queue. Used in tests.
+func (m *Multi) repairQueueAll() {
+	for m.repairQueueStep() > 0 {
+	}
+}
+
+// repairQueued restores the chunks of a file from the repair queue that are on
+// missing or dead locations, are missing from their stores, or still fail to
+// read if they failed before it was queued. Chunks on offline stores are left
+// alone, as the scrubbers do.
+func (m *Multi) repairQueued(e meta.RepairEntry, locs map[[16]byte]meta.Location) error {
+	f, err := m.getFile(e.Path)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return nil
+	}
+
+	// chunks that failed to read may be corrupt, which Stat can't see
+	failed := make(map[int]bool, len(e.Bad))
+	for _, i := range m.rereadChunks(f, e.Bad) {
+		failed[i] = true
+	}
+
+	var bad []int
+	for i, id := range f.Locations {
+		loc, ok := locs[id]
+		if !ok || loc.Dead || failed[i] {
+			bad = append(bad, i)
+			continue
+		}
+
+		st := m.finder.StoreFor(id)
+		if st == nil {
+			continue
+		}
+
+		_, err := st.Stat(localKeyFor(f, i), nil)
+		if err == store.ErrNotFound {
+			bad = append(bad, i)
+		}
+	}
+
+	if len(bad) == 0 {
+		return nil
+	}
+
+	logging.Infof("Repairing chunks %v of %v (margin %v)", bad, e.Path, e.Margin)
+
+	return m.repairOrRebuild(e.Path, f.PrefixID, bad)
+}
+
+// repairFeed tracks the locations this proxy has queued the files of since
+// they became unavailable, so each is only scanned once.
+type repairFeed struct {
+	// cursor is the last chunk queued on each location still being scanned
+	cursor map[[16]byte]string
+
+	// done holds locations that have been fully scanned
+	done map[[16]byte]bool
+}
+
+func (m *Multi) repairFeedLoop() error {
+	feed := repairFeed{
+		cursor: make(map[[16]byte]string),
+		done:   make(map[[16]byte]bool),
+	}
+
+	for {
+		select {
+		case <-m.tomb.Dying():
+			return nil
+		case <-time.After(jitterDuration(repairFeedWait)):
+			// keep going without waiting until every location is done
+			for {
+				more, err := m.repairFeedStep(&feed, time.Now().Add(repairFeedBudget))
+				if err != nil {
+					logging.Errorf("Couldn't queue files from unavailable stores: %v", err)
+					break
+				}
+				if !more {
+					break
+				}
+
+				select {
+				case <-m.tomb.Dying():
+					return nil
+				default:
+				}
+			}
+		}
+	}
+}
+
+// repairFeedStep notices locations that have gone offline or been marked dead
+// since the last call, and queues the at-risk files on them for repair,
+// repairFeedCount chunks per transaction until the deadline. It returns whether
+// any location was left unfinished.
+//
+// Every file on a dead location is queued. Files on offline locations are only
+// queued if they also have a chunk on a dead or missing location, since they
+// can't be repaired until then, but losing the offline location lowers their
+// margin.
+func (m *Multi) repairFeedStep(feed *repairFeed, deadline time.Time) (bool, error) {
+	var locs map[[16]byte]meta.Location
+	err := m.db.RunReadTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		locs, err = locationsByUUID(layer)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	more := false
+	for id, loc := range locs {
+		available := !loc.Dead && m.finder.StoreFor(id) != nil
+		if available {
+			delete(feed.cursor, id)
+			delete(feed.done, id)
+			continue
+		}
+		if feed.done[id] {
+			continue
+		}
+		if time.Now().After(deadline) {
+			more = true
+			continue
+		}
+
+		done, err := m.feedLocation(feed, id, loc, locs, deadline)
+		if err != nil {
+			return false, err
+		}
+		if !done {
+			more = true
+		}
+	}
+
+	return more, nil
+}
+
+// feedLocation queues the at-risk files on the unavailable location id, from
+// where the last call left off until it runs out of chunks or time. It returns
+// whether every chunk on the location has been looked at.
+func (m *Multi) feedLocation(feed *repairFeed, id [16]byte, loc meta.Location, locs map[[16]byte]meta.Location, deadline time.Time) (bool, error) {
+	for time.Now().Before(deadline) {
+		after := feed.cursor[id]
+		var chunks []string
+		var atRisk []events.Event
+		err := m.db.RunTx(func(ctx kvl.Ctx) error {
+			atRisk = nil
+
+			layer, err := meta.Open(ctx)
+			if err != nil {
+				return err
+			}
+
+			chunks, err = layer.GetLocationContents(id, after, repairFeedCount)
+			if err != nil {
+				return err
+			}
+
+			for _, chunk := range chunks {
+				pid, err := prefixIDFromLocalKey(chunk)
+				if err != nil {
+					continue
+				}
+
+				path, err := layer.PathForPrefixID(pid)
+				if err != nil {
+					if err == kvl.ErrNotFound {
+						continue
+					}
+					return err
+				}
+
+				f, err := layer.GetFile(path)
+				if err != nil {
+					return err
+				}
+				if f == nil || f.PrefixID != pid {
+					continue
+				}
+
+				if !loc.Dead && !hasLostChunk(f, locs) {
+					continue
+				}
+
+				err = m.queueRepair(layer, f, m.fileMargin(f, locs, nil), nil, &atRisk)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+		m.emitAll(atRisk)
+
+		if len(chunks) == 0 {
+			logging.Warnf("Queued at-risk files on unavailable store %v for repair",
+				uuid.Fmt(id))
+			delete(feed.cursor, id)
+			feed.done[id] = true
+			return true, nil
+		}
+
+		feed.cursor[id] = chunks[len(chunks)-1]
+	}
+
+	return false, nil
+}
+
+// hasLostChunk returns whether f has a chunk on a dead or missing location.
+func hasLostChunk(f *meta.File, locs map[[16]byte]meta.Location) bool {
+	for _, id := range f.Locations {
+		loc, ok := locs[id]
+		if !ok || loc.Dead {
+			return true
+		}
+	}
+	return false
+}
+
+// queueLocationRepair adds the file at path to the repair queue from the
+// location scrubber, if it still has the prefix ID pid. missing is the local
+// key of a chunk found missing from a store that is online, or empty. Events
+// for files at risk are added to atRisk, as in queueRepair.
+func (m *Multi) queueLocationRepair(layer *meta.Layer, path string, pid [16]byte, locs map[[16]byte]meta.Location, missing string, atRisk *[]events.Event) error {
+	f, err := layer.GetFile(path)
+	if err != nil {
+		return err
+	}
+	if f == nil || f.PrefixID != pid {
+		return nil
+	}
+
+	var bad []int
+	for i := range f.Locations {
+		if localKeyFor(f, i) == missing {
+			bad = append(bad, i)
+		}
+	}
+
+	return m.queueRepair(layer, f, m.fileMargin(f, locs, bad), nil, atRisk)
+}
+
+// queueRepair adds f to the repair queue with the given margin, and the
+// indices of chunks that failed to read in bad. If it can't lose any more
+// chunks, an event reporting it is added to atRisk, for the caller to emit once
+// the transaction has committed.
+func (m *Multi) queueRepair(layer *meta.Layer, f *meta.File, margin int, bad []int, atRisk *[]events.Event) error {
+	err := layer.QueueRepair(f.Path, margin, bad)
+	if err != nil {
+		return err
+	}
+
+	if margin < 1 {
+		*atRisk = append(*atRisk, events.Event{
+			Type: events.FileAtRisk,
+			Message: fmt.Sprintf("%v can lose %v more chunks before it can't be read",
+				f.Path, margin),
+			Path:    f.Path,
+			Details: map[string]interface{}{"margin": margin},
+		})
+	}
+
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/encryptio/slime/internal/logging"
 	"github.com/encryptio/slime/internal/meta"
 	"github.com/encryptio/slime/internal/store"
 	"github.com/encryptio/slime/internal/uuid"
@@ -22,7 +23,7 @@ func (m *Multi) scrubFilesAll() {
 	for {
 		done, err := m.scrubFilesStep()
 		if err != nil {
-			log.Printf("Couldn't scrubFilesStep in scrubFilesAll: %v", err)
+			logging.Errorf("Couldn't scrubFilesStep in scrubFilesAll: %v", err)
 			return
 		}
 		if done {
@@ -40,9 +41,18 @@ func (m *Multi) scrubFilesLoop() error {
 		case <-m.tomb.Dying():
 			return nil
 		case <-time.After(jitterDuration(scrubFilesWait)):
+			// files known to be at risk come before the walk over all files
+			for m.repairQueueStep() > 0 {
+				select {
+				case <-m.tomb.Dying():
+					return nil
+				default:
+				}
+			}
+
 			_, err := m.scrubFilesStep()
 			if err != nil {
-				log.Printf("Couldn't run scrubFilesStep: %v", err)
+				logging.Errorf("Couldn't run scrubFilesStep: %v", err)
 			}
 		}
 	}
@@ -110,22 +120,25 @@ func (m *Multi) scrubFilesStep() (bool, error) {
 }
 
 func (m *Multi) scrubFile(file meta.File, allLocs map[[16]byte]meta.Location) {
+	m.throttle(&m.limiters.scrub, 1, 0)
+
 	m.mu.Lock()
 	conf := m.config
 	m.mu.Unlock()
 
 	var messages []string
 	rebuild := false
-	for _, id := range file.Locations {
+	var bad []int
+	for i, id := range file.Locations {
 		loc, ok := allLocs[id]
 		if !ok {
-			rebuild = true
+			bad = append(bad, i)
 			messages = append(messages, fmt.Sprintf("location %v does not exist", uuid.Fmt(id)))
 			continue
 		}
 
 		if loc.Dead {
-			rebuild = true
+			bad = append(bad, i)
 			messages = append(messages, fmt.Sprintf("location %v is marked dead", uuid.Fmt(id)))
 			continue
 		}
@@ -137,10 +150,39 @@ func (m *Multi) scrubFile(file meta.File, allLocs map[[16]byte]meta.Location) {
 		}
 	}
 
-	if len(file.Locations) != conf.Total || int(file.DataChunks) != conf.Need {
+	if file.Archived && conf.ArchiveAfter <= 0 {
 		rebuild = true
-		messages = append(messages, fmt.Sprintf("has redundancy %v of %v, but want %v of %v",
-			file.DataChunks, len(file.Locations), conf.Need, conf.Total))
+		messages = append(messages, "is archived, but archiving is disabled")
+	} else if file.Archived {
+		// archived files always follow the whole archive layout
+		if len(file.Locations) != conf.ArchiveTotal ||
+			int(file.DataChunks) != conf.ArchiveNeed ||
+			file.Codec != conf.ArchiveCodec ||
+			int(file.LocalGroup) != conf.ArchiveLocalGroup {
+
+			rebuild = true
+			messages = append(messages, fmt.Sprintf("has archive layout %v of %v (%v), but want %v of %v (%v)",
+				file.DataChunks, len(file.Locations), CodecName(file.Codec),
+				conf.ArchiveNeed, conf.ArchiveTotal, CodecName(conf.ArchiveCodec)))
+		}
+	} else {
+		if len(file.Locations) != conf.Total || int(file.DataChunks) != conf.Need {
+			rebuild = true
+			messages = append(messages, fmt.Sprintf("has redundancy %v of %v, but want %v of %v",
+				file.DataChunks, len(file.Locations), conf.Need, conf.Total))
+		}
+
+		if file.Codec == conf.Codec && int(file.LocalGroup) != conf.LocalGroup {
+			rebuild = true
+			messages = append(messages, fmt.Sprintf("has local groups of %v, but want %v",
+				file.LocalGroup, conf.LocalGroup))
+		}
+
+		if conf.MigrateCodec && file.Codec != conf.Codec {
+			rebuild = true
+			messages = append(messages, fmt.Sprintf("uses codec %v, but want %v",
+				CodecName(file.Codec), CodecName(conf.Codec)))
+		}
 	}
 
 	for _, msg := range messages {
@@ -150,23 +192,66 @@ func (m *Multi) scrubFile(file meta.File, allLocs map[[16]byte]meta.Location) {
 	if rebuild {
 		err := m.rebuild(file.Path)
 		if err != nil {
-			log.Printf("scan on %v: couldn't rebuild: %v", file.Path, err)
+			logging.Errorf("scan on %v: couldn't rebuild: %v", file.Path, err)
 			return
 		}
 
 		log.Printf("scan on %v: successfully rebuilt", file.Path)
+	} else if len(bad) > 0 {
+		err := m.repairOrRebuild(file.Path, file.PrefixID, bad)
+		if err != nil {
+			logging.Errorf("scan on %v: couldn't repair: %v", file.Path, err)
+			return
+		}
+
+		log.Printf("scan on %v: successfully repaired", file.Path)
 	}
 }
 
 func (m *Multi) rebuild(path string) error {
-	data, st, err := m.Get(path, store.GetOptions{})
+	f, err := m.getFile(path)
 	if err != nil {
 		return err
 	}
+	if f == nil {
+		return store.ErrNotFound
+	}
+
+	m.throttle(&m.limiters.rebuild, 1, int64(f.Size))
+
+	m.mu.Lock()
+	archiving := m.config.ArchiveAfter > 0
+	m.mu.Unlock()
+
+	err = m.rewrite(f, writeOptions{
+		tier:      f.Tier,
+		archived:  f.Archived && archiving,
+		writeTime: f.WriteTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	m.repairMeter.add(storedSize(f.Size, int(f.DataChunks), len(f.Locations)), time.Now())
+	return nil
+}
+
+// rewrite rewrites f with the current layout, as described by opts. It fails
+// with store.ErrCASFailure if the file at f.Path has been changed since f was
+// read, so that settings taken from f aren't applied to newer data.
+func (m *Multi) rewrite(f *meta.File, opts writeOptions) error {
+	data, st, err := m.Get(f.Path, store.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if st.SHA256 != f.SHA256 {
+		return store.ErrCASFailure
+	}
 
-	err = m.CAS(path,
-		store.CASV{Present: true, SHA256: st.SHA256},
-		store.CASV{Present: true, SHA256: st.SHA256, Data: data}, nil)
+	opts.replaces = f.PrefixID
+	err = m.casWith(f.Path,
+		store.CASV{Present: true, SHA256: f.SHA256},
+		store.CASV{Present: true, SHA256: f.SHA256, Data: data}, opts)
 	if err != nil {
 		return err
 	}
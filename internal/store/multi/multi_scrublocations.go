@@ -4,6 +4,8 @@ import (
 	"log"
 	"time"
 
+	"github.com/encryptio/slime/internal/events"
+	"github.com/encryptio/slime/internal/logging"
 	"github.com/encryptio/slime/internal/meta"
 	"github.com/encryptio/slime/internal/store"
 	"github.com/encryptio/slime/internal/uuid"
@@ -38,7 +40,7 @@ func (m *Multi) scrubLocationsAll() {
 		return nil
 	})
 	if err != nil {
-		log.Printf("Couldn't get all locations: %v", err)
+		logging.Errorf("Couldn't get all locations: %v", err)
 		return
 	}
 
@@ -50,7 +52,7 @@ func (m *Multi) scrubLocationsAll() {
 	for {
 		done, err := m.scrubLocationsStep()
 		if err != nil {
-			log.Printf("Couldn't scrubLocationsStep in scrubLocationsAll: %v", err)
+			logging.Errorf("Couldn't scrubLocationsStep in scrubLocationsAll: %v", err)
 			return
 		}
 		if done {
@@ -70,7 +72,7 @@ func (m *Multi) scrubLocationsLoop() error {
 		case <-time.After(jitterDuration(scrubLocationsWait)):
 			_, err := m.scrubLocationsStep()
 			if err != nil {
-				log.Printf("Couldn't run scrubLocationsStep: %v", err)
+				logging.Errorf("Couldn't run scrubLocationsStep: %v", err)
 			}
 		}
 	}
@@ -196,6 +198,20 @@ func (m *Multi) scrubLocationsStep() (bool, error) {
 		return true, nil
 	}
 
+	var locs map[[16]byte]meta.Location
+	err = m.db.RunReadTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		locs, err = locationsByUUID(layer)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
 	wantFilesMap := make(map[string]struct{}, len(wantFiles))
 	for _, f := range wantFiles {
 		wantFilesMap[f] = struct{}{}
@@ -203,17 +219,19 @@ func (m *Multi) scrubLocationsStep() (bool, error) {
 
 	st := m.finder.StoreFor(thisLoc.UUID)
 	if st == nil {
-		log.Printf("Couldn't scrubLocation %v, it is offline",
+		logging.Warnf("Couldn't scrubLocation %v, it is offline",
 			uuid.Fmt(thisLoc.UUID))
 		return false, nil
 	}
 
 	haveFiles, err := st.List(from, scrubLocationsCount, nil)
 	if err != nil {
-		log.Printf("Couldn't List from %v: %v", uuid.Fmt(thisLoc.UUID), err)
+		logging.Errorf("Couldn't List from %v: %v", uuid.Fmt(thisLoc.UUID), err)
 		return false, nil
 	}
 
+	m.throttle(&m.limiters.scrub, int64(len(haveFiles)), 0)
+
 	haveFilesMap := make(map[string]struct{}, len(haveFiles))
 	for _, f := range haveFiles {
 		haveFilesMap[f] = struct{}{}
@@ -237,12 +255,12 @@ func (m *Multi) scrubLocationsStep() (bool, error) {
 		if _, ok := wantFilesMap[have]; !ok {
 			pid, err := prefixIDFromLocalKey(have)
 			if err != nil {
-				log.Printf("Couldn't figure out PrefixID from localKey(%#v): %v",
+				logging.Errorf("Couldn't figure out PrefixID from localKey(%#v): %v",
 					have, err)
 
 				err = st.CAS(have, store.AnyV, store.MissingV, nil)
 				if err != nil {
-					log.Printf("Couldn't delete extraneous chunk %v from %v: %v",
+					logging.Errorf("Couldn't delete extraneous chunk %v from %v: %v",
 						have, uuid.Fmt(thisLoc.UUID), err)
 					continue
 				}
@@ -273,7 +291,7 @@ func (m *Multi) scrubLocationsStep() (bool, error) {
 				return nil
 			})
 			if err != nil {
-				log.Printf("Couldn't check WAL for PrefixID %v: %v",
+				logging.Errorf("Couldn't check WAL for PrefixID %v: %v",
 					uuid.Fmt(pid), err)
 				continue
 			}
@@ -284,11 +302,11 @@ func (m *Multi) scrubLocationsStep() (bool, error) {
 				continue
 			}
 
-			log.Printf("deleting extraneous chunk %v on %v",
+			logging.Warnf("deleting extraneous chunk %v on %v",
 				have, uuid.Fmt(thisLoc.UUID))
 			err = st.CAS(have, store.AnyV, store.MissingV, nil)
 			if err != nil {
-				log.Printf("Couldn't delete extraneous chunk %v from %v: %v",
+				logging.Errorf("Couldn't delete extraneous chunk %v from %v: %v",
 					have, uuid.Fmt(thisLoc.UUID), err)
 				continue
 			}
@@ -297,19 +315,21 @@ func (m *Multi) scrubLocationsStep() (bool, error) {
 
 	for _, want := range checkWantFiles {
 		if _, ok := haveFilesMap[want]; !ok {
-			log.Printf("missing chunk %v on %v", want, uuid.Fmt(thisLoc.UUID))
+			logging.Warnf("missing chunk %v on %v", want, uuid.Fmt(thisLoc.UUID))
 
 			pid, err := prefixIDFromLocalKey(want)
 			if err != nil {
-				log.Printf("Couldn't figure out PrefixID from localKey(%#v): %v",
+				logging.Errorf("Couldn't figure out PrefixID from localKey(%#v): %v",
 					want, err)
 				continue
 			}
 
 			var inWAL bool
 			var path string
+			var atRisk []events.Event
 			err = m.db.RunTx(func(ctx kvl.Ctx) error {
 				path = ""
+				atRisk = nil
 
 				layer, err := meta.Open(ctx)
 				if err != nil {
@@ -326,28 +346,25 @@ func (m *Multi) scrubLocationsStep() (bool, error) {
 					if err != nil {
 						return err
 					}
+
+					return m.queueLocationRepair(layer, path, pid, locs, want, &atRisk)
 				}
 
 				return nil
 			})
 			if err != nil {
-				log.Printf("Couldn't get path for PrefixID %v: %v",
+				logging.Errorf("Couldn't queue repair for PrefixID %v: %v",
 					uuid.Fmt(pid), err)
 				continue
 			}
+			m.emitAll(atRisk)
 
 			if inWAL {
 				log.Printf("skipping rebuild of %v, prefix in WAL", path)
 				continue
 			}
 
-			err = m.rebuild(path)
-			if err != nil {
-				log.Printf("Couldn't rebuild %v: %v", path, err)
-				continue
-			}
-
-			log.Printf("successfully rebuilt %v", path)
+			logging.Infof("queued %v for repair", path)
 		}
 	}
 
@@ -363,8 +380,10 @@ func (m *Multi) scrubLocationsStep() (bool, error) {
 
 			var inWAL bool
 			var path string
+			var atRisk []events.Event
 			err = m.db.RunTx(func(ctx kvl.Ctx) error {
 				path = ""
+				atRisk = nil
 
 				layer, err := meta.Open(ctx)
 				if err != nil {
@@ -381,28 +400,23 @@ func (m *Multi) scrubLocationsStep() (bool, error) {
 					if err != nil {
 						return err
 					}
+
+					return m.queueLocationRepair(layer, path, pid, locs, "", &atRisk)
 				}
 
 				return nil
 			})
 			if err != nil {
-				log.Printf("Couldn't check wal/path for PrefixID %v: %v",
+				logging.Errorf("Couldn't queue repair for PrefixID %v: %v",
 					uuid.Fmt(pid), err)
 				continue
 			}
+			m.emitAll(atRisk)
 
 			if inWAL {
 				log.Printf("skipping rebuild of PrefixID %v on dead store, prefix in WAL", uuid.Fmt(pid))
 				continue
 			}
-
-			err = m.rebuild(path)
-			if err != nil {
-				log.Printf("Couldn't rebuild %v: %v", path, err)
-				continue
-			}
-
-			log.Printf("successfully rebuilt %v", path)
 		}
 	}
 
@@ -1,9 +1,9 @@
 package multi
 
 import (
-	"log"
 	"time"
 
+	"github.com/encryptio/slime/internal/logging"
 	"github.com/encryptio/slime/internal/meta"
 
 	"github.com/encryptio/kvl"
@@ -21,7 +21,7 @@ func (m *Multi) scrubWALLoop() error {
 		case <-time.After(jitterDuration(scrubWALWait)):
 			err := m.scrubWAL()
 			if err != nil {
-				log.Printf("Couldn't run scrubWAL: %v", err)
+				logging.Errorf("Couldn't run scrubWAL: %v", err)
 			}
 		}
 	}
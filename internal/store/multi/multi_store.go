@@ -6,15 +6,15 @@ import (
 	"fmt"
 	"math/rand"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/encryptio/slime/internal/meta"
 	"github.com/encryptio/slime/internal/retry"
-	"github.com/encryptio/slime/internal/rs"
-	"github.com/encryptio/slime/internal/rs/gf"
 	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/tracing"
 	"github.com/encryptio/slime/internal/uuid"
 
 	"github.com/encryptio/kvl"
@@ -25,6 +25,8 @@ var (
 	ErrInsufficientChunks = errors.New("not enough chunks available")
 	ErrBadHash            = errors.New("bad checksum after reconstruction")
 	ErrTooManyRetries     = errors.New("too many retries")
+	ErrUnknownCodec       = errors.New("unknown codec")
+	ErrBadChunkLength     = errors.New("chunks have differing lengths")
 
 	dataOnlyTimeout = time.Second * 5
 )
@@ -42,6 +44,14 @@ func prefixIDFromLocalKey(key string) ([16]byte, error) {
 	return uuid.Parse(parts[0])
 }
 
+func chunkIndexFromLocalKey(key string) (int, error) {
+	i := strings.LastIndex(key, "_")
+	if i == -1 {
+		return 0, errors.New("not enough key components")
+	}
+	return strconv.Atoi(key[i+1:])
+}
+
 func (m *Multi) UUID() [16]byte {
 	return m.uuid
 }
@@ -51,8 +61,13 @@ func (m *Multi) Name() string {
 }
 
 func (m *Multi) getFile(key string) (*meta.File, error) {
+	return m.getFileTraced(key, tracing.SpanContext{})
+}
+
+// getFileTraced is getFile, tracing the transaction as a child of parent.
+func (m *Multi) getFileTraced(key string, parent tracing.SpanContext) (*meta.File, error) {
 	var file *meta.File
-	err := m.db.RunReadTx(func(ctx kvl.Ctx) error {
+	err := m.runReadTx(parent, "getFile", func(ctx kvl.Ctx) error {
 		layer, err := meta.Open(ctx)
 		if err != nil {
 			return err
@@ -67,10 +82,36 @@ func (m *Multi) getFile(key string) (*meta.File, error) {
 	return file, nil
 }
 
-func (m *Multi) Get(key string, opts store.GetOptions) ([]byte, store.Stat, error) {
+// runTx is m.db.RunTx, traced as a child of parent.
+func (m *Multi) runTx(parent tracing.SpanContext, name string, fn func(kvl.Ctx) error) error {
+	span := tracing.Start(parent, "kvl.RunTx "+name)
+	err := m.db.RunTx(fn)
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+// runReadTx is m.db.RunReadTx, traced as a child of parent.
+func (m *Multi) runReadTx(parent tracing.SpanContext, name string, fn func(kvl.Ctx) error) error {
+	span := tracing.Start(parent, "kvl.RunReadTx "+name)
+	err := m.db.RunReadTx(fn)
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+func (m *Multi) Get(key string, opts store.GetOptions) (data []byte, st store.Stat, err error) {
+	span := tracing.Start(opts.Trace, "multi.Get")
+	span.SetAttribute("key", key)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	opts.Trace = span.Context()
+
 	r := retry.New(10)
 	for r.Next() {
-		f, err := m.getFile(key)
+		f, err := m.getFileTraced(key, opts.Trace)
 		if err != nil {
 			return nil, store.Stat{}, err
 		}
@@ -81,7 +122,7 @@ func (m *Multi) Get(key string, opts store.GetOptions) ([]byte, store.Stat, erro
 
 		data, err := m.reconstruct(f, opts)
 		if err != nil {
-			f2, err2 := m.getFile(key)
+			f2, err2 := m.getFileTraced(key, opts.Trace)
 			if err2 != nil {
 				return nil, store.Stat{}, err2
 			}
@@ -103,7 +144,40 @@ func (m *Multi) Get(key string, opts store.GetOptions) ([]byte, store.Stat, erro
 	return nil, store.Stat{}, ErrTooManyRetries
 }
 
+// getChunkData fetches enough chunks of f to reconstruct it. Data chunks are
+// requested first. If any of them fail, or are slower than their store's
+// hedge delay (see Finder.HedgeDelay), parity chunks are requested from the
+// fastest stores as well, and whichever chunks arrive first are used. Requests
+// still outstanding at that point are cancelled.
 func (m *Multi) getChunkData(f *meta.File, opts store.GetOptions) [][]byte {
+	return m.getChunkDataExcept(f, opts, nil)
+}
+
+// getChunkDataExcept is like getChunkData, but never reads the chunks at the
+// given indices.
+//
+// Chunks that fail to read from stores that are online schedule a read repair
+// of the file.
+func (m *Multi) getChunkDataExcept(f *meta.File, opts store.GetOptions, except []int) [][]byte {
+	span := tracing.Start(opts.Trace, "multi.getChunkData")
+	span.SetAttribute("key", f.Path)
+	defer span.End()
+
+	skip := make([]bool, len(f.Locations))
+	for _, idx := range except {
+		skip[idx] = true
+	}
+
+	var failed []int
+	requested := 0
+	defer func() {
+		span.SetAttribute("requested", requested)
+		span.SetAttribute("failed", len(failed))
+		if len(failed) > 0 {
+			m.scheduleReadRepair(*f, failed)
+		}
+	}()
+
 	var wg sync.WaitGroup
 	defer wg.Wait()
 
@@ -111,78 +185,141 @@ func (m *Multi) getChunkData(f *meta.File, opts store.GetOptions) [][]byte {
 	defer close(localCancel)
 
 	chunkData := make([][]byte, len(f.Locations))
+	have := make([]bool, len(f.Locations))
 
 	type chunkResult struct {
-		index int
-		data  []byte
+		index  int
+		data   []byte
+		failed bool // the store was online, but the read failed
 	}
 
 	// NB: buffer size is to avoid deadlocks between defer wg.Wait() and results
 	// writes during local and upstream cancellation
 	results := make(chan chunkResult, len(f.Locations))
 
+	// all chunks are about the same size, so one estimate does for hedging
+	chunkSize := int64(f.Size)
+	if f.DataChunks > 0 {
+		chunkSize = (chunkSize + int64(f.DataChunks) - 1) / int64(f.DataChunks)
+	}
+
 	work := func(i int) {
 		st := m.finder.StoreFor(f.Locations[i])
 		var data []byte
+		failed := false
 		if st != nil {
 			localKey := localKeyFor(f, i)
-			data, _, _ = st.Get(localKey, store.GetOptions{
-				Cancel:   localCancel,
-				NoVerify: opts.NoVerify,
+			start := time.Now()
+			var err error
+			data, _, err = st.Get(localKey, store.GetOptions{
+				Cancel:    localCancel,
+				NoVerify:  opts.NoVerify,
+				RequestID: opts.RequestID,
+				Trace:     span.Context(),
 			})
+			if err == nil {
+				m.finder.RecordLatency(f.Locations[i], int64(len(data)), time.Since(start))
+			} else {
+				// slow stores are the ones whose reads get cancelled, so
+				// those count too, as far as they got
+				m.finder.RecordLatencyBound(f.Locations[i], chunkSize, time.Since(start))
+				if err != store.ErrCancelled {
+					failed = true
+				}
+			}
 			// TODO: log err?
 		}
-		results <- chunkResult{i, data}
+		results <- chunkResult{i, data, failed}
 		wg.Done()
 	}
 
+	// Parity chunks, fastest stores first
+	var parity []chunkDelay
+	for i := int(f.DataChunks); i < len(f.Locations); i++ {
+		if !skip[i] {
+			parity = append(parity, chunkDelay{i, m.finder.HedgeDelay(f.Locations[i], chunkSize)})
+		}
+	}
+	sort.Stable(chunkDelaySlice(parity))
+
+	pending := 0
+	launchParity := func(count int) {
+		for ; count > 0 && len(parity) > 0; count-- {
+			wg.Add(1)
+			pending++
+			requested++
+			go work(parity[0].index)
+			parity = parity[1:]
+		}
+	}
+
 	// try to get data only at first
+	var hedgeDelay time.Duration
 	for i := 0; i < int(f.DataChunks); i++ {
+		if skip[i] {
+			launchParity(1)
+			continue
+		}
+		if d := m.finder.HedgeDelay(f.Locations[i], chunkSize); d > hedgeDelay {
+			hedgeDelay = d
+		}
 		wg.Add(1)
+		pending++
+		requested++
 		go work(i)
 	}
 
-	timer := time.NewTimer(dataOnlyTimeout)
-	timeoutChan := timer.C
+	timer := time.NewTimer(hedgeDelay)
 	defer timer.Stop()
 
-	returned := 0
-	got := 0
-	for {
+	for pending > 0 {
 		select {
 		case res := <-results:
-			returned++
+			pending--
 			if res.data != nil {
-				got++
 				chunkData[res.index] = res.data
+				have[res.index] = true
+				if canDecode(f, have) {
+					return chunkData
+				}
+				if pending == 0 {
+					// this chunk didn't help (possible with CodecLRC)
+					launchParity(1)
+				}
 			} else {
-				if timeoutChan != nil {
-					// failed to get one of the data chunks, go get the parity
-					timeoutChan = nil
-					for i := int(f.DataChunks); i < len(f.Locations); i++ {
-						wg.Add(1)
-						go work(i)
-					}
+				if res.failed {
+					failed = append(failed, res.index)
 				}
+				// replace the failed request
+				launchParity(1)
 			}
 
-			if got >= int(f.DataChunks) || returned == len(f.Locations) {
-				return chunkData
-			}
-		case <-timeoutChan:
-			// data was too slow returning, go get the parity
-			timeoutChan = nil
-			for i := int(f.DataChunks); i < len(f.Locations); i++ {
-				wg.Add(1)
-				go work(i)
+		case <-timer.C:
+			// Requests are slower than expected; race one more request
+			// against each of them.
+			launchParity(pending)
+			if len(parity) > 0 {
+				timer.Reset(hedgeDelay)
 			}
+
 		case <-opts.Cancel:
 			return chunkData
 		}
 	}
+
+	return chunkData
 }
 
-func (m *Multi) reconstruct(f *meta.File, opts store.GetOptions) ([]byte, error) {
+func (m *Multi) reconstruct(f *meta.File, opts store.GetOptions) (data []byte, err error) {
+	span := tracing.Start(opts.Trace, "multi.reconstruct")
+	span.SetAttribute("key", f.Path)
+	span.SetAttribute("size", int64(f.Size))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	opts.Trace = span.Context()
+
 	chunkData := m.getChunkData(f, opts)
 
 	select {
@@ -191,54 +328,9 @@ func (m *Multi) reconstruct(f *meta.File, opts store.GetOptions) ([]byte, error)
 	default:
 	}
 
-	rawDataAvailable := f.MappingValue == 0
-	if rawDataAvailable {
-		for i := 0; i < int(f.DataChunks); i++ {
-			if chunkData[i] == nil {
-				rawDataAvailable = false
-				break
-			}
-		}
-	}
-
-	data := make([]byte, 0, int(f.Size)+16)
-	if rawDataAvailable {
-		// fast path:
-		// - chunkData[0..f.DataChunks-1] are non-nil
-		// - f.MappingValue == 0
-
-		// TODO: fast path when f.MappingValue != 0
-		for i := 0; i < int(f.DataChunks); i++ {
-			data = append(data, chunkData[i]...)
-		}
-		data = data[:int(f.Size)]
-	} else {
-		// slow path: full reconstruction
-
-		indicies := make([]int, 0, len(chunkData))
-		chunks := make([][]uint32, 0, len(chunkData))
-		for i, data := range chunkData {
-			if data == nil {
-				continue
-			}
-			chunk := gf.MapToGFWith(data, f.MappingValue)
-
-			indicies = append(indicies, i)
-			chunks = append(chunks, chunk)
-		}
-
-		if len(chunks) < int(f.DataChunks) {
-			return nil, ErrInsufficientChunks
-		}
-
-		chunks = chunks[:int(f.DataChunks)]
-		indicies = indicies[:int(f.DataChunks)]
-
-		dataVecs := rs.RecoverData(chunks, indicies)
-		for _, vec := range dataVecs {
-			data = append(data, gf.MapFromGF(f.MappingValue, vec)...)
-		}
-		data = data[:int(f.Size)]
+	data, err = decodeChunks(f, chunkData)
+	if err != nil {
+		return nil, err
 	}
 
 	if !opts.NoVerify {
@@ -268,43 +360,91 @@ func (m *Multi) Stat(key string, cancel <-chan struct{}) (store.Stat, error) {
 	}, nil
 }
 
-func splitVector(data []uint32, count int) [][]uint32 {
-	perVector := (len(data) + count - 1) / count
+func (m *Multi) CAS(key string, from, to store.CASV, cancel <-chan struct{}) error {
+	return m.cas(key, from, to, "", tracing.SpanContext{})
+}
 
-	parts := make([][]uint32, count)
-	for i := range parts {
-		if len(data) >= perVector {
-			parts[i] = data[:perVector]
-			data = data[perVector:]
-		} else {
-			n := make([]uint32, perVector)
-			copy(n, data)
-			parts[i] = n
-			data = nil
-		}
-	}
+// WithRequestID returns a view of the Multi that sends id along with the chunk
+// writes it makes. Reads use GetOptions.RequestID instead.
+func (m *Multi) WithRequestID(id string) store.Store {
+	return requestMulti{m, id, tracing.SpanContext{}}
+}
 
-	if len(data) > 0 {
-		panic("splitVector has leftovers")
-	}
+// WithTrace returns a view of the Multi that traces its writes as children of
+// sc. Reads use GetOptions.Trace instead.
+func (m *Multi) WithTrace(sc tracing.SpanContext) store.Store {
+	return requestMulti{m, "", sc}
+}
 
-	// pad the last with zeroes if needed
-	if len(parts[len(parts)-1]) != perVector {
-		n := make([]uint32, perVector)
-		copy(n, parts[len(parts)-1])
-		parts[len(parts)-1] = n
+type requestMulti struct {
+	*Multi
+	requestID string
+	trace     tracing.SpanContext
+}
+
+func (r requestMulti) WithRequestID(id string) store.Store {
+	return requestMulti{r.Multi, id, r.trace}
+}
+
+func (r requestMulti) WithTrace(sc tracing.SpanContext) store.Store {
+	return requestMulti{r.Multi, r.requestID, sc}
+}
+
+func (r requestMulti) CAS(key string, from, to store.CASV, cancel <-chan struct{}) error {
+	return r.cas(key, from, to, r.requestID, r.trace)
+}
+
+func (m *Multi) cas(key string, from, to store.CASV, requestID string, trace tracing.SpanContext) error {
+	span := tracing.Start(trace, "multi.CAS")
+	span.SetAttribute("key", key)
+	span.SetAttribute("size", len(to.Data))
+	defer span.End()
+
+	m.mu.Lock()
+	tier := m.config.HotTier
+	m.mu.Unlock()
+
+	err := m.casWith(key, from, to, writeOptions{
+		tier:      tier,
+		requestID: requestID,
+		trace:     span.Context(),
+	})
+	span.SetError(err)
+	if err == nil && to.Present {
+		m.RecordAccess(key)
 	}
+	return err
+}
 
-	return parts
+// writeOptions controls where and how casWith writes new chunks.
+type writeOptions struct {
+	tier     string // tier of the locations to write to
+	archived bool   // use the archive layout instead of the write layout
+
+	// writeTime is recorded instead of the current time if it is nonzero, so
+	// that rewriting a file doesn't make it look new.
+	writeTime int64
+
+	// replaces is the prefix ID the file being replaced must still have, if
+	// nonzero. It keeps settings copied from a file, such as writeTime, from
+	// being applied to different data written since.
+	replaces [16]byte
+
+	// requestID is sent along with the chunk writes, if not empty
+	requestID string
+
+	// trace is the span the write is part of, if it is being traced
+	trace tracing.SpanContext
 }
 
-func (m *Multi) CAS(key string, from, to store.CASV, cancel <-chan struct{}) error {
+// casWith is CAS, writing any new chunks as described by opts.
+func (m *Multi) casWith(key string, from, to store.CASV, opts writeOptions) error {
 	var file *meta.File
 	prefixid := uuid.Gen4()
 
 	if to.Present {
 		// check before doing work; additionally, add a WAL entry
-		err := m.db.RunTx(func(ctx kvl.Ctx) error {
+		err := m.runTx(opts.trace, "check", func(ctx kvl.Ctx) error {
 			layer, err := meta.Open(ctx)
 			if err != nil {
 				return err
@@ -329,6 +469,15 @@ func (m *Multi) CAS(key string, from, to store.CASV, cancel <-chan struct{}) err
 					}
 				}
 			}
+			if !replacesFile(opts, oldFile) {
+				return store.ErrCASFailure
+			}
+
+			bytes, objects := usageDelta(oldFile, to)
+			err = layer.CheckQuotas(key, bytes, objects)
+			if err != nil {
+				return err
+			}
 
 			err = layer.WALMark(prefixid)
 			if err != nil {
@@ -338,17 +487,20 @@ func (m *Multi) CAS(key string, from, to store.CASV, cancel <-chan struct{}) err
 			return nil
 		})
 		if err != nil {
+			if err == meta.ErrQuotaExceeded {
+				err = store.ErrQuotaExceeded
+			}
 			return err
 		}
 
-		file, err = m.writeChunks(key, to.Data, to.SHA256, prefixid)
+		file, err = m.writeChunks(key, to.Data, to.SHA256, prefixid, opts)
 		if err != nil {
 			return err
 		}
 	}
 
 	var oldFile *meta.File
-	err := m.db.RunTx(func(ctx kvl.Ctx) error {
+	err := m.runTx(opts.trace, "commit", func(ctx kvl.Ctx) error {
 		layer, err := meta.Open(ctx)
 		if err != nil {
 			return err
@@ -373,6 +525,15 @@ func (m *Multi) CAS(key string, from, to store.CASV, cancel <-chan struct{}) err
 				}
 			}
 		}
+		if !replacesFile(opts, oldFile) {
+			return store.ErrCASFailure
+		}
+
+		bytes, objects := usageDelta(oldFile, to)
+		err = layer.ChargeUsage(key, bytes, objects)
+		if err != nil {
+			return err
+		}
 
 		if to.Present {
 			err = layer.SetFile(file)
@@ -404,6 +565,9 @@ func (m *Multi) CAS(key string, from, to store.CASV, cancel <-chan struct{}) err
 		if file != nil {
 			m.asyncDeletions <- file
 		}
+		if err == meta.ErrQuotaExceeded {
+			err = store.ErrQuotaExceeded
+		}
 		return err
 	}
 
@@ -414,6 +578,29 @@ func (m *Multi) CAS(key string, from, to store.CASV, cancel <-chan struct{}) err
 	return nil
 }
 
+// replacesFile returns whether a write with opts may replace oldFile (nil if
+// there is none.)
+func replacesFile(opts writeOptions, oldFile *meta.File) bool {
+	if opts.replaces == [16]byte{} {
+		return true
+	}
+	return oldFile != nil && oldFile.PrefixID == opts.replaces
+}
+
+// usageDelta returns how replacing oldFile (nil if there is none) with to
+// changes the bytes and objects counted against quotas.
+func usageDelta(oldFile *meta.File, to store.CASV) (bytes, objects int64) {
+	if oldFile != nil {
+		bytes -= int64(oldFile.Size)
+		objects--
+	}
+	if to.Present {
+		bytes += int64(len(to.Data))
+		objects++
+	}
+	return bytes, objects
+}
+
 func (m *Multi) deleteChunks(file *meta.File) error {
 	if file == nil {
 		return nil
@@ -438,52 +625,68 @@ func (m *Multi) deleteChunks(file *meta.File) error {
 	return nil
 }
 
-func (m *Multi) getStoreWeights() map[[16]byte]int64 {
-	finderEntries := m.finder.Stores()
+// placementBias is added to every store's available space when choosing
+// where to write, so that nearly full stores still get some writes until they
+// reach their limits, rather than almost none.
+var placementBias int64 = 10000000000
 
-	weights := make(map[[16]byte]int64, len(finderEntries))
-	for id, fe := range finderEntries {
-		weights[id] = 10000000000 + fe.Free
+// placementScore returns how much a store is preferred for new chunks, taking
+// its limits and weight into account. It is not positive if no new chunks
+// should be written to it.
+func placementScore(loc meta.Location, fe FinderEntry) int64 {
+	avail := loc.Available(fe.Free, fe.Capacity)
+	if avail <= 0 {
+		return avail
 	}
-
-	return weights
+	return (placementBias + avail) / 100 * loc.PlacementWeight()
 }
 
-func (m *Multi) orderTargets() ([]store.Store, error) {
-	m.mu.Lock()
-	conf := m.config
-	m.mu.Unlock()
-
-	storesMap := make(map[[16]byte]store.Store)
-	for id, fe := range m.finder.Stores() {
-		storesMap[id] = fe.Store
-	}
+// orderTargets returns the writable stores in the given tier with room for new
+// chunks, in a random order weighted by their placement scores, along with
+// every known location. It fails if there are fewer than total of them.
+func (m *Multi) orderTargets(tier string, total int) ([]store.Store, map[[16]byte]meta.Location, error) {
+	finderEntries := m.finder.Stores()
 
-	var locs []meta.Location
+	var locs map[[16]byte]meta.Location
 	err := m.db.RunReadTx(func(ctx kvl.Ctx) error {
 		layer, err := meta.Open(ctx)
 		if err != nil {
 			return err
 		}
 
-		locs, err = layer.AllLocations()
+		locs, err = locationsByUUID(layer)
 		return err
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	storesMap := make(map[[16]byte]store.Store, len(locs))
+	weights := make(map[[16]byte]int64, len(locs))
+	writable := 0
 	for _, loc := range locs {
-		if loc.Dead {
-			delete(storesMap, loc.UUID)
+		fe, ok := finderEntries[loc.UUID]
+		if !ok || !loc.Writable() || loc.Tier != tier {
+			continue
+		}
+		writable++
+
+		score := placementScore(loc, fe)
+		if score <= 0 {
+			continue
 		}
+
+		storesMap[loc.UUID] = fe.Store
+		weights[loc.UUID] = score
 	}
 
-	if len(storesMap) < conf.Total {
-		return nil, ErrInsufficientStores
+	if writable < total {
+		return nil, nil, ErrInsufficientStores
 	}
 
-	weights := m.getStoreWeights()
+	if len(storesMap) < total {
+		return nil, nil, store.ErrFull
+	}
 
 	stores := make([]store.Store, 0, len(storesMap))
 	for len(weights) > 0 {
@@ -510,63 +713,161 @@ func (m *Multi) orderTargets() ([]store.Store, error) {
 		delete(weights, chosenID)
 	}
 
-	return stores, nil
+	return stores, locs, nil
+}
+
+// failureDomain returns the name shared by locations that are likely to fail
+// together. Stores reached through the same chunk server usually share a
+// machine.
+func failureDomain(loc meta.Location) string {
+	return loc.URL
 }
 
-func (m *Multi) writeChunks(key string, data []byte, sha [32]byte, prefixid [16]byte) (*meta.File, error) {
+// groupDomains returns the failure domains holding the other members of chunk
+// idx's local group. It is empty unless f uses CodecLRC and idx is a member of
+// a local group.
+func groupDomains(f *meta.File, idx int, locs map[[16]byte]meta.Location) map[string]bool {
+	domains := make(map[string]bool)
+	if f.Codec != CodecLRC {
+		return domains
+	}
+
+	layout := lrcLayoutFor(f)
+	if !layout.valid() || layout.groupOf(idx) < 0 {
+		return domains
+	}
+
+	for _, member := range layout.members(layout.groupOf(idx)) {
+		if member == idx {
+			continue
+		}
+		if loc, ok := locs[f.Locations[member]]; ok {
+			domains[failureDomain(loc)] = true
+		}
+	}
+	return domains
+}
+
+// placeGroups reorders stores, as returned by orderTargets, so that stores[i]
+// is where chunk i of a file with the given LRC layout goes. The members of
+// each local group are put in different failure domains where possible, so
+// that losing one of them costs a group at most one chunk, which its local
+// parity can rebuild. Stores past the first l.total are left over as spares.
+func placeGroups(stores []store.Store, locs map[[16]byte]meta.Location, l lrcLayout) []store.Store {
+	left := append([]store.Store(nil), stores...)
+	take := func(avoid map[string]bool) store.Store {
+		pick := 0
+		for i, st := range left {
+			if !avoid[failureDomain(locs[st.UUID()])] {
+				pick = i
+				break
+			}
+		}
+		st := left[pick]
+		left = append(left[:pick], left[pick+1:]...)
+		return st
+	}
+
+	placed := make([]store.Store, l.total)
+	for g := 0; g < l.groups(); g++ {
+		avoid := make(map[string]bool)
+		for _, idx := range l.members(g) {
+			placed[idx] = take(avoid)
+			avoid[failureDomain(locs[placed[idx].UUID()])] = true
+		}
+	}
+	for i := l.need; i < l.need+l.global(); i++ {
+		placed[i] = take(nil)
+	}
+
+	return append(placed, left...)
+}
+
+func (m *Multi) writeChunks(key string, data []byte, sha [32]byte, prefixid [16]byte, opts writeOptions) (_ *meta.File, err error) {
+	span := tracing.Start(opts.trace, "multi.writeChunks")
+	span.SetAttribute("key", key)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	m.mu.Lock()
 	conf := m.config
 	m.mu.Unlock()
 
-	stores, err := m.orderTargets()
+	need, total, codec, localGroup := conf.Need, conf.Total, conf.Codec, conf.LocalGroup
+	if opts.archived {
+		need, total, codec, localGroup = conf.ArchiveNeed, conf.ArchiveTotal,
+			conf.ArchiveCodec, conf.ArchiveLocalGroup
+	}
+
+	stores, locs, err := m.orderTargets(opts.tier, total)
 	if err != nil {
 		return nil, err
 	}
+	if codec == CodecLRC {
+		stores = placeGroups(stores, locs, lrcLayout{need, total, localGroup})
+	}
+
+	mapping, parts := encodeChunks(codec, data, need, total, localGroup)
 
-	mapping, all := gf.MapToGF(data)
-	parts := splitVector(all, conf.Need)
-	parityParts := make([][]uint32, conf.Total-conf.Need)
-	for i := range parityParts {
-		parityParts[i] = rs.CreateParity(parts, i+len(parts), nil)
+	writeTime := opts.writeTime
+	if writeTime == 0 {
+		writeTime = time.Now().Unix()
 	}
-	parts = append(parts, parityParts...)
 
 	file := &meta.File{
 		Path:         key,
 		Size:         uint64(len(data)),
-		WriteTime:    time.Now().Unix(),
+		WriteTime:    writeTime,
 		PrefixID:     prefixid,
-		DataChunks:   uint16(conf.Need),
+		DataChunks:   uint16(need),
 		MappingValue: mapping,
+		Codec:        codec,
+		LocalGroup:   uint16(localGroup),
+		Tier:         opts.tier,
+		Archived:     opts.archived,
 		SHA256:       sha,
 	}
 
-	storeCh := make(chan store.Store, len(stores))
-	for _, st := range stores {
-		storeCh <- st
+	// Chunk i goes to stores[i]; if that write fails, it goes to whichever
+	// of the spare stores is free next.
+	spares := make(chan store.Store, len(stores)-len(parts))
+	for _, st := range stores[len(parts):] {
+		spares <- st
 	}
-	close(storeCh)
+	close(spares)
 
 	file.Locations = make([][16]byte, len(parts))
 	errs := make(chan error)
 	for i, part := range parts {
-		go func(i int, part []uint32) {
-			data := gf.MapFromGF(mapping, part)
+		go func(i int, part []byte, first store.Store) {
 			localKey := localKeyFor(file, i)
-			dataV := store.DataV(data)
-			for st := range storeCh {
-				err := st.CAS(localKey, store.AnyV, dataV, nil)
+			dataV := store.DataV(part)
+			write := func(st store.Store) bool {
+				tagged := store.WithTrace(store.WithRequestID(st, opts.requestID), span.Context())
+				err := tagged.CAS(localKey, store.AnyV, dataV, nil)
 				if err != nil {
 					// TODO: log
-					continue
+					return false
 				}
 
 				file.Locations[i] = st.UUID()
+				return true
+			}
+
+			if write(first) {
 				errs <- nil
 				return
 			}
+			for st := range spares {
+				if write(st) {
+					errs <- nil
+					return
+				}
+			}
 			errs <- ErrInsufficientStores
-		}(i, part)
+		}(i, part, stores[i])
 	}
 
 	var theError error
@@ -616,6 +917,18 @@ func (m *Multi) List(after string, limit int, cancel <-chan struct{}) ([]string,
 	return names, nil
 }
 
+type chunkDelay struct {
+	index int
+	delay time.Duration
+}
+
+// sort.Interface
+type chunkDelaySlice []chunkDelay
+
+func (s chunkDelaySlice) Len() int           { return len(s) }
+func (s chunkDelaySlice) Less(i, j int) bool { return s[i].delay < s[j].delay }
+func (s chunkDelaySlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 // sort.Interface
 type int64Slice []int64
 
@@ -1,16 +1,27 @@
 package multi
 
 import (
+	"io/ioutil"
 	"math/rand"
 	"net/http/httptest"
+	"os"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/encryptio/slime/internal/chunkserver"
+	"github.com/encryptio/slime/internal/events"
+	"github.com/encryptio/slime/internal/meta"
 	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/store/cache"
 	"github.com/encryptio/slime/internal/store/storetests"
+	"github.com/encryptio/slime/internal/tracing"
+	"github.com/encryptio/slime/internal/uuid"
 
+	"github.com/encryptio/kvl"
 	"github.com/encryptio/kvl/backend/ram"
 )
 
@@ -308,3 +319,1349 @@ func TestMultiHungStoreDoesntBlock(t *testing.T) {
 		k.setBlocked(false)
 	}
 }
+
+func TestMultiCodecs(t *testing.T) {
+	for _, codec := range []uint8{CodecPrime, CodecGF256} {
+		killers, multi, _, done := prepareMultiTest(t, 3, 5, 5)
+
+		err := multi.SetCodec(codec, false)
+		if err != nil {
+			done()
+			t.Fatalf("Couldn't set codec: %v", err)
+		}
+
+		for i := 0; i < 20; i++ {
+			key := strconv.FormatInt(int64(i), 10)
+			storetests.ShouldCAS(t, multi, key, store.MissingV, store.DataV(randomValue(i*7)))
+		}
+
+		killers[0].setKilled(true)
+		killers[3].setKilled(true)
+
+		for i := 0; i < 20; i++ {
+			key := strconv.FormatInt(int64(i), 10)
+			f, err := multi.getFile(key)
+			if err != nil {
+				t.Fatalf("Couldn't get file: %v", err)
+			}
+			if f.Codec != codec {
+				t.Errorf("file %v has codec %v, wanted %v", key, f.Codec, codec)
+			}
+
+			_, _, err = multi.Get(key, store.GetOptions{})
+			if err != nil {
+				t.Errorf("Couldn't Get(%v) with codec %v: %v",
+					key, CodecName(codec), err)
+			}
+		}
+
+		done()
+	}
+}
+
+func TestMultiScrubMigratesCodec(t *testing.T) {
+	_, multi, _, done := prepareMultiTest(t, 2, 3, 3)
+	defer done()
+
+	data := []byte("an old file, written before the times of GF(2^8)")
+
+	err := multi.SetCodec(CodecPrime, false)
+	if err != nil {
+		t.Fatalf("Couldn't set codec: %v", err)
+	}
+
+	storetests.ShouldCAS(t, multi, "a", store.MissingV, store.DataV(data))
+
+	err = multi.SetCodec(CodecGF256, false)
+	if err != nil {
+		t.Fatalf("Couldn't set codec: %v", err)
+	}
+
+	multi.scrubAll()
+
+	f, err := multi.getFile("a")
+	if err != nil {
+		t.Fatalf("Couldn't get file: %v", err)
+	}
+	if f.Codec != CodecPrime {
+		t.Errorf("scrub migrated file codec without migration enabled")
+	}
+
+	err = multi.SetCodec(CodecGF256, true)
+	if err != nil {
+		t.Fatalf("Couldn't set codec: %v", err)
+	}
+
+	multi.scrubAll()
+
+	f, err = multi.getFile("a")
+	if err != nil {
+		t.Fatalf("Couldn't get file: %v", err)
+	}
+	if f.Codec != CodecGF256 {
+		t.Errorf("scrub did not migrate file to new codec")
+	}
+
+	storetests.ShouldGet(t, multi, "a", data)
+}
+
+func TestMultiLRCLocalRepair(t *testing.T) {
+	killers, multi, mocks, done := prepareMultiTest(t, 4, 8, 8)
+	defer done()
+
+	err := multi.SetLayout(Layout{Need: 4, Total: 8, Codec: CodecLRC, LocalGroup: 2}, nil)
+	if err != nil {
+		t.Fatalf("Couldn't set layout: %v", err)
+	}
+
+	data := randomValue(1000)
+	storetests.ShouldCAS(t, multi, "key", store.MissingV, store.DataV(data))
+
+	f, err := multi.getFile("key")
+	if err != nil {
+		t.Fatalf("Couldn't get file: %v", err)
+	}
+
+	mockFor := func(id [16]byte) int {
+		for i, mock := range mocks {
+			if mock.UUID() == id {
+				return i
+			}
+		}
+		t.Fatalf("No mock store for %v", uuid.Fmt(id))
+		return -1
+	}
+
+	// Lose chunk 0, then take the stores holding the other group's data and
+	// one global parity chunk offline. A full rebuild is impossible now, but
+	// chunk 0 can still be rebuilt from chunk 1 and its local parity.
+	storetests.ShouldCAS(t, mocks[mockFor(f.Locations[0])], localKeyFor(f, 0),
+		store.AnyV, store.MissingV)
+	for _, idx := range []int{2, 3, 4} {
+		killers[mockFor(f.Locations[idx])].setKilled(true)
+	}
+
+	err = multi.repairOrRebuild("key", f.PrefixID, []int{0})
+	if err != nil {
+		t.Fatalf("Couldn't repair chunk 0: %v", err)
+	}
+
+	storetests.ShouldGet(t, mocks[mockFor(f.Locations[0])], localKeyFor(f, 0), data[:250])
+
+	for _, killer := range killers {
+		killer.setKilled(false)
+	}
+
+	storetests.ShouldGet(t, multi, "key", data)
+}
+
+func TestMultiLRCBadLayout(t *testing.T) {
+	_, multi, _, done := prepareMultiTest(t, 4, 8, 8)
+	defer done()
+
+	bad := []Layout{
+		{Need: 4, Total: 8, Codec: CodecLRC},
+		{Need: 4, Total: 5, Codec: CodecLRC, LocalGroup: 2},
+		{Need: 4, Total: 8, Codec: CodecLRC, LocalGroup: 5},
+		{Need: 4, Total: 8, Codec: CodecGF256, LocalGroup: 2},
+	}
+
+	for _, l := range bad {
+		err := multi.SetLayout(l, nil)
+		if _, ok := err.(BadConfigError); !ok {
+			t.Errorf("SetLayout(%#v) returned %v, wanted a BadConfigError", l, err)
+		}
+	}
+}
+
+func TestMultiSetLayoutAudit(t *testing.T) {
+	_, multi, _, done := prepareMultiTest(t, 2, 3, 3)
+	defer done()
+
+	e := meta.AuditEntry{Time: 1000, ID: uuid.Gen4(), Action: "redundancy"}
+	err := multi.SetLayout(Layout{Need: 2, Total: 3, Codec: DefaultCodec}, &e)
+	if err != nil {
+		t.Fatalf("Couldn't set layout: %v", err)
+	}
+
+	// a rejected layout records nothing
+	bad := meta.AuditEntry{Time: 2000, ID: uuid.Gen4(), Action: "redundancy"}
+	err = multi.SetLayout(Layout{Need: 4, Total: 3, Codec: DefaultCodec}, &bad)
+	if _, ok := err.(BadConfigError); !ok {
+		t.Fatalf("SetLayout with a bad layout returned %v, wanted a BadConfigError", err)
+	}
+
+	var entries []meta.AuditEntry
+	err = multi.db.RunReadTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+		entries, err = layer.AuditEntries(0, [16]byte{}, 10)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Couldn't get audit entries: %v", err)
+	}
+	if !reflect.DeepEqual(entries, []meta.AuditEntry{e}) {
+		t.Errorf("Audit log has %v, wanted %v", entries, []meta.AuditEntry{e})
+	}
+}
+
+func TestPlaceGroups(t *testing.T) {
+	// Eight stores on four chunk servers
+	var stores []store.Store
+	locs := make(map[[16]byte]meta.Location)
+	for i := 0; i < 8; i++ {
+		mock := storetests.NewMockStore(0)
+		defer mock.Close()
+		stores = append(stores, mock)
+		locs[mock.UUID()] = meta.Location{
+			UUID: mock.UUID(),
+			URL:  "http://server" + strconv.Itoa(i%4),
+		}
+	}
+
+	layout := lrcLayout{4, 8, 2}
+	for try := 0; try < 20; try++ {
+		order := make([]store.Store, len(stores))
+		for i, j := range rand.Perm(len(stores)) {
+			order[i] = stores[j]
+		}
+
+		placed := placeGroups(order, locs, layout)
+		if len(placed) != len(stores) {
+			t.Fatalf("placeGroups returned %v stores, wanted %v", len(placed), len(stores))
+		}
+
+		seen := make(map[store.Store]bool)
+		for _, st := range placed {
+			if seen[st] {
+				t.Fatalf("placeGroups returned a store twice")
+			}
+			seen[st] = true
+		}
+
+		for g := 0; g < layout.groups(); g++ {
+			domains := make(map[string]bool)
+			for _, idx := range layout.members(g) {
+				domain := failureDomain(locs[placed[idx].UUID()])
+				if domains[domain] {
+					t.Errorf("placeGroups put two members of group %v on %v", g, domain)
+				}
+				domains[domain] = true
+			}
+		}
+	}
+}
+
+func TestMultiHedgedRead(t *testing.T) {
+	killers, multi, mocks, done := prepareMultiTest(t, 2, 4, 4)
+	defer done()
+
+	storetests.ShouldCAS(t, multi, "a", store.MissingV, store.DataV([]byte("data")))
+
+	// All stores have been fast so far, so hedging should kick in long
+	// before dataOnlyTimeout.
+	for _, mock := range mocks {
+		for i := 0; i < 10; i++ {
+			multi.finder.RecordLatency(mock.UUID(), 2, time.Millisecond)
+		}
+	}
+
+	f, err := multi.getFile("a")
+	if err != nil {
+		t.Fatalf("Couldn't get file: %v", err)
+	}
+
+	for i, mock := range mocks {
+		if mock.UUID() == f.Locations[0] {
+			killers[i].setBlocked(true)
+			defer killers[i].setBlocked(false)
+		}
+	}
+
+	start := time.Now()
+	storetests.ShouldGet(t, multi, "a", []byte("data"))
+	if elapsed := time.Since(start); elapsed > dataOnlyTimeout/2 {
+		t.Errorf("read with a hung data chunk took %v", elapsed)
+	}
+}
+
+func TestMultiRepairKeepsHealthyChunks(t *testing.T) {
+	for _, codec := range []uint8{CodecPrime, CodecGF256} {
+		_, multi, _, done := prepareMultiTest(t, 2, 4, 6)
+
+		err := multi.SetCodec(codec, false)
+		if err != nil {
+			done()
+			t.Fatalf("Couldn't set codec: %v", err)
+		}
+
+		data := randomValue(1001)
+		storetests.ShouldCAS(t, multi, "a", store.MissingV, store.DataV(data))
+
+		before, err := multi.getFile("a")
+		if err != nil {
+			done()
+			t.Fatalf("Couldn't get file: %v", err)
+		}
+
+		for _, idx := range []int{0, 3} {
+			err = multi.db.RunTx(func(ctx kvl.Ctx) error {
+				layer, err := meta.Open(ctx)
+				if err != nil {
+					return err
+				}
+
+				loc, err := layer.GetLocation(before.Locations[idx])
+				if err != nil {
+					return err
+				}
+				loc.Dead = true
+				return layer.SetLocation(*loc)
+			})
+			if err != nil {
+				done()
+				t.Fatalf("Couldn't mark location dead: %v", err)
+			}
+		}
+
+		multi.scrubFilesAll()
+
+		after, err := multi.getFile("a")
+		if err != nil {
+			done()
+			t.Fatalf("Couldn't get file: %v", err)
+		}
+
+		if after.PrefixID != before.PrefixID {
+			t.Errorf("%v: repair rewrote the whole file", CodecName(codec))
+		}
+		for i := range before.Locations {
+			moved := before.Locations[i] != after.Locations[i]
+			if moved != (i == 0 || i == 3) {
+				t.Errorf("%v: chunk %v moved: %v", CodecName(codec), i, moved)
+			}
+		}
+
+		storetests.ShouldGet(t, multi, "a", data)
+
+		done()
+	}
+}
+
+func TestMultiRebuildsQuarantined(t *testing.T) {
+	_, multi, mocks, done := prepareMultiTest(t, 2, 3, 3)
+	defer done()
+
+	data := []byte("hello world! this is some test data.")
+
+	storetests.ShouldCAS(t, multi, "key", store.MissingV, store.DataV(data))
+
+	names, err := mocks[0].List("", 1, nil)
+	if err != nil {
+		t.Fatalf("Couldn't list first mock: %v", err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("Didn't get a name from mock")
+	}
+
+	mocks[0].Quarantine(names[0])
+	storetests.ShouldGetMiss(t, mocks[0], names[0])
+
+	seen := make(map[[16]byte]map[string]int64)
+	multi.rebuildQuarantined(seen, nil)
+
+	storetests.ShouldFullList(t, mocks[0], names)
+	storetests.ShouldGet(t, multi, "key", data)
+
+	if _, ok := seen[mocks[0].UUID()][names[0]]; !ok {
+		t.Errorf("Rebuilt chunk was not remembered as handled")
+	}
+}
+
+func TestMultiDeepScrub(t *testing.T) {
+	for _, codec := range []uint8{CodecPrime, CodecGF256} {
+		for _, idx := range []int{0, 3} {
+			_, multi, mocks, done := prepareMultiTest(t, 2, 4, 4)
+
+			err := multi.SetCodec(codec, false)
+			if err != nil {
+				done()
+				t.Fatalf("Couldn't set codec: %v", err)
+			}
+
+			data := randomValue(1001)
+			storetests.ShouldCAS(t, multi, "key", store.MissingV, store.DataV(data))
+
+			f, err := multi.getFile("key")
+			if err != nil {
+				done()
+				t.Fatalf("Couldn't get file: %v", err)
+			}
+
+			var mock *storetests.MockStore
+			for _, m := range mocks {
+				if m.UUID() == f.Locations[idx] {
+					mock = m
+				}
+			}
+
+			// replace the chunk with one that is internally valid, but
+			// doesn't agree with the others
+			key := localKeyFor(f, idx)
+			good, _, err := mock.Get(key, store.GetOptions{})
+			if err != nil {
+				done()
+				t.Fatalf("Couldn't get chunk: %v", err)
+			}
+			wrong := append([]byte(nil), good...)
+			wrong[5]++
+			storetests.ShouldCAS(t, mock, key, store.AnyV, store.DataV(wrong))
+
+			name := CodecName(codec) + " chunk " + strconv.Itoa(idx)
+
+			multi.deepScrubAll()
+			stats := multi.DeepScrubStats()
+			if stats.Files != 1 || stats.Inconsistent != 1 || stats.Repaired != 0 {
+				t.Errorf("%v: stats after reporting scrub are %+v", name, stats)
+			}
+			storetests.ShouldGet(t, mock, key, wrong)
+
+			err = multi.SetDeepScrub(DeepScrubConfig{Rate: 1, Repair: true}, nil)
+			if err != nil {
+				done()
+				t.Fatalf("Couldn't configure deep scrub: %v", err)
+			}
+
+			multi.deepScrubAll()
+			stats = multi.DeepScrubStats()
+			if stats.Files != 2 || stats.Inconsistent != 2 || stats.Repaired != 1 {
+				t.Errorf("%v: stats after repairing scrub are %+v", name, stats)
+			}
+
+			multi.deepScrubAll()
+			stats = multi.DeepScrubStats()
+			if stats.Files != 3 || stats.Inconsistent != 2 {
+				t.Errorf("%v: stats after clean scrub are %+v", name, stats)
+			}
+
+			storetests.ShouldGet(t, multi, "key", data)
+
+			done()
+		}
+	}
+}
+
+func TestMultiLocationModes(t *testing.T) {
+	_, multi, mocks, done := prepareMultiTest(t, 2, 3, 5)
+	defer done()
+
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+		storetests.ShouldCAS(t, multi, key, store.MissingV, store.DataV([]byte("value "+key)))
+	}
+
+	setMode := func(id [16]byte, mode uint8) {
+		err := multi.db.RunTx(func(ctx kvl.Ctx) error {
+			layer, err := meta.Open(ctx)
+			if err != nil {
+				return err
+			}
+
+			loc, err := layer.GetLocation(id)
+			if err != nil {
+				return err
+			}
+			loc.Mode = mode
+			return layer.SetLocation(*loc)
+		})
+		if err != nil {
+			t.Fatalf("Couldn't set location mode: %v", err)
+		}
+	}
+
+	readOnly, draining := mocks[0], mocks[1]
+	setMode(readOnly.UUID(), meta.LocationReadOnly)
+	setMode(draining.UUID(), meta.LocationDraining)
+	multi.finder.test(0)
+
+	readOnlyBefore, err := readOnly.List("", 0, nil)
+	if err != nil {
+		t.Fatalf("Couldn't list read only store: %v", err)
+	}
+	drainingBefore, err := draining.List("", 0, nil)
+	if err != nil {
+		t.Fatalf("Couldn't list draining store: %v", err)
+	}
+	if len(drainingBefore) == 0 {
+		t.Fatalf("No chunks were written to the draining store")
+	}
+
+	storetests.ShouldCAS(t, multi, "new", store.MissingV, store.DataV([]byte("new value")))
+	f, err := multi.getFile("new")
+	if err != nil {
+		t.Fatalf("Couldn't get file: %v", err)
+	}
+	for _, id := range f.Locations {
+		if id == readOnly.UUID() || id == draining.UUID() {
+			t.Errorf("New chunk was written to %v store", uuid.Fmt(id))
+		}
+	}
+
+	for multi.drainStep(nil) > 0 {
+	}
+
+	storetests.ShouldListCount(t, draining, 0)
+	storetests.ShouldFullList(t, readOnly, readOnlyBefore)
+
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+		storetests.ShouldGet(t, multi, key, []byte("value "+key))
+	}
+}
+
+func TestMultiPlacementLimits(t *testing.T) {
+	_, multi, mocks, done := prepareMultiTest(t, 2, 3, 4)
+	defer done()
+
+	setLimits := func(id [16]byte, reserved int64, maxFill uint8) {
+		err := multi.db.RunTx(func(ctx kvl.Ctx) error {
+			layer, err := meta.Open(ctx)
+			if err != nil {
+				return err
+			}
+
+			loc, err := layer.GetLocation(id)
+			if err != nil {
+				return err
+			}
+			loc.Reserved = reserved
+			loc.MaxFill = maxFill
+			return layer.SetLocation(*loc)
+		})
+		if err != nil {
+			t.Fatalf("Couldn't set location limits: %v", err)
+		}
+	}
+
+	for _, mock := range mocks {
+		mock.SetSize(1000000)
+	}
+	mocks[0].SetSize(1000)
+	storetests.ShouldCAS(t, mocks[0], "filler", store.MissingV, store.DataV(randomValue(50)))
+
+	// one store over its fill limit, one under its reserve
+	setLimits(mocks[0].UUID(), 0, 1)
+	setLimits(mocks[1].UUID(), 0, 0)
+	setLimits(mocks[2].UUID(), 1000, 0)
+	setLimits(mocks[3].UUID(), 2000000, 0)
+	multi.finder.test(0)
+
+	err := multi.CAS("full", store.MissingV, store.DataV([]byte("some data")), nil)
+	if err != store.ErrFull {
+		t.Errorf("CAS with two stores full returned %v, wanted %v", err, store.ErrFull)
+	}
+
+	setLimits(mocks[3].UUID(), 0, 90)
+	multi.finder.test(0)
+
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+		storetests.ShouldCAS(t, multi, key, store.MissingV, store.DataV([]byte("value "+key)))
+	}
+	storetests.ShouldFullList(t, mocks[0], []string{"filler"})
+}
+
+func TestMultiQuotas(t *testing.T) {
+	_, multi, _, done := prepareMultiTest(t, 2, 3, 3)
+	defer done()
+
+	getUsage := func(prefix string) meta.Usage {
+		var u meta.Usage
+		err := multi.db.RunReadTx(func(ctx kvl.Ctx) error {
+			layer, err := meta.Open(ctx)
+			if err != nil {
+				return err
+			}
+			u, err = layer.GetUsage(prefix)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Couldn't get usage: %v", err)
+		}
+		return u
+	}
+
+	storetests.ShouldCAS(t, multi, "a/old", store.MissingV, store.DataV(randomValue(30)))
+	storetests.ShouldCAS(t, multi, "b/other", store.MissingV, store.DataV(randomValue(500)))
+
+	err := multi.db.RunTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+		return layer.SetQuota(meta.Quota{Prefix: "a/", HardBytes: 100, SoftObjects: 3})
+	})
+	if err != nil {
+		t.Fatalf("Couldn't set quota: %v", err)
+	}
+
+	// the existing file is counted when the quota is set
+	if u := getUsage("a/"); u != (meta.Usage{Bytes: 30, Objects: 1}) {
+		t.Errorf("Usage after setting quota is %+v, wanted 30 bytes in 1 object", u)
+	}
+
+	storetests.ShouldCAS(t, multi, "a/1", store.MissingV, store.DataV(randomValue(40)))
+	storetests.ShouldCASError(t, multi, "a/2", store.MissingV,
+		store.DataV(randomValue(40)), store.ErrQuotaExceeded)
+
+	// keys outside the prefix are not limited
+	storetests.ShouldCAS(t, multi, "b/more", store.MissingV, store.DataV(randomValue(500)))
+
+	// shrinking a file is always allowed
+	storetests.ShouldCAS(t, multi, "a/1", store.AnyV, store.DataV(randomValue(10)))
+	if u := getUsage("a/"); u != (meta.Usage{Bytes: 40, Objects: 2}) {
+		t.Errorf("Usage after overwrite is %+v, wanted 40 bytes in 2 objects", u)
+	}
+
+	// the third object crosses the soft limit, and the fourth is refused
+	storetests.ShouldCAS(t, multi, "a/2", store.MissingV, store.DataV(randomValue(10)))
+	storetests.ShouldCASError(t, multi, "a/3", store.MissingV,
+		store.DataV(randomValue(10)), store.ErrQuotaExceeded)
+
+	storetests.ShouldCAS(t, multi, "a/old", store.AnyV, store.MissingV)
+	storetests.ShouldCAS(t, multi, "a/3", store.MissingV, store.DataV(randomValue(10)))
+	if u := getUsage("a/"); u != (meta.Usage{Bytes: 30, Objects: 3}) {
+		t.Errorf("Usage after delete is %+v, wanted 30 bytes in 3 objects", u)
+	}
+}
+
+func TestMultiCachesAcrossProxies(t *testing.T) {
+	_, multi, _, done := prepareMultiTest(t, 2, 3, 3)
+	defer done()
+
+	// a second proxy on the same database
+	multi2, err := NewMulti(multi.db, multi.finder, 0)
+	if err != nil {
+		t.Fatalf("Couldn't create second multi: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "slime_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk, err := cache.OpenDisk(dir, 1<<20, multi2)
+	if err != nil {
+		multi2.Close()
+		t.Fatalf("Couldn't open disk cache: %v", err)
+	}
+	defer disk.Close() // closes multi2
+
+	proxy1 := cache.New(1<<20, multi)
+	proxy2 := cache.New(1<<20, disk)
+
+	for i := 0; i < 5; i++ {
+		value := []byte("value " + strconv.Itoa(i))
+		storetests.ShouldCAS(t, proxy1, "key", store.AnyV, store.DataV(value))
+		storetests.ShouldGet(t, proxy2, "key", value)
+		storetests.ShouldGet(t, proxy1, "key", value)
+	}
+
+	storetests.ShouldCAS(t, proxy2, "key", store.AnyV, store.MissingV)
+	storetests.ShouldGetMiss(t, proxy1, "key")
+}
+
+func TestMultiTiering(t *testing.T) {
+	_, multi, mocks, done := prepareMultiTest(t, 2, 3, 6)
+	defer done()
+
+	cold := make(map[[16]byte]bool)
+	err := multi.db.RunTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, mock := range mocks[3:] {
+			loc, err := layer.GetLocation(mock.UUID())
+			if err != nil {
+				return err
+			}
+			loc.Tier = "cold"
+			err = layer.SetLocation(*loc)
+			if err != nil {
+				return err
+			}
+			cold[mock.UUID()] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Couldn't set location tiers: %v", err)
+	}
+	multi.finder.test(0)
+
+	err = multi.SetTiering(TieringConfig{Hot: "", Cold: "cold", DemoteAfter: time.Hour}, nil)
+	if err != nil {
+		t.Fatalf("Couldn't set tiering: %v", err)
+	}
+
+	shouldBeInTier := func(key, tier string) {
+		f, err := multi.getFile(key)
+		if err != nil {
+			t.Fatalf("Couldn't get file %v: %v", key, err)
+		}
+		if f.Tier != tier {
+			t.Errorf("File %v is in tier %#v, wanted %#v", key, f.Tier, tier)
+		}
+		for _, id := range f.Locations {
+			if cold[id] != (tier == "cold") {
+				t.Errorf("File %v in tier %#v has a chunk on %v", key, tier, uuid.Fmt(id))
+			}
+		}
+	}
+
+	storetests.ShouldCAS(t, multi, "old", store.MissingV, store.DataV([]byte("old value")))
+	storetests.ShouldCAS(t, multi, "new", store.MissingV, store.DataV([]byte("new value")))
+	shouldBeInTier("old", "")
+	shouldBeInTier("new", "")
+
+	err = multi.db.RunTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = layer.SetAccessTime("old", time.Now().Add(-2*time.Hour).Unix())
+		if err != nil {
+			return err
+		}
+		return layer.SetAccessTime("new", time.Now().Unix())
+	})
+	if err != nil {
+		t.Fatalf("Couldn't set access times: %v", err)
+	}
+
+	err = multi.tieringStep()
+	if err != nil {
+		t.Fatalf("Couldn't run tiering step: %v", err)
+	}
+	shouldBeInTier("old", "cold")
+	shouldBeInTier("new", "")
+	storetests.ShouldGet(t, multi, "old", []byte("old value"))
+
+	// moving it again must not make it look recently used
+	err = multi.tieringStep()
+	if err != nil {
+		t.Fatalf("Couldn't run tiering step: %v", err)
+	}
+	shouldBeInTier("old", "cold")
+
+	// one read, such as a backup's, leaves it cold, even for tieringStep...
+	multi.RecordAccess("old")
+	multi.flushAccess(true)
+	shouldBeInTier("old", "cold")
+	err = multi.tieringStep()
+	if err != nil {
+		t.Fatalf("Couldn't run tiering step: %v", err)
+	}
+	shouldBeInTier("old", "cold")
+
+	// ...but reading it again brings it back
+	multi.RecordAccess("old")
+	multi.flushAccess(true)
+	shouldBeInTier("old", "")
+	storetests.ShouldGet(t, multi, "old", []byte("old value"))
+
+	for _, mock := range mocks[3:] {
+		storetests.ShouldListCount(t, mock, 0)
+	}
+
+	// a file written again after it was listed is left alone
+	listed, err := multi.getFile("new")
+	if err != nil {
+		t.Fatalf("Couldn't get file: %v", err)
+	}
+	storetests.ShouldCAS(t, multi, "new", store.AnyV, store.DataV([]byte("newer value")))
+	err = multi.moveToTier(*listed, "cold", time.Now().Add(-2*time.Hour).Unix())
+	if err != store.ErrCASFailure {
+		t.Errorf("moveToTier of a file written since returned %v, wanted %v",
+			err, store.ErrCASFailure)
+	}
+	shouldBeInTier("new", "")
+	storetests.ShouldGet(t, multi, "new", []byte("newer value"))
+}
+
+func TestMultiArchive(t *testing.T) {
+	_, multi, _, done := prepareMultiTest(t, 2, 3, 6)
+	defer done()
+
+	for i := 0; i < 5; i++ {
+		key := strconv.Itoa(i)
+		storetests.ShouldCAS(t, multi, key, store.MissingV, store.DataV([]byte(strings.Repeat("value "+key, 100))))
+	}
+
+	err := multi.SetArchive(ArchiveConfig{
+		Layout: Layout{Need: 4, Total: 5, Codec: DefaultCodec},
+		After:  time.Hour,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Couldn't set archive config: %v", err)
+	}
+
+	// only files written long enough ago are archived
+	multi.archiveAll()
+	if stats := multi.ArchiveStats(); stats.Files != 0 {
+		t.Errorf("Archived %v new files", stats.Files)
+	}
+
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	err = multi.db.RunTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < 3; i++ {
+			f, err := layer.GetFile(strconv.Itoa(i))
+			if err != nil {
+				return err
+			}
+			f.WriteTime = old
+			err = layer.SetFile(f)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Couldn't set write times: %v", err)
+	}
+
+	multi.archiveAll()
+
+	stats := multi.ArchiveStats()
+	if stats.Files != 3 {
+		t.Errorf("Archived %v files, wanted 3", stats.Files)
+	}
+	if stats.Saved <= 0 {
+		t.Errorf("Archiving saved %v bytes, wanted a positive number", stats.Saved)
+	}
+
+	shouldHaveLayout := func(key string, archived bool, need, total int) *meta.File {
+		f, err := multi.getFile(key)
+		if err != nil {
+			t.Fatalf("Couldn't get file %v: %v", key, err)
+		}
+		if f.Archived != archived || int(f.DataChunks) != need || len(f.Locations) != total {
+			t.Errorf("File %v has archived=%v and %v of %v, wanted archived=%v and %v of %v",
+				key, f.Archived, f.DataChunks, len(f.Locations), archived, need, total)
+		}
+		return f
+	}
+
+	for i := 0; i < 5; i++ {
+		key := strconv.Itoa(i)
+		if i < 3 {
+			f := shouldHaveLayout(key, true, 4, 5)
+			if f.WriteTime != old {
+				t.Errorf("Archiving %v changed its write time", key)
+			}
+		} else {
+			shouldHaveLayout(key, false, 2, 3)
+		}
+		storetests.ShouldGet(t, multi, key, []byte(strings.Repeat("value "+key, 100)))
+	}
+
+	// the scrubber must leave archived files in the archive layout
+	before, err := multi.getFile("0")
+	if err != nil {
+		t.Fatalf("Couldn't get file: %v", err)
+	}
+	multi.scrubFilesAll()
+	after := shouldHaveLayout("0", true, 4, 5)
+	if after.PrefixID != before.PrefixID {
+		t.Errorf("Scrubber rewrote an archived file")
+	}
+
+	// and rewrite them with the write layout once archiving is disabled
+	err = multi.SetArchive(ArchiveConfig{}, nil)
+	if err != nil {
+		t.Fatalf("Couldn't disable archiving: %v", err)
+	}
+	multi.scrubFilesAll()
+	for i := 0; i < 5; i++ {
+		key := strconv.Itoa(i)
+		shouldHaveLayout(key, false, 2, 3)
+		storetests.ShouldGet(t, multi, key, []byte(strings.Repeat("value "+key, 100)))
+	}
+}
+
+func TestMultiArchiveOverwritten(t *testing.T) {
+	_, multi, _, done := prepareMultiTest(t, 2, 3, 6)
+	defer done()
+
+	err := multi.SetArchive(ArchiveConfig{
+		Layout: Layout{Need: 4, Total: 5, Codec: DefaultCodec},
+		After:  time.Hour,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Couldn't set archive config: %v", err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	for _, key := range []string{"a", "b"} {
+		storetests.ShouldCAS(t, multi, key, store.MissingV, store.DataV([]byte("old "+key)))
+
+		// the archiver listed the file while it was old...
+		listed, err := multi.getFile(key)
+		if err != nil {
+			t.Fatalf("Couldn't get file: %v", err)
+		}
+		listed.WriteTime = old
+
+		// ...but a client wrote it again before it got to it, with new data
+		// for a, and the same data for b
+		data := []byte("new " + key)
+		if key == "b" {
+			data = []byte("old " + key)
+		}
+		storetests.ShouldCAS(t, multi, key, store.AnyV, store.DataV(data))
+
+		if written := multi.archiveFile(listed); written != 0 {
+			t.Errorf("Archived %v after it was written again", key)
+		}
+
+		f, err := multi.getFile(key)
+		if err != nil {
+			t.Fatalf("Couldn't get file: %v", err)
+		}
+		if f.Archived || f.WriteTime == old {
+			t.Errorf("Rewrite of %v used the settings of the file it replaced", key)
+		}
+		storetests.ShouldGet(t, multi, key, data)
+	}
+}
+
+func TestMultiRepairQueue(t *testing.T) {
+	killers, multi, mocks, done := prepareMultiTest(t, 2, 4, 5)
+	defer done()
+
+	mocksByUUID := make(map[[16]byte]*storetests.MockStore, len(mocks))
+	for _, mock := range mocks {
+		mocksByUUID[mock.UUID()] = mock
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		storetests.ShouldCAS(t, multi, key, store.MissingV, store.DataV([]byte("value of "+key)))
+	}
+
+	removeChunks := func(key string, idxs ...int) {
+		f, err := multi.getFile(key)
+		if err != nil {
+			t.Fatalf("Couldn't get file: %v", err)
+		}
+		for _, idx := range idxs {
+			storetests.ShouldCAS(t, mocksByUUID[f.Locations[idx]],
+				localKeyFor(f, idx), store.AnyV, store.MissingV)
+		}
+	}
+
+	missingChunks := func(key string) int {
+		f, err := multi.getFile(key)
+		if err != nil {
+			t.Fatalf("Couldn't get file: %v", err)
+		}
+		missing := 0
+		for i, id := range f.Locations {
+			_, err := mocksByUUID[id].Stat(localKeyFor(f, i), nil)
+			if err == store.ErrNotFound {
+				missing++
+			}
+		}
+		return missing
+	}
+
+	shouldDepth := func(want map[int]int64) {
+		depth, err := multi.RepairQueueDepth()
+		if err != nil {
+			t.Fatalf("Couldn't get repair queue depth: %v", err)
+		}
+		if !reflect.DeepEqual(depth, want) {
+			t.Errorf("Repair queue depth is %v, wanted %v", depth, want)
+		}
+	}
+
+	removeChunks("a", 0)
+	removeChunks("b", 0, 1)
+
+	// the location scrubber sees one location at a time, so it only knows
+	// about one missing chunk of each file
+	multi.scrubLocationsAll()
+	shouldDepth(map[int]int64{1: 2})
+
+	// queueing again with a lower margin moves the file up
+	fb, err := multi.getFile("b")
+	if err != nil {
+		t.Fatalf("Couldn't get file: %v", err)
+	}
+	multi.queueReadFailures(*fb, []int{0, 1})
+	shouldDepth(map[int]int64{0: 1, 1: 1})
+
+	// the file closest to being lost comes first
+	oldCount := repairQueueCount
+	repairQueueCount = 1
+	defer func() { repairQueueCount = oldCount }()
+
+	multi.repairQueueStep()
+	if missing := missingChunks("b"); missing != 0 {
+		t.Errorf("b has %v missing chunks after one repair queue step", missing)
+	}
+	if missing := missingChunks("a"); missing != 1 {
+		t.Errorf("a has %v missing chunks after one repair queue step, wanted 1", missing)
+	}
+	shouldDepth(map[int]int64{1: 1})
+
+	multi.repairQueueAll()
+	if missing := missingChunks("a"); missing != 0 {
+		t.Errorf("a has %v missing chunks after the repair queue was drained", missing)
+	}
+	shouldDepth(map[int]int64{})
+
+	// a repair that fails goes back in the queue
+	removeChunks("c", 0)
+	multi.scrubLocationsAll()
+	shouldDepth(map[int]int64{1: 1})
+
+	for _, killer := range killers {
+		killer.setKilled(true)
+	}
+	if repaired := multi.repairQueueStep(); repaired != 0 {
+		t.Errorf("repairQueueStep repaired %v files with every store down", repaired)
+	}
+	for _, killer := range killers {
+		killer.setKilled(false)
+	}
+	shouldDepth(map[int]int64{1: 1})
+
+	multi.repairQueueAll()
+	if missing := missingChunks("c"); missing != 0 {
+		t.Errorf("c has %v missing chunks after the repair queue was drained", missing)
+	}
+	shouldDepth(map[int]int64{})
+}
+
+func TestMultiReadRepair(t *testing.T) {
+	_, multi, mocks, done := prepareMultiTest(t, 2, 3, 3)
+	defer done()
+
+	storetests.ShouldCAS(t, multi, "key", store.MissingV, store.DataV([]byte("value")))
+
+	f, err := multi.getFile("key")
+	if err != nil {
+		t.Fatalf("Couldn't get file: %v", err)
+	}
+
+	var chunkStore *storetests.MockStore
+	for _, mock := range mocks {
+		if mock.UUID() == f.Locations[0] {
+			chunkStore = mock
+		}
+	}
+	storetests.ShouldCAS(t, chunkStore, localKeyFor(f, 0), store.AnyV, store.MissingV)
+
+	// use up the read repair allowance, so the repair waits long enough for
+	// the second read to find it already scheduled
+	err = multi.SetLimits(Limits{ReadRepair: Limit{OpsPerSecond: 1}})
+	if err != nil {
+		t.Fatalf("Couldn't set limits: %v", err)
+	}
+	multi.throttle(&multi.limiters.readRepair, 1, 0)
+
+	storetests.ShouldGet(t, multi, "key", []byte("value"))
+	storetests.ShouldGet(t, multi, "key", []byte("value"))
+
+	for i := 0; i < 500; i++ {
+		if multi.ReadRepairStats().Repaired > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	want := ReadRepairStats{Scheduled: 1, Deduplicated: 1, Repaired: 1}
+	if got := multi.ReadRepairStats(); got != want {
+		t.Errorf("ReadRepairStats returned %#v, wanted %#v", got, want)
+	}
+
+	f, err = multi.getFile("key")
+	if err != nil {
+		t.Fatalf("Couldn't get file: %v", err)
+	}
+	for i, id := range f.Locations {
+		for _, mock := range mocks {
+			if mock.UUID() != id {
+				continue
+			}
+			_, err := mock.Stat(localKeyFor(f, i), nil)
+			if err != nil {
+				t.Errorf("Chunk %v is missing after read repair: %v", i, err)
+			}
+		}
+	}
+}
+
+func TestMultiHealth(t *testing.T) {
+	killers, multi, mocks, done := prepareMultiTest(t, 2, 4, 4)
+	defer done()
+
+	for _, key := range []string{"a", "b"} {
+		storetests.ShouldCAS(t, multi, key, store.MissingV, store.DataV([]byte("value of "+key)))
+	}
+
+	shouldHealth := func(want HealthReport) HealthReport {
+		report, err := multi.Health()
+		if err != nil {
+			t.Fatalf("Couldn't get health: %v", err)
+		}
+		if report.Locations != want.Locations || report.Online != want.Online ||
+			report.Offline != want.Offline || report.Dead != want.Dead {
+			t.Errorf("Health has %v/%v/%v/%v total/online/offline/dead locations, wanted %v/%v/%v/%v",
+				report.Locations, report.Online, report.Offline, report.Dead,
+				want.Locations, want.Online, want.Offline, want.Dead)
+		}
+		if !reflect.DeepEqual(report.Margins, want.Margins) {
+			t.Errorf("Health margins are %v, wanted %v", report.Margins, want.Margins)
+		}
+		if report.Unreadable != want.Unreadable {
+			t.Errorf("Health has %v unreadable files, wanted %v", report.Unreadable, want.Unreadable)
+		}
+		return report
+	}
+
+	shouldHealth(HealthReport{Locations: 4, Online: 4, Margins: map[int]int64{}})
+
+	err := multi.db.RunTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		loc, err := layer.GetLocation(mocks[0].UUID())
+		if err != nil {
+			return err
+		}
+		loc.Dead = true
+		return layer.SetLocation(*loc)
+	})
+	if err != nil {
+		t.Fatalf("Couldn't mark location dead: %v", err)
+	}
+
+	killers[1].setKilled(true)
+	multi.finder.test(0)
+
+	report := shouldHealth(HealthReport{
+		Locations: 4, Online: 2, Offline: 1, Dead: 1,
+		Margins: map[int]int64{0: 2},
+	})
+	wantBytes := 2 * storedSize(uint64(len("value of a")), 2, 1)
+	if report.RepairBytes != wantBytes {
+		t.Errorf("Health has %v bytes to repair, wanted %v", report.RepairBytes, wantBytes)
+	}
+	if report.RepairETA != 0 {
+		t.Errorf("Health has a repair ETA of %v with nothing repaired recently", report.RepairETA)
+	}
+
+	multi.repairMeter.add(repairMeterMinutes*60, time.Now())
+	report = shouldHealth(HealthReport{
+		Locations: 4, Online: 2, Offline: 1, Dead: 1,
+		Margins: map[int]int64{0: 2},
+	})
+	wantETA := time.Duration(wantBytes) * time.Second
+	if report.RepairETA != wantETA {
+		t.Errorf("Health has a repair ETA of %v, wanted %v", report.RepairETA, wantETA)
+	}
+
+	killers[2].setKilled(true)
+	multi.finder.test(0)
+
+	report = shouldHealth(HealthReport{
+		Locations: 4, Online: 1, Offline: 2, Dead: 1,
+		Margins:    map[int]int64{-1: 2},
+		Unreadable: 2,
+	})
+	if len(report.UnreadablePaths) != 2 {
+		t.Errorf("Health lists unreadable paths %v, wanted both files", report.UnreadablePaths)
+	}
+}
+
+func TestMultiHealthLRC(t *testing.T) {
+	killers, multi, mocks, done := prepareMultiTest(t, 4, 7, 7)
+	defer done()
+
+	err := multi.SetLayout(Layout{Need: 4, Total: 7, Codec: CodecLRC, LocalGroup: 2}, nil)
+	if err != nil {
+		t.Fatalf("Couldn't set layout: %v", err)
+	}
+
+	storetests.ShouldCAS(t, multi, "a", store.MissingV, store.DataV(randomValue(1000)))
+
+	f, err := multi.getFile("a")
+	if err != nil {
+		t.Fatalf("Couldn't get file: %v", err)
+	}
+
+	// Both data chunks of the first group are gone. Five of seven chunks are
+	// left, one more than need, but the file can't be read.
+	for _, idx := range []int{0, 1} {
+		for i, mock := range mocks {
+			if mock.UUID() == f.Locations[idx] {
+				killers[i].setKilled(true)
+			}
+		}
+	}
+	multi.finder.test(0)
+
+	report, err := multi.Health()
+	if err != nil {
+		t.Fatalf("Couldn't get health: %v", err)
+	}
+	if !reflect.DeepEqual(report.Margins, map[int]int64{-1: 1}) {
+		t.Errorf("Health margins are %v, wanted map[-1:1]", report.Margins)
+	}
+	if report.Unreadable != 1 || !reflect.DeepEqual(report.UnreadablePaths, []string{"a"}) {
+		t.Errorf("Health has %v unreadable files %v, wanted 1 (a)",
+			report.Unreadable, report.UnreadablePaths)
+	}
+}
+
+type recordEvents struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func (r *recordEvents) Send(e events.Event) error {
+	r.mu.Lock()
+	r.events = append(r.events, e)
+	r.mu.Unlock()
+	return nil
+}
+
+func TestMultiEvents(t *testing.T) {
+	killers, multi, mocks, done := prepareMultiTest(t, 2, 3, 3)
+	defer done()
+
+	rec := &recordEvents{}
+	d := events.NewDispatcher()
+	d.AddSink(rec)
+	multi.SetEvents(d)
+	multi.finder.SetEvents(d)
+
+	err := multi.SetRedundancy(1, 3)
+	if err != nil {
+		t.Fatalf("Couldn't set redundancy: %v", err)
+	}
+
+	// unchanged
+	err = multi.SetRedundancy(1, 3)
+	if err != nil {
+		t.Fatalf("Couldn't set redundancy: %v", err)
+	}
+
+	killers[0].setKilled(true)
+	multi.finder.test(0)
+	killers[0].setKilled(false)
+	multi.finder.Rescan()
+
+	multi.SetEvents(nil)
+	multi.finder.SetEvents(nil)
+	d.Close()
+
+	var got []string
+	for _, e := range rec.events {
+		got = append(got, e.Type)
+		if e.Type == events.StoreDisconnected || e.Type == events.StoreConnected {
+			if e.Store != uuid.Fmt(mocks[0].UUID()) {
+				t.Errorf("%v event is for store %v, wanted %v",
+					e.Type, e.Store, uuid.Fmt(mocks[0].UUID()))
+			}
+		}
+	}
+
+	want := []string{events.RedundancyChanged, events.StoreDisconnected, events.StoreConnected}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got events %v, wanted %v", got, want)
+	}
+}
+
+type recordSpans struct {
+	mu    sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (r *recordSpans) Export(spans []tracing.SpanData) error {
+	r.mu.Lock()
+	r.spans = append(r.spans, spans...)
+	r.mu.Unlock()
+	return nil
+}
+
+func TestMultiTrace(t *testing.T) {
+	_, multi, _, done := prepareMultiTest(t, 2, 3, 3)
+	defer done()
+
+	rec := &recordSpans{}
+	tracing.Configure(rec, 1)
+	defer tracing.Configure(nil, 0)
+
+	root := tracing.StartRoot("test")
+	err := store.WithTrace(multi, root.Context()).CAS("key", store.AnyV,
+		store.DataV([]byte("traced data")), nil)
+	if err != nil {
+		t.Fatalf("Couldn't CAS: %v", err)
+	}
+	storetests.ShouldGet(t, multi, "key", []byte("traced data"))
+	_, _, err = multi.Get("key", store.GetOptions{Trace: root.Context()})
+	if err != nil {
+		t.Fatalf("Couldn't Get: %v", err)
+	}
+	root.End()
+	tracing.Flush()
+
+	counts := make(map[string]int)
+	for _, span := range rec.spans {
+		counts[span.Name]++
+		if span.TraceID != root.Context().TraceID {
+			t.Errorf("Span %v is in trace %x, wanted %x",
+				span.Name, span.TraceID, root.Context().TraceID)
+		}
+	}
+
+	want := map[string]int{
+		"test":                  1,
+		"multi.CAS":             1,
+		"kvl.RunTx check":       1,
+		"multi.writeChunks":     1,
+		"storehttp.Client PUT":  3,
+		"kvl.RunTx commit":      1,
+		"multi.Get":             1,
+		"kvl.RunReadTx getFile": 1,
+		"multi.reconstruct":     1,
+		"multi.getChunkData":    1,
+	}
+	for name, count := range want {
+		if counts[name] != count {
+			t.Errorf("Got %v %#v spans, wanted %v", counts[name], name, count)
+		}
+	}
+
+	// hedged requests may read parity chunks as well
+	if counts["storehttp.Client GET"] < 2 {
+		t.Errorf("Got %v chunk GET spans, wanted at least 2", counts["storehttp.Client GET"])
+	}
+}
@@ -0,0 +1,433 @@
+package multi
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/meta"
+	"github.com/encryptio/slime/internal/store"
+
+	"github.com/encryptio/kvl"
+)
+
+var (
+	tieringWait         = time.Second * 30
+	accessFlushInterval = time.Minute
+)
+
+const (
+	tieringFileCount = 10
+	tieringMaxScan   = 100
+	accessFlushBatch = 100
+
+	// accessMaxPending is the most files whose access times are held between
+	// flushes; reads of other files are not recorded until the next flush
+	accessMaxPending = 100000
+)
+
+// TieringConfig controls which tier of locations files are stored in. New
+// files are written to the Hot tier. Files that have not been read for
+// DemoteAfter are moved to the Cold tier, and moved back when they are read
+// twice within DemoteAfter. A single read doesn't move them back, so that
+// reading every file once, as a backup does, leaves the Cold tier alone.
+//
+// Tiers are the labels set on locations with meta.Location.Tier; "" is the
+// tier of unlabeled locations. Tiering is disabled if Hot and Cold are the
+// same or DemoteAfter is zero.
+type TieringConfig struct {
+	Hot         string
+	Cold        string
+	DemoteAfter time.Duration
+}
+
+func (c TieringConfig) enabled() bool {
+	return c.Hot != c.Cold && c.DemoteAfter > 0
+}
+
+// tierFor returns the tier a file belongs in, given when it was last used.
+func (c TieringConfig) tierFor(lastUsed int64, now time.Time) string {
+	if now.Sub(time.Unix(lastUsed, 0)) > c.DemoteAfter {
+		return c.Cold
+	}
+	return c.Hot
+}
+
+type accessState struct {
+	mu    sync.Mutex
+	times map[string]access
+}
+
+// access is the reads of a file since the last flush.
+type access struct {
+	last  int64 // unix seconds
+	reads int
+}
+
+// GetTiering returns the tiering configuration.
+func (m *Multi) GetTiering() TieringConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return TieringConfig{
+		Hot:         m.config.HotTier,
+		Cold:        m.config.ColdTier,
+		DemoteAfter: m.config.DemoteAfter,
+	}
+}
+
+// SetTiering changes the tiering configuration for all proxies. If audit is not
+// nil, it is added to the audit log in the same transaction.
+func (m *Multi) SetTiering(c TieringConfig, audit *meta.AuditEntry) error {
+	if c.DemoteAfter < 0 {
+		return BadConfigError("demote after is negative")
+	}
+
+	err := m.db.RunTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = layer.SetConfig("tier-hot", []byte(c.Hot))
+		if err != nil {
+			return err
+		}
+
+		err = layer.SetConfig("tier-cold", []byte(c.Cold))
+		if err != nil {
+			return err
+		}
+
+		err = layer.SetConfig("tier-demote-after",
+			strconv.AppendInt(nil, int64(c.DemoteAfter/time.Second), 10))
+		if err != nil {
+			return err
+		}
+		return addAudit(layer, audit)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.config.HotTier = c.Hot
+	m.config.ColdTier = c.Cold
+	m.config.DemoteAfter = c.DemoteAfter
+	m.mu.Unlock()
+
+	return nil
+}
+
+func loadTieringConfig(layer *meta.Layer, conf *multiConfig) error {
+	hot, err := layer.GetConfig("tier-hot")
+	if err != nil {
+		return err
+	}
+	conf.HotTier = string(hot)
+
+	cold, err := layer.GetConfig("tier-cold")
+	if err != nil {
+		return err
+	}
+	conf.ColdTier = string(cold)
+
+	demoteBytes, err := layer.GetConfig("tier-demote-after")
+	if err != nil {
+		return err
+	}
+	conf.DemoteAfter = 0
+	if demoteBytes != nil {
+		seconds, err := strconv.ParseInt(string(demoteBytes), 10, 64)
+		if err != nil {
+			return err
+		}
+		conf.DemoteAfter = time.Duration(seconds) * time.Second
+	}
+
+	return nil
+}
+
+// RecordAccess notes that the file at key was read or written. Access times
+// are written to the meta database in batches, and are used to decide which
+// files to move between tiers. Nothing is recorded while tiering is disabled.
+func (m *Multi) RecordAccess(key string) {
+	if !m.GetTiering().enabled() {
+		return
+	}
+
+	now := time.Now().Unix()
+
+	m.access.mu.Lock()
+	defer m.access.mu.Unlock()
+
+	if m.access.times == nil {
+		m.access.times = make(map[string]access)
+	}
+	a, ok := m.access.times[key]
+	if !ok && len(m.access.times) >= accessMaxPending {
+		return
+	}
+	m.access.times[key] = access{last: now, reads: a.reads + 1}
+}
+
+func (m *Multi) accessFlushLoop() error {
+	for {
+		select {
+		case <-m.tomb.Dying():
+			m.flushAccess(false)
+			return nil
+		case <-time.After(jitterDuration(accessFlushInterval)):
+			m.flushAccess(true)
+		}
+	}
+}
+
+// flushAccess writes the access times recorded since the last flush to the
+// meta database. If promote is true, any of the files read that are not in the
+// hot tier are moved there, if they were read before within DemoteAfter.
+func (m *Multi) flushAccess(promote bool) {
+	m.access.mu.Lock()
+	times := m.access.times
+	m.access.times = nil
+	m.access.mu.Unlock()
+
+	conf := m.GetTiering()
+	if !conf.enabled() {
+		return
+	}
+	now := time.Now()
+
+	paths := make([]string, 0, len(times))
+	for path := range times {
+		paths = append(paths, path)
+	}
+
+	var promoting []meta.File
+	for len(paths) > 0 {
+		batch := paths
+		if len(batch) > accessFlushBatch {
+			batch = batch[:accessFlushBatch]
+		}
+		paths = paths[len(batch):]
+
+		var batchPromote []meta.File
+		err := m.db.RunTx(func(ctx kvl.Ctx) error {
+			batchPromote = nil
+
+			layer, err := meta.Open(ctx)
+			if err != nil {
+				return err
+			}
+
+			for _, path := range batch {
+				f, err := layer.GetFile(path)
+				if err != nil {
+					return err
+				}
+				if f == nil {
+					continue
+				}
+
+				before, err := layer.GetAccessTime(path)
+				if err != nil {
+					return err
+				}
+
+				a := times[path]
+				err = layer.SetAccessTime(path, a.last)
+				if err != nil {
+					return err
+				}
+
+				if !promote || f.Tier == conf.Hot {
+					continue
+				}
+
+				// files written before access times were recorded fall back
+				// to their write time, as in tieringStep
+				if before == 0 {
+					before = f.WriteTime
+				}
+				if a.reads > 1 || conf.tierFor(before, now) == conf.Hot {
+					batchPromote = append(batchPromote, *f)
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			logging.Errorf("Couldn't record access times: %v", err)
+			continue
+		}
+
+		promoting = append(promoting, batchPromote...)
+	}
+
+	for _, f := range promoting {
+		m.throttle(&m.limiters.tiering, 1, int64(f.Size))
+
+		err := m.rewrite(&f, writeOptions{
+			tier:      conf.Hot,
+			archived:  f.Archived,
+			writeTime: f.WriteTime,
+		})
+		if err == store.ErrCASFailure {
+			// written since it was read, and new writes go to the hot tier
+			continue
+		}
+		if err != nil {
+			logging.Errorf("Couldn't promote %v to tier %#v: %v", f.Path, conf.Hot, err)
+			continue
+		}
+		log.Printf("Promoted %v to tier %#v", f.Path, conf.Hot)
+	}
+}
+
+func (m *Multi) tieringLoop() error {
+	for {
+		select {
+		case <-m.tomb.Dying():
+			return nil
+		case <-time.After(jitterDuration(tieringWait)):
+			if !m.GetTiering().enabled() {
+				continue
+			}
+
+			err := m.tieringStep()
+			if err != nil {
+				logging.Errorf("Couldn't run tiering step: %v", err)
+			}
+		}
+	}
+}
+
+// tieringStep checks the next batch of files and moves those that are in the
+// wrong tier, moving at most tieringFileCount files.
+func (m *Multi) tieringStep() error {
+	conf := m.GetTiering()
+
+	moved := 0
+	scanned := 0
+	defer func() {
+		if moved > 0 {
+			log.Printf("Moved %v files between tiers out of %v scanned", moved, scanned)
+		}
+	}()
+
+	for moved < tieringFileCount && scanned < tieringMaxScan {
+		var files []meta.File
+		var accessTimes []int64
+		err := m.db.RunTx(func(ctx kvl.Ctx) error {
+			files = nil
+			accessTimes = nil
+
+			l, err := meta.Open(ctx)
+			if err != nil {
+				return err
+			}
+
+			startkey, err := l.GetConfig("tierpos")
+			if err != nil {
+				return err
+			}
+
+			files, err = l.ListFiles(string(startkey), 20)
+			if err != nil {
+				return err
+			}
+
+			for _, f := range files {
+				at, err := l.GetAccessTime(f.Path)
+				if err != nil {
+					return err
+				}
+				accessTimes = append(accessTimes, at)
+			}
+
+			if len(files) > 0 {
+				return l.SetConfig("tierpos", []byte(files[len(files)-1].Path))
+			}
+			return l.SetConfig("tierpos", []byte{})
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(files) == 0 {
+			break
+		}
+
+		now := time.Now()
+		for i, f := range files {
+			scanned++
+
+			// files written before access times were recorded fall back to
+			// their write time
+			lastUsed := accessTimes[i]
+			if lastUsed == 0 {
+				lastUsed = f.WriteTime
+			}
+
+			want := conf.tierFor(lastUsed, now)
+			if f.Tier == conf.Cold && want == conf.Hot {
+				// promoting is left to flushAccess, which waits for a
+				// second read
+				want = f.Tier
+			}
+			if f.Tier != want {
+				m.throttle(&m.limiters.tiering, 1, int64(f.Size))
+
+				err := m.moveToTier(f, want, lastUsed)
+				switch {
+				case err == store.ErrCASFailure:
+					// written since it was listed; the next pass will see
+					// the new file
+				case err != nil:
+					logging.Errorf("Couldn't move %v to tier %#v: %v", f.Path, want, err)
+				default:
+					moved++
+				}
+			}
+
+			if moved >= tieringFileCount || scanned >= tieringMaxScan {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// moveToTier rewrites the file f into the given tier. lastUsed is recorded as
+// its access time first, so that files that fell back to their write time
+// keep their age. It fails with store.ErrCASFailure if f has been written
+// again since it was read.
+func (m *Multi) moveToTier(f meta.File, tier string, lastUsed int64) error {
+	err := m.db.RunTx(func(ctx kvl.Ctx) error {
+		layer, err := meta.Open(ctx)
+		if err != nil {
+			return err
+		}
+
+		cur, err := layer.GetFile(f.Path)
+		if err != nil {
+			return err
+		}
+		if cur == nil || cur.PrefixID != f.PrefixID {
+			return store.ErrCASFailure
+		}
+
+		return layer.SetAccessTime(f.Path, lastUsed)
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.rewrite(&f, writeOptions{
+		tier:      tier,
+		archived:  f.Archived,
+		writeTime: f.WriteTime,
+	})
+}
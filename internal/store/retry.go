@@ -153,3 +153,55 @@ func (rs *RetryStore) CAS(key string, from, to CASV, cancel <-chan struct{}) err
 	}
 	return s.CAS(key, from, to, cancel)
 }
+
+// Capacity passes through to the inner Store if it is a CapacityStore, and
+// otherwise returns ErrUnsupported.
+func (rs *RetryStore) Capacity(cancel <-chan struct{}) (int64, error) {
+	s := rs.getInner()
+	if s == nil {
+		return 0, ErrUnavailable
+	}
+	if cs, ok := s.(CapacityStore); ok {
+		return cs.Capacity(cancel)
+	}
+	return 0, ErrUnsupported
+}
+
+// ListQuarantine passes through to the inner Store if it is a
+// QuarantineStore, and otherwise returns an empty list.
+func (rs *RetryStore) ListQuarantine(cancel <-chan struct{}) ([]QuarantineEntry, error) {
+	s := rs.getInner()
+	if s == nil {
+		return nil, ErrUnavailable
+	}
+	if qs, ok := s.(QuarantineStore); ok {
+		return qs.ListQuarantine(cancel)
+	}
+	return nil, nil
+}
+
+// HashcheckStatus passes through to the inner Store if it is a HashcheckStore,
+// and otherwise returns ErrUnsupported.
+func (rs *RetryStore) HashcheckStatus(cancel <-chan struct{}) (HashcheckStatus, error) {
+	s := rs.getInner()
+	if s == nil {
+		return HashcheckStatus{}, ErrUnavailable
+	}
+	if hs, ok := s.(HashcheckStore); ok {
+		return hs.HashcheckStatus(cancel)
+	}
+	return HashcheckStatus{}, ErrUnsupported
+}
+
+// ControlHashcheck passes through to the inner Store if it is a
+// HashcheckStore, and otherwise returns ErrUnsupported.
+func (rs *RetryStore) ControlHashcheck(req HashcheckRequest, cancel <-chan struct{}) (HashcheckStatus, error) {
+	s := rs.getInner()
+	if s == nil {
+		return HashcheckStatus{}, ErrUnavailable
+	}
+	if hs, ok := s.(HashcheckStore); ok {
+		return hs.ControlHashcheck(req, cancel)
+	}
+	return HashcheckStatus{}, ErrUnsupported
+}
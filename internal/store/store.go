@@ -5,6 +5,9 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"time"
+
+	"github.com/encryptio/slime/internal/tracing"
 )
 
 var (
@@ -23,6 +26,23 @@ var (
 	// ErrCancelled is returned from Stores when the cancel channel is closed
 	// and the operation has been aborted.
 	ErrCancelled = errors.New("cancelled")
+
+	// ErrFull is returned from Store.CAS when there is no space left to store
+	// the value, or no space allowed by the store's limits.
+	ErrFull = errors.New("no space left for new values")
+
+	// ErrQuotaExceeded is returned from Store.CAS when the new value would
+	// take the data under a key prefix over its quota. Servers respond to it
+	// as they do to ErrFull.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// ErrUnsupported is returned when a Store wraps another that does not
+	// support the optional interface being called.
+	ErrUnsupported = errors.New("not supported by this store")
+
+	// ErrBadHashcheckOperation is returned from HashcheckStore.ControlHashcheck
+	// when the request is not understood.
+	ErrBadHashcheckOperation = errors.New("bad hashcheck operation")
 )
 
 type Stat struct {
@@ -94,6 +114,13 @@ type GetOptions struct {
 	// If the channel given in Cancel is closed, then the Store call may return
 	// early with ErrCanceled.
 	Cancel <-chan struct{}
+
+	// RequestID identifies the request the Get is part of in logs. Stores that
+	// make requests of their own pass it along.
+	RequestID string
+
+	// Trace is the span the Get is part of, if it is being traced.
+	Trace tracing.SpanContext
 }
 
 var (
@@ -154,3 +181,150 @@ type RangeReadStore interface {
 	// empty byte slice.
 	GetPartial(key string, start, length int64, opts GetOptions) ([]byte, Stat, error)
 }
+
+// A RequestIDStore can tag the requests it makes with the ID of the request
+// that caused them, so that they can be matched up in logs.
+type RequestIDStore interface {
+	Store
+
+	// WithRequestID returns a Store that acts like this one, but tags the
+	// requests it makes with id. Get uses GetOptions.RequestID instead, if set.
+	WithRequestID(id string) Store
+}
+
+// WithRequestID returns st tagged with id if it is a RequestIDStore, and st
+// otherwise.
+func WithRequestID(st Store, id string) Store {
+	if id == "" {
+		return st
+	}
+	if rs, ok := st.(RequestIDStore); ok {
+		return rs.WithRequestID(id)
+	}
+	return st
+}
+
+// A TraceStore can trace the requests it makes as part of a span.
+type TraceStore interface {
+	Store
+
+	// WithTrace returns a Store that acts like this one, but traces the
+	// requests it makes as children of sc. Get uses GetOptions.Trace instead,
+	// if valid.
+	WithTrace(sc tracing.SpanContext) Store
+}
+
+// WithTrace returns st tracing as part of sc if it is a TraceStore, and st
+// otherwise.
+func WithTrace(st Store, sc tracing.SpanContext) Store {
+	if !sc.Valid() {
+		return st
+	}
+	if ts, ok := st.(TraceStore); ok {
+		return ts.WithTrace(sc)
+	}
+	return st
+}
+
+// A CapacityStore can report the total size of the space its values are kept
+// in, free or not.
+type CapacityStore interface {
+	Store
+
+	// Capacity returns the total number of bytes the store could hold if it
+	// were empty, including space used by other things on the same device.
+	Capacity(cancel <-chan struct{}) (int64, error)
+}
+
+// A QuarantineStore sets aside values that were found to be corrupt instead of
+// deleting them outright.
+type QuarantineStore interface {
+	Store
+
+	// ListQuarantine returns the values currently in quarantine, sorted by
+	// key.
+	ListQuarantine(cancel <-chan struct{}) ([]QuarantineEntry, error)
+}
+
+// A QuarantineEntry describes a value that was moved to quarantine.
+type QuarantineEntry struct {
+	Key string
+
+	// Length in bytes of the quarantined file, including any headers the
+	// store keeps with the data.
+	Size int64
+
+	// Epoch timestamp of when the value was quarantined.
+	Time int64
+}
+
+// Operations for HashcheckRequest.
+const (
+	// HashcheckStart restarts the hash check from the first key, unpausing it
+	// if needed.
+	HashcheckStart = "start"
+
+	// HashcheckPause stops the hash check where it is until it is resumed.
+	HashcheckPause = "pause"
+
+	// HashcheckResume continues a paused hash check.
+	HashcheckResume = "resume"
+
+	// HashcheckThrottle changes the time the hash check sleeps between values.
+	HashcheckThrottle = "throttle"
+)
+
+// A HashcheckStore runs a background check of the hashes of its values, which
+// can be observed and controlled while it runs.
+type HashcheckStore interface {
+	Store
+
+	// HashcheckStatus returns the progress of the current hash check pass.
+	HashcheckStatus(cancel <-chan struct{}) (HashcheckStatus, error)
+
+	// ControlHashcheck changes the state of the hash check, and returns its
+	// status afterwards.
+	ControlHashcheck(req HashcheckRequest, cancel <-chan struct{}) (HashcheckStatus, error)
+}
+
+// A HashcheckRequest is an operation for HashcheckStore.ControlHashcheck.
+type HashcheckRequest struct {
+	// One of HashcheckStart, HashcheckPause, HashcheckResume, or
+	// HashcheckThrottle.
+	Operation string
+
+	// The new sleep time per value checked and per byte checked, for
+	// HashcheckThrottle.
+	PerFileWait time.Duration
+	PerByteWait time.Duration
+}
+
+// HashcheckStatus describes the progress of a HashcheckStore's hash check.
+type HashcheckStatus struct {
+	Paused bool
+
+	// Full is true if a pass requested with HashcheckStart is still running.
+	Full bool
+
+	// The last key checked in the current pass, or "" if it hasn't checked
+	// any.
+	Position string
+
+	// The number of values found good and bad in the current pass.
+	Good, Bad int64
+
+	// The number of keys after Position. It is counted once per pass, so
+	// keys written since are not included.
+	Remaining int64
+
+	// Estimated time until the current pass finishes, or zero if unknown.
+	ETA time.Duration
+
+	PerFileWait time.Duration
+	PerByteWait time.Duration
+
+	// Results of the last pass to finish. LastFinished is the epoch timestamp
+	// it finished at, or 0 if none have.
+	LastGood, LastBad int64
+	LastFinished      int64
+}
@@ -0,0 +1,221 @@
+package storedir
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/encryptio/slime/internal/store"
+)
+
+type simulatedCrash struct {
+	point string
+}
+
+// runUntilCrash runs fn with a crashHook that panics at the n'th crash point
+// reached. It returns the name of the point the crash happened at, or "" if
+// fn finished before reaching it.
+func runUntilCrash(n int, fn func()) (point string) {
+	count := 0
+	crashHook = func(p string) {
+		count++
+		if count == n {
+			panic(simulatedCrash{p})
+		}
+	}
+
+	defer func() {
+		crashHook = nil
+		if r := recover(); r != nil {
+			c, ok := r.(simulatedCrash)
+			if !ok {
+				panic(r)
+			}
+			point = c.point
+		}
+	}()
+
+	fn()
+	return ""
+}
+
+func shouldCAS(t *testing.T, ds *Directory, key string, to store.CASV) {
+	err := ds.CAS(key, store.AnyV, to, nil)
+	if err != nil {
+		t.Fatalf("Couldn't CAS %#v: %v", key, err)
+	}
+}
+
+// shouldBeConsistent checks that ds, freshly opened, has no leftovers from
+// incomplete operations, that its splits don't overlap, and that every key in
+// want holds one of the listed values ("" meaning missing.)
+func shouldBeConsistent(t *testing.T, context string, ds *Directory, want map[string][]string) {
+	err := filepath.Walk(filepath.Join(ds.Dir, "data"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(path, ".new") || strings.HasSuffix(path, ".old") {
+			t.Errorf("in %v, %v was left behind", context, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("in %v, couldn't walk data directory: %v", context, err)
+	}
+
+	for i := 0; i+1 < len(ds.splits); i++ {
+		if ds.splits[i].High >= ds.splits[i+1].Low {
+			t.Errorf("in %v, splits %v and %v overlap", context, ds.splits[i], ds.splits[i+1])
+		}
+	}
+
+	var present []string
+	for key, values := range want {
+		data, _, err := ds.Get(key, store.GetOptions{})
+		if err != nil && err != store.ErrNotFound {
+			t.Errorf("in %v, couldn't get %#v: %v", context, key, err)
+			continue
+		}
+		got := string(data)
+		if err == nil {
+			present = append(present, key)
+		}
+
+		ok := false
+		for _, v := range values {
+			ok = ok || v == got
+		}
+		if !ok {
+			t.Errorf("in %v, %#v = %#v, but wanted one of %#v", context, key, got, values)
+		}
+	}
+
+	list, err := ds.List("", 0, nil)
+	if err != nil {
+		t.Fatalf("in %v, couldn't list: %v", context, err)
+	}
+	if len(list) != len(present) {
+		t.Errorf("in %v, listed %v keys, but %v are readable", context, len(list), len(present))
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	manyKeys := func(ds *Directory) {
+		for i := 0; i < 40; i++ {
+			shouldCAS(t, ds, strconv.Itoa(i), store.DataV([]byte("value "+strconv.Itoa(i))))
+		}
+	}
+	manyWant := func() map[string][]string {
+		want := make(map[string][]string)
+		for i := 0; i < 40; i++ {
+			want[strconv.Itoa(i)] = []string{"value " + strconv.Itoa(i)}
+		}
+		return want
+	}
+
+	tests := []struct {
+		name  string
+		setup func(ds *Directory)
+		op    func(ds *Directory)
+		want  map[string][]string
+	}{
+		{
+			name: "create",
+			setup: func(ds *Directory) {
+				shouldCAS(t, ds, "other", store.DataV([]byte("other")))
+			},
+			op: func(ds *Directory) {
+				ds.CAS("key", store.MissingV, store.DataV([]byte("new")), nil)
+			},
+			want: map[string][]string{
+				"key":   {"", "new"},
+				"other": {"other"},
+			},
+		},
+		{
+			name: "overwrite",
+			setup: func(ds *Directory) {
+				shouldCAS(t, ds, "key", store.DataV([]byte("old")))
+			},
+			op: func(ds *Directory) {
+				ds.CAS("key", store.AnyV, store.DataV([]byte("new")), nil)
+			},
+			want: map[string][]string{
+				"key": {"old", "new"},
+			},
+		},
+		{
+			name: "delete",
+			setup: func(ds *Directory) {
+				shouldCAS(t, ds, "key", store.DataV([]byte("old")))
+				shouldCAS(t, ds, "other", store.DataV([]byte("other")))
+			},
+			op: func(ds *Directory) {
+				ds.CAS("key", store.AnyV, store.MissingV, nil)
+			},
+			want: map[string][]string{
+				"key":   {"old", ""},
+				"other": {"other"},
+			},
+		},
+		{
+			name: "resplit split",
+			setup: func(ds *Directory) {
+				manyKeys(ds)
+				ds.minSplitSize = 2
+				ds.maxSplitSize = 8
+			},
+			op: func(ds *Directory) {
+				ds.resplit()
+			},
+			want: manyWant(),
+		},
+		{
+			name: "resplit merge",
+			setup: func(ds *Directory) {
+				manyKeys(ds)
+				ds.minSplitSize = 2
+				ds.maxSplitSize = 8
+				ds.resplit()
+				ds.minSplitSize = 20
+				ds.maxSplitSize = 100
+			},
+			op: func(ds *Directory) {
+				ds.resplit()
+			},
+			want: manyWant(),
+		},
+	}
+
+	for _, test := range tests {
+		for n := 1; ; n++ {
+			ds, tmpDir := makeTestingDirectory(t)
+			test.setup(ds)
+
+			point := runUntilCrash(n, func() { test.op(ds) })
+			ds.Close()
+
+			context := test.name + " finishing normally"
+			if point != "" {
+				context = test.name + " crashing at " + strconv.Itoa(n) + " (" + point + ")"
+			}
+
+			ds, err := openDirectoryImpl(tmpDir, 0, 0, DurabilityFileDir, 0, true)
+			if err != nil {
+				os.RemoveAll(tmpDir)
+				t.Fatalf("in %v, couldn't reopen directory: %v", context, err)
+			}
+
+			shouldBeConsistent(t, context, ds, test.want)
+
+			ds.Close()
+			os.RemoveAll(tmpDir)
+
+			if point == "" {
+				break
+			}
+		}
+	}
+}
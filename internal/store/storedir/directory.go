@@ -28,7 +28,15 @@ package storedir
 //     variable size data
 //
 // Key files that are found to violate their FNV hashes are moved into the
-// "quarantine" directory.
+// "quarantine" directory, and their modification time is set to the time they
+// were quarantined.
+//
+// Keys are written to a ".new" file beside their final path, then the existing
+// file (if any) is renamed to ".old", the ".new" file is renamed into place,
+// and the ".old" file is removed. A crash at any step leaves either the old or
+// the new contents recoverable by loadSplitsAndRecover. A crash during a
+// resplit leaves two splits with overlapping key ranges, which
+// loadSplitsAndRecover merges back together.
 
 import (
 	"bytes"
@@ -48,6 +56,7 @@ import (
 
 	"gopkg.in/tomb.v2"
 
+	"github.com/encryptio/slime/internal/logging"
 	"github.com/encryptio/slime/internal/store"
 	"github.com/encryptio/slime/internal/uuid"
 )
@@ -67,11 +76,14 @@ func (l splitsByLow) Less(i, j int) bool { return l[i].Low < l[j].Low }
 
 // A Directory is a Store which stores its data on a local filesystem.
 type Directory struct {
-	Dir         string
-	uuid        [16]byte
-	name        string
-	perFileWait time.Duration
-	perByteWait time.Duration
+	Dir        string
+	uuid       [16]byte
+	name       string
+	hashcheck  *HashcheckControl
+	durability Durability
+
+	// quarantined files older than this are removed; zero keeps them forever
+	quarantineRetention time.Duration
 
 	tomb tomb.Tomb
 
@@ -112,12 +124,14 @@ func CreateDirectory(dir string) error {
 	return f.Close()
 }
 
-// OpenDirectory opens an existing directory store.
-func OpenDirectory(dir string, perFileWait, perByteWait time.Duration) (*Directory, error) {
-	return openDirectoryImpl(dir, perFileWait, perByteWait, false)
+// OpenDirectory opens an existing directory store. durability sets how
+// carefully changes are flushed to disk. Quarantined files are removed after
+// quarantineRetention, or kept forever if it is not positive.
+func OpenDirectory(dir string, perFileWait, perByteWait time.Duration, durability Durability, quarantineRetention time.Duration) (*Directory, error) {
+	return openDirectoryImpl(dir, perFileWait, perByteWait, durability, quarantineRetention, false)
 }
 
-func openDirectoryImpl(dir string, perFileWait, perByteWait time.Duration, disableBackgroundLoops bool) (*Directory, error) {
+func openDirectoryImpl(dir string, perFileWait, perByteWait time.Duration, durability Durability, quarantineRetention time.Duration, disableBackgroundLoops bool) (*Directory, error) {
 	data, err := ioutil.ReadFile(filepath.Join(dir, "uuid"))
 	if err != nil {
 		return nil, err
@@ -134,10 +148,12 @@ func openDirectoryImpl(dir string, perFileWait, perByteWait time.Duration, disab
 		Dir:          dir,
 		uuid:         myUUID,
 		name:         host + ":" + dir,
-		perFileWait:  perFileWait,
-		perByteWait:  perByteWait,
+		hashcheck:    NewHashcheckControl(perFileWait, perByteWait),
+		durability:   durability,
 		minSplitSize: 500,
 		maxSplitSize: 2000,
+
+		quarantineRetention: quarantineRetention,
 	}
 
 	err = ds.loadSplitsAndRecover()
@@ -149,6 +165,9 @@ func openDirectoryImpl(dir string, perFileWait, perByteWait time.Duration, disab
 		if !disableBackgroundLoops {
 			ds.tomb.Go(ds.hashcheckLoop)
 			ds.tomb.Go(ds.resplitLoop)
+			if quarantineRetention > 0 {
+				ds.tomb.Go(ds.quarantinePurgeLoop)
+			}
 		}
 		return nil
 	})
@@ -232,8 +251,14 @@ func (ds *Directory) loadSplitsAndRecover() error {
 				} else {
 					// base file does NOT exist, move any .old file into place.
 					err = os.Rename(basePath+".old", basePath)
-					if err != nil && !os.IsNotExist(err) {
-						return err
+					if err != nil {
+						if !os.IsNotExist(err) {
+							return err
+						}
+
+						// no .old file either, so this was the first write
+						// of the key and it never completed.
+						continue
 					}
 				}
 
@@ -242,7 +267,7 @@ func (ds *Directory) loadSplitsAndRecover() error {
 
 			keyBytes, err := base64.URLEncoding.DecodeString(name)
 			if err != nil {
-				log.Printf("Bad filename in storedir at %v", filepath.Join(thisPath, name))
+				logging.Warnf("Bad filename in storedir at %v", filepath.Join(thisPath, name))
 				continue
 			}
 
@@ -263,7 +288,9 @@ func (ds *Directory) loadSplitsAndRecover() error {
 		}
 
 		if !foundOne {
-			// only bad filenames in this split, skip it
+			// only bad filenames or incomplete writes in this split, skip it.
+			// removing the directory only succeeds if it's now empty.
+			os.Remove(thisPath)
 			continue
 		}
 
@@ -295,7 +322,7 @@ func (ds *Directory) loadSplitsAndRecover() error {
 
 			keyBytes, err := base64.URLEncoding.DecodeString(name)
 			if err != nil {
-				log.Printf("Bad filename in storedir at %v", filepath.Join(ds.Dir, "data", name))
+				logging.Warnf("Bad filename in storedir at %v", filepath.Join(ds.Dir, "data", name))
 				continue
 			}
 
@@ -319,10 +346,15 @@ func (ds *Directory) loadSplitsAndRecover() error {
 
 			err = os.Rename(oldPath, newPath)
 			if err != nil {
-				log.Printf("Couldn't rename from %v to %v during migration: %v", oldPath, newPath, err)
+				logging.Errorf("Couldn't rename from %v to %v during migration: %v", oldPath, newPath, err)
 			}
 		}
 
+		err = ds.syncDirs(filepath.Join(ds.Dir, "data", "0"), filepath.Join(ds.Dir, "data"))
+		if err != nil {
+			return err
+		}
+
 		if foundOne {
 			// at least one non-bad filename was found, the split is valid
 			ds.splits = append(ds.splits, this)
@@ -331,6 +363,24 @@ func (ds *Directory) loadSplitsAndRecover() error {
 
 	sort.Sort(splitsByLow(ds.splits))
 
+	// a resplit that was interrupted leaves the keys it was moving spread
+	// across two splits with overlapping ranges. finish the job by merging
+	// them back together.
+	for i := 0; i+1 < len(ds.splits); {
+		if ds.splits[i].High < ds.splits[i+1].Low {
+			i++
+			continue
+		}
+
+		log.Printf("Merging overlapping splits %v and %v in %v",
+			ds.splits[i].Name, ds.splits[i+1].Name, ds.Dir)
+
+		err := ds.resplitMerge(ds.splits[i+1].Name)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -580,12 +630,21 @@ func (ds *Directory) CAS(key string, from, to store.CASV, cancel <-chan struct{}
 			}
 		}
 
+		err = ds.syncFile(fh)
+		if err != nil {
+			fh.Close()
+			os.Remove(path + ".new")
+			return err
+		}
+
 		err = fh.Close()
 		if err != nil {
 			os.Remove(path + ".new")
 			return err
 		}
 
+		crashPoint("cas: wrote new file")
+
 		if oldPath != "" {
 			// move the old file out of the way
 
@@ -594,6 +653,8 @@ func (ds *Directory) CAS(key string, from, to store.CASV, cancel <-chan struct{}
 				os.Remove(path + ".new")
 				return err
 			}
+
+			crashPoint("cas: moved old file aside")
 		}
 
 		// move the .new file to its resting place
@@ -607,6 +668,15 @@ func (ds *Directory) CAS(key string, from, to store.CASV, cancel <-chan struct{}
 			return err
 		}
 
+		// once the rename is on disk, a crash can no longer revert the key
+		// to its old contents.
+		err = ds.syncDirs(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+
+		crashPoint("cas: moved new file into place")
+
 		// clean up the old file
 		if oldPath != "" {
 			err = os.Remove(oldPath + ".old")
@@ -624,7 +694,12 @@ func (ds *Directory) CAS(key string, from, to store.CASV, cancel <-chan struct{}
 		return nil
 	}
 
-	return os.Remove(oldPath)
+	err = os.Remove(oldPath)
+	if err != nil {
+		return err
+	}
+
+	return ds.syncDirs(filepath.Dir(oldPath))
 }
 
 func (ds *Directory) chooseSplit(key string) (split, error) {
@@ -641,6 +716,11 @@ func (ds *Directory) chooseSplit(key string) (split, error) {
 			return split{}, err
 		}
 
+		err = ds.syncDirs(filepath.Join(ds.Dir, "data"))
+		if err != nil {
+			return split{}, err
+		}
+
 		ds.splits = append(ds.splits, this)
 
 		return this, nil
@@ -3,6 +3,7 @@
 package storedir
 
 import (
+	"os"
 	"path/filepath"
 
 	"golang.org/x/sys/unix"
@@ -18,3 +19,28 @@ func (ds *Directory) FreeSpace(cancel <-chan struct{}) (int64, error) {
 	// TODO: figure out and properly handle overflow
 	return int64(s.Bavail) * int64(s.Bsize), nil
 }
+
+func (ds *Directory) Capacity(cancel <-chan struct{}) (int64, error) {
+	s := unix.Statfs_t{}
+	err := unix.Statfs(filepath.Join(ds.Dir, "data"), &s)
+	if err != nil {
+		return -1, err
+	}
+
+	return int64(s.Blocks) * int64(s.Bsize), nil
+}
+
+func syncDir(dir string) error {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = fh.Sync()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+
+	return fh.Close()
+}
@@ -30,3 +30,28 @@ func (ds *Directory) FreeSpace(cancel <-chan struct{}) (int64, error) {
 
 	return free, nil
 }
+
+func (ds *Directory) Capacity(cancel <-chan struct{}) (int64, error) {
+	dir, err := filepath.Abs(ds.Dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var avail, total, free int64
+	r1, _, err := getDiskFreeSpaceExW.Call(
+		uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(dir))),
+		uintptr(unsafe.Pointer(&avail)),
+		uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&free)))
+	if r1 == 0 {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+func syncDir(dir string) error {
+	// directories can't be opened for writing on windows, so they can't be
+	// flushed; NTFS journals its metadata updates instead.
+	return nil
+}
@@ -0,0 +1,83 @@
+package storedir
+
+import (
+	"fmt"
+	"os"
+)
+
+// Durability controls how hard a Directory works to make its changes survive
+// a crash or power loss.
+type Durability int
+
+const (
+	// DurabilityNone leaves flushing to the operating system. After a power
+	// loss, recent writes may be lost or truncated.
+	DurabilityNone Durability = iota
+
+	// DurabilityFile fsyncs each key file before renaming it into place, so a
+	// key is never replaced by a partially written file.
+	DurabilityFile
+
+	// DurabilityFileDir additionally fsyncs directories after entries are
+	// created, renamed, or removed, so writes, deletes, resplits, and
+	// quarantines are on disk by the time they return.
+	DurabilityFileDir
+)
+
+var durabilityNames = map[Durability]string{
+	DurabilityNone:    "none",
+	DurabilityFile:    "file",
+	DurabilityFileDir: "file+dir",
+}
+
+func (d Durability) String() string {
+	if name, ok := durabilityNames[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+// ParseDurability parses the name of a durability mode, as returned by
+// Durability.String.
+func ParseDurability(s string) (Durability, error) {
+	for d, name := range durabilityNames {
+		if name == s {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown durability mode %#v", s)
+}
+
+// crashHook, if set, is called at each point during a multi-step update of
+// the filesystem where the process dying would leave intermediate state on
+// disk for loadSplitsAndRecover to clean up. Only tests set it.
+var crashHook func(point string)
+
+func crashPoint(point string) {
+	if crashHook != nil {
+		crashHook(point)
+	}
+}
+
+func (ds *Directory) syncFile(fh *os.File) error {
+	if ds.durability < DurabilityFile {
+		return nil
+	}
+	return fh.Sync()
+}
+
+// syncDirs fsyncs each of the given directories, in order. When an entry is
+// moved between directories, the destination should be synced first, so that
+// a crash never loses the entry from both.
+func (ds *Directory) syncDirs(dirs ...string) error {
+	if ds.durability < DurabilityFileDir {
+		return nil
+	}
+	for _, dir := range dirs {
+		err := syncDir(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,15 +3,18 @@ package storedir
 import (
 	"encoding/base64"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/encryptio/slime/internal/logging"
 	"github.com/encryptio/slime/internal/store"
 	"github.com/encryptio/slime/internal/uuid"
 )
 
+// hashcheckBatch is the most keys checked by each step of the hash check.
+var hashcheckBatch = 100
+
 func (ds *Directory) Hashcheck() (good, bad int64) {
 	after := ""
 	for {
@@ -26,16 +29,36 @@ func (ds *Directory) Hashcheck() (good, bad int64) {
 	}
 }
 
+func (ds *Directory) HashcheckStatus(cancel <-chan struct{}) (store.HashcheckStatus, error) {
+	return ds.hashcheck.Status(func(after string) (int64, error) {
+		keys, err := ds.List(after, 0, cancel)
+		return int64(len(keys)), err
+	})
+}
+
+func (ds *Directory) ControlHashcheck(req store.HashcheckRequest, cancel <-chan struct{}) (store.HashcheckStatus, error) {
+	err := ds.hashcheck.Control(req)
+	if err != nil {
+		return store.HashcheckStatus{}, err
+	}
+	return ds.HashcheckStatus(cancel)
+}
+
 func (ds *Directory) hashcheckLoop() error {
 	for {
+		if !ds.hashcheck.WaitUnpaused(ds.tomb.Dying()) {
+			return nil
+		}
+
 		_, bad := ds.hashstep()
 		if bad != 0 {
-			log.Printf("Found %v bad items hash check on %v\n",
+			logging.Warnf("Found %v bad items hash check on %v",
 				bad, uuid.Fmt(ds.UUID()))
 		}
 
 		select {
 		case <-time.After(5 * time.Second):
+		case <-ds.hashcheck.Kicked():
 		case <-ds.tomb.Dying():
 			return nil
 		}
@@ -50,15 +73,17 @@ func (ds *Directory) hashstep() (good, bad int64) {
 	if err == nil {
 		after = string(data)
 	} else if !os.IsNotExist(err) {
-		log.Printf("Couldn't read %v: %v", statePath, err)
+		logging.Errorf("Couldn't read %v: %v", statePath, err)
 		return
 	}
 
+	after = ds.hashcheck.StepStart(after)
 	good, bad, after = ds.hashstepInner(after)
+	ds.hashcheck.StepDone(good, bad, after)
 
 	err = ioutil.WriteFile(statePath, []byte(after), 0666)
 	if err != nil {
-		log.Printf("Couldn't write to %v: %v", statePath, err)
+		logging.Errorf("Couldn't write to %v: %v", statePath, err)
 		return
 	}
 
@@ -68,9 +93,9 @@ func (ds *Directory) hashstep() (good, bad int64) {
 func (ds *Directory) hashstepInner(afterIn string) (good, bad int64, after string) {
 	after = afterIn
 
-	keys, err := ds.List(after, 100, nil)
+	keys, err := ds.List(after, hashcheckBatch, nil)
 	if err != nil {
-		log.Printf("Couldn't list in %v for hash check: %v", ds.Dir, err)
+		logging.Errorf("Couldn't list in %v for hash check: %v", ds.Dir, err)
 		return
 	}
 
@@ -87,18 +112,13 @@ func (ds *Directory) hashstepInner(afterIn string) (good, bad int64, after strin
 			good++
 		}
 
-		wait := ds.perFileWait + time.Duration(len(data))*ds.perByteWait
+		size := len(data)
 		data = nil // free memory before sleep
-		if wait > 0 {
-			time.Sleep(wait)
-		}
 
 		after = key
 
-		select {
-		case <-ds.tomb.Dying():
+		if !ds.hashcheck.Sleep(size, ds.tomb.Dying()) {
 			return
-		default:
 		}
 	}
 
@@ -110,7 +130,21 @@ func (ds *Directory) quarantine(key, path string) {
 
 	err := os.Rename(path, quarantinePath)
 	if err != nil {
-		log.Printf("Couldn't quarantine %v into %v: %v",
+		logging.Errorf("Couldn't quarantine %v into %v: %v",
 			path, quarantinePath, err)
+		return
+	}
+
+	// record when the file was quarantined, for the retention period
+	now := time.Now()
+	err = os.Chtimes(quarantinePath, now, now)
+	if err != nil {
+		logging.Errorf("Couldn't set quarantine time on %v: %v", quarantinePath, err)
+	}
+
+	err = ds.syncDirs(filepath.Dir(quarantinePath), filepath.Dir(path))
+	if err != nil {
+		logging.Errorf("Couldn't sync directories after quarantining %v: %v",
+			path, err)
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/encryptio/slime/internal/store"
 	"github.com/encryptio/slime/internal/store/storetests"
@@ -29,3 +30,127 @@ func TestDirectoryCorruption(t *testing.T) {
 	shouldHashcheck(t, ds, 0, 0)
 	shouldFileExist(t, filepath.Join(tmpDir, "quarantine", "b3RoZXI="))
 }
+
+func shouldHashcheckStatus(t *testing.T, ds *Directory, good, remaining int64) store.HashcheckStatus {
+	st, err := ds.HashcheckStatus(nil)
+	if err != nil {
+		t.Fatalf("Couldn't get hashcheck status: %v", err)
+	}
+	if st.Good != good || st.Remaining != remaining {
+		t.Errorf("HashcheckStatus() = (good %v, remaining %v), but wanted (%v, %v)",
+			st.Good, st.Remaining, good, remaining)
+	}
+	return st
+}
+
+// finishHashcheckPass runs hashcheck steps until the current pass is done.
+func finishHashcheckPass(ds *Directory) {
+	ds.hashstep()
+	for ds.hashcheck.Position() != "" {
+		ds.hashstep()
+	}
+}
+
+func TestDirectoryHashcheckControl(t *testing.T) {
+	defer func(old int) { hashcheckBatch = old }(hashcheckBatch)
+	hashcheckBatch = 1
+
+	ds, tmpDir := makeTestingDirectory(t)
+	defer os.RemoveAll(tmpDir)
+	defer ds.Close()
+
+	storetests.ShouldCAS(t, ds, "a", store.AnyV, store.DataV([]byte("alpha")))
+	storetests.ShouldCAS(t, ds, "b", store.AnyV, store.DataV([]byte("beta")))
+
+	shouldHashcheckStatus(t, ds, 0, 2)
+
+	ds.hashstep()
+	st := shouldHashcheckStatus(t, ds, 1, 1)
+	if st.Position != "a" {
+		t.Errorf("Hashcheck position is %#v after one step, wanted \"a\"", st.Position)
+	}
+
+	finishHashcheckPass(ds)
+	st = shouldHashcheckStatus(t, ds, 2, 2)
+	if st.LastGood != 2 || st.LastFinished == 0 {
+		t.Errorf("Finished pass recorded as %v good at %v", st.LastGood, st.LastFinished)
+	}
+
+	storetests.ShouldCAS(t, ds, "c", store.AnyV, store.DataV([]byte("gamma")))
+	ds.hashstep()
+	ds.hashstep()
+	shouldHashcheckStatus(t, ds, 2, 1)
+
+	st, err := ds.ControlHashcheck(store.HashcheckRequest{Operation: store.HashcheckStart}, nil)
+	if err != nil {
+		t.Fatalf("Couldn't start hashcheck: %v", err)
+	}
+	if !st.Full {
+		t.Errorf("Started hashcheck is not marked full")
+	}
+
+	ds.hashstep()
+	shouldHashcheckStatus(t, ds, 1, 2)
+	finishHashcheckPass(ds)
+	st = shouldHashcheckStatus(t, ds, 3, 3)
+	if st.Full {
+		t.Errorf("Finished hashcheck is still marked full")
+	}
+
+	st, err = ds.ControlHashcheck(store.HashcheckRequest{Operation: store.HashcheckPause}, nil)
+	if err != nil || !st.Paused {
+		t.Errorf("Pausing hashcheck returned (paused %v, %v)", st.Paused, err)
+	}
+	st, err = ds.ControlHashcheck(store.HashcheckRequest{Operation: store.HashcheckResume}, nil)
+	if err != nil || st.Paused {
+		t.Errorf("Resuming hashcheck returned (paused %v, %v)", st.Paused, err)
+	}
+
+	st, err = ds.ControlHashcheck(store.HashcheckRequest{
+		Operation:   store.HashcheckThrottle,
+		PerFileWait: time.Millisecond,
+		PerByteWait: time.Nanosecond,
+	}, nil)
+	if err != nil || st.PerFileWait != time.Millisecond || st.PerByteWait != time.Nanosecond {
+		t.Errorf("Throttling hashcheck returned (%v, %v, %v)", st.PerFileWait, st.PerByteWait, err)
+	}
+
+	_, err = ds.ControlHashcheck(store.HashcheckRequest{Operation: "bogus"}, nil)
+	if err != store.ErrBadHashcheckOperation {
+		t.Errorf("Bad hashcheck operation returned %v, wanted %v", err, store.ErrBadHashcheckOperation)
+	}
+}
+
+func TestHashcheckControlCountsOncePerPass(t *testing.T) {
+	c := NewHashcheckControl(0, 0)
+
+	counts := 0
+	count := func(after string) (int64, error) {
+		counts++
+		return 10, nil
+	}
+
+	shouldStatus := func(remaining int64, wantCounts int) {
+		st, err := c.Status(count)
+		if err != nil {
+			t.Fatalf("Couldn't get status: %v", err)
+		}
+		if st.Remaining != remaining || counts != wantCounts {
+			t.Errorf("Status() = remaining %v after %v counts, wanted %v after %v",
+				st.Remaining, counts, remaining, wantCounts)
+		}
+	}
+
+	c.StepStart("")
+	shouldStatus(10, 1)
+	c.StepDone(3, 1, "d")
+	shouldStatus(6, 1)
+	c.StepStart("d")
+	c.StepDone(2, 0, "f")
+	shouldStatus(4, 1)
+
+	// finishing the pass counts again
+	c.StepStart("f")
+	c.StepDone(4, 0, "")
+	shouldStatus(10, 2)
+}
@@ -0,0 +1,257 @@
+package storedir
+
+import (
+	"sync"
+	"time"
+
+	"github.com/encryptio/slime/internal/store"
+)
+
+// A HashcheckControl holds the throttle and progress of a local store's
+// background hash check, and lets it be paused, resumed, or restarted while it
+// runs.
+//
+// The hash check calls StepStart and StepDone around each batch of keys it
+// checks, and Sleep after each key.
+type HashcheckControl struct {
+	mu          sync.Mutex
+	perFileWait time.Duration
+	perByteWait time.Duration
+
+	paused   bool
+	unpaused chan struct{} // closed while not paused
+	kick     chan struct{}
+	restart  bool
+	full     bool
+
+	position  string
+	good, bad int64
+
+	// Counting the keys left is as slow as listing them, so it's done once
+	// per pass and the count is kept up to date by subtracting keys checked
+	// since. pass changes when a pass starts or finishes.
+	pass         int64
+	counted      bool
+	countPass    int64
+	countLeft    int64
+	countChecked int64
+
+	// time spent on the current pass, not counting pauses, for the ETA
+	elapsed     time.Duration
+	stepStart   time.Time
+	pausedStart time.Time
+	pausedTotal time.Duration
+	stepPaused  time.Duration
+
+	lastGood, lastBad int64
+	lastFinished      int64
+}
+
+// NewHashcheckControl creates a HashcheckControl with the given initial
+// throttle.
+func NewHashcheckControl(perFileWait, perByteWait time.Duration) *HashcheckControl {
+	c := &HashcheckControl{
+		perFileWait: perFileWait,
+		perByteWait: perByteWait,
+		unpaused:    make(chan struct{}),
+		kick:        make(chan struct{}, 1),
+	}
+	close(c.unpaused)
+	return c
+}
+
+// Kicked returns a channel that receives a value when a new pass is requested,
+// so the hash check loop can skip its sleep between batches.
+func (c *HashcheckControl) Kicked() <-chan struct{} {
+	return c.kick
+}
+
+// StepStart is called before checking a batch of keys after saved, the
+// position stored on disk. It returns the position to start from.
+func (c *HashcheckControl) StepStart(saved string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.restart {
+		c.restart = false
+		saved = ""
+	}
+
+	if saved == "" {
+		c.good, c.bad = 0, 0
+		c.elapsed = 0
+		c.pass++
+	}
+
+	c.position = saved
+	c.stepStart = time.Now()
+	c.stepPaused = c.pausedTotal
+
+	return saved
+}
+
+// StepDone is called after checking a batch of keys, with the number of good
+// and bad values found and the last key checked, or "" if the pass finished.
+func (c *HashcheckControl) StepDone(good, bad int64, after string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.good += good
+	c.bad += bad
+	c.elapsed += time.Since(c.stepStart) - (c.pausedTotal - c.stepPaused)
+
+	if c.restart {
+		// a new pass was requested during this step; StepStart resets
+		return
+	}
+
+	c.position = after
+	if after == "" {
+		c.pass++
+		c.full = false
+		c.lastGood, c.lastBad = c.good, c.bad
+		c.lastFinished = time.Now().Unix()
+	}
+}
+
+// Sleep waits for the throttle delay after checking a value of the given size,
+// and then for as long as the hash check is paused. It returns false if dying
+// is closed first.
+func (c *HashcheckControl) Sleep(size int, dying <-chan struct{}) bool {
+	c.mu.Lock()
+	wait := c.perFileWait + time.Duration(size)*c.perByteWait
+	c.mu.Unlock()
+
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-dying:
+			return false
+		}
+	}
+
+	return c.WaitUnpaused(dying)
+}
+
+// WaitUnpaused waits for as long as the hash check is paused. It returns false
+// if dying is closed first.
+func (c *HashcheckControl) WaitUnpaused(dying <-chan struct{}) bool {
+	select {
+	case <-dying:
+		return false
+	default:
+	}
+
+	c.mu.Lock()
+	unpaused := c.unpaused
+	c.mu.Unlock()
+
+	select {
+	case <-unpaused:
+		return true
+	case <-dying:
+		return false
+	}
+}
+
+// Position returns the last key checked in the current pass.
+func (c *HashcheckControl) Position() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.position
+}
+
+// Status returns the progress of the hash check. count is called to count the
+// keys after a position, at most once per pass; Remaining is estimated from
+// that count after, so it does not include keys written since.
+func (c *HashcheckControl) Status(count func(after string) (int64, error)) (store.HashcheckStatus, error) {
+	c.mu.Lock()
+	if !c.counted || c.countPass != c.pass {
+		pass, position, checked := c.pass, c.position, c.good+c.bad
+		c.mu.Unlock()
+
+		left, err := count(position)
+		if err != nil {
+			return store.HashcheckStatus{}, err
+		}
+
+		c.mu.Lock()
+		if c.pass == pass {
+			c.counted = true
+			c.countPass = pass
+			c.countLeft = left
+			c.countChecked = checked
+		}
+	}
+	defer c.mu.Unlock()
+
+	remaining := c.countLeft - (c.good + c.bad - c.countChecked)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	st := store.HashcheckStatus{
+		Paused:       c.paused,
+		Full:         c.full,
+		Position:     c.position,
+		Good:         c.good,
+		Bad:          c.bad,
+		Remaining:    remaining,
+		PerFileWait:  c.perFileWait,
+		PerByteWait:  c.perByteWait,
+		LastGood:     c.lastGood,
+		LastBad:      c.lastBad,
+		LastFinished: c.lastFinished,
+	}
+
+	checked := c.good + c.bad
+	if checked > 0 && c.elapsed > 0 {
+		st.ETA = time.Duration(float64(c.elapsed) / float64(checked) * float64(remaining))
+	}
+
+	return st, nil
+}
+
+// Control applies req to the hash check.
+func (c *HashcheckControl) Control(req store.HashcheckRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch req.Operation {
+	case store.HashcheckStart:
+		c.restart = true
+		c.full = true
+		c.resume()
+		select {
+		case c.kick <- struct{}{}:
+		default:
+		}
+	case store.HashcheckPause:
+		if !c.paused {
+			c.paused = true
+			c.pausedStart = time.Now()
+			c.unpaused = make(chan struct{})
+		}
+	case store.HashcheckResume:
+		c.resume()
+	case store.HashcheckThrottle:
+		if req.PerFileWait < 0 || req.PerByteWait < 0 {
+			return store.ErrBadHashcheckOperation
+		}
+		c.perFileWait = req.PerFileWait
+		c.perByteWait = req.PerByteWait
+	default:
+		return store.ErrBadHashcheckOperation
+	}
+
+	return nil
+}
+
+// Assumes c.mu is held.
+func (c *HashcheckControl) resume() {
+	if c.paused {
+		c.paused = false
+		c.pausedTotal += time.Since(c.pausedStart)
+		close(c.unpaused)
+	}
+}
@@ -0,0 +1,120 @@
+package storedir
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/store"
+)
+
+// QuarantinePurgeInterval is how often quarantined files are checked against
+// the retention period.
+var QuarantinePurgeInterval = time.Hour
+
+// ReadQuarantine lists the quarantined files in dir, which is laid out like
+// the quarantine directory of a Directory: one file per key, named by the
+// base64 URL encoding of the key, with a modification time of when it was
+// quarantined.
+func ReadQuarantine(dir string) ([]store.QuarantineEntry, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]store.QuarantineEntry, 0, len(fis))
+	for _, fi := range fis {
+		keyBytes, err := base64.URLEncoding.DecodeString(fi.Name())
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, store.QuarantineEntry{
+			Key:  string(keyBytes),
+			Size: fi.Size(),
+			Time: fi.ModTime().Unix(),
+		})
+	}
+
+	sort.Sort(quarantineByKey(entries))
+
+	return entries, nil
+}
+
+// PurgeQuarantine removes the files in the quarantine directory dir that were
+// quarantined before the given time. It returns the number of files removed.
+func PurgeQuarantine(dir string, before time.Time) (int, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, fi := range fis {
+		if !fi.ModTime().Before(before) {
+			continue
+		}
+
+		err := os.Remove(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+type quarantineByKey []store.QuarantineEntry
+
+func (l quarantineByKey) Len() int           { return len(l) }
+func (l quarantineByKey) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l quarantineByKey) Less(i, j int) bool { return l[i].Key < l[j].Key }
+
+func (ds *Directory) ListQuarantine(cancel <-chan struct{}) ([]store.QuarantineEntry, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	select {
+	case <-cancel:
+		return nil, store.ErrCancelled
+	default:
+	}
+
+	return ReadQuarantine(filepath.Join(ds.Dir, "quarantine"))
+}
+
+func (ds *Directory) purgeQuarantine() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	dir := filepath.Join(ds.Dir, "quarantine")
+	removed, err := PurgeQuarantine(dir, time.Now().Add(-ds.quarantineRetention))
+	if err != nil {
+		logging.Errorf("Couldn't purge old files from %v: %v", dir, err)
+	}
+	if removed > 0 {
+		log.Printf("Purged %v files older than %v from %v",
+			removed, ds.quarantineRetention, dir)
+	}
+}
+
+func (ds *Directory) quarantinePurgeLoop() error {
+	for {
+		ds.purgeQuarantine()
+
+		select {
+		case <-time.After(QuarantinePurgeInterval):
+		case <-ds.tomb.Dying():
+			return nil
+		}
+	}
+}
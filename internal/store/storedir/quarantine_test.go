@@ -0,0 +1,61 @@
+package storedir
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/store/storetests"
+)
+
+func shouldListQuarantine(t *testing.T, ds *Directory, keys []string) {
+	entries, err := ds.ListQuarantine(nil)
+	if err != nil {
+		t.Fatalf("Couldn't list quarantine: %v", err)
+	}
+
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Key)
+	}
+
+	if len(got) != len(keys) {
+		t.Errorf("ListQuarantine() = %#v, but wanted %#v", got, keys)
+		return
+	}
+	for i := range got {
+		if got[i] != keys[i] {
+			t.Errorf("ListQuarantine() = %#v, but wanted %#v", got, keys)
+			return
+		}
+	}
+}
+
+func TestDirectoryQuarantine(t *testing.T) {
+	ds, tmpDir := makeTestingDirectory(t)
+	defer os.RemoveAll(tmpDir)
+	defer ds.Close()
+
+	shouldListQuarantine(t, ds, nil)
+
+	storetests.ShouldCAS(t, ds, "hello", store.AnyV, store.DataV([]byte("world")))
+	storetests.ShouldCAS(t, ds, "other", store.AnyV, store.DataV([]byte("werld")))
+	shouldCorrupt(t, filepath.Join(tmpDir, "data", "1", "aGVsbG8="))
+	shouldCorrupt(t, filepath.Join(tmpDir, "data", "1", "b3RoZXI="))
+	shouldHashcheck(t, ds, 0, 2)
+
+	shouldListQuarantine(t, ds, []string{"hello", "other"})
+
+	old := time.Now().Add(-2 * time.Hour)
+	err := os.Chtimes(filepath.Join(tmpDir, "quarantine", "aGVsbG8="), old, old)
+	if err != nil {
+		t.Fatalf("Couldn't change modification time: %v", err)
+	}
+
+	ds.quarantineRetention = time.Hour
+	ds.purgeQuarantine()
+
+	shouldListQuarantine(t, ds, []string{"other"})
+}
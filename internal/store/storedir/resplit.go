@@ -4,12 +4,13 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"sort"
 	"time"
+
+	"github.com/encryptio/slime/internal/logging"
 )
 
 func (ds *Directory) resplitLoop() error {
@@ -119,13 +120,25 @@ func (ds *Directory) resplitMerge(name string) error {
 		err := os.Rename(fromPath, toPath)
 		if err != nil {
 			// TODO: mark this Directory as failed and do not respond to further requests
-			log.Printf("Couldn't move %v to %v during resplitting: %v", fromPath, toPath, err)
+			logging.Errorf("Couldn't move %v to %v during resplitting: %v", fromPath, toPath, err)
 			return err
 		}
+
+		crashPoint("resplit merge: moved file")
+	}
+
+	err = ds.syncDirs(toDir, fromDir)
+	if err != nil {
+		return err
 	}
 
 	os.Remove(fromDir)
 
+	err = ds.syncDirs(filepath.Join(ds.Dir, "data"))
+	if err != nil {
+		return err
+	}
+
 	if ds.splits[toIdx].Low > ds.splits[fromIdx].Low {
 		ds.splits[toIdx].Low = ds.splits[fromIdx].Low
 	}
@@ -194,6 +207,11 @@ func (ds *Directory) resplitSplit(name string) error {
 		break
 	}
 
+	err = ds.syncDirs(filepath.Join(ds.Dir, "data"))
+	if err != nil {
+		return err
+	}
+
 	for _, key := range toNew {
 		name := base64.URLEncoding.EncodeToString([]byte(key))
 		oldPath := filepath.Join(dir, name)
@@ -201,9 +219,16 @@ func (ds *Directory) resplitSplit(name string) error {
 		err := os.Rename(oldPath, newPath)
 		if err != nil {
 			// TODO: mark this Directory as failed and do not respond to further requests
-			log.Printf("Couldn't move %v to %v during resplitting: %v", oldPath, newPath, err)
+			logging.Errorf("Couldn't move %v to %v during resplitting: %v", oldPath, newPath, err)
 			return err
 		}
+
+		crashPoint("resplit split: moved file")
+	}
+
+	err = ds.syncDirs(newDir, dir)
+	if err != nil {
+		return err
 	}
 
 	newSplit := split{
@@ -60,7 +60,7 @@ func makeTestingDirectory(t *testing.T) (*Directory, string) {
 		t.Fatalf("CreateDirectory returned unexpected error %v", err)
 	}
 
-	ds, err := openDirectoryImpl(tmpDir, 0, 0, true)
+	ds, err := openDirectoryImpl(tmpDir, 0, 0, DurabilityFileDir, 0, true)
 	if err != nil {
 		os.RemoveAll(tmpDir)
 		t.Fatalf("OpenDirectory returned unexpected error %v", err)
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"hash"
 	"io"
@@ -17,15 +18,18 @@ import (
 
 	"github.com/encryptio/slime/internal/httputil"
 	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/tracing"
 	"github.com/encryptio/slime/internal/uuid"
 )
 
 // Client is a Store which interfaces with the standard HTTP interface.
 type Client struct {
-	url    string
-	uuid   [16]byte
-	name   string
-	client *http.Client
+	url       string
+	uuid      [16]byte
+	name      string
+	client    *http.Client
+	requestID string              // sent with every request if not empty
+	trace     tracing.SpanContext // parent of request spans, if valid
 }
 
 // NewClient creates a Client. The URL passed should end with a trailing slash.
@@ -62,6 +66,23 @@ func (cc *Client) Close() error {
 	return nil
 }
 
+// WithRequestID returns a copy of the Client that sends id in the
+// X-Request-ID header of its requests. The copy shares its connections with
+// cc.
+func (cc *Client) WithRequestID(id string) store.Store {
+	c := *cc
+	c.requestID = id
+	return &c
+}
+
+// WithTrace returns a copy of the Client that traces its requests as children
+// of sc. The copy shares its connections with cc.
+func (cc *Client) WithTrace(sc tracing.SpanContext) store.Store {
+	c := *cc
+	c.trace = sc
+	return &c
+}
+
 func (cc *Client) UUID() [16]byte {
 	return cc.uuid
 }
@@ -71,13 +92,20 @@ func (cc *Client) Name() string {
 }
 
 func (cc *Client) Get(key string, opts store.GetOptions) ([]byte, store.Stat, error) {
-	var headers http.Header
+	headers := make(http.Header, 2)
 	if opts.NoVerify {
-		headers = make(http.Header, 1)
 		headers.Set("X-Slime-Noverify", "true")
 	}
+	if opts.RequestID != "" {
+		headers.Set(httputil.RequestIDHeader, opts.RequestID)
+	}
 
-	resp, err := cc.startReq("GET", cc.url+url.QueryEscape(key), nil, headers, opts.Cancel)
+	c := cc
+	if opts.Trace.Valid() {
+		c = cc.WithTrace(opts.Trace).(*Client)
+	}
+
+	resp, err := c.startReq("GET", cc.url+url.QueryEscape(key), nil, headers, opts.Cancel)
 	if err != nil {
 		return nil, store.Stat{}, err
 	}
@@ -170,7 +198,7 @@ func (cc *Client) CAS(key string, from, to store.CASV, cancel <-chan struct{}) e
 		}
 	}
 
-	resp, err := cc.client.Do(req)
+	resp, err := cc.do(req)
 	if err != nil {
 		return err
 	}
@@ -184,6 +212,10 @@ func (cc *Client) CAS(key string, from, to store.CASV, cancel <-chan struct{}) e
 		return store.ErrCASFailure
 	}
 
+	if resp.StatusCode == http.StatusInsufficientStorage {
+		return store.ErrFull
+	}
+
 	if resp.StatusCode == http.StatusNotFound {
 		if from.Any || !from.Present {
 			return nil
@@ -236,6 +268,87 @@ func (cc *Client) List(after string, limit int, cancel <-chan struct{}) ([]strin
 	return strs, nil
 }
 
+func (cc *Client) ListQuarantine(cancel <-chan struct{}) ([]store.QuarantineEntry, error) {
+	resp, err := cc.startReq("GET", cc.url+"?mode=quarantine", nil, nil, cancel)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, httputil.ReadResponseAsError(resp)
+	}
+
+	var list []quarantineEntryJSON
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]store.QuarantineEntry, len(list))
+	for i, e := range list {
+		entries[i] = store.QuarantineEntry{
+			Key:  e.Key,
+			Size: e.Size,
+			Time: e.Time,
+		}
+	}
+
+	return entries, nil
+}
+
+func (cc *Client) HashcheckStatus(cancel <-chan struct{}) (store.HashcheckStatus, error) {
+	resp, err := cc.startReq("GET", cc.url+"?mode=hashcheck", nil, nil, cancel)
+	if err != nil {
+		return store.HashcheckStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	return readHashcheckStatus(resp)
+}
+
+func (cc *Client) ControlHashcheck(req store.HashcheckRequest, cancel <-chan struct{}) (store.HashcheckStatus, error) {
+	reqJSON := hashcheckRequestJSON{Operation: req.Operation}
+	if req.Operation == store.HashcheckThrottle {
+		reqJSON.SleepPerFile = req.PerFileWait.String()
+		reqJSON.SleepPerByte = req.PerByteWait.String()
+	}
+
+	body, err := json.Marshal(reqJSON)
+	if err != nil {
+		return store.HashcheckStatus{}, err
+	}
+
+	headers := make(http.Header, 1)
+	headers.Set("Content-Type", "application/json; charset=utf-8")
+
+	resp, err := cc.startReq("POST", cc.url+"?mode=hashcheck",
+		bytes.NewReader(body), headers, cancel)
+	if err != nil {
+		return store.HashcheckStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	return readHashcheckStatus(resp)
+}
+
+func readHashcheckStatus(resp *http.Response) (store.HashcheckStatus, error) {
+	switch {
+	case resp.StatusCode == http.StatusNotImplemented:
+		return store.HashcheckStatus{}, store.ErrUnsupported
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return store.HashcheckStatus{}, httputil.ReadResponseAsError(resp)
+	}
+
+	var st hashcheckStatusJSON
+	err := json.NewDecoder(resp.Body).Decode(&st)
+	if err != nil {
+		return store.HashcheckStatus{}, err
+	}
+
+	return st.toStatus()
+}
+
 func (cc *Client) FreeSpace(cancel <-chan struct{}) (int64, error) {
 	resp, err := cc.startReq("GET", cc.url+"?mode=free", nil, nil, cancel)
 	if err != nil {
@@ -255,6 +368,28 @@ func (cc *Client) FreeSpace(cancel <-chan struct{}) (int64, error) {
 	return strconv.ParseInt(string(data), 10, 64)
 }
 
+func (cc *Client) Capacity(cancel <-chan struct{}) (int64, error) {
+	resp, err := cc.startReq("GET", cc.url+"?mode=capacity", nil, nil, cancel)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotImplemented:
+		return 0, store.ErrUnsupported
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return 0, httputil.ReadResponseAsError(resp)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 32))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
 func (cc *Client) Stat(key string, cancel <-chan struct{}) (store.Stat, error) {
 	resp, err := cc.startReq("HEAD", cc.url+url.QueryEscape(key), nil, nil, cancel)
 	if err != nil {
@@ -371,7 +506,7 @@ func (cc *Client) startReq(
 
 	req.Cancel = cancel
 
-	resp, err := cc.client.Do(req)
+	resp, err := cc.do(req)
 
 	select {
 	case <-cancel:
@@ -380,3 +515,43 @@ func (cc *Client) startReq(
 		return resp, err
 	}
 }
+
+// do sends req with the client's request ID, tracing it in a span that ends
+// when the response body is closed.
+func (cc *Client) do(req *http.Request) (*http.Response, error) {
+	if cc.requestID != "" {
+		req.Header.Set(httputil.RequestIDHeader, cc.requestID)
+	}
+
+	span := tracing.Start(cc.trace, "storehttp.Client "+req.Method)
+	if span == nil {
+		tracing.Inject(req.Header, cc.trace)
+		return cc.client.Do(req)
+	}
+
+	span.SetAttribute("store", cc.name)
+	span.SetAttribute("url", req.URL.String())
+	tracing.Inject(req.Header, span.Context())
+
+	resp, err := cc.client.Do(req)
+	if err != nil {
+		span.SetError(err)
+		span.End()
+		return nil, err
+	}
+
+	span.SetAttribute("status", resp.StatusCode)
+	resp.Body = spanBody{resp.Body, span}
+	return resp, nil
+}
+
+// spanBody ends a span when the response body it wraps is closed.
+type spanBody struct {
+	io.ReadCloser
+	span *tracing.Span
+}
+
+func (b spanBody) Close() error {
+	b.span.End()
+	return b.ReadCloser.Close()
+}
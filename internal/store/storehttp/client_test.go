@@ -126,3 +126,43 @@ func TestClientBadSHA(t *testing.T) {
 		t.Fatalf("Wanted hash mismatch error on corrupt get, got err %v", err)
 	}
 }
+
+func TestClientHashcheckUnsupported(t *testing.T) {
+	mock := storetests.NewMockStore(0)
+	srv := httptest.NewServer(NewServer(mock))
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("Couldn't initialize client: %v", err)
+	}
+	defer client.Close()
+
+	_, err = client.HashcheckStatus(nil)
+	if err != store.ErrUnsupported {
+		t.Errorf("HashcheckStatus() returned %v, wanted %v", err, store.ErrUnsupported)
+	}
+}
+
+func TestClientCapacity(t *testing.T) {
+	mock := storetests.NewMockStore(0)
+	srv := httptest.NewServer(NewServer(mock))
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("Couldn't initialize client: %v", err)
+	}
+	defer client.Close()
+
+	_, err = client.Capacity(nil)
+	if err != store.ErrUnsupported {
+		t.Errorf("Capacity() on unlimited store returned %v, wanted %v", err, store.ErrUnsupported)
+	}
+
+	mock.SetSize(1000)
+	capacity, err := client.Capacity(nil)
+	if err != nil || capacity != 1000 {
+		t.Errorf("Capacity() = (%v, %v), wanted (1000, nil)", capacity, err)
+	}
+}
@@ -138,6 +138,47 @@ func TestHTTPNoVerify(t *testing.T) {
 	}
 }
 
+type requestIDRecorder struct {
+	store.Store
+	ids *[]string
+}
+
+func (r requestIDRecorder) Get(key string, opts store.GetOptions) ([]byte, store.Stat, error) {
+	*r.ids = append(*r.ids, "get "+opts.RequestID)
+	return r.Store.Get(key, opts)
+}
+
+func (r requestIDRecorder) WithRequestID(id string) store.Store {
+	*r.ids = append(*r.ids, "write "+id)
+	return r
+}
+
+func TestHTTPRequestID(t *testing.T) {
+	mock := storetests.NewMockStore(0)
+	var ids []string
+
+	srv := httptest.NewServer(NewServer(requestIDRecorder{mock, &ids}))
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("Couldn't initialize client: %v", err)
+	}
+
+	err = store.WithRequestID(client, "put-id").CAS("key", store.AnyV,
+		store.DataV([]byte("data")), nil)
+	if err != nil {
+		t.Fatalf("Couldn't CAS: %v", err)
+	}
+	client.Get("key", store.GetOptions{RequestID: "get-id"})
+	client.Get("key", store.GetOptions{})
+
+	want := []string{"write put-id", "get get-id", "get "}
+	if !reflect.DeepEqual(ids, want) {
+		t.Fatalf("Wanted request ids %#v, but got %#v", want, ids)
+	}
+}
+
 type cancelRecorder struct {
 	store.Store
 	mu      sync.Mutex
@@ -3,6 +3,7 @@ package storehttp
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -13,11 +14,22 @@ import (
 	"strings"
 	"time"
 
+	"github.com/encryptio/slime/internal/httputil"
+	"github.com/encryptio/slime/internal/logging"
 	"github.com/encryptio/slime/internal/retry"
 	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/tracing"
 	"github.com/encryptio/slime/internal/uuid"
 )
 
+// requestFields returns the fields to log with errors serving r.
+func requestFields(r *http.Request) logging.Fields {
+	if id := r.Header.Get(httputil.RequestIDHeader); id != "" {
+		return logging.Fields{"request_id": id}
+	}
+	return nil
+}
+
 var errBadIfMatchFormat = errors.New("bad format for if-match header value")
 
 // MaxFileSize is the maximum size to accept in a Server request.
@@ -34,8 +46,18 @@ const MaxFileSize = 1024 * 1024 * 64 // 64MiB
 //     GET /?mode=list&after=xx&limit=nn - list keys, after and limit are
 //                                         optional.
 //     GET /?mode=free - get the number of free bytes
+//     GET /?mode=capacity - get the total number of bytes, or 501 if the
+//                           store doesn't know
 //     GET /?mode=uuid - get the uuid
 //     GET /?mode=name - get the name
+//     GET /?mode=quarantine - list quarantined values as JSON, or an empty
+//                             list if the store doesn't quarantine values
+//     GET /?mode=hashcheck - get the hash check status as JSON
+//     POST /?mode=hashcheck - start, pause, resume, or throttle the hash
+//                             check; returns the new status
+//
+// A PUT responds with 507 if the store is full, or the value would exceed a
+// quota.
 //
 // The X-Content-SHA256 header is used to verify the hash of PUT'd content
 // and is sent in responses.
@@ -142,8 +164,14 @@ func (h *Server) serveRoot(w http.ResponseWriter, r *http.Request) {
 		h.serveList(w, r)
 	case "free":
 		h.serveFree(w, r)
+	case "capacity":
+		h.serveCapacity(w, r)
 	case "name":
 		h.serveName(w, r)
+	case "quarantine":
+		h.serveQuarantine(w, r)
+	case "hashcheck":
+		h.serveHashcheck(w, r)
 	case "", "uuid":
 		h.serveUUID(w, r)
 	default:
@@ -204,6 +232,30 @@ func (h *Server) serveFree(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(strconv.FormatInt(free, 10)))
 }
 
+func (h *Server) serveCapacity(w http.ResponseWriter, r *http.Request) {
+	cs, ok := h.store.(store.CapacityStore)
+	if !ok {
+		http.Error(w, store.ErrUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	canceller := makeCanceller(w)
+	defer canceller.Close()
+
+	capacity, err := cs.Capacity(canceller.Cancel)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == store.ErrUnsupported {
+			status = http.StatusNotImplemented
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(strconv.FormatInt(capacity, 10)))
+}
+
 func (h *Server) serveUUID(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(uuid.Fmt(h.store.UUID())))
@@ -214,6 +266,173 @@ func (h *Server) serveName(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(h.store.Name()))
 }
 
+// quarantineEntryJSON is the wire format of a store.QuarantineEntry.
+type quarantineEntryJSON struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	Time int64  `json:"time"`
+}
+
+func (h *Server) serveQuarantine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	canceller := makeCanceller(w)
+	defer canceller.Close()
+
+	var entries []store.QuarantineEntry
+	if qs, ok := h.store.(store.QuarantineStore); ok {
+		var err error
+		entries, err = qs.ListQuarantine(canceller.Cancel)
+		if err != nil {
+			logging.Errorf("Couldn't ListQuarantine(): %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	ret := make([]quarantineEntryJSON, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, quarantineEntryJSON{
+			Key:  e.Key,
+			Size: e.Size,
+			Time: e.Time,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ret)
+}
+
+// hashcheckStatusJSON is the wire format of a store.HashcheckStatus.
+type hashcheckStatusJSON struct {
+	Paused       bool    `json:"paused"`
+	Full         bool    `json:"full"`
+	Position     string  `json:"position"`
+	Good         int64   `json:"good"`
+	Bad          int64   `json:"bad"`
+	Remaining    int64   `json:"remaining"`
+	ETA          float64 `json:"eta_seconds"`
+	SleepPerFile string  `json:"sleep_per_file"`
+	SleepPerByte string  `json:"sleep_per_byte"`
+	LastGood     int64   `json:"last_good"`
+	LastBad      int64   `json:"last_bad"`
+	LastFinished int64   `json:"last_finished"`
+}
+
+func hashcheckStatusToJSON(st store.HashcheckStatus) hashcheckStatusJSON {
+	return hashcheckStatusJSON{
+		Paused:       st.Paused,
+		Full:         st.Full,
+		Position:     st.Position,
+		Good:         st.Good,
+		Bad:          st.Bad,
+		Remaining:    st.Remaining,
+		ETA:          st.ETA.Seconds(),
+		SleepPerFile: st.PerFileWait.String(),
+		SleepPerByte: st.PerByteWait.String(),
+		LastGood:     st.LastGood,
+		LastBad:      st.LastBad,
+		LastFinished: st.LastFinished,
+	}
+}
+
+func (j hashcheckStatusJSON) toStatus() (store.HashcheckStatus, error) {
+	perFile, err := time.ParseDuration(j.SleepPerFile)
+	if err != nil {
+		return store.HashcheckStatus{}, err
+	}
+	perByte, err := time.ParseDuration(j.SleepPerByte)
+	if err != nil {
+		return store.HashcheckStatus{}, err
+	}
+
+	return store.HashcheckStatus{
+		Paused:       j.Paused,
+		Full:         j.Full,
+		Position:     j.Position,
+		Good:         j.Good,
+		Bad:          j.Bad,
+		Remaining:    j.Remaining,
+		ETA:          time.Duration(j.ETA * float64(time.Second)),
+		PerFileWait:  perFile,
+		PerByteWait:  perByte,
+		LastGood:     j.LastGood,
+		LastBad:      j.LastBad,
+		LastFinished: j.LastFinished,
+	}, nil
+}
+
+// hashcheckRequestJSON is the wire format of a store.HashcheckRequest.
+type hashcheckRequestJSON struct {
+	Operation    string `json:"operation"`
+	SleepPerFile string `json:"sleep_per_file,omitempty"`
+	SleepPerByte string `json:"sleep_per_byte,omitempty"`
+}
+
+func (h *Server) serveHashcheck(w http.ResponseWriter, r *http.Request) {
+	hs, ok := h.store.(store.HashcheckStore)
+	if !ok {
+		http.Error(w, store.ErrUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	canceller := makeCanceller(w)
+	defer canceller.Close()
+
+	var st store.HashcheckStatus
+	var err error
+	switch r.Method {
+	case "GET":
+		st, err = hs.HashcheckStatus(canceller.Cancel)
+	case "POST":
+		var reqJSON hashcheckRequestJSON
+		err = json.NewDecoder(r.Body).Decode(&reqJSON)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req := store.HashcheckRequest{Operation: reqJSON.Operation}
+		if reqJSON.Operation == store.HashcheckThrottle {
+			req.PerFileWait, err = time.ParseDuration(reqJSON.SleepPerFile)
+			if err == nil {
+				req.PerByteWait, err = time.ParseDuration(reqJSON.SleepPerByte)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		st, err = hs.ControlHashcheck(req, canceller.Cancel)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		switch err {
+		case store.ErrBadHashcheckOperation:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case store.ErrUnsupported:
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+		default:
+			logging.Errorf("Couldn't get hashcheck status: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(hashcheckStatusToJSON(st))
+}
+
 func (h *Server) serveObjectGet(w http.ResponseWriter, r *http.Request, obj string) {
 	canceller := makeCanceller(w)
 	defer canceller.Close()
@@ -230,7 +449,7 @@ func (h *Server) serveObjectGet(w http.ResponseWriter, r *http.Request, obj stri
 				http.Error(w, "not found", http.StatusNotFound)
 				return
 			}
-			log.Printf("Couldn't Stat(%#v): %v", obj, err)
+			logging.Log(logging.Error, fmt.Sprintf("Couldn't Stat(%#v): %v", obj, err), requestFields(r))
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -282,13 +501,17 @@ func (h *Server) serveObjectGet(w http.ResponseWriter, r *http.Request, obj stri
 		}
 
 		data, st, err = h.rangeStore.GetPartial(obj, start, length, store.GetOptions{
-			Cancel:   canceller.Cancel,
-			NoVerify: noverify,
+			Cancel:    canceller.Cancel,
+			NoVerify:  noverify,
+			RequestID: r.Header.Get(httputil.RequestIDHeader),
+			Trace:     tracing.Extract(r.Header),
 		})
 	} else {
 		data, st, err = h.store.Get(obj, store.GetOptions{
-			Cancel:   canceller.Cancel,
-			NoVerify: noverify,
+			Cancel:    canceller.Cancel,
+			NoVerify:  noverify,
+			RequestID: r.Header.Get(httputil.RequestIDHeader),
+			Trace:     tracing.Extract(r.Header),
 		})
 	}
 
@@ -297,7 +520,7 @@ func (h *Server) serveObjectGet(w http.ResponseWriter, r *http.Request, obj stri
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
-		log.Printf("Couldn't Get(%#v): %v", obj, err)
+		logging.Log(logging.Error, fmt.Sprintf("Couldn't Get(%#v): %v", obj, err), requestFields(r))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -342,7 +565,7 @@ func (h *Server) serveObjectHead(w http.ResponseWriter, r *http.Request, obj str
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		log.Printf("Couldn't Stat(%#v): %v", obj, err)
+		logging.Log(logging.Error, fmt.Sprintf("Couldn't Stat(%#v): %v", obj, err), requestFields(r))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -378,7 +601,7 @@ func (h *Server) serveObjectPut(w http.ResponseWriter, r *http.Request, obj stri
 	tee := io.TeeReader(io.LimitReader(r.Body, MaxFileSize+1), hash)
 	data, err := ioutil.ReadAll(tee)
 	if err != nil {
-		log.Printf("Couldn't read object body in PUT: %v", err)
+		logging.Log(logging.Error, fmt.Sprintf("Couldn't read object body in PUT: %v", err), requestFields(r))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -417,7 +640,9 @@ func (h *Server) serveObjectPut(w http.ResponseWriter, r *http.Request, obj stri
 	canceller := makeCanceller(w)
 	defer canceller.Close()
 
-	err = h.store.CAS(obj, from, store.CASV{
+	st := store.WithRequestID(h.store, r.Header.Get(httputil.RequestIDHeader))
+	st = store.WithTrace(st, tracing.Extract(r.Header))
+	err = st.CAS(obj, from, store.CASV{
 		Present: true,
 		SHA256:  haveHash,
 		Data:    data,
@@ -427,7 +652,11 @@ func (h *Server) serveObjectPut(w http.ResponseWriter, r *http.Request, obj stri
 			http.Error(w, err.Error(), http.StatusPreconditionFailed)
 			return
 		}
-		log.Printf("Couldn't CAS(%#v): %v", obj, err)
+		if err == store.ErrFull || err == store.ErrQuotaExceeded {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		logging.Log(logging.Error, fmt.Sprintf("Couldn't CAS(%#v): %v", obj, err), requestFields(r))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -439,6 +668,9 @@ func (h *Server) serveObjectDelete(w http.ResponseWriter, r *http.Request, obj s
 	canceller := makeCanceller(w)
 	defer canceller.Close()
 
+	st := store.WithRequestID(h.store, r.Header.Get(httputil.RequestIDHeader))
+	st = store.WithTrace(st, tracing.Extract(r.Header))
+
 	doRetry := true
 	retr := retry.New(10)
 	for retr.Next() {
@@ -453,22 +685,22 @@ func (h *Server) serveObjectDelete(w http.ResponseWriter, r *http.Request, obj s
 		if from.Any {
 			// TODO: make the CAS interface rich enough to handle this
 			// without Stat
-			st, err := h.store.Stat(obj, canceller.Cancel)
+			stat, err := st.Stat(obj, canceller.Cancel)
 			if err != nil {
 				if err == store.ErrNotFound {
 					http.Error(w, "not found", http.StatusNotFound)
 					return
 				}
-				log.Printf("Couldn't Stat(%#v): %v", obj, err)
+				logging.Log(logging.Error, fmt.Sprintf("Couldn't Stat(%#v): %v", obj, err), requestFields(r))
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 
-			from = store.CASV{Present: true, SHA256: st.SHA256}
+			from = store.CASV{Present: true, SHA256: stat.SHA256}
 			doRetry = true
 		}
 
-		err = h.store.CAS(obj, from, store.CASV{Present: false}, canceller.Cancel)
+		err = st.CAS(obj, from, store.CASV{Present: false}, canceller.Cancel)
 		if err != nil {
 			if err == store.ErrCASFailure {
 				if doRetry {
@@ -479,7 +711,7 @@ func (h *Server) serveObjectDelete(w http.ResponseWriter, r *http.Request, obj s
 					return
 				}
 			}
-			log.Printf("Couldn't CAS(%#v): %v", obj, err)
+			logging.Log(logging.Error, fmt.Sprintf("Couldn't CAS(%#v): %v", obj, err), requestFields(r))
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -0,0 +1,192 @@
+package storepack
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/encryptio/slime/internal/logging"
+)
+
+// A sealed segment is compacted once at least this fraction of it is garbage.
+const compactMinGarbage = 0.5
+
+func (p *Pack) compactLoop() error {
+	for {
+		for {
+			compacted, err := p.compactStep()
+			if err != nil {
+				logging.Errorf("Couldn't compact segments in %v: %v", p.Dir, err)
+			}
+			if !compacted || err != nil {
+				break
+			}
+
+			select {
+			case <-p.tomb.Dying():
+				return nil
+			default:
+			}
+		}
+
+		select {
+		case <-time.After(time.Minute):
+		case <-p.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+// garbage returns the number of bytes compacting s would free.
+//
+// Tombstones are only garbage in the oldest segment. Anywhere else, they
+// might still hide a value in an older segment, so compaction copies them
+// forward.
+func (p *Pack) garbage(s *segment, oldest bool) int64 {
+	g := s.size - s.live
+	if !oldest {
+		g -= s.tombs
+	}
+	return g
+}
+
+// compactStep compacts the sealed segment with the most garbage, if any has
+// enough. It returns whether a segment was compacted.
+func (p *Pack) compactStep() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var oldest uint64
+	for id := range p.segments {
+		if oldest == 0 || id < oldest {
+			oldest = id
+		}
+	}
+
+	var best *segment
+	var bestGarbage int64
+	for id, s := range p.segments {
+		if s == p.active || s.size == 0 {
+			continue
+		}
+
+		g := p.garbage(s, id == oldest)
+		if float64(g) < compactMinGarbage*float64(s.size) {
+			continue
+		}
+
+		if best == nil || g > bestGarbage {
+			best = s
+			bestGarbage = g
+		}
+	}
+
+	if best == nil {
+		return false, nil
+	}
+
+	return true, p.compact(best, best.id == oldest)
+}
+
+// compact copies the live records of the sealed segment s to the active
+// segment, then removes s. p.mu must be held for writing.
+func (p *Pack) compact(s *segment, oldest bool) error {
+	rdr := newSegmentReader(s, 0)
+
+	var offset int64
+	damaged := false
+	header := make([]byte, recordHeaderSize)
+	for offset < s.size {
+		_, err := io.ReadFull(rdr, header)
+		if err != nil {
+			return err
+		}
+
+		h, err := decodeRecordHeader(header)
+		if err != nil || h.Len() > s.size-offset {
+			// skip to the next good record, as scanSegment does
+			damaged = true
+			next, err := p.findRecord(s, offset+1)
+			if err != nil {
+				return err
+			}
+			if next < 0 {
+				break
+			}
+			offset = next
+			rdr = newSegmentReader(s, offset)
+			continue
+		}
+
+		record := make([]byte, int(h.Len()))
+		copy(record, header)
+		_, err = io.ReadFull(rdr, record[recordHeaderSize:])
+		if err != nil {
+			return err
+		}
+
+		key := string(record[recordHeaderSize : recordHeaderSize+h.KeyLen])
+		data := record[recordHeaderSize+h.KeyLen:]
+
+		e, present := p.entries[key]
+		isLive := present && e.seg == s.id && e.offset == offset
+
+		switch {
+		case h.Kind == recordValue && isLive:
+			if !checkRecord(h, record) {
+				p.quarantine(key, e)
+				break
+			}
+
+			err = p.appendRecord(recordValue, key, data, h.SHA256, h.WriteTime)
+			if err != nil {
+				return err
+			}
+
+		case h.Kind == recordTombstone && !present && !oldest:
+			// a value for this key may still be in an older segment
+			err = p.appendRecord(recordTombstone, key, nil, h.SHA256, h.WriteTime)
+			if err != nil {
+				return err
+			}
+		}
+
+		offset += h.Len()
+	}
+
+	if damaged {
+		// Anything still pointing into s was in the damaged bytes, and can't
+		// be copied.
+		for key, e := range p.entries {
+			if e.seg == s.id {
+				p.quarantine(key, e)
+			}
+		}
+	}
+
+	// the copies must be on disk before the originals are removed, whatever
+	// the durability mode.
+	err := p.active.fh.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = s.fh.Close()
+	if err != nil {
+		return err
+	}
+	delete(p.segments, s.id)
+
+	err = os.Remove(p.segmentPath(s.id, ".idx"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.Remove(p.segmentPath(s.id, ".seg"))
+	if err != nil {
+		return err
+	}
+
+	return p.syncDirs(filepath.Join(p.Dir, "segments"))
+}
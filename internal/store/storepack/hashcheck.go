@@ -0,0 +1,167 @@
+package storepack
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/store/storedir"
+	"github.com/encryptio/slime/internal/uuid"
+)
+
+// Hashcheck verifies the CRC of every value in the pack, quarantining any that
+// fail. It returns the number of good and bad values found.
+func (p *Pack) Hashcheck() (good, bad int64) {
+	after := ""
+	for {
+		var goodStep, badStep int64
+		goodStep, badStep, after = p.hashstepInner(after)
+		good += goodStep
+		bad += badStep
+
+		if after == "" {
+			return
+		}
+	}
+}
+
+func (p *Pack) HashcheckStatus(cancel <-chan struct{}) (store.HashcheckStatus, error) {
+	return p.hashcheck.Status(func(after string) (int64, error) {
+		keys, err := p.List(after, 0, cancel)
+		return int64(len(keys)), err
+	})
+}
+
+func (p *Pack) ControlHashcheck(req store.HashcheckRequest, cancel <-chan struct{}) (store.HashcheckStatus, error) {
+	err := p.hashcheck.Control(req)
+	if err != nil {
+		return store.HashcheckStatus{}, err
+	}
+	return p.HashcheckStatus(cancel)
+}
+
+func (p *Pack) hashcheckLoop() error {
+	for {
+		if !p.hashcheck.WaitUnpaused(p.tomb.Dying()) {
+			return nil
+		}
+
+		_, bad := p.hashstep()
+		if bad != 0 {
+			logging.Warnf("Found %v bad items hash check on %v",
+				bad, uuid.Fmt(p.UUID()))
+		}
+
+		select {
+		case <-time.After(5 * time.Second):
+		case <-p.hashcheck.Kicked():
+		case <-p.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+func (p *Pack) hashstep() (good, bad int64) {
+	statePath := filepath.Join(p.Dir, "hashcheck-at")
+	after := ""
+
+	data, err := ioutil.ReadFile(statePath)
+	if err == nil {
+		after = string(data)
+	} else if !os.IsNotExist(err) {
+		logging.Errorf("Couldn't read %v: %v", statePath, err)
+		return
+	}
+
+	after = p.hashcheck.StepStart(after)
+	good, bad, after = p.hashstepInner(after)
+	p.hashcheck.StepDone(good, bad, after)
+
+	err = ioutil.WriteFile(statePath, []byte(after), 0666)
+	if err != nil {
+		logging.Errorf("Couldn't write to %v: %v", statePath, err)
+		return
+	}
+
+	return
+}
+
+func (p *Pack) hashstepInner(afterIn string) (good, bad int64, after string) {
+	after = afterIn
+
+	keys, err := p.List(after, 100, nil)
+	if err != nil {
+		logging.Errorf("Couldn't list in %v for hash check: %v", p.Dir, err)
+		return
+	}
+
+	if len(keys) == 0 {
+		after = ""
+		return
+	}
+
+	for _, key := range keys {
+		// Get checks the record's CRC and quarantines it if it's bad
+		data, _, err := p.Get(key, store.GetOptions{})
+		if err != nil && err != store.ErrNotFound {
+			bad++
+		} else {
+			good++
+		}
+
+		size := len(data)
+		data = nil // free memory before sleep
+
+		after = key
+
+		if !p.hashcheck.Sleep(size, p.tomb.Dying()) {
+			return
+		}
+	}
+
+	return
+}
+
+func (p *Pack) ListQuarantine(cancel <-chan struct{}) ([]store.QuarantineEntry, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	select {
+	case <-cancel:
+		return nil, store.ErrCancelled
+	default:
+	}
+
+	return storedir.ReadQuarantine(filepath.Join(p.Dir, "quarantine"))
+}
+
+func (p *Pack) purgeQuarantine() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dir := filepath.Join(p.Dir, "quarantine")
+	removed, err := storedir.PurgeQuarantine(dir, time.Now().Add(-p.quarantineRetention))
+	if err != nil {
+		logging.Errorf("Couldn't purge old files from %v: %v", dir, err)
+	}
+	if removed > 0 {
+		log.Printf("Purged %v files older than %v from %v",
+			removed, p.quarantineRetention, dir)
+	}
+}
+
+func (p *Pack) quarantinePurgeLoop() error {
+	for {
+		p.purgeQuarantine()
+
+		select {
+		case <-time.After(storedir.QuarantinePurgeInterval):
+		case <-p.tomb.Dying():
+			return nil
+		}
+	}
+}
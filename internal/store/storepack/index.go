@@ -0,0 +1,266 @@
+package storepack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/encryptio/slime/internal/logging"
+)
+
+// Each .idx file has the following format:
+//     8-byte magic "slimeidx"
+//     8-byte size of the segment it indexes
+//     for each record in the segment, in order:
+//         1-byte kind
+//         2-byte key length
+//         8-byte offset of the record
+//         8-byte length of the record
+//         variable size key
+//     4-byte CRC-32C of all of the preceding data
+//
+// All integers are big endian.
+
+const indexMagic = "slimeidx"
+
+var errBadIndex = errors.New("bad index file")
+
+// An indexRecord describes one record in a segment.
+type indexRecord struct {
+	Kind   uint8
+	Key    string
+	Offset int64
+	Length int64
+}
+
+func (p *Pack) writeIndex(s *segment, records []indexRecord) error {
+	size := len(indexMagic) + 8 + 4
+	for _, r := range records {
+		size += 1 + 2 + 8 + 8 + len(r.Key)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, indexMagic...)
+	buf = appendUint64(buf, uint64(s.size))
+	for _, r := range records {
+		buf = append(buf, r.Kind)
+		buf = append(buf, byte(len(r.Key)>>8), byte(len(r.Key)))
+		buf = appendUint64(buf, uint64(r.Offset))
+		buf = appendUint64(buf, uint64(r.Length))
+		buf = append(buf, r.Key...)
+	}
+	crc := crc32.Checksum(buf, crcTable)
+	buf = append(buf, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	path := p.segmentPath(s.id, ".idx")
+
+	fh, err := os.Create(path + ".new")
+	if err != nil {
+		return err
+	}
+
+	_, err = fh.Write(buf)
+	if err == nil {
+		err = p.syncFile(fh)
+	}
+	if err != nil {
+		fh.Close()
+		os.Remove(path + ".new")
+		return err
+	}
+
+	err = fh.Close()
+	if err != nil {
+		os.Remove(path + ".new")
+		return err
+	}
+
+	err = os.Rename(path+".new", path)
+	if err != nil {
+		os.Remove(path + ".new")
+		return err
+	}
+
+	return p.syncDirs(filepath.Join(p.Dir, "segments"))
+}
+
+// readIndex reads the .idx file for s. It returns an error if the file is
+// missing, damaged, or doesn't match the segment.
+func (p *Pack) readIndex(s *segment) ([]indexRecord, error) {
+	buf, err := ioutil.ReadFile(p.segmentPath(s.id, ".idx"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < len(indexMagic)+8+4 || string(buf[:len(indexMagic)]) != indexMagic {
+		return nil, errBadIndex
+	}
+
+	body := buf[:len(buf)-4]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, errBadIndex
+	}
+
+	body = body[len(indexMagic):]
+	if int64(binary.BigEndian.Uint64(body)) != s.size {
+		return nil, errBadIndex
+	}
+	body = body[8:]
+
+	var records []indexRecord
+	for len(body) > 0 {
+		if len(body) < 1+2+8+8 {
+			return nil, errBadIndex
+		}
+
+		r := indexRecord{
+			Kind:   body[0],
+			Offset: int64(binary.BigEndian.Uint64(body[3:11])),
+			Length: int64(binary.BigEndian.Uint64(body[11:19])),
+		}
+		keyLen := int(binary.BigEndian.Uint16(body[1:3]))
+		body = body[19:]
+
+		if len(body) < keyLen {
+			return nil, errBadIndex
+		}
+		r.Key = string(body[:keyLen])
+		body = body[keyLen:]
+
+		records = append(records, r)
+	}
+
+	return records, nil
+}
+
+// scanSegment reads every record in s, checking their CRCs, and returns the
+// offset just past the last good record.
+//
+// When a record's header is bad or runs past the end of the segment, scanning
+// resumes at the next record whose header and CRC are both good. The damaged
+// bytes in between are skipped; whatever records they held are lost, but the
+// rest of the segment isn't. If no good record follows, the damage is the torn
+// tail of an interrupted write, and scanning stops.
+//
+// Records with bad CRCs are only dropped if no good records follow them, as
+// happens after a torn write. Otherwise, they're returned like any other, so
+// that the hash check finds and quarantines them.
+func (p *Pack) scanSegment(s *segment) ([]indexRecord, int64, error) {
+	rdr := newSegmentReader(s, 0)
+
+	var records []indexRecord
+	var offset, good int64
+	goodRecords := 0
+	header := make([]byte, recordHeaderSize)
+	for offset < s.size {
+		_, err := io.ReadFull(rdr, header)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, 0, err
+		}
+
+		var h recordHeader
+		if err == nil {
+			h, err = decodeRecordHeader(header)
+		}
+		if err != nil || h.Len() > s.size-offset {
+			next, err := p.findRecord(s, offset+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			if next < 0 {
+				break
+			}
+
+			logging.Errorf("Skipping %v damaged bytes at offset %v of %v",
+				next-offset, offset, p.segmentPath(s.id, ".seg"))
+			offset = next
+			rdr = newSegmentReader(s, offset)
+			continue
+		}
+
+		key := make([]byte, h.KeyLen)
+		_, err = io.ReadFull(rdr, key)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		crc := crc32.New(crcTable)
+		crc.Write(header[4:])
+		crc.Write(key)
+		_, err = io.CopyN(crc, rdr, h.DataLen)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		records = append(records, indexRecord{
+			Kind:   h.Kind,
+			Key:    string(key),
+			Offset: offset,
+			Length: h.Len(),
+		})
+		offset += h.Len()
+
+		if crc.Sum32() == h.CRC {
+			good = offset
+			goodRecords = len(records)
+		}
+	}
+
+	if goodRecords < len(records) {
+		logging.Warnf("Dropping %v bad records at the end of %v",
+			len(records)-goodRecords, p.segmentPath(s.id, ".seg"))
+	}
+
+	return records[:goodRecords], good, nil
+}
+
+// findRecord returns the offset of the first record in s at or after from
+// whose header and CRC are both good, or -1 if there is none.
+func (p *Pack) findRecord(s *segment, from int64) (int64, error) {
+	const window = 256 * 1024
+
+	buf := make([]byte, window+recordHeaderSize)
+	for start := from; start+recordHeaderSize <= s.size; start += window {
+		n, err := s.fh.ReadAt(buf, start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if rest := s.size - start; int64(n) > rest {
+			n = int(rest)
+		}
+
+		for i := 0; i < window && i+recordHeaderSize <= n; i++ {
+			offset := start + int64(i)
+			h, err := decodeRecordHeader(buf[i : i+recordHeaderSize])
+			if err != nil || h.Len() > s.size-offset {
+				continue
+			}
+
+			crc := crc32.New(crcTable)
+			_, err = io.Copy(crc, io.NewSectionReader(s.fh, offset+4, h.Len()-4))
+			if err != nil {
+				return 0, err
+			}
+			if crc.Sum32() == h.CRC {
+				return offset, nil
+			}
+		}
+	}
+
+	return -1, nil
+}
+
+func newSegmentReader(s *segment, offset int64) *bufio.Reader {
+	return bufio.NewReaderSize(io.NewSectionReader(s.fh, offset, s.size-offset), 256*1024)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
@@ -0,0 +1,104 @@
+package storepack
+
+import (
+	"sort"
+)
+
+const maxRecentKeys = 4096
+
+// keyIndex keeps the keys of a Pack in sorted order for List. New keys go into
+// a small sorted batch, which is merged into the main slice once it grows
+// large, so inserts stay cheap with millions of keys.
+//
+// Removed keys are left in place and filtered out by the live function given
+// to list; they're dropped whenever the slices are merged.
+type keyIndex struct {
+	sorted []string
+	recent []string
+	stale  int
+}
+
+func searchStrings(list []string, key string) (int, bool) {
+	i := sort.SearchStrings(list, key)
+	return i, i < len(list) && list[i] == key
+}
+
+// add records a key as present. live reports whether a key is still present,
+// and is used to drop removed keys when merging.
+func (ki *keyIndex) add(key string, live func(string) bool) {
+	if _, found := searchStrings(ki.sorted, key); found {
+		// removed and added again
+		ki.stale--
+		return
+	}
+
+	i, found := searchStrings(ki.recent, key)
+	if found {
+		ki.stale--
+		return
+	}
+
+	ki.recent = append(ki.recent, "")
+	copy(ki.recent[i+1:], ki.recent[i:])
+	ki.recent[i] = key
+
+	if len(ki.recent) >= maxRecentKeys {
+		ki.merge(live)
+	}
+}
+
+// remove records that a key which was added is no longer present.
+func (ki *keyIndex) remove(key string, live func(string) bool) {
+	ki.stale++
+	if ki.stale > (len(ki.sorted)+len(ki.recent))/2 {
+		ki.merge(live)
+	}
+}
+
+func (ki *keyIndex) merge(live func(string) bool) {
+	merged := make([]string, 0, len(ki.sorted)+len(ki.recent)-ki.stale)
+	i, j := 0, 0
+	for i < len(ki.sorted) || j < len(ki.recent) {
+		var key string
+		if j >= len(ki.recent) || (i < len(ki.sorted) && ki.sorted[i] < ki.recent[j]) {
+			key = ki.sorted[i]
+			i++
+		} else {
+			key = ki.recent[j]
+			j++
+		}
+
+		if live(key) {
+			merged = append(merged, key)
+		}
+	}
+
+	ki.sorted = merged
+	ki.recent = nil
+	ki.stale = 0
+}
+
+// list returns up to limit present keys greater than after, in order. If limit
+// is <= 0, all such keys are returned.
+func (ki *keyIndex) list(after string, limit int, live func(string) bool) []string {
+	i := sort.SearchStrings(ki.sorted, after)
+	j := sort.SearchStrings(ki.recent, after)
+
+	var ret []string
+	for (i < len(ki.sorted) || j < len(ki.recent)) && (limit <= 0 || len(ret) < limit) {
+		var key string
+		if j >= len(ki.recent) || (i < len(ki.sorted) && ki.sorted[i] < ki.recent[j]) {
+			key = ki.sorted[i]
+			i++
+		} else {
+			key = ki.recent[j]
+			j++
+		}
+
+		if key > after && live(key) {
+			ret = append(ret, key)
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,741 @@
+// Package storepack implements a store.Store that packs many values into
+// large append-only segment files, for stores with very many small values.
+package storepack
+
+// The directory structure used by storepack is:
+//
+// $DIR/
+//     uuid
+//     hashcheck-at
+//     quarantine/
+//         $ENCODEDKEY
+//         ...
+//     segments/
+//         $ID.seg
+//         $ID.idx
+//         ...
+//
+// Values are appended as records (see record.go) to the segment with the
+// highest ID, the active segment. Deletes append tombstone records. Once the
+// active segment reaches its maximum size, it is sealed: an index of the
+// records in it is written to its .idx file, and a new active segment is
+// started. A later record for a key always overrides earlier ones, in segment
+// ID then offset order.
+//
+// On open, the .idx files are read instead of the sealed segments, and the
+// active segment is scanned. A torn record at the end of the active segment
+// is truncated away. Damage elsewhere is skipped over, keeping the records
+// after it.
+//
+// Segments with mostly overwritten or deleted records are compacted by copying
+// the records that are still live into the active segment, then removing the
+// old segment.
+//
+// Records that are found to violate their CRCs are copied into the
+// "quarantine" directory, and a tombstone is written for their key.
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+
+	"github.com/encryptio/slime/internal/logging"
+	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/store/storedir"
+	"github.com/encryptio/slime/internal/uuid"
+)
+
+const defaultMaxSegmentSize = 64 * 1024 * 1024
+
+type segment struct {
+	id    uint64
+	fh    *os.File
+	size  int64 // bytes of records written
+	live  int64 // bytes of value records still referenced by the index
+	tombs int64 // bytes of tombstone records
+
+	// records appended to the active segment, for its .idx file
+	records []indexRecord
+}
+
+type entry struct {
+	seg    uint64
+	offset int64
+	length int64 // of the whole record
+}
+
+// A Pack is a Store which packs its data into segment files on a local
+// filesystem.
+type Pack struct {
+	Dir        string
+	uuid       [16]byte
+	name       string
+	hashcheck  *storedir.HashcheckControl
+	durability storedir.Durability
+
+	// quarantined records older than this are removed; zero keeps them forever
+	quarantineRetention time.Duration
+
+	tomb tomb.Tomb
+
+	// mu protects all operations in the pack as well as the fields below
+	mu             sync.RWMutex
+	entries        map[string]entry
+	keys           keyIndex
+	segments       map[uint64]*segment
+	active         *segment
+	maxSegmentSize int64
+}
+
+// CreatePack initializes a new Pack at the given location, suitable for
+// OpenPack. It will return an error if one already exists.
+func CreatePack(dir string) error {
+	dirs := []string{
+		dir,
+		filepath.Join(dir, "segments"),
+		filepath.Join(dir, "quarantine"),
+	}
+	for _, d := range dirs {
+		err := os.Mkdir(d, 0777)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "uuid"),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write([]byte(uuid.Fmt(uuid.Gen4())))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// OpenPack opens an existing pack store. durability sets how carefully
+// changes are flushed to disk. Quarantined records are removed after
+// quarantineRetention, or kept forever if it is not positive.
+func OpenPack(dir string, perFileWait, perByteWait time.Duration, durability storedir.Durability, quarantineRetention time.Duration) (*Pack, error) {
+	return openPackImpl(dir, perFileWait, perByteWait, durability, quarantineRetention, false)
+}
+
+func openPackImpl(dir string, perFileWait, perByteWait time.Duration, durability storedir.Durability, quarantineRetention time.Duration, disableBackgroundLoops bool) (*Pack, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "uuid"))
+	if err != nil {
+		return nil, err
+	}
+
+	myUUID, err := uuid.Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+
+	p := &Pack{
+		Dir:            dir,
+		uuid:           myUUID,
+		name:           host + ":" + dir,
+		hashcheck:      storedir.NewHashcheckControl(perFileWait, perByteWait),
+		durability:     durability,
+		entries:        make(map[string]entry),
+		segments:       make(map[uint64]*segment),
+		maxSegmentSize: defaultMaxSegmentSize,
+
+		quarantineRetention: quarantineRetention,
+	}
+
+	err = p.loadSegments()
+	if err != nil {
+		p.closeSegments()
+		return nil, err
+	}
+
+	p.tomb.Go(func() error {
+		if !disableBackgroundLoops {
+			p.tomb.Go(p.hashcheckLoop)
+			p.tomb.Go(p.compactLoop)
+			if quarantineRetention > 0 {
+				p.tomb.Go(p.quarantinePurgeLoop)
+			}
+		}
+		return nil
+	})
+
+	return p, nil
+}
+
+func (p *Pack) segmentPath(id uint64, ext string) string {
+	return filepath.Join(p.Dir, "segments", fmt.Sprintf("%016x%s", id, ext))
+}
+
+func (p *Pack) live(key string) bool {
+	_, ok := p.entries[key]
+	return ok
+}
+
+func (p *Pack) loadSegments() error {
+	names, err := readdirnames(filepath.Join(p.Dir, "segments"))
+	if err != nil {
+		return err
+	}
+
+	var ids []uint64
+	for _, name := range names {
+		if strings.HasSuffix(name, ".new") {
+			// an incomplete .idx write
+			err := os.Remove(filepath.Join(p.Dir, "segments", name))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !strings.HasSuffix(name, ".seg") {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ".seg"), 16, 64)
+		if err != nil {
+			logging.Warnf("Bad filename in storepack at %v", filepath.Join(p.Dir, "segments", name))
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Sort(uint64s(ids))
+
+	for i, id := range ids {
+		last := i == len(ids)-1
+
+		fh, err := os.OpenFile(p.segmentPath(id, ".seg"), os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+
+		fi, err := fh.Stat()
+		if err != nil {
+			fh.Close()
+			return err
+		}
+
+		s := &segment{
+			id:   id,
+			fh:   fh,
+			size: fi.Size(),
+		}
+		p.segments[id] = s
+
+		if !last {
+			records, err := p.readIndex(s)
+			if err == nil {
+				p.applyAll(s, records)
+				continue
+			}
+			if !os.IsNotExist(err) {
+				logging.Warnf("Couldn't read index for %v, scanning instead: %v",
+					p.segmentPath(id, ".seg"), err)
+			}
+		}
+
+		records, good, err := p.scanSegment(s)
+		if err != nil {
+			return err
+		}
+
+		if good < s.size {
+			if last {
+				logging.Warnf("Truncating incomplete write at offset %v of %v",
+					good, p.segmentPath(id, ".seg"))
+				err = fh.Truncate(good)
+				if err != nil {
+					return err
+				}
+			} else {
+				logging.Warnf("Ignoring damaged records after offset %v of %v",
+					good, p.segmentPath(id, ".seg"))
+			}
+			s.size = good
+		}
+
+		p.applyAll(s, records)
+
+		if last {
+			s.records = records
+		} else {
+			err = p.writeIndex(s, records)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(ids) > 0 {
+		p.active = p.segments[ids[len(ids)-1]]
+		return nil
+	}
+
+	return p.startSegment(1)
+}
+
+func (p *Pack) applyAll(s *segment, records []indexRecord) {
+	for _, r := range records {
+		p.apply(s, r)
+	}
+}
+
+// apply updates the index for a record that was just written to, or read from,
+// the end of segment s.
+func (p *Pack) apply(s *segment, r indexRecord) {
+	old, existed := p.entries[r.Key]
+	if existed {
+		if oldSeg := p.segments[old.seg]; oldSeg != nil {
+			oldSeg.live -= old.length
+		}
+	}
+
+	if r.Kind == recordTombstone {
+		s.tombs += r.Length
+		if existed {
+			delete(p.entries, r.Key)
+			p.keys.remove(r.Key, p.live)
+		}
+		return
+	}
+
+	p.entries[r.Key] = entry{
+		seg:    s.id,
+		offset: r.Offset,
+		length: r.Length,
+	}
+	s.live += r.Length
+	if !existed {
+		p.keys.add(r.Key, p.live)
+	}
+}
+
+// startSegment creates a new, empty active segment.
+func (p *Pack) startSegment(id uint64) error {
+	fh, err := os.OpenFile(p.segmentPath(id, ".seg"),
+		os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	err = p.syncDirs(filepath.Join(p.Dir, "segments"))
+	if err != nil {
+		fh.Close()
+		return err
+	}
+
+	s := &segment{
+		id: id,
+		fh: fh,
+	}
+	p.segments[id] = s
+	p.active = s
+	return nil
+}
+
+// seal writes the index for the active segment and starts a new one. The
+// sealed segment is always synced, since compaction relies on the records it
+// copies into it being on disk.
+func (p *Pack) seal() error {
+	err := p.active.fh.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = p.writeIndex(p.active, p.active.records)
+	if err != nil {
+		return err
+	}
+	p.active.records = nil
+
+	return p.startSegment(p.active.id + 1)
+}
+
+// appendRecord writes a record to the active segment, sealing it first if the
+// record would make it too large, and updates the index to match. It does not
+// sync the segment; see syncSegment.
+func (p *Pack) appendRecord(kind uint8, key string, data []byte, sha [32]byte, writeTime int64) error {
+	header := encodeRecord(kind, key, data, sha, writeTime)
+	length := int64(len(header) + len(data))
+
+	if p.active.size > 0 && p.active.size+length > p.maxSegmentSize {
+		err := p.seal()
+		if err != nil {
+			return err
+		}
+	}
+
+	s := p.active
+	offset := s.size
+
+	_, err := s.fh.WriteAt(header, offset)
+	if err == nil && len(data) > 0 {
+		_, err = s.fh.WriteAt(data, offset+int64(len(header)))
+	}
+	if err != nil {
+		s.fh.Truncate(offset) // ignore error; it'll be cleaned up on open
+		return err
+	}
+
+	s.size += length
+
+	r := indexRecord{
+		Kind:   kind,
+		Key:    key,
+		Offset: offset,
+		Length: length,
+	}
+	s.records = append(s.records, r)
+	p.apply(s, r)
+
+	return nil
+}
+
+func (p *Pack) closeSegments() {
+	for _, s := range p.segments {
+		s.fh.Close()
+	}
+	p.segments = nil
+}
+
+func (p *Pack) Available() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	data, err := ioutil.ReadFile(filepath.Join(p.Dir, "uuid"))
+	if err != nil {
+		return false
+	}
+
+	thatUUID, err := uuid.Parse(string(data))
+	if err != nil {
+		return false
+	}
+
+	return thatUUID == p.uuid
+}
+
+func (p *Pack) Close() error {
+	p.tomb.Kill(nil)
+	err := p.tomb.Wait()
+
+	p.mu.Lock()
+	p.closeSegments()
+	p.mu.Unlock()
+
+	return err
+}
+
+// readRecord reads the whole record for key at e, and checks its CRC if verify
+// is set. A record for a different key, as from a stale index, is corrupt.
+func (p *Pack) readRecord(key string, e entry, verify bool) (recordHeader, []byte, error) {
+	s := p.segments[e.seg]
+	if s == nil {
+		return recordHeader{}, nil, fmt.Errorf("segment %x is missing", e.seg)
+	}
+
+	if e.length < recordHeaderSize || int64(int(e.length)) != e.length {
+		return recordHeader{}, nil, ErrCorruptObject
+	}
+
+	buf := make([]byte, int(e.length))
+	_, err := s.fh.ReadAt(buf, e.offset)
+	if err != nil {
+		if err == io.EOF {
+			return recordHeader{}, nil, ErrCorruptObject
+		}
+		return recordHeader{}, nil, err
+	}
+
+	h, err := decodeRecordHeader(buf)
+	if err != nil || h.Len() != e.length {
+		return recordHeader{}, nil, ErrCorruptObject
+	}
+
+	if string(buf[recordHeaderSize:recordHeaderSize+h.KeyLen]) != key {
+		return recordHeader{}, nil, ErrCorruptObject
+	}
+
+	if verify && !checkRecord(h, buf) {
+		return recordHeader{}, nil, ErrCorruptObject
+	}
+
+	return h, buf, nil
+}
+
+// readHeader reads just the header of the record for e.
+func (p *Pack) readHeader(e entry) (recordHeader, error) {
+	s := p.segments[e.seg]
+	if s == nil {
+		return recordHeader{}, fmt.Errorf("segment %x is missing", e.seg)
+	}
+
+	var buf [recordHeaderSize]byte
+	_, err := s.fh.ReadAt(buf[:], e.offset)
+	if err != nil {
+		if err == io.EOF {
+			return recordHeader{}, ErrCorruptObject
+		}
+		return recordHeader{}, err
+	}
+
+	h, err := decodeRecordHeader(buf[:])
+	if err != nil || h.Len() != e.length {
+		return recordHeader{}, ErrCorruptObject
+	}
+
+	return h, nil
+}
+
+func (p *Pack) Get(key string, opts store.GetOptions) ([]byte, store.Stat, error) {
+	p.mu.RLock()
+
+	select {
+	case <-opts.Cancel:
+		p.mu.RUnlock()
+		return nil, store.Stat{}, store.ErrCancelled
+	default:
+	}
+
+	e, ok := p.entries[key]
+	if !ok {
+		p.mu.RUnlock()
+		return nil, store.Stat{}, store.ErrNotFound
+	}
+
+	h, buf, err := p.readRecord(key, e, !opts.NoVerify)
+	p.mu.RUnlock()
+
+	if err == ErrCorruptObject {
+		p.mu.Lock()
+		if p.entries[key] == e {
+			p.quarantine(key, e)
+		}
+		p.mu.Unlock()
+		return nil, store.Stat{}, ErrCorruptObject
+	}
+	if err != nil {
+		return nil, store.Stat{}, err
+	}
+
+	return buf[recordHeaderSize+h.KeyLen:], store.Stat{
+		SHA256:    h.SHA256,
+		Size:      h.DataLen,
+		WriteTime: h.WriteTime,
+	}, nil
+}
+
+func (p *Pack) Stat(key string, cancel <-chan struct{}) (store.Stat, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	e, ok := p.entries[key]
+	if !ok {
+		return store.Stat{}, store.ErrNotFound
+	}
+
+	h, err := p.readHeader(e)
+	if err != nil {
+		return store.Stat{}, err
+	}
+
+	return store.Stat{
+		SHA256:    h.SHA256,
+		Size:      h.DataLen,
+		WriteTime: h.WriteTime,
+	}, nil
+}
+
+func (p *Pack) CAS(key string, from, to store.CASV, cancel <-chan struct{}) error {
+	if len(key) > maxKeyLength {
+		return ErrKeyTooLong
+	}
+
+	p.mu.Lock()
+	s, err := p.casLocked(key, from, to, cancel)
+	p.mu.Unlock()
+
+	if err != nil || s == nil {
+		return err
+	}
+
+	// Syncing without p.mu held lets other operations go on meanwhile, and
+	// lets concurrent writes share a sync.
+	return p.syncSegment(s)
+}
+
+// casLocked does the work of CAS with p.mu held for writing. It returns the
+// segment that was written to, if any.
+func (p *Pack) casLocked(key string, from, to store.CASV, cancel <-chan struct{}) (*segment, error) {
+	select {
+	case <-cancel:
+		return nil, store.ErrCancelled
+	default:
+	}
+
+	e, present := p.entries[key]
+
+	if !from.Any {
+		if from.Present {
+			if !present {
+				return nil, store.ErrCASFailure
+			}
+
+			h, err := p.readHeader(e)
+			if err != nil {
+				return nil, err
+			}
+			if h.SHA256 != from.SHA256 {
+				return nil, store.ErrCASFailure
+			}
+		} else {
+			if present {
+				return nil, store.ErrCASFailure
+			}
+		}
+	}
+
+	var err error
+	if to.Present {
+		err = p.appendRecord(recordValue, key, to.Data, to.SHA256, time.Now().Unix())
+	} else if present {
+		err = p.appendRecord(recordTombstone, key, nil, [32]byte{}, time.Now().Unix())
+	} else {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return p.active, nil
+}
+
+func (p *Pack) List(afterKey string, limit int, cancel <-chan struct{}) ([]string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	select {
+	case <-cancel:
+		return nil, store.ErrCancelled
+	default:
+	}
+
+	ret := p.keys.list(afterKey, limit, p.live)
+	if ret == nil {
+		ret = make([]string, 0)
+	}
+	return ret, nil
+}
+
+func (p *Pack) UUID() [16]byte {
+	return p.uuid
+}
+
+func (p *Pack) Name() string {
+	return p.name
+}
+
+// quarantine copies the record for key into the quarantine directory and
+// writes a tombstone for it. p.mu must be held for writing.
+func (p *Pack) quarantine(key string, e entry) {
+	quarantinePath := filepath.Join(p.Dir, "quarantine", base64.URLEncoding.EncodeToString([]byte(key)))
+
+	s := p.segments[e.seg]
+	if s != nil {
+		fh, err := os.Create(quarantinePath)
+		if err == nil {
+			_, err = io.Copy(fh, io.NewSectionReader(s.fh, e.offset, e.length))
+			if err == nil {
+				err = fh.Close()
+			} else {
+				fh.Close()
+			}
+		}
+		if err != nil {
+			logging.Errorf("Couldn't copy %#v into quarantine at %v: %v",
+				key, quarantinePath, err)
+		}
+	}
+
+	err := p.appendRecord(recordTombstone, key, nil, [32]byte{}, time.Now().Unix())
+	if err == nil {
+		err = p.syncFile(p.active.fh)
+	}
+	if err != nil {
+		logging.Errorf("Couldn't write tombstone for quarantined %#v in %v: %v",
+			key, p.Dir, err)
+	}
+}
+
+// syncSegment flushes the records written to s, according to the durability
+// mode. p.mu must not be held. If s was sealed and compacted away in the
+// meantime, sealing it already synced it.
+func (p *Pack) syncSegment(s *segment) error {
+	err := p.syncFile(s.fh)
+	if err != nil {
+		p.mu.RLock()
+		compacted := p.segments != nil && p.segments[s.id] != s
+		p.mu.RUnlock()
+		if compacted {
+			return nil
+		}
+	}
+	return err
+}
+
+func (p *Pack) syncFile(fh *os.File) error {
+	if p.durability < storedir.DurabilityFile {
+		return nil
+	}
+	return fh.Sync()
+}
+
+// syncDirs fsyncs each of the given directories, in order.
+func (p *Pack) syncDirs(dirs ...string) error {
+	if p.durability < storedir.DurabilityFileDir {
+		return nil
+	}
+	for _, dir := range dirs {
+		err := syncDir(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readdirnames(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	list, err := f.Readdirnames(-1)
+	f.Close()
+	return list, err
+}
+
+type uint64s []uint64
+
+func (l uint64s) Len() int           { return len(l) }
+func (l uint64s) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l uint64s) Less(i, j int) bool { return l[i] < l[j] }
@@ -0,0 +1,302 @@
+package storepack
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/store/storedir"
+	"github.com/encryptio/slime/internal/store/storetests"
+)
+
+func makeTestingPack(t *testing.T) (*Pack, string) {
+	tmpDir, err := ioutil.TempDir("", "slime_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+
+	err = CreatePack(tmpDir)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		t.Fatalf("CreatePack returned unexpected error %v", err)
+	}
+
+	p := reopenTestingPack(t, tmpDir)
+	return p, tmpDir
+}
+
+func reopenTestingPack(t *testing.T, dir string) *Pack {
+	p, err := openPackImpl(dir, 0, 0, storedir.DurabilityFileDir, 0, true)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("OpenPack returned unexpected error %v", err)
+	}
+	return p
+}
+
+func shouldHashcheck(t *testing.T, p *Pack, good, bad int64) {
+	gotGood, gotBad := p.Hashcheck()
+	if gotGood != good || gotBad != bad {
+		t.Errorf("Hashcheck() = (%v, %v), but wanted (%v, %v)",
+			gotGood, gotBad, good, bad)
+	}
+}
+
+func segmentCount(t *testing.T, dir string) int {
+	matches, err := filepath.Glob(filepath.Join(dir, "segments", "*.seg"))
+	if err != nil {
+		t.Fatalf("Couldn't list segments: %v", err)
+	}
+	return len(matches)
+}
+
+func TestPackCommon(t *testing.T) {
+	p, tmpDir := makeTestingPack(t)
+	defer os.RemoveAll(tmpDir)
+	defer p.Close()
+
+	storetests.TestStore(t, p)
+	shouldHashcheck(t, p, 0, 0)
+}
+
+func TestPackCommonSmallSegments(t *testing.T) {
+	p, tmpDir := makeTestingPack(t)
+	defer os.RemoveAll(tmpDir)
+	defer p.Close()
+
+	p.mu.Lock()
+	p.maxSegmentSize = 256
+	p.mu.Unlock()
+
+	storetests.TestStore(t, p)
+	shouldHashcheck(t, p, 0, 0)
+}
+
+func TestPackReopen(t *testing.T) {
+	p, tmpDir := makeTestingPack(t)
+	defer os.RemoveAll(tmpDir)
+
+	p.maxSegmentSize = 512
+
+	for i := 0; i < 50; i++ {
+		storetests.ShouldCAS(t, p, strconv.Itoa(i), store.AnyV, store.DataV([]byte("value "+strconv.Itoa(i))))
+	}
+	for i := 0; i < 50; i += 3 {
+		storetests.ShouldCAS(t, p, strconv.Itoa(i), store.AnyV, store.DataV([]byte("changed "+strconv.Itoa(i))))
+	}
+	for i := 1; i < 50; i += 3 {
+		storetests.ShouldCAS(t, p, strconv.Itoa(i), store.AnyV, store.MissingV)
+	}
+	p.Close()
+
+	if segmentCount(t, tmpDir) < 2 {
+		t.Fatalf("Expected several segments to be written")
+	}
+
+	p = reopenTestingPack(t, tmpDir)
+	defer p.Close()
+
+	var keys []string
+	for i := 0; i < 50; i++ {
+		key := strconv.Itoa(i)
+		switch i % 3 {
+		case 0:
+			storetests.ShouldGet(t, p, key, []byte("changed "+key))
+			keys = append(keys, key)
+		case 1:
+			storetests.ShouldGetMiss(t, p, key)
+		case 2:
+			storetests.ShouldGet(t, p, key, []byte("value "+key))
+			keys = append(keys, key)
+		}
+	}
+	storetests.ShouldListCount(t, p, len(keys))
+}
+
+func TestPackTornWrite(t *testing.T) {
+	p, tmpDir := makeTestingPack(t)
+	defer os.RemoveAll(tmpDir)
+
+	storetests.ShouldCAS(t, p, "a", store.AnyV, store.DataV([]byte("alpha")))
+	storetests.ShouldCAS(t, p, "b", store.AnyV, store.DataV([]byte("beta")))
+	goodSize := p.active.size
+	path := p.segmentPath(p.active.id, ".seg")
+	p.Close()
+
+	// simulate a crash partway through writing a record
+	record := encodeRecord(recordValue, "c", []byte("gamma"), store.DataV([]byte("gamma")).SHA256, 0)
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Couldn't open segment: %v", err)
+	}
+	_, err = fh.Write(record[:len(record)-3])
+	fh.Close()
+	if err != nil {
+		t.Fatalf("Couldn't write to segment: %v", err)
+	}
+
+	p = reopenTestingPack(t, tmpDir)
+	if p.active.size != goodSize {
+		t.Errorf("Active segment is %v bytes after recovery, wanted %v", p.active.size, goodSize)
+	}
+	storetests.ShouldGet(t, p, "a", []byte("alpha"))
+	storetests.ShouldGet(t, p, "b", []byte("beta"))
+	storetests.ShouldGetMiss(t, p, "c")
+	storetests.ShouldCAS(t, p, "c", store.AnyV, store.DataV([]byte("gamma")))
+	p.Close()
+
+	p = reopenTestingPack(t, tmpDir)
+	defer p.Close()
+	storetests.ShouldGet(t, p, "c", []byte("gamma"))
+	storetests.ShouldFullList(t, p, []string{"a", "b", "c"})
+}
+
+func TestPackDamagedHeader(t *testing.T) {
+	p, tmpDir := makeTestingPack(t)
+	defer os.RemoveAll(tmpDir)
+
+	storetests.ShouldCAS(t, p, "a", store.AnyV, store.DataV([]byte("alpha")))
+	storetests.ShouldCAS(t, p, "b", store.AnyV, store.DataV([]byte("beta")))
+	storetests.ShouldCAS(t, p, "c", store.AnyV, store.DataV([]byte("gamma")))
+	size := p.active.size
+	e := p.entries["b"]
+	path := p.segmentPath(e.seg, ".seg")
+	p.Close()
+
+	// break the kind byte of the record in the middle of the segment
+	fh, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Couldn't open segment: %v", err)
+	}
+	_, err = fh.WriteAt([]byte{0xff}, e.offset+4)
+	fh.Close()
+	if err != nil {
+		t.Fatalf("Couldn't corrupt segment: %v", err)
+	}
+
+	p = reopenTestingPack(t, tmpDir)
+	if p.active.size != size {
+		t.Errorf("Active segment is %v bytes after recovery, wanted %v", p.active.size, size)
+	}
+	storetests.ShouldGet(t, p, "a", []byte("alpha"))
+	storetests.ShouldGetMiss(t, p, "b")
+	storetests.ShouldGet(t, p, "c", []byte("gamma"))
+	storetests.ShouldCAS(t, p, "d", store.AnyV, store.DataV([]byte("delta")))
+	p.Close()
+
+	p = reopenTestingPack(t, tmpDir)
+	defer p.Close()
+	storetests.ShouldFullList(t, p, []string{"a", "c", "d"})
+	storetests.ShouldGet(t, p, "d", []byte("delta"))
+}
+
+func TestPackCompaction(t *testing.T) {
+	p, tmpDir := makeTestingPack(t)
+	defer os.RemoveAll(tmpDir)
+
+	p.maxSegmentSize = 1024
+
+	for i := 0; i < 100; i++ {
+		storetests.ShouldCAS(t, p, strconv.Itoa(i), store.AnyV, store.DataV([]byte("value "+strconv.Itoa(i))))
+	}
+	for i := 0; i < 100; i++ {
+		if i%10 != 0 {
+			storetests.ShouldCAS(t, p, strconv.Itoa(i), store.AnyV, store.MissingV)
+		}
+	}
+
+	before := segmentCount(t, tmpDir)
+	for {
+		compacted, err := p.compactStep()
+		if err != nil {
+			t.Fatalf("compactStep returned unexpected error %v", err)
+		}
+		if !compacted {
+			break
+		}
+	}
+	after := segmentCount(t, tmpDir)
+
+	if after >= before {
+		t.Errorf("Compaction left %v segments, had %v before", after, before)
+	}
+
+	check := func(p *Pack) {
+		var keys []string
+		for i := 0; i < 100; i++ {
+			key := strconv.Itoa(i)
+			if i%10 == 0 {
+				storetests.ShouldGet(t, p, key, []byte("value "+key))
+				keys = append(keys, key)
+			} else {
+				storetests.ShouldGetMiss(t, p, key)
+			}
+		}
+		storetests.ShouldListCount(t, p, len(keys))
+	}
+
+	check(p)
+	p.Close()
+
+	p = reopenTestingPack(t, tmpDir)
+	defer p.Close()
+	check(p)
+}
+
+func TestPackHashcheckCorruption(t *testing.T) {
+	p, tmpDir := makeTestingPack(t)
+	defer os.RemoveAll(tmpDir)
+
+	storetests.ShouldCAS(t, p, "a", store.AnyV, store.DataV([]byte("alpha")))
+	storetests.ShouldCAS(t, p, "b", store.AnyV, store.DataV([]byte("beta")))
+	storetests.ShouldCAS(t, p, "c", store.AnyV, store.DataV([]byte("gamma")))
+
+	e := p.entries["b"]
+	fh, err := os.OpenFile(p.segmentPath(e.seg, ".seg"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Couldn't open segment: %v", err)
+	}
+	_, err = fh.WriteAt([]byte("X"), e.offset+recordHeaderSize+1)
+	fh.Close()
+	if err != nil {
+		t.Fatalf("Couldn't corrupt segment: %v", err)
+	}
+
+	shouldHashcheck(t, p, 2, 1)
+	storetests.ShouldGetMiss(t, p, "b")
+	shouldHashcheck(t, p, 2, 0)
+
+	_, err = os.Stat(filepath.Join(tmpDir, "quarantine", base64.URLEncoding.EncodeToString([]byte("b"))))
+	if err != nil {
+		t.Errorf("Couldn't stat quarantined record: %v", err)
+	}
+
+	p.Close()
+
+	p = reopenTestingPack(t, tmpDir)
+	defer p.Close()
+	storetests.ShouldGetMiss(t, p, "b")
+	storetests.ShouldFullList(t, p, []string{"a", "c"})
+}
+
+func TestPackWrongKeyRecord(t *testing.T) {
+	p, tmpDir := makeTestingPack(t)
+	defer os.RemoveAll(tmpDir)
+	defer p.Close()
+
+	storetests.ShouldCAS(t, p, "a", store.AnyV, store.DataV([]byte("alpha")))
+	storetests.ShouldCAS(t, p, "b", store.AnyV, store.DataV([]byte("bravo")))
+
+	// a stale index entry pointing at another key's record
+	p.mu.Lock()
+	p.entries["a"] = p.entries["b"]
+	p.mu.Unlock()
+
+	storetests.ShouldGetError(t, p, "a", ErrCorruptObject)
+	storetests.ShouldGetMiss(t, p, "a")
+	storetests.ShouldGet(t, p, "b", []byte("bravo"))
+}
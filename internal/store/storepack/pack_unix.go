@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package storepack
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+func (p *Pack) FreeSpace(cancel <-chan struct{}) (int64, error) {
+	s := unix.Statfs_t{}
+	err := unix.Statfs(filepath.Join(p.Dir, "segments"), &s)
+	if err != nil {
+		return -1, err
+	}
+
+	// TODO: figure out and properly handle overflow
+	return int64(s.Bavail) * int64(s.Bsize), nil
+}
+
+func (p *Pack) Capacity(cancel <-chan struct{}) (int64, error) {
+	s := unix.Statfs_t{}
+	err := unix.Statfs(filepath.Join(p.Dir, "segments"), &s)
+	if err != nil {
+		return -1, err
+	}
+
+	return int64(s.Blocks) * int64(s.Bsize), nil
+}
+
+func syncDir(dir string) error {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = fh.Sync()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+
+	return fh.Close()
+}
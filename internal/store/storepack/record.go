@@ -0,0 +1,110 @@
+package storepack
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// Each record in a segment file has the following format:
+//     4-byte CRC-32C of all of the following data
+//     1-byte kind (recordValue or recordTombstone)
+//     2-byte key length
+//     8-byte data length
+//     8-byte write time, in seconds since the epoch
+//     32-byte SHA256 of the data
+//     variable size key
+//     variable size data
+//
+// All integers are big endian.
+
+const (
+	recordValue     = 1
+	recordTombstone = 2
+
+	recordHeaderSize = 4 + 1 + 2 + 8 + 8 + 32
+
+	maxKeyLength = 1<<16 - 1
+)
+
+var (
+	ErrCorruptObject = errors.New("object is corrupt")
+	ErrKeyTooLong    = errors.New("key is too long")
+
+	errBadRecord = errors.New("bad record")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type recordHeader struct {
+	CRC       uint32
+	Kind      uint8
+	KeyLen    int
+	DataLen   int64
+	WriteTime int64
+	SHA256    [32]byte
+}
+
+// Len returns the length of the whole record, including the header.
+func (h recordHeader) Len() int64 {
+	return recordHeaderSize + int64(h.KeyLen) + h.DataLen
+}
+
+func (h recordHeader) encode(buf []byte) {
+	buf[4] = h.Kind
+	binary.BigEndian.PutUint16(buf[5:7], uint16(h.KeyLen))
+	binary.BigEndian.PutUint64(buf[7:15], uint64(h.DataLen))
+	binary.BigEndian.PutUint64(buf[15:23], uint64(h.WriteTime))
+	copy(buf[23:55], h.SHA256[:])
+	binary.BigEndian.PutUint32(buf[0:4], h.CRC)
+}
+
+func decodeRecordHeader(buf []byte) (recordHeader, error) {
+	h := recordHeader{
+		CRC:       binary.BigEndian.Uint32(buf[0:4]),
+		Kind:      buf[4],
+		KeyLen:    int(binary.BigEndian.Uint16(buf[5:7])),
+		DataLen:   int64(binary.BigEndian.Uint64(buf[7:15])),
+		WriteTime: int64(binary.BigEndian.Uint64(buf[15:23])),
+	}
+	copy(h.SHA256[:], buf[23:55])
+
+	if h.Kind != recordValue && h.Kind != recordTombstone {
+		return recordHeader{}, errBadRecord
+	}
+	if h.KeyLen == 0 || h.DataLen < 0 {
+		return recordHeader{}, errBadRecord
+	}
+	if h.Kind == recordTombstone && h.DataLen != 0 {
+		return recordHeader{}, errBadRecord
+	}
+
+	return h, nil
+}
+
+// encodeRecord returns the header and key of a record, with the CRC filled in
+// to cover data as well. The data itself is not copied.
+func encodeRecord(kind uint8, key string, data []byte, sha [32]byte, writeTime int64) []byte {
+	h := recordHeader{
+		Kind:      kind,
+		KeyLen:    len(key),
+		DataLen:   int64(len(data)),
+		WriteTime: writeTime,
+		SHA256:    sha,
+	}
+
+	buf := make([]byte, recordHeaderSize+len(key))
+	h.encode(buf)
+	copy(buf[recordHeaderSize:], key)
+
+	crc := crc32.Update(0, crcTable, buf[4:])
+	h.CRC = crc32.Update(crc, crcTable, data)
+	binary.BigEndian.PutUint32(buf[0:4], h.CRC)
+
+	return buf
+}
+
+// checkRecord verifies the CRC of a whole record.
+func checkRecord(h recordHeader, record []byte) bool {
+	return crc32.Checksum(record[4:], crcTable) == h.CRC
+}
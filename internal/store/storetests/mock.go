@@ -15,11 +15,14 @@ import (
 var ErrNotEnoughMockSpace = errors.New("no space left in MockStore")
 
 var _ store.RangeReadStore = &MockStore{}
+var _ store.QuarantineStore = &MockStore{}
+var _ store.CapacityStore = &MockStore{}
 
 type MockStore struct {
 	mu         sync.Mutex
 	cond       *sync.Cond
 	contents   map[string]storeEntry
+	quarantine map[string]store.QuarantineEntry
 	size, used int64
 	blocked    bool
 
@@ -33,9 +36,10 @@ type storeEntry struct {
 
 func NewMockStore(size int64) *MockStore {
 	m := &MockStore{
-		contents: make(map[string]storeEntry, 128),
-		uuid:     uuid.Gen4(),
-		size:     size,
+		contents:   make(map[string]storeEntry, 128),
+		quarantine: make(map[string]store.QuarantineEntry),
+		uuid:       uuid.Gen4(),
+		size:       size,
 	}
 	m.cond = sync.NewCond(&m.mu)
 	return m
@@ -136,6 +140,28 @@ func (m *MockStore) FreeSpace(cancel <-chan struct{}) (int64, error) {
 	return m.size - m.used, nil
 }
 
+// Capacity returns the size the MockStore was created with, or ErrUnsupported
+// if it is unlimited.
+func (m *MockStore) Capacity(cancel <-chan struct{}) (int64, error) {
+	m.mu.Lock()
+	m.waitUnblocked()
+	defer m.mu.Unlock()
+
+	if m.size <= 0 {
+		return 0, store.ErrUnsupported
+	}
+
+	return m.size, nil
+}
+
+// SetSize changes the size of the MockStore. A size of zero or less makes it
+// unlimited.
+func (m *MockStore) SetSize(size int64) {
+	m.mu.Lock()
+	m.size = size
+	m.mu.Unlock()
+}
+
 func (m *MockStore) Stat(key string, cancel <-chan struct{}) (store.Stat, error) {
 	_, st, err := m.Get(key, store.GetOptions{Cancel: cancel})
 	return st, err
@@ -183,6 +209,45 @@ func (m *MockStore) CAS(key string, from, to store.CASV, cancel <-chan struct{})
 	return nil
 }
 
+// Quarantine removes key from the store and lists it as quarantined, as a
+// real store does when it finds a corrupt value.
+func (m *MockStore) Quarantine(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.contents[key]
+	if !ok {
+		return
+	}
+
+	delete(m.contents, key)
+	m.used -= int64(len(entry.data))
+	m.quarantine[key] = store.QuarantineEntry{
+		Key:  key,
+		Size: int64(len(entry.data)),
+		Time: time.Now().Unix(),
+	}
+}
+
+func (m *MockStore) ListQuarantine(cancel <-chan struct{}) ([]store.QuarantineEntry, error) {
+	m.mu.Lock()
+	m.waitUnblocked()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.quarantine))
+	for key := range m.quarantine {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	entries := make([]store.QuarantineEntry, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, m.quarantine[key])
+	}
+
+	return entries, nil
+}
+
 func (m *MockStore) Close() error {
 	m.mu.Lock()
 	m.waitUnblocked()
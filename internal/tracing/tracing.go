@@ -0,0 +1,331 @@
+// Package tracing records spans of time spent in object operations, linked
+// across the proxy and chunk servers with W3C trace context headers, and
+// exports them for latency debugging.
+//
+// There is no context package here; the SpanContext of the span an operation
+// is part of is passed along explicitly, in store.GetOptions.Trace or through
+// store.WithTrace, and sent to other servers in the traceparent header.
+package tracing
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/encryptio/slime/internal/logging"
+)
+
+// Header is the HTTP header carrying the trace context of a request.
+const Header = "traceparent"
+
+var errBadTraceParent = errors.New("bad traceparent header")
+
+// A SpanContext identifies a span, so that spans can be made children of it.
+// The zero SpanContext is not part of any trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool // whether spans in this trace are recorded
+}
+
+// Valid returns whether sc is part of a trace.
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// String formats sc as the value of a traceparent header.
+func (sc SpanContext) String() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" +
+		hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseSpanContext parses the value of a traceparent header.
+func ParseSpanContext(s string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, errBadTraceParent
+	}
+
+	_, err := hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	if err != nil {
+		return SpanContext{}, errBadTraceParent
+	}
+	_, err = hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	if err != nil {
+		return SpanContext{}, errBadTraceParent
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, errBadTraceParent
+	}
+	sc.Sampled = flags[0]&1 == 1
+
+	if !sc.Valid() {
+		return SpanContext{}, errBadTraceParent
+	}
+	return sc, nil
+}
+
+// Inject sets the traceparent header in h to sc, if sc is valid.
+func Inject(h http.Header, sc SpanContext) {
+	if sc.Valid() {
+		h.Set(Header, sc.String())
+	}
+}
+
+// Extract returns the trace context in the traceparent header of h, or the
+// zero SpanContext if there is none or it can't be parsed.
+func Extract(h http.Header) SpanContext {
+	sc, err := ParseSpanContext(h.Get(Header))
+	if err != nil {
+		return SpanContext{}
+	}
+	return sc
+}
+
+// SpanData is a finished span, as given to an Exporter.
+type SpanData struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte // zero for the root span of a trace
+	Name     string
+	Start    time.Time
+	End      time.Time
+
+	Attributes map[string]interface{}
+	Error      string // empty if the operation succeeded
+}
+
+// A Span is an operation being timed. A nil *Span does nothing, so callers
+// need not check whether tracing is enabled.
+type Span struct {
+	ctx SpanContext
+
+	mu   sync.Mutex
+	data SpanData
+}
+
+// Start begins a span that is a child of parent. It returns nil if tracing is
+// disabled or parent is not valid; operations that are not part of a traced
+// request are not traced.
+func Start(parent SpanContext, name string) *Span {
+	if !parent.Valid() || !Enabled() {
+		return nil
+	}
+	return newSpan(parent.TraceID, parent.SpanID, parent.Sampled, name)
+}
+
+// StartRoot begins the first span of a new trace, which is recorded with the
+// configured sample rate. It returns nil if tracing is disabled.
+func StartRoot(name string) *Span {
+	mu.Lock()
+	enabled := exporter != nil
+	sampled := rand.Float64() < sampleRate
+	mu.Unlock()
+
+	if !enabled {
+		return nil
+	}
+
+	var traceID [16]byte
+	rand.Read(traceID[:])
+	return newSpan(traceID, [8]byte{}, sampled, name)
+}
+
+func newSpan(traceID [16]byte, parentID [8]byte, sampled bool, name string) *Span {
+	s := &Span{}
+	s.ctx.TraceID = traceID
+	s.ctx.Sampled = sampled
+	rand.Read(s.ctx.SpanID[:])
+
+	if sampled {
+		s.data = SpanData{
+			TraceID:  traceID,
+			SpanID:   s.ctx.SpanID,
+			ParentID: parentID,
+			Name:     name,
+			Start:    time.Now(),
+		}
+	}
+
+	return s
+}
+
+// Context returns the SpanContext of s, for starting children of it. It is
+// the zero SpanContext if s is nil.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.ctx
+}
+
+// SetAttribute records a value describing the operation, such as the key
+// being read. Values should be strings, numbers, or bools.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || !s.ctx.Sampled {
+		return
+	}
+
+	s.mu.Lock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+	s.mu.Unlock()
+}
+
+// SetError records that the operation failed with err, if err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || !s.ctx.Sampled || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.data.Error = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export. Calls after the first do
+// nothing.
+func (s *Span) End() {
+	if s == nil || !s.ctx.Sampled {
+		return
+	}
+
+	s.mu.Lock()
+	if !s.data.End.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	select {
+	case queue <- data:
+	default:
+		// the exporter has fallen behind; losing spans is better than
+		// slowing down requests
+	}
+}
+
+// An Exporter sends finished spans somewhere they can be looked at.
+type Exporter interface {
+	Export(spans []SpanData) error
+}
+
+var (
+	// exportBatch is the most spans given to an Exporter at once, and
+	// exportInterval the longest a span waits before being exported.
+	exportBatch    = 512
+	exportInterval = 2 * time.Second
+
+	queue   = make(chan SpanData, 10000)
+	flushes = make(chan chan struct{})
+
+	mu         sync.Mutex
+	exporter   Exporter
+	sampleRate float64
+	exporting  bool
+)
+
+// Configure enables tracing, exporting spans to e. New traces are recorded
+// with probability rate (from 0 to 1); traces started elsewhere are
+// recorded if the caller recorded them. A nil e disables tracing.
+func Configure(e Exporter, rate float64) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	exporter = e
+	sampleRate = rate
+
+	if e != nil && !exporting {
+		exporting = true
+		go exportLoop()
+	}
+}
+
+// Enabled returns whether tracing is configured.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return exporter != nil
+}
+
+// Flush waits for the spans that have ended so far to be exported.
+func Flush() {
+	mu.Lock()
+	running := exporting
+	mu.Unlock()
+
+	if !running {
+		return
+	}
+
+	done := make(chan struct{})
+	flushes <- done
+	<-done
+}
+
+func exportLoop() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		mu.Lock()
+		e := exporter
+		mu.Unlock()
+
+		if e != nil {
+			err := e.Export(batch)
+			if err != nil {
+				logging.Errorf("Couldn't export %v trace spans: %v", len(batch), err)
+			}
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case span := <-queue:
+			batch = append(batch, span)
+			if len(batch) >= exportBatch {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-flushes:
+		drain:
+			for {
+				select {
+				case span := <-queue:
+					batch = append(batch, span)
+					if len(batch) >= exportBatch {
+						export()
+					}
+				default:
+					break drain
+				}
+			}
+			export()
+			close(done)
+		}
+	}
+}
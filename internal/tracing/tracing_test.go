@@ -0,0 +1,186 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type recordExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (r *recordExporter) Export(spans []SpanData) error {
+	r.mu.Lock()
+	r.spans = append(r.spans, spans...)
+	r.mu.Unlock()
+	return nil
+}
+
+func TestSpanContextHeader(t *testing.T) {
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	h := make(http.Header)
+	h.Set(Header, header)
+	sc := Extract(h)
+	if !sc.Valid() || !sc.Sampled {
+		t.Fatalf("Extracted %#v from %v", sc, header)
+	}
+	if sc.String() != header {
+		t.Fatalf("Formatted %v as %v", header, sc.String())
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseSpanContext(bad)
+		if err == nil {
+			t.Errorf("ParseSpanContext(%#v) succeeded", bad)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	rec := &recordExporter{}
+	Configure(rec, 1)
+	defer Configure(nil, 0)
+
+	if Start(SpanContext{}, "orphan") != nil {
+		t.Errorf("Start without a parent returned a span")
+	}
+
+	root := StartRoot("root")
+	child := Start(root.Context(), "child")
+	child.SetAttribute("key", "value")
+	child.End()
+	child.End()
+	root.End()
+	Flush()
+
+	if len(rec.spans) != 2 {
+		t.Fatalf("Got %v spans, wanted 2", len(rec.spans))
+	}
+	c, r := rec.spans[0], rec.spans[1]
+	if c.Name != "child" || r.Name != "root" {
+		t.Fatalf("Got spans named %v and %v", c.Name, r.Name)
+	}
+	if c.TraceID != r.TraceID || c.ParentID != r.SpanID || r.ParentID != [8]byte{} {
+		t.Errorf("Child span %#v is not linked to root span %#v", c, r)
+	}
+	if c.Attributes["key"] != "value" {
+		t.Errorf("Child span has attributes %#v", c.Attributes)
+	}
+
+	rec.spans = nil
+	Configure(rec, 0)
+	root = StartRoot("unsampled")
+	child = Start(root.Context(), "child")
+	if child == nil || child.Context().Sampled {
+		t.Errorf("Child of unsampled span is %#v", child)
+	}
+	child.End()
+	root.End()
+	Flush()
+
+	if len(rec.spans) != 0 {
+		t.Errorf("Unsampled trace exported %v spans", len(rec.spans))
+	}
+}
+
+func testSpan() SpanData {
+	root := newSpan([16]byte{1}, [8]byte{2}, true, "op")
+	root.SetAttribute("size", 5)
+	root.data.End = root.data.Start
+	return root.data
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slime_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "spans.json")
+	e, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatalf("Couldn't create exporter: %v", err)
+	}
+
+	err = e.Export([]SpanData{testSpan(), testSpan()})
+	if err != nil {
+		t.Fatalf("Couldn't export: %v", err)
+	}
+	e.Close()
+
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Couldn't open exported spans: %v", err)
+	}
+	defer fh.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		lines++
+		var span spanJSON
+		err := json.Unmarshal(scanner.Bytes(), &span)
+		if err != nil {
+			t.Fatalf("Couldn't decode %q: %v", scanner.Text(), err)
+		}
+		if span.Name != "op" || span.TraceID != "01000000000000000000000000000000" ||
+			span.ParentID != "0200000000000000" {
+			t.Errorf("Exported span %#v", span)
+		}
+	}
+	if lines != 2 {
+		t.Errorf("Got %v lines, wanted 2", lines)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var got otlpRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewDecoder(r.Body).Decode(&got)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	err := NewOTLPExporter(srv.URL, "test").Export([]SpanData{testSpan()})
+	if err != nil {
+		t.Fatalf("Couldn't export: %v", err)
+	}
+
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Got OTLP request %#v", got)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("Got %v spans, wanted 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "op" || span.ParentSpanID != "0200000000000000" ||
+		len(span.Attributes) != 1 || span.Attributes[0].Value["intValue"] != "5" {
+		t.Errorf("Exported span %#v", span)
+	}
+
+	srv.Close()
+	err = NewOTLPExporter(srv.URL, "test").Export([]SpanData{testSpan()})
+	if err == nil {
+		t.Errorf("Export to a closed server succeeded")
+	}
+}
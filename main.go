@@ -13,11 +13,17 @@ import (
 	"time"
 
 	"github.com/encryptio/slime/internal/chunkserver"
+	"github.com/encryptio/slime/internal/events"
 	"github.com/encryptio/slime/internal/httputil"
+	"github.com/encryptio/slime/internal/logging"
 	"github.com/encryptio/slime/internal/meta"
 	"github.com/encryptio/slime/internal/proxyserver"
+	"github.com/encryptio/slime/internal/rs"
 	"github.com/encryptio/slime/internal/store"
+	"github.com/encryptio/slime/internal/store/multi"
 	"github.com/encryptio/slime/internal/store/storedir"
+	"github.com/encryptio/slime/internal/store/storepack"
+	"github.com/encryptio/slime/internal/tracing"
 	"github.com/encryptio/slime/internal/uuid"
 
 	"github.com/encryptio/kvl"
@@ -47,8 +53,33 @@ func (d *tomlDuration) UnmarshalTOML(b []byte) error {
 	return err
 }
 
+type tomlEventSink struct {
+	Type    string
+	URL     string
+	Retries int
+	Path    string
+	Command []string
+	Timeout tomlDuration
+	Events  []string
+}
+
+type tomlLimit struct {
+	BytesPerSecond int64 `toml:"bytes-per-second"`
+	OpsPerSecond   int64 `toml:"ops-per-second"`
+}
+
 var config struct {
-	GCPercent int `toml:"gc-percent"`
+	GCPercent int    `toml:"gc-percent"`
+	LogLevel  string `toml:"log-level"`
+	LogFormat string `toml:"log-format"`
+
+	Tracing struct {
+		Exporter    string
+		URL         string
+		Path        string
+		ServiceName string  `toml:"service-name"`
+		SampleRate  float64 `toml:"sample-rate"`
+	}
 
 	Proxy struct {
 		Listen           string
@@ -59,19 +90,36 @@ var config struct {
 			Type string
 			DSN  string
 		}
-		CacheSize          int  `toml:"cache-size"`
-		DisableHTTPLogging bool `toml:"disable-http-logging"`
+		CacheSize          int    `toml:"cache-size"`
+		DiskCacheDir       string `toml:"disk-cache-dir"`
+		DiskCacheSize      int64  `toml:"disk-cache-size"`
+		DisableHTTPLogging bool   `toml:"disable-http-logging"`
+		CodecWorkers       int    `toml:"codec-workers"`
+		AuditData          bool   `toml:"audit-data"`
+		Limits             struct {
+			Scrub      tomlLimit
+			Rebuild    tomlLimit
+			Rebalance  tomlLimit
+			ReadRepair tomlLimit `toml:"read-repair"`
+			DeepScrub  tomlLimit `toml:"deep-scrub"`
+			Archive    tomlLimit
+			Tiering    tomlLimit
+		}
+		Events []tomlEventSink
 	}
 	Chunk struct {
 		Listen           string
 		ParallelRequests int `toml:"parallel-requests"`
 		Debug            bool
 		Dirs             []string
+		PackDirs         []string `toml:"pack-dirs"`
 		Scrubber         struct {
 			SleepPerFile tomlDuration `toml:"sleep-per-file"`
 			SleepPerByte tomlDuration `toml:"sleep-per-byte"`
 		}
-		DisableHTTPLogging bool `toml:"disable-http-logging"`
+		DisableHTTPLogging  bool   `toml:"disable-http-logging"`
+		Durability          string `toml:"durability"`
+		QuarantineRetention string `toml:"quarantine-retention"`
 	}
 }
 
@@ -101,6 +149,24 @@ func loadConfigOrDie() {
 		config.GCPercent = 20
 	}
 
+	logLevel, err := logging.ParseLevel(config.LogLevel)
+	if config.LogLevel == "" {
+		logLevel, err = logging.Info, nil
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	switch config.LogFormat {
+	case "", "text":
+		logging.Configure(os.Stderr, logLevel, false)
+	case "json":
+		logging.Configure(os.Stderr, logLevel, true)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown log format %#v\n", config.LogFormat)
+		os.Exit(1)
+	}
+
 	if config.Proxy.Listen == "" {
 		config.Proxy.Listen = "127.0.0.1:17942"
 	}
@@ -123,6 +189,12 @@ func loadConfigOrDie() {
 	if config.Chunk.Scrubber.SleepPerByte.Duration <= 0 {
 		config.Chunk.Scrubber.SleepPerByte.Duration = 1500 * time.Nanosecond
 	}
+	if config.Chunk.Durability == "" {
+		config.Chunk.Durability = storedir.DurabilityFileDir.String()
+	}
+	if config.Chunk.QuarantineRetention == "" {
+		config.Chunk.QuarantineRetention = "720h"
+	}
 }
 
 func initRandom() {
@@ -147,6 +219,8 @@ func help() {
 	fmt.Fprintf(os.Stderr, "        reindex a database\n")
 	fmt.Fprintf(os.Stderr, "    fmt-dir dir\n")
 	fmt.Fprintf(os.Stderr, "        initialize a new directory store\n")
+	fmt.Fprintf(os.Stderr, "    fmt-pack-dir dir\n")
+	fmt.Fprintf(os.Stderr, "        initialize a new pack store, for many small chunks\n")
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "If config-file.toml is needed but not given, it defaults to:\n")
 	fmt.Fprintf(os.Stderr, "    %s\n", defaultConfigLocation)
@@ -175,41 +249,62 @@ func fmtDir() {
 	}
 }
 
+func fmtPackDir() {
+	if len(os.Args) != 2 {
+		help()
+		os.Exit(1)
+	}
+
+	err := storepack.CreatePack(os.Args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
 func chunkServer() {
 	loadConfigOrDie()
 	debug.SetGCPercent(config.GCPercent)
+	tracingOrDie("slime-chunk-server")
 
-	stores := make([]store.Store, len(config.Chunk.Dirs))
-	for i := range config.Chunk.Dirs {
-		dir := config.Chunk.Dirs[i]
-		construct := func() store.Store {
-			log.Printf("Trying to open store at %v", dir)
+	durability, err := storedir.ParseDurability(config.Chunk.Durability)
+	if err != nil {
+		log.Fatalf("Bad chunk durability setting: %v", err)
+	}
 
-			start := time.Now()
+	// zero or negative keeps quarantined files forever
+	quarantineRetention, err := time.ParseDuration(config.Chunk.QuarantineRetention)
+	if err != nil {
+		log.Fatalf("Bad chunk quarantine-retention setting: %v", err)
+	}
 
-			ds, err := storedir.OpenDirectory(
+	var stores []store.Store
+	for i := range config.Chunk.Dirs {
+		dir := config.Chunk.Dirs[i]
+		stores = append(stores, chunkStore(dir, func() (store.Store, error) {
+			return storedir.OpenDirectory(
 				dir,
 				config.Chunk.Scrubber.SleepPerFile.Duration,
 				config.Chunk.Scrubber.SleepPerByte.Duration,
+				durability,
+				quarantineRetention,
 			)
-
-			if err != nil {
-				log.Printf("Couldn't open store at %v: %v", dir, err)
-				return nil
-			}
-
-			dur := time.Now().Sub(start)
-
-			log.Printf("Store at %v opened with UUID %v in %v",
-				dir, uuid.Fmt(ds.UUID()), dur)
-
-			return ds
-		}
-		stores[i] = store.NewRetryStore(construct, time.Second*15)
+		}))
+	}
+	for i := range config.Chunk.PackDirs {
+		dir := config.Chunk.PackDirs[i]
+		stores = append(stores, chunkStore(dir, func() (store.Store, error) {
+			return storepack.OpenPack(
+				dir,
+				config.Chunk.Scrubber.SleepPerFile.Duration,
+				config.Chunk.Scrubber.SleepPerByte.Duration,
+				durability,
+				quarantineRetention,
+			)
+		}))
 	}
 
 	var h http.Handler
-	var err error
 	h, err = chunkserver.New(stores)
 	if err != nil {
 		log.Fatalf("Couldn't initialize handler: %v", err)
@@ -220,12 +315,138 @@ func chunkServer() {
 	if !config.Chunk.DisableHTTPLogging {
 		h = httputil.LogHTTPRequests(h)
 	}
+	h = httputil.TraceHTTPRequests(h)
+	h = httputil.AddRequestIDs(h)
 	serveOrDie(config.Chunk.Listen, h)
 }
 
+// chunkStore wraps the store opened by open for the directory dir in a
+// RetryStore, so that it can appear and disappear while the chunk server runs.
+func chunkStore(dir string, open func() (store.Store, error)) store.Store {
+	construct := func() store.Store {
+		log.Printf("Trying to open store at %v", dir)
+
+		start := time.Now()
+
+		st, err := open()
+		if err != nil {
+			log.Printf("Couldn't open store at %v: %v", dir, err)
+			return nil
+		}
+
+		dur := time.Now().Sub(start)
+
+		log.Printf("Store at %v opened with UUID %v in %v",
+			dir, uuid.Fmt(st.UUID()), dur)
+
+		return st
+	}
+	return store.NewRetryStore(construct, time.Second*15)
+}
+
+func eventsOrDie() *events.Dispatcher {
+	if len(config.Proxy.Events) == 0 {
+		return nil
+	}
+
+	known := make(map[string]bool, len(events.Types))
+	for _, t := range events.Types {
+		known[t] = true
+	}
+
+	d := events.NewDispatcher()
+	for _, sink := range config.Proxy.Events {
+		for _, t := range sink.Events {
+			if !known[t] {
+				log.Fatalf("Unknown event type %#v", t)
+			}
+		}
+
+		switch sink.Type {
+		case "webhook":
+			if sink.URL == "" {
+				log.Fatalf("webhook event sink needs a url")
+			}
+			retries := sink.Retries
+			if retries <= 0 {
+				retries = 5
+			}
+			d.AddSink(events.NewHTTPSink(sink.URL, retries), sink.Events...)
+
+		case "file":
+			if sink.Path == "" {
+				log.Fatalf("file event sink needs a path")
+			}
+			fs, err := events.NewFileSink(sink.Path)
+			if err != nil {
+				log.Fatalf("Couldn't open event log: %v", err)
+			}
+			d.AddSink(fs, sink.Events...)
+
+		case "exec":
+			if len(sink.Command) == 0 {
+				log.Fatalf("exec event sink needs a command")
+			}
+			d.AddSink(&events.ExecSink{
+				Command: sink.Command,
+				Timeout: sink.Timeout.Duration,
+			}, sink.Events...)
+
+		default:
+			log.Fatalf("Unknown event sink type %#v", sink.Type)
+		}
+	}
+
+	return d
+}
+
+// tracingOrDie enables tracing as described by the config, naming the service
+// defaultService unless the config says otherwise.
+func tracingOrDie(defaultService string) {
+	conf := config.Tracing
+
+	rate := conf.SampleRate
+	if rate < 0 || rate > 1 {
+		log.Fatalf("tracing sample-rate must be between 0 and 1")
+	}
+	if rate == 0 {
+		rate = 1
+	}
+
+	service := conf.ServiceName
+	if service == "" {
+		service = defaultService
+	}
+
+	switch conf.Exporter {
+	case "":
+		return
+
+	case "otlp":
+		if conf.URL == "" {
+			log.Fatalf("otlp tracing exporter needs a url")
+		}
+		tracing.Configure(tracing.NewOTLPExporter(conf.URL, service), rate)
+
+	case "file":
+		if conf.Path == "" {
+			log.Fatalf("file tracing exporter needs a path")
+		}
+		fe, err := tracing.NewFileExporter(conf.Path)
+		if err != nil {
+			log.Fatalf("Couldn't open trace file: %v", err)
+		}
+		tracing.Configure(fe, rate)
+
+	default:
+		log.Fatalf("Unknown tracing exporter %#v", conf.Exporter)
+	}
+}
+
 func proxyServer() {
 	loadConfigOrDie()
 	debug.SetGCPercent(config.GCPercent)
+	tracingOrDie("slime-proxy")
 
 	db, err := kvl.Open(config.Proxy.Database.Type, config.Proxy.Database.DSN)
 	if err != nil {
@@ -234,12 +455,34 @@ func proxyServer() {
 	}
 	defer db.Close()
 
-	var h http.Handler
-	h, err = proxyserver.New(db, config.Proxy.Scrubbers, config.Proxy.CacheSize)
+	rs.SetWorkers(config.Proxy.CodecWorkers)
+
+	if config.Proxy.DiskCacheSize > 0 && config.Proxy.DiskCacheDir == "" {
+		log.Fatalf("disk-cache-size is set, but disk-cache-dir is not")
+	}
+
+	ph, err := proxyserver.New(db, config.Proxy.Scrubbers,
+		proxyserver.CacheConfig{
+			MemorySize: config.Proxy.CacheSize,
+			DiskDir:    config.Proxy.DiskCacheDir,
+			DiskSize:   config.Proxy.DiskCacheSize,
+		},
+		multi.Limits{
+			Scrub:      multi.Limit(config.Proxy.Limits.Scrub),
+			Rebuild:    multi.Limit(config.Proxy.Limits.Rebuild),
+			Rebalance:  multi.Limit(config.Proxy.Limits.Rebalance),
+			ReadRepair: multi.Limit(config.Proxy.Limits.ReadRepair),
+			DeepScrub:  multi.Limit(config.Proxy.Limits.DeepScrub),
+			Archive:    multi.Limit(config.Proxy.Limits.Archive),
+			Tiering:    multi.Limit(config.Proxy.Limits.Tiering),
+		},
+		eventsOrDie())
 	if err != nil {
 		log.Fatalf("Couldn't initialize handler: %v", err)
 	}
+	ph.SetAuditData(config.Proxy.AuditData)
 
+	var h http.Handler = ph
 	h = httputil.NewLimitParallelism(config.Proxy.ParallelRequests, h)
 
 	h = httputil.AddDebugHandlers(h, config.Proxy.Debug)
@@ -248,6 +491,9 @@ func proxyServer() {
 		h = httputil.LogHTTPRequests(h)
 	}
 
+	h = httputil.TraceHTTPRequests(h)
+	h = httputil.AddRequestIDs(h)
+
 	if config.Proxy.Listen == "none" {
 		for {
 			time.Sleep(time.Hour)
@@ -290,6 +536,8 @@ func main() {
 	switch command {
 	case "fmt-dir":
 		fmtDir()
+	case "fmt-pack-dir":
+		fmtPackDir()
 	case "chunk-server":
 		chunkServer()
 	case "proxy-server":
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+type archive struct {
+	Need       int    `json:"need"`
+	Total      int    `json:"total"`
+	Codec      string `json:"codec"`
+	LocalGroup int    `json:"local_group"`
+	After      string `json:"after"`
+	Rate       int64  `json:"rate"`
+	Position   string `json:"position"`
+	Scanned    int64  `json:"scanned"`
+	Files      int64  `json:"files"`
+	Bytes      int64  `json:"bytes"`
+	Saved      int64  `json:"saved"`
+}
+
+func handleArchive(args []string) error {
+	if len(args) == 0 {
+		return handleArchiveGet()
+	}
+
+	switch args[0] {
+	case "get":
+		if len(args) != 1 {
+			return errors.New("archive get does not take any arguments")
+		}
+		return handleArchiveGet()
+
+	case "set":
+		if len(args) != 4 && len(args) != 5 {
+			return errors.New("archive set takes three or four arguments")
+		}
+
+		rate := "0"
+		if len(args) == 5 {
+			rate = args[4]
+		}
+
+		return handleArchiveSet(args[1], args[2], args[3], rate)
+
+	case "codec":
+		if len(args) != 2 {
+			return errors.New("archive codec takes one argument")
+		}
+		return handleArchivePost(map[string]interface{}{"codec": args[1]})
+
+	case "off":
+		if len(args) != 1 {
+			return errors.New("archive off does not take any arguments")
+		}
+		return handleArchivePost(map[string]interface{}{"after": "0s"})
+
+	default:
+		return fmt.Errorf("bad archive subcommand %v", args[0])
+	}
+}
+
+func handleArchiveGet() error {
+	var a archive
+	err := jsonGet(conf.Base+"archive", &a)
+	if err != nil {
+		return err
+	}
+
+	printArchive(a)
+	return nil
+}
+
+func handleArchiveSet(needStr, totalStr, after, rateStr string) error {
+	need, err := strconv.ParseInt(needStr, 10, 0)
+	if err != nil {
+		return fmt.Errorf(`bad format for "need": %v`, err)
+	}
+
+	total, err := strconv.ParseInt(totalStr, 10, 0)
+	if err != nil {
+		return fmt.Errorf(`bad format for "total": %v`, err)
+	}
+
+	rate, err := strconv.ParseInt(rateStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf(`bad format for "bytes-per-second": %v`, err)
+	}
+
+	return handleArchivePost(map[string]interface{}{
+		"need":  need,
+		"total": total,
+		"after": after,
+		"rate":  rate,
+	})
+}
+
+func handleArchivePost(req map[string]interface{}) error {
+	var a archive
+	err := jsonPost(conf.Base+"archive", req, &a)
+	if err != nil {
+		return err
+	}
+
+	printArchive(a)
+	return nil
+}
+
+func printArchive(a archive) {
+	if a.After == "0s" {
+		fmt.Printf("Archiving is disabled\n")
+	} else {
+		fmt.Printf("Files written more than %v ago are re-encoded to need %v of %v using the %v codec\n",
+			a.After, a.Need, a.Total, a.Codec)
+		if a.LocalGroup > 0 {
+			fmt.Printf("Local parity groups hold %v data chunks\n", a.LocalGroup)
+		}
+		if a.Rate > 0 {
+			fmt.Printf("Each proxy re-encodes up to %v bytes per second\n", a.Rate)
+		}
+	}
+
+	if a.Scanned > 0 {
+		fmt.Printf("This proxy checked %v files (last was %#v), archived %v (%.1f MiB), saving %.1f MiB\n",
+			a.Scanned, a.Position, a.Files, float64(a.Bytes)/1024/1024,
+			float64(a.Saved)/1024/1024)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+type auditEntry struct {
+	Time   time.Time       `json:"time"`
+	Action string          `json:"action"`
+	User   string          `json:"user"`
+	Source string          `json:"source"`
+	Target string          `json:"target"`
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+func handleAudit(args []string) error {
+	if len(args) > 2 {
+		return errors.New("audit takes at most a limit and an action")
+	}
+
+	q := url.Values{}
+	if len(args) > 0 {
+		limit, err := strconv.Atoi(args[0])
+		if err != nil || limit <= 0 {
+			return errors.New("bad format for limit")
+		}
+		q.Set("limit", args[0])
+	}
+	if len(args) > 1 {
+		q.Set("action", args[1])
+	}
+
+	var entries []auditEntry
+	err := jsonGet(conf.Base+"audit?"+q.Encode(), &entries)
+	if err != nil {
+		return err
+	}
+
+	table := [][]string{
+		[]string{"Time", "User", "Source", "Action", "Target", "Before", "After"},
+	}
+
+	// print oldest first, so the newest changes end up nearest the prompt
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		table = append(table, []string{
+			e.Time.Local().Format("2006-01-02 15:04:05"),
+			e.User,
+			e.Source,
+			e.Action,
+			e.Target,
+			auditValue(e.Before),
+			auditValue(e.After),
+		})
+	}
+
+	widthLimit := 0
+	if !conf.Wide {
+		widthLimit = getTTYWidth()
+	}
+	printTable(os.Stdout, table, widthLimit)
+	return nil
+}
+
+func auditValue(v json.RawMessage) string {
+	if len(v) == 0 || string(v) == "null" {
+		return "-"
+	}
+	return string(v)
+}
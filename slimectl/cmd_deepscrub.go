@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+type deepScrub struct {
+	Rate         int64  `json:"rate"`
+	Repair       bool   `json:"repair"`
+	Position     string `json:"position"`
+	Files        int64  `json:"files"`
+	Bytes        int64  `json:"bytes"`
+	Inconsistent int64  `json:"inconsistent"`
+	Repaired     int64  `json:"repaired"`
+}
+
+func handleDeepScrub(args []string) error {
+	if len(args) == 0 {
+		return handleDeepScrubGet()
+	}
+
+	switch args[0] {
+	case "get":
+		if len(args) != 1 {
+			return errors.New("deepscrub get does not take any arguments")
+		}
+		return handleDeepScrubGet()
+
+	case "set":
+		if len(args) != 2 && len(args) != 3 {
+			return errors.New("deepscrub set takes one or two arguments")
+		}
+
+		repair := false
+		if len(args) == 3 {
+			if args[2] != "repair" {
+				return fmt.Errorf("bad deepscrub set option %v", args[2])
+			}
+			repair = true
+		}
+
+		return handleDeepScrubSet(args[1], repair)
+
+	default:
+		return fmt.Errorf("bad deepscrub subcommand %v", args[0])
+	}
+}
+
+func handleDeepScrubGet() error {
+	var d deepScrub
+	err := jsonGet(conf.Base+"deepscrub", &d)
+	if err != nil {
+		return err
+	}
+
+	printDeepScrub(d)
+	return nil
+}
+
+func handleDeepScrubSet(rateStr string, repair bool) error {
+	rate, err := strconv.ParseInt(rateStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf(`bad format for "rate": %v`, err)
+	}
+
+	var d deepScrub
+	err = jsonPost(conf.Base+"deepscrub", struct {
+		Rate   int64 `json:"rate"`
+		Repair bool  `json:"repair"`
+	}{
+		Rate:   rate,
+		Repair: repair,
+	}, &d)
+	if err != nil {
+		return err
+	}
+
+	printDeepScrub(d)
+	return nil
+}
+
+func printDeepScrub(d deepScrub) {
+	switch {
+	case d.Rate <= 0:
+		fmt.Printf("Deep scrub is disabled\n")
+	case d.Repair:
+		fmt.Printf("Deep scrub reads %v bytes per second per proxy, and repairs inconsistent chunks\n", d.Rate)
+	default:
+		fmt.Printf("Deep scrub reads %v bytes per second per proxy, and reports inconsistent chunks\n", d.Rate)
+	}
+
+	if d.Files > 0 {
+		fmt.Printf("This proxy checked %v files (%.1f MiB), found %v inconsistent, repaired %v\n",
+			d.Files, float64(d.Bytes)/1024/1024, d.Inconsistent, d.Repaired)
+	}
+}
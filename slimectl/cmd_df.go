@@ -5,9 +5,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strconv"
 )
 
+type tierResponse struct {
+	Tier     string `json:"tier"`
+	Stores   int    `json:"stores"`
+	Free     int64  `json:"free"`
+	Capacity int64  `json:"capacity"`
+	Used     int64  `json:"used"`
+}
+
 func handleDF(args []string) error {
 	if len(args) != 0 {
 		return errors.New("df does not take arguments")
@@ -28,6 +37,37 @@ func handleDF(args []string) error {
 		return err
 	}
 
+	var tiers []tierResponse
+	err = jsonGet(conf.Base+"tiers", &tiers)
+	if err != nil {
+		return err
+	}
+
+	// only worth breaking down when some stores are labeled
+	if len(tiers) > 1 || (len(tiers) == 1 && tiers[0].Tier != "") {
+		table := [][]string{
+			[]string{"Tier", "Stores", "Used", "Free", "Capacity"},
+		}
+		for _, t := range tiers {
+			name := t.Tier
+			if name == "" {
+				name = "(default)"
+			}
+
+			var used, capacity string
+			if t.Capacity > 0 {
+				used = fmt.Sprintf("%.1f GiB", float64(t.Used)/(1024*1024*1024))
+				capacity = fmt.Sprintf("%.1f GiB", float64(t.Capacity)/(1024*1024*1024))
+			}
+
+			table = append(table, []string{name, strconv.Itoa(t.Stores), used,
+				fmt.Sprintf("%.1f GiB", float64(t.Free)/(1024*1024*1024)),
+				capacity})
+		}
+		printTable(os.Stdout, table, 0)
+		fmt.Printf("\n")
+	}
+
 	fmt.Printf("%.1f GiB unused space in cluster\n",
 		float64(free)/(1024*1024*1024))
 
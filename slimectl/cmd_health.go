@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+type health struct {
+	Status    string `json:"status"`
+	Locations struct {
+		Total   int `json:"total"`
+		Online  int `json:"online"`
+		Offline int `json:"offline"`
+		Dead    int `json:"dead"`
+	} `json:"locations"`
+	Margins []struct {
+		Margin int   `json:"margin"`
+		Files  int64 `json:"files"`
+	} `json:"margins"`
+	Unreadable      int64    `json:"unreadable"`
+	UnreadablePaths []string `json:"unreadable_paths"`
+	RepairBytes     int64    `json:"repair_bytes"`
+	RepairRate      float64  `json:"repair_rate"`
+	RepairETA       string   `json:"repair_eta"`
+}
+
+func handleHealth(args []string) error {
+	if len(args) != 0 {
+		return errors.New("health does not take any arguments")
+	}
+
+	var h health
+	err := jsonGet(conf.Base+"health", &h)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Status: %v\n", h.Status)
+	fmt.Printf("Locations: %v online, %v offline, %v dead\n",
+		h.Locations.Online, h.Locations.Offline, h.Locations.Dead)
+
+	if len(h.Margins) > 0 {
+		fmt.Printf("\nFiles with chunks on unavailable locations:\n")
+		table := [][]string{[]string{"Margin", "Files"}}
+		for _, m := range h.Margins {
+			table = append(table, []string{
+				strconv.Itoa(m.Margin),
+				strconv.FormatInt(m.Files, 10),
+			})
+		}
+		printTable(os.Stdout, table, 0)
+	}
+
+	if h.Unreadable > 0 {
+		fmt.Printf("\n%v files are unreadable:\n", h.Unreadable)
+		for _, path := range h.UnreadablePaths {
+			fmt.Printf("    %v\n", path)
+		}
+		if int64(len(h.UnreadablePaths)) < h.Unreadable {
+			fmt.Printf("    ...\n")
+		}
+	}
+
+	if h.RepairBytes > 0 {
+		fmt.Printf("\n%.1f GiB awaiting repair", float64(h.RepairBytes)/(1024*1024*1024))
+		if h.RepairETA != "" {
+			fmt.Printf(", about %v at %.1f MiB/s", h.RepairETA, h.RepairRate/(1024*1024))
+		}
+		fmt.Printf("\n")
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+type limit struct {
+	BytesPerSecond int64 `json:"bytes_per_second"`
+	OpsPerSecond   int64 `json:"ops_per_second"`
+}
+
+type limits struct {
+	Scrub      limit `json:"scrub"`
+	Rebuild    limit `json:"rebuild"`
+	Rebalance  limit `json:"rebalance"`
+	ReadRepair limit `json:"read_repair"`
+	DeepScrub  limit `json:"deep_scrub"`
+	Archive    limit `json:"archive"`
+	Tiering    limit `json:"tiering"`
+}
+
+func handleLimits(args []string) error {
+	if len(args) == 0 {
+		return handleLimitsGet()
+	}
+
+	switch args[0] {
+	case "get":
+		if len(args) != 1 {
+			return errors.New("limits get does not take any arguments")
+		}
+		return handleLimitsGet()
+
+	case "set":
+		if len(args) != 4 {
+			return errors.New("limits set requires an activity, bytes per second, and operations per second")
+		}
+		return handleLimitsSet(args[1], args[2], args[3])
+
+	default:
+		return fmt.Errorf("bad limits subcommand %v", args[0])
+	}
+}
+
+func handleLimitsGet() error {
+	var l limits
+	err := jsonGet(conf.Base+"limits", &l)
+	if err != nil {
+		return err
+	}
+
+	printLimits(l)
+	return nil
+}
+
+func handleLimitsSet(activity, bytesStr, opsStr string) error {
+	field := activity
+	switch activity {
+	case "scrub", "rebuild", "rebalance", "archive", "tiering":
+	case "read-repair":
+		field = "read_repair"
+	case "deep-scrub":
+		field = "deep_scrub"
+	default:
+		return fmt.Errorf("unknown activity %v", activity)
+	}
+
+	bytes, err := strconv.ParseInt(bytesStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf(`bad format for "bytes-per-second": %v`, err)
+	}
+
+	ops, err := strconv.ParseInt(opsStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf(`bad format for "ops-per-second": %v`, err)
+	}
+
+	var l limits
+	err = jsonPost(conf.Base+"limits", map[string]limit{
+		field: limit{BytesPerSecond: bytes, OpsPerSecond: ops},
+	}, &l)
+	if err != nil {
+		return err
+	}
+
+	printLimits(l)
+	return nil
+}
+
+func printLimits(l limits) {
+	format := func(n int64) string {
+		if n <= 0 {
+			return "unlimited"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+
+	table := [][]string{
+		[]string{"Activity", "Bytes/s", "Ops/s"},
+		[]string{"scrub", format(l.Scrub.BytesPerSecond), format(l.Scrub.OpsPerSecond)},
+		[]string{"rebuild", format(l.Rebuild.BytesPerSecond), format(l.Rebuild.OpsPerSecond)},
+		[]string{"rebalance", format(l.Rebalance.BytesPerSecond), format(l.Rebalance.OpsPerSecond)},
+		[]string{"read-repair", format(l.ReadRepair.BytesPerSecond), format(l.ReadRepair.OpsPerSecond)},
+		[]string{"deep-scrub", format(l.DeepScrub.BytesPerSecond), format(l.DeepScrub.OpsPerSecond)},
+		[]string{"archive", format(l.Archive.BytesPerSecond), format(l.Archive.OpsPerSecond)},
+		[]string{"tiering", format(l.Tiering.BytesPerSecond), format(l.Tiering.OpsPerSecond)},
+	}
+	printTable(os.Stdout, table, 0)
+}
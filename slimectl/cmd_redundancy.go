@@ -7,8 +7,11 @@ import (
 )
 
 type redundancy struct {
-	Need  int `json:"need"`
-	Total int `json:"total"`
+	Need         int    `json:"need"`
+	Total        int    `json:"total"`
+	Codec        string `json:"codec,omitempty"`
+	MigrateCodec bool   `json:"migrate_codec"`
+	LocalGroup   int    `json:"local_group"`
 }
 
 func handleRedundancy(args []string) error {
@@ -21,12 +24,31 @@ func handleRedundancy(args []string) error {
 		return handleRedundancyGet()
 
 	case "set":
+		if len(args) == 5 && args[1] == "lrc" {
+			return handleRedundancySetLRC(args[2], args[3], args[4])
+		}
+
 		if len(args) != 3 {
-			return errors.New("redundancy set takes two arguments")
+			return errors.New("redundancy set takes two arguments, or \"lrc\" and three arguments")
 		}
 
 		return handleRedundancySet(args[1], args[2])
 
+	case "codec":
+		if len(args) != 2 && len(args) != 3 {
+			return errors.New("redundancy codec takes one or two arguments")
+		}
+
+		migrate := false
+		if len(args) == 3 {
+			if args[2] != "migrate" {
+				return fmt.Errorf("bad redundancy codec option %v", args[2])
+			}
+			migrate = true
+		}
+
+		return handleRedundancyCodec(args[1], migrate)
+
 	default:
 		return fmt.Errorf("bad redundancy subcommand %v", args[0])
 	}
@@ -41,6 +63,7 @@ func handleRedundancyGet() error {
 	}
 
 	fmt.Printf("Redundancy is set to need %v of %v\n", r.Need, r.Total)
+	printCodec(r)
 	return nil
 }
 
@@ -55,8 +78,12 @@ func handleRedundancySet(needStr, totalStr string) error {
 		return fmt.Errorf(`bad format for "total": %v`, err)
 	}
 
+	// Only need and total are sent; the proxy leaves the codec alone.
 	var r redundancy
-	err = jsonPost(conf.Base+"redundancy", redundancy{
+	err = jsonPost(conf.Base+"redundancy", struct {
+		Need  int `json:"need"`
+		Total int `json:"total"`
+	}{
 		Need:  int(need),
 		Total: int(total),
 	}, &r)
@@ -68,3 +95,76 @@ func handleRedundancySet(needStr, totalStr string) error {
 
 	return nil
 }
+
+func handleRedundancySetLRC(needStr, totalStr, groupStr string) error {
+	need, err := strconv.ParseInt(needStr, 10, 0)
+	if err != nil {
+		return fmt.Errorf(`bad format for "need": %v`, err)
+	}
+
+	total, err := strconv.ParseInt(totalStr, 10, 0)
+	if err != nil {
+		return fmt.Errorf(`bad format for "total": %v`, err)
+	}
+
+	group, err := strconv.ParseInt(groupStr, 10, 0)
+	if err != nil {
+		return fmt.Errorf(`bad format for "group": %v`, err)
+	}
+
+	var r redundancy
+	err = jsonPost(conf.Base+"redundancy", struct {
+		Need       int    `json:"need"`
+		Total      int    `json:"total"`
+		Codec      string `json:"codec"`
+		LocalGroup int    `json:"local_group"`
+	}{
+		Need:       int(need),
+		Total:      int(total),
+		Codec:      "lrc",
+		LocalGroup: int(group),
+	}, &r)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Redundancy sucessfully changed to %v of %v\n", r.Need, r.Total)
+	printCodec(r)
+
+	return nil
+}
+
+func handleRedundancyCodec(codec string, migrate bool) error {
+	var r redundancy
+	err := jsonPost(conf.Base+"redundancy", struct {
+		Codec        string `json:"codec"`
+		MigrateCodec bool   `json:"migrate_codec"`
+	}{
+		Codec:        codec,
+		MigrateCodec: migrate,
+	}, &r)
+	if err != nil {
+		return err
+	}
+
+	printCodec(r)
+	return nil
+}
+
+func printCodec(r redundancy) {
+	if r.Codec == "" {
+		// proxy is too old to report a codec
+		return
+	}
+
+	codec := r.Codec
+	if r.LocalGroup > 0 {
+		codec = fmt.Sprintf("%v with local groups of %v", r.Codec, r.LocalGroup)
+	}
+
+	if r.MigrateCodec {
+		fmt.Printf("New files use codec %v, existing files are being migrated\n", codec)
+	} else {
+		fmt.Printf("New files use codec %v\n", codec)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+)
+
+type repairQueue struct {
+	Total   int64 `json:"total"`
+	Margins []struct {
+		Margin int   `json:"margin"`
+		Files  int64 `json:"files"`
+	} `json:"margins"`
+}
+
+func handleRepairQueue(args []string) error {
+	if len(args) != 0 {
+		return errors.New("repairqueue does not take any arguments")
+	}
+
+	var q repairQueue
+	err := jsonGet(conf.Base+"repairqueue", &q)
+	if err != nil {
+		return err
+	}
+
+	table := [][]string{[]string{"Margin", "Files"}}
+	for _, m := range q.Margins {
+		table = append(table, []string{
+			strconv.Itoa(m.Margin),
+			strconv.FormatInt(m.Files, 10),
+		})
+	}
+	table = append(table, []string{"total", strconv.FormatInt(q.Total, 10)})
+	printTable(os.Stdout, table, 0)
+	return nil
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,6 +32,41 @@ func handleStore(args []string) error {
 			return fmt.Errorf("too many arguments to store %v", args[0])
 		}
 		return handleStoreStoreOperation(args[0], args[1])
+	case "mode":
+		if len(args) < 3 {
+			return errors.New("store mode requires a storeid and a mode argument")
+		}
+		if len(args) > 4 {
+			return errors.New("too many arguments to store mode")
+		}
+		drainRate := ""
+		if len(args) == 4 {
+			drainRate = args[3]
+		}
+		return handleStoreMode(args[1], args[2], drainRate)
+	case "placement":
+		if len(args) != 5 {
+			return errors.New("store placement requires a storeid, reserved bytes, max fill percent, and weight")
+		}
+		return handleStorePlacement(args[1], args[2], args[3], args[4])
+	case "tier":
+		if len(args) != 3 {
+			return errors.New("store tier requires a storeid and a tier argument")
+		}
+		return handleStoreTier(args[1], args[2])
+	case "quarantine":
+		if len(args) == 1 {
+			return errors.New("store quarantine requires a storeid argument")
+		}
+		if len(args) > 2 {
+			return errors.New("too many arguments to store quarantine")
+		}
+		return handleStoreQuarantine(args[1])
+	case "verify":
+		if len(args) == 1 {
+			return errors.New("store verify requires a storeid argument")
+		}
+		return handleStoreVerify(args[1], args[2:])
 	case "scan":
 		if len(args) == 1 {
 			return fmt.Errorf("store scan requires a url argument")
@@ -53,9 +90,17 @@ type storeResponse struct {
 	URL       string    `json:"url"`
 	Name      string    `json:"name"`
 	Dead      bool      `json:"dead"`
+	Mode      string    `json:"mode"`
+	DrainRate int64     `json:"drain_rate,omitempty"`
+	Tier      string    `json:"tier"`
+	Reserved  int64     `json:"reserved"`
+	MaxFill   uint8     `json:"max_fill"`
+	Weight    int64     `json:"weight"`
 	Connected bool      `json:"connected"`
 	LastSeen  time.Time `json:"last_seen"`
 	Free      int64     `json:"free,omitempty"`
+	Capacity  int64     `json:"capacity,omitempty"`
+	Full      bool      `json:"full,omitempty"`
 	Error     string    `json:"error,omitempty"`
 }
 
@@ -105,7 +150,7 @@ func handleStoreList() error {
 	sort.Sort(storeResponseByName(list))
 
 	table := [][]string{
-		[]string{"Name", "UUID", "Status", "Free"},
+		[]string{"Name", "UUID", "Status", "Tier", "Free", "Reserved", "Max Fill", "Weight"},
 	}
 
 	for _, st := range list {
@@ -115,6 +160,12 @@ func handleStoreList() error {
 		} else {
 			status = "disconnected"
 		}
+		if st.Full {
+			status = fmt.Sprintf("full (%v)", status)
+		}
+		if st.Mode != "" && st.Mode != "normal" {
+			status = fmt.Sprintf("%v (%v)", st.Mode, status)
+		}
 		if st.Dead {
 			status = fmt.Sprintf("dead (%v)", status)
 		}
@@ -124,7 +175,18 @@ func handleStoreList() error {
 			free = fmt.Sprintf("%.1f GiB", float64(st.Free)/1024/1024/1024)
 		}
 
-		table = append(table, []string{st.Name, st.UUID, status, free})
+		var reserved string
+		if st.Reserved > 0 {
+			reserved = fmt.Sprintf("%.1f GiB", float64(st.Reserved)/1024/1024/1024)
+		}
+
+		var maxFill string
+		if st.MaxFill > 0 {
+			maxFill = fmt.Sprintf("%v%%", st.MaxFill)
+		}
+
+		table = append(table, []string{st.Name, st.UUID, status, st.Tier, free,
+			reserved, maxFill, strconv.FormatInt(st.Weight, 10)})
 	}
 
 	widthLimit := 0
@@ -151,6 +213,240 @@ func handleStoreStoreOperation(operation string, target string) error {
 	}, &list)
 }
 
+func handleStoreMode(target, mode, drainRateStr string) error {
+	_, err := uuid.Parse(target)
+	if err != nil {
+		target, err = resolveStoreUUID(target)
+		if err != nil {
+			return err
+		}
+	}
+
+	var drainRate int64
+	if drainRateStr != "" {
+		if mode != "draining" {
+			return errors.New("a rate may only be given when draining")
+		}
+		drainRate, err = strconv.ParseInt(drainRateStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf(`bad format for "bytes-per-second": %v`, err)
+		}
+	}
+
+	var list []storeResponse
+	return jsonPost(conf.Base+"stores", struct {
+		Operation string `json:"operation"`
+		UUID      string `json:"uuid"`
+		Mode      string `json:"mode"`
+		DrainRate int64  `json:"drain_rate,omitempty"`
+	}{
+		Operation: "mode",
+		UUID:      target,
+		Mode:      mode,
+		DrainRate: drainRate,
+	}, &list)
+}
+
+func handleStorePlacement(target, reservedStr, maxFillStr, weightStr string) error {
+	_, err := uuid.Parse(target)
+	if err != nil {
+		target, err = resolveStoreUUID(target)
+		if err != nil {
+			return err
+		}
+	}
+
+	reserved, err := strconv.ParseInt(reservedStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf(`bad format for "reserved": %v`, err)
+	}
+
+	maxFill, err := strconv.ParseInt(maxFillStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf(`bad format for "max fill": %v`, err)
+	}
+
+	weight, err := strconv.ParseInt(weightStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf(`bad format for "weight": %v`, err)
+	}
+
+	var list []storeResponse
+	return jsonPost(conf.Base+"stores", struct {
+		Operation string `json:"operation"`
+		UUID      string `json:"uuid"`
+		Reserved  int64  `json:"reserved"`
+		MaxFill   int64  `json:"max_fill"`
+		Weight    int64  `json:"weight"`
+	}{
+		Operation: "placement",
+		UUID:      target,
+		Reserved:  reserved,
+		MaxFill:   maxFill,
+		Weight:    weight,
+	}, &list)
+}
+
+func handleStoreTier(target, tier string) error {
+	_, err := uuid.Parse(target)
+	if err != nil {
+		target, err = resolveStoreUUID(target)
+		if err != nil {
+			return err
+		}
+	}
+
+	var list []storeResponse
+	return jsonPost(conf.Base+"stores", map[string]string{
+		"operation": "tier",
+		"uuid":      target,
+		"tier":      tier,
+	}, &list)
+}
+
+type quarantineResponse struct {
+	Key  string    `json:"key"`
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"`
+}
+
+func handleStoreQuarantine(target string) error {
+	_, err := uuid.Parse(target)
+	if err != nil {
+		target, err = resolveStoreUUID(target)
+		if err != nil {
+			return err
+		}
+	}
+
+	var list []quarantineResponse
+	err = jsonGet(conf.Base+"quarantine?uuid="+url.QueryEscape(target), &list)
+	if err != nil {
+		return err
+	}
+
+	table := [][]string{
+		[]string{"Key", "Size", "Quarantined"},
+	}
+
+	for _, e := range list {
+		table = append(table, []string{
+			e.Key,
+			fmt.Sprintf("%v", e.Size),
+			e.Time.Local().Format("2006-01-02 15:04:05"),
+		})
+	}
+
+	widthLimit := 0
+	if !conf.Wide {
+		widthLimit = getTTYWidth()
+	}
+	printTable(os.Stdout, table, widthLimit)
+	return nil
+}
+
+type hashcheckResponse struct {
+	UUID         string     `json:"uuid"`
+	Paused       bool       `json:"paused"`
+	Full         bool       `json:"full"`
+	Position     string     `json:"position"`
+	Good         int64      `json:"good"`
+	Bad          int64      `json:"bad"`
+	Remaining    int64      `json:"remaining"`
+	ETA          float64    `json:"eta_seconds"`
+	SleepPerFile string     `json:"sleep_per_file"`
+	SleepPerByte string     `json:"sleep_per_byte"`
+	LastGood     int64      `json:"last_good"`
+	LastBad      int64      `json:"last_bad"`
+	LastFinished *time.Time `json:"last_finished"`
+}
+
+func handleStoreVerify(target string, args []string) error {
+	_, err := uuid.Parse(target)
+	if err != nil {
+		target, err = resolveStoreUUID(target)
+		if err != nil {
+			return err
+		}
+	}
+
+	operation := "start"
+	if len(args) > 0 {
+		operation = args[0]
+	}
+
+	req := map[string]string{
+		"uuid":      target,
+		"operation": operation,
+	}
+
+	var res hashcheckResponse
+	switch operation {
+	case "status":
+		if len(args) > 1 {
+			return errors.New("too many arguments to store verify status")
+		}
+		err = jsonGet(conf.Base+"hashcheck?uuid="+url.QueryEscape(target), &res)
+	case "start", "pause", "resume":
+		if len(args) > 1 {
+			return fmt.Errorf("too many arguments to store verify %v", operation)
+		}
+		err = jsonPost(conf.Base+"hashcheck", req, &res)
+	case "throttle":
+		if len(args) != 3 {
+			return errors.New("store verify throttle requires sleep-per-file and sleep-per-byte arguments")
+		}
+		req["sleep_per_file"] = args[1]
+		req["sleep_per_byte"] = args[2]
+		err = jsonPost(conf.Base+"hashcheck", req, &res)
+	default:
+		return fmt.Errorf("unknown store verify operation %v", operation)
+	}
+	if err != nil {
+		return err
+	}
+
+	var state string
+	switch {
+	case res.Paused:
+		state = "paused"
+	case res.Full:
+		state = "verifying"
+	default:
+		state = "background"
+	}
+
+	eta := "unknown"
+	if res.ETA > 0 {
+		eta = (time.Duration(res.ETA) * time.Second).String()
+	}
+
+	last := "never"
+	if res.LastFinished != nil {
+		last = fmt.Sprintf("%v (%v good, %v bad)",
+			res.LastFinished.Local().Format("2006-01-02 15:04:05"),
+			res.LastGood, res.LastBad)
+	}
+
+	table := [][]string{
+		[]string{"State", state},
+		[]string{"Position", res.Position},
+		[]string{"Good", fmt.Sprintf("%v", res.Good)},
+		[]string{"Bad", fmt.Sprintf("%v", res.Bad)},
+		[]string{"Remaining", fmt.Sprintf("%v", res.Remaining)},
+		[]string{"ETA", eta},
+		[]string{"Throttle", fmt.Sprintf("%v per file, %v per byte", res.SleepPerFile, res.SleepPerByte)},
+		[]string{"Last pass", last},
+	}
+
+	widthLimit := 0
+	if !conf.Wide {
+		widthLimit = getTTYWidth()
+	}
+	printTable(os.Stdout, table, widthLimit)
+	return nil
+}
+
 func handleStoreScan(url string) error {
 	var list []storeResponse
 	return jsonPost(conf.Base+"stores", map[string]string{
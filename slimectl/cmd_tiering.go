@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+type tiering struct {
+	Hot         string `json:"hot"`
+	Cold        string `json:"cold"`
+	DemoteAfter string `json:"demote_after"`
+}
+
+func handleTiering(args []string) error {
+	if len(args) == 0 {
+		return handleTieringGet()
+	}
+
+	switch args[0] {
+	case "get":
+		if len(args) != 1 {
+			return errors.New("tiering get does not take any arguments")
+		}
+		return handleTieringGet()
+
+	case "set":
+		if len(args) != 4 {
+			return errors.New("tiering set requires a hot tier, a cold tier, and a demote-after duration")
+		}
+		return handleTieringSet(args[1], args[2], args[3])
+
+	default:
+		return fmt.Errorf("bad tiering subcommand %v", args[0])
+	}
+}
+
+func handleTieringGet() error {
+	var t tiering
+	err := jsonGet(conf.Base+"tiering", &t)
+	if err != nil {
+		return err
+	}
+
+	printTiering(t)
+	return nil
+}
+
+func handleTieringSet(hot, cold, demoteAfter string) error {
+	var t tiering
+	err := jsonPost(conf.Base+"tiering", tiering{
+		Hot:         hot,
+		Cold:        cold,
+		DemoteAfter: demoteAfter,
+	}, &t)
+	if err != nil {
+		return err
+	}
+
+	printTiering(t)
+	return nil
+}
+
+func printTiering(t tiering) {
+	if t.Hot == t.Cold || t.DemoteAfter == "0s" {
+		fmt.Printf("Tiering is disabled; new files are written to tier %#v\n", t.Hot)
+		return
+	}
+
+	fmt.Printf("New and recently read files are kept in tier %#v\n", t.Hot)
+	fmt.Printf("Files not read for %v are moved to tier %#v\n", t.DemoteAfter, t.Cold)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+type usage struct {
+	Prefix      string `json:"prefix"`
+	Bytes       int64  `json:"bytes"`
+	Objects     int64  `json:"objects"`
+	SoftBytes   int64  `json:"soft_bytes"`
+	HardBytes   int64  `json:"hard_bytes"`
+	SoftObjects int64  `json:"soft_objects"`
+	HardObjects int64  `json:"hard_objects"`
+}
+
+func handleUsage(args []string) error {
+	if len(args) == 0 {
+		return handleUsageGet()
+	}
+
+	switch args[0] {
+	case "get":
+		if len(args) != 1 {
+			return errors.New("usage get does not take any arguments")
+		}
+		return handleUsageGet()
+
+	case "set":
+		if len(args) != 4 && len(args) != 6 {
+			return errors.New("usage set requires a prefix, soft and hard byte limits, and optionally soft and hard object limits")
+		}
+		return handleUsageSet(args[1], args[2:])
+
+	case "remove":
+		if len(args) != 2 {
+			return errors.New("usage remove requires a prefix")
+		}
+		var list []usage
+		err := jsonPost(conf.Base+"usage", map[string]string{
+			"operation": "remove",
+			"prefix":    args[1],
+		}, &list)
+		if err != nil {
+			return err
+		}
+		printUsage(list)
+		return nil
+
+	default:
+		return fmt.Errorf("bad usage subcommand %v", args[0])
+	}
+}
+
+func handleUsageGet() error {
+	var list []usage
+	err := jsonGet(conf.Base+"usage", &list)
+	if err != nil {
+		return err
+	}
+
+	printUsage(list)
+	return nil
+}
+
+func handleUsageSet(prefix string, limitArgs []string) error {
+	names := []string{"soft-bytes", "hard-bytes", "soft-objects", "hard-objects"}
+	limits := make([]int64, len(names))
+	for i, arg := range limitArgs {
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf(`bad format for "%v": %v`, names[i], err)
+		}
+		limits[i] = n
+	}
+
+	var list []usage
+	err := jsonPost(conf.Base+"usage", map[string]interface{}{
+		"operation":    "set",
+		"prefix":       prefix,
+		"soft_bytes":   limits[0],
+		"hard_bytes":   limits[1],
+		"soft_objects": limits[2],
+		"hard_objects": limits[3],
+	}, &list)
+	if err != nil {
+		return err
+	}
+
+	printUsage(list)
+	return nil
+}
+
+func printUsage(list []usage) {
+	limit := func(n int64) string {
+		if n <= 0 {
+			return "-"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+
+	table := [][]string{
+		[]string{"Prefix", "Bytes", "Soft", "Hard", "Objects", "Soft", "Hard"},
+	}
+	for _, u := range list {
+		prefix := u.Prefix
+		if prefix == "" {
+			prefix = "(all)"
+		}
+		table = append(table, []string{
+			prefix,
+			strconv.FormatInt(u.Bytes, 10),
+			limit(u.SoftBytes),
+			limit(u.HardBytes),
+			strconv.FormatInt(u.Objects, 10),
+			limit(u.SoftObjects),
+			limit(u.HardObjects),
+		})
+	}
+	printTable(os.Stdout, table, 0)
+}
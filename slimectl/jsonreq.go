@@ -8,6 +8,10 @@ import (
 )
 
 func jsonRequest(req *http.Request, responseInto interface{}) error {
+	if conf.User != "" {
+		req.Header.Set("X-Slime-User", conf.User)
+	}
+
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
@@ -15,11 +15,13 @@ var configLocation = filepath.Join(os.Getenv("HOME"), ".config", "slimectl.toml"
 var conf struct {
 	Wide bool   `toml:"wide"`
 	Base string `toml:"base"`
+	User string `toml:"user"`
 }
 
 func setOptions() {
 	// first set default values
 	conf.Base = "http://127.0.0.1:17942/"
+	conf.User = os.Getenv("USER")
 
 	// then read slimectl.toml, if available
 	data, err := ioutil.ReadFile(configLocation)
@@ -37,6 +39,7 @@ func setOptions() {
 	// then add flags
 	flag.BoolVar(&conf.Wide, "w", conf.Wide, "never ellipsize columns")
 	flag.StringVar(&conf.Base, "base", conf.Base, "slime proxy base url")
+	flag.StringVar(&conf.User, "user", conf.User, "user name recorded in the audit log")
 }
 
 func showUsage() {
@@ -46,6 +49,7 @@ func showUsage() {
 	fmt.Fprintf(os.Stderr, "Reads TOML options from %v:\n", configLocation)
 	fmt.Fprintf(os.Stderr, "  wide = bool # default value for -w\n")
 	fmt.Fprintf(os.Stderr, "  base = string # default value for -base\n")
+	fmt.Fprintf(os.Stderr, "  user = string # default value for -user\n")
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "Flags (use before subcommand):\n")
 	flag.PrintDefaults()
@@ -55,13 +59,44 @@ func showUsage() {
 	fmt.Fprintf(os.Stderr, "  %s store dead <storeid>\n", prog)
 	fmt.Fprintf(os.Stderr, "  %s store undead <storeid>\n", prog)
 	fmt.Fprintf(os.Stderr, "  %s store delete <storeid>\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s store mode <storeid> <normal|readonly|draining> [bytes-per-second]\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s store placement <storeid> <reserved-bytes> <max-fill-percent> <weight>\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s store tier <storeid> <tier>\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s store quarantine <storeid>\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s store verify <storeid> [start|status|pause|resume]\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s store verify <storeid> throttle <sleep-per-file> <sleep-per-byte>\n", prog)
 	fmt.Fprintf(os.Stderr, "  %s store scan <url>\n", prog)
 	fmt.Fprintf(os.Stderr, "  %s store rescan\n", prog)
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "  %s redundancy [get]\n", prog)
 	fmt.Fprintf(os.Stderr, "  %s redundancy set <need> <total>\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s redundancy set lrc <need> <total> <group>\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s redundancy codec <prime|gf256|lrc> [migrate]\n", prog)
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "  %s df\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s health\n", prog)
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "  %s deepscrub [get]\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s deepscrub set <bytes-per-second> [repair]\n", prog)
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "  %s limits [get]\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s limits set <scrub|rebuild|rebalance|read-repair|deep-scrub|archive|tiering> <bytes-per-second> <ops-per-second>\n", prog)
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "  %s archive [get]\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s archive set <need> <total> <after> [bytes-per-second]\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s archive codec <prime|gf256>\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s archive off\n", prog)
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "  %s tiering [get]\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s tiering set <hot-tier> <cold-tier> <demote-after>\n", prog)
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "  %s repairqueue\n", prog)
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "  %s usage [get]\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s usage set <prefix> <soft-bytes> <hard-bytes> [<soft-objects> <hard-objects>]\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s usage remove <prefix>\n", prog)
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "  %s audit [limit] [action]\n", prog)
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "A \"storeid\" may be a uuid or a unique substring of a store's name or uuid\n")
 }
@@ -86,6 +121,22 @@ func main() {
 		err = handleRedundancy(args[1:])
 	case "df":
 		err = handleDF(args[1:])
+	case "health":
+		err = handleHealth(args[1:])
+	case "deepscrub":
+		err = handleDeepScrub(args[1:])
+	case "limits":
+		err = handleLimits(args[1:])
+	case "archive":
+		err = handleArchive(args[1:])
+	case "tiering":
+		err = handleTiering(args[1:])
+	case "repairqueue":
+		err = handleRepairQueue(args[1:])
+	case "usage":
+		err = handleUsage(args[1:])
+	case "audit":
+		err = handleAudit(args[1:])
 	default:
 		err = fmt.Errorf("unknown subcommand %v", args[0])
 	}